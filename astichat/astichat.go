@@ -2,9 +2,11 @@ package astichat
 
 import (
 	"bytes"
-	"crypto/sha512"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"net"
+	"time"
 )
 
 // Vars
@@ -12,24 +14,39 @@ var (
 	aesKeyBits     = 256
 	b64            = base64.StdEncoding
 	privateKeyBits = 4096
-	pubHash        = sha512.New()
 )
 
 // Event names
 const (
+	EventNameAck              = "ack"
+	EventNameFragment         = "fragment"
+	EventNameMessageDelivered = "message.delivered"
+	EventNameMessageQueued    = "message.queued"
 	EventNamePeerConnect      = "peer.connect"
 	EventNamePeerConnected    = "peer.connected"
 	EventNamePeerDisconnect   = "peer.disconnect"
 	EventNamePeerDisconnected = "peer.disconnected"
 	EventNamePeerJoined       = "peer.joined"
+	EventNamePeerMessaged     = "peer.messaged"
+	EventNamePeerPing         = "peer.ping"
+	EventNamePeerProbe        = "peer.probe"
+	EventNamePeerProbed       = "peer.probed"
+	EventNamePeerRead         = "peer.read"
+	EventNamePeerRelay        = "peer.relay"
+	EventNamePeerRelayed      = "peer.relayed"
 	EventNamePeerTyped        = "peer.typed"
+	EventNamePeerTyping       = "peer.typing"
+	EventNamePeerUnknown      = "peer.unknown"
+	EventNameServerShutdown   = "server.shutdown"
 )
 
 // Messages
 var (
 	MessageConnect    = []byte("connect")
 	MessageDisconnect = []byte("disconnect")
+	MessagePing       = []byte("ping")
 	MessageToken      = []byte("token")
+	MessageTyping     = []byte("typing")
 )
 
 // ValidateMessage validates a message
@@ -39,3 +56,48 @@ func ValidateMessage(msg, expected []byte) (err error) {
 	}
 	return
 }
+
+// Shutdown represents a shutdown message
+// Clients should wait for the reconnect hint, if any, before reconnecting
+type Shutdown struct {
+	ReconnectAfter time.Duration `json:"reconnect_after,omitempty"`
+}
+
+// Connect represents a connect message
+type Connect struct {
+	Addrs []*net.UDPAddr `json:"addrs,omitempty"`
+	Build *BuildInfo     `json:"build,omitempty"`
+}
+
+// ParseConnect parses a connect message
+// Clients that don't advertise candidate addrs send the plain connect message
+func ParseConnect(msg []byte) (c Connect, err error) {
+	if bytes.Equal(msg, MessageConnect) {
+		return
+	}
+	if err = json.Unmarshal(msg, &c); err != nil {
+		err = fmt.Errorf("%s while unmarshaling connect message", err)
+		return
+	}
+	return
+}
+
+// Ping represents a ping message
+// The server sends the ping back in peer.unknown so that the client knows the server has decrypted it and that
+// peer.unknown has not been spoofed
+type Ping struct {
+	Nonce string `json:"nonce"`
+}
+
+// ParsePing parses a ping message
+// Clients that don't send a nonce send the plain ping message
+func ParsePing(msg []byte) (p Ping, err error) {
+	if bytes.Equal(msg, MessagePing) {
+		return
+	}
+	if err = json.Unmarshal(msg, &p); err != nil {
+		err = fmt.Errorf("%s while unmarshaling ping message", err)
+		return
+	}
+	return
+}
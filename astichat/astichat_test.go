@@ -0,0 +1,19 @@
+package astichat_test
+
+import (
+	"testing"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePing(t *testing.T) {
+	var p, err = astichat.ParsePing([]byte(`{"nonce":"n"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, astichat.Ping{Nonce: "n"}, p)
+	p, err = astichat.ParsePing(astichat.MessagePing)
+	assert.NoError(t, err)
+	assert.Equal(t, astichat.Ping{}, p)
+	_, err = astichat.ParsePing([]byte("invalid"))
+	assert.Error(t, err)
+}
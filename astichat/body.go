@@ -6,6 +6,9 @@ import (
 	"time"
 )
 
+// bodyValidity is how far the creation date of a request can be from now
+const bodyValidity = 5 * time.Second
+
 // Body represents a body
 type Body struct {
 	Error   *BodyError   `json:"error,omitempty"`
@@ -20,6 +23,7 @@ type BodyError struct {
 // BodyRequest represents a request body
 type BodyRequest struct {
 	CreatedAt time.Time        `json:"created_at,omitempty"`
+	Device    string           `json:"device,omitempty"`
 	Message   EncryptedMessage `json:"message,omitempty"`
 	Username  string           `json:"username,omitempty"`
 }
@@ -49,9 +53,8 @@ func (b Body) Process(now time.Time, prvSrc *PrivateKey) (msg []byte, err error)
 		return
 	}
 
-	// Validate the request's creation date
-	if b.Request.CreatedAt.After(now.Add(5*time.Second)) || b.Request.CreatedAt.Before(now.Add(-5*time.Second)) {
-		err = fmt.Errorf("Request creation date %s is invalid compared to now %s", b.Request.CreatedAt, now)
+	// Validate the request
+	if err = b.Validate(now); err != nil {
 		return
 	}
 
@@ -61,3 +64,22 @@ func (b Body) Process(now time.Time, prvSrc *PrivateKey) (msg []byte, err error)
 	}
 	return
 }
+
+// Validate performs cheap checks on the body so that invalid requests can be discarded before any RSA work
+func (b Body) Validate(now time.Time) error {
+	// Check request
+	if b.Request == nil {
+		return errors.New("Request is empty")
+	}
+
+	// Validate the request's creation date
+	if b.Request.CreatedAt.After(now.Add(bodyValidity)) || b.Request.CreatedAt.Before(now.Add(-bodyValidity)) {
+		return fmt.Errorf("Request creation date %s is invalid compared to now %s", b.Request.CreatedAt, now)
+	}
+
+	// Validate the encrypted key's size
+	if len(b.Request.Message.Key) != privateKeyBits/8 {
+		return fmt.Errorf("Invalid encrypted key size %d", len(b.Request.Message.Key))
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package astichat
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// BrokerMessage represents a message exchanged between server instances through a broker
+type BrokerMessage struct {
+	EventName string          `json:"event_name"`
+	Instance  string          `json:"instance"` // Id of the server instance that published the message
+	Payload   json.RawMessage `json:"payload,omitempty"`
+}
+
+// BrokerHandler handles the messages of a topic
+type BrokerHandler func(m BrokerMessage)
+
+// Broker represents an object able to dispatch messages between server instances
+// Messages published on a topic are received by all the instances that have subscribed to it, including the
+// publisher
+type Broker interface {
+	Close() error
+	Publish(topic string, m BrokerMessage) error
+	Subscribe(topic string, h BrokerHandler) error
+}
+
+// MemoryBroker is a broker dispatching messages between server instances of the same process
+// Messages are dispatched synchronously and in order
+type MemoryBroker struct {
+	handlers map[string][]BrokerHandler // Indexed by topic
+	mutex    *sync.Mutex
+}
+
+// NewMemoryBroker creates a new memory broker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		handlers: make(map[string][]BrokerHandler),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// Close implements the Broker interface
+func (b *MemoryBroker) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.handlers = make(map[string][]BrokerHandler)
+	return nil
+}
+
+// Publish implements the Broker interface
+func (b *MemoryBroker) Publish(topic string, m BrokerMessage) error {
+	b.mutex.Lock()
+	var hs = append([]BrokerHandler{}, b.handlers[topic]...)
+	b.mutex.Unlock()
+	for _, h := range hs {
+		h(m)
+	}
+	return nil
+}
+
+// Subscribe implements the Broker interface
+func (b *MemoryBroker) Subscribe(topic string, h BrokerHandler) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.handlers[topic] = append(b.handlers[topic], h)
+	return nil
+}
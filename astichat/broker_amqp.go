@@ -0,0 +1,278 @@
+package astichat
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/asticode/go-astilog"
+	"github.com/streadway/amqp"
+)
+
+// Consts
+const (
+	amqpExchangeKind = "direct"
+)
+
+// AMQPConfiguration represents an AMQP configuration
+type AMQPConfiguration struct {
+	Addr             string        `toml:"addr"`
+	Exchange         string        `toml:"exchange"`
+	ReconnectBackoff time.Duration `toml:"reconnect_backoff"` // Delay between reconnection attempts once the connection is lost
+}
+
+// AMQPChannel represents the parts of an AMQP channel used by the AMQP broker
+// *amqp.Channel implements it
+type AMQPChannel interface {
+	Close() error
+	Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+}
+
+// AMQPDialFunc opens an AMQP channel as well as the connection it belongs to, if any
+type AMQPDialFunc func() (ch AMQPChannel, conn io.Closer, err error)
+
+// AMQPBroker is a broker dispatching messages between server instances through an AMQP server such as rabbitmq
+// Each instance consumes its own exclusive queue which is bound to the exchange with the topics it has subscribed to
+// When the connection is lost, the broker redials, declares a new queue and binds it to the same topics
+type AMQPBroker struct {
+	backoff  time.Duration
+	channel  AMQPChannel
+	closed   bool
+	conn     io.Closer
+	dial     AMQPDialFunc
+	exchange string
+	handlers map[string]BrokerHandler // Indexed by topic
+	Logger   astilog.Logger
+	mutex    *sync.Mutex
+	queue    string
+}
+
+// NewAMQPBroker connects to an AMQP server and creates a new AMQP broker
+func NewAMQPBroker(c AMQPConfiguration) (*AMQPBroker, error) {
+	return NewAMQPBrokerWithDialFunc(func() (ch AMQPChannel, conn io.Closer, err error) {
+		// Dial
+		var ac *amqp.Connection
+		if ac, err = amqp.Dial(c.Addr); err != nil {
+			return
+		}
+
+		// Open channel
+		if ch, err = ac.Channel(); err != nil {
+			ac.Close()
+			return
+		}
+		conn = ac
+		return
+	}, c.Exchange, c.ReconnectBackoff)
+}
+
+// NewAMQPBrokerWithDialFunc creates a new AMQP broker that redials with the dial func whenever the connection is lost
+func NewAMQPBrokerWithDialFunc(dial AMQPDialFunc, exchange string, backoff time.Duration) (b *AMQPBroker, err error) {
+	// Dial
+	var ch AMQPChannel
+	var conn io.Closer
+	if ch, conn, err = dial(); err != nil {
+		return
+	}
+
+	// Create broker
+	if b, err = NewAMQPBrokerWithChannel(ch, exchange); err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	b.backoff = backoff
+	b.conn = conn
+	b.dial = dial
+	return
+}
+
+// NewAMQPBrokerWithChannel creates a new AMQP broker on top of an AMQP channel
+// The broker can't reconnect once the channel is closed
+func NewAMQPBrokerWithChannel(ch AMQPChannel, exchange string) (b *AMQPBroker, err error) {
+	b = &AMQPBroker{
+		exchange: exchange,
+		handlers: make(map[string]BrokerHandler),
+		Logger:   astilog.NopLogger(),
+		mutex:    &sync.Mutex{},
+	}
+
+	// Consume
+	var ds <-chan amqp.Delivery
+	if ds, err = b.consume(ch); err != nil {
+		return
+	}
+	go b.read(ds)
+	return
+}
+
+// consume declares the exchange and the queue of the instance on a channel, binds the queue to the topics that
+// have been subscribed to and starts consuming it
+func (b *AMQPBroker) consume(ch AMQPChannel) (ds <-chan amqp.Delivery, err error) {
+	// Declare exchange
+	if err = ch.ExchangeDeclare(b.exchange, amqpExchangeKind, true, false, false, false, nil); err != nil {
+		return
+	}
+
+	// Declare queue
+	// The queue is named by the server and deleted once the instance is gone
+	var q amqp.Queue
+	if q, err = ch.QueueDeclare("", false, true, true, false, nil); err != nil {
+		return
+	}
+
+	// Bind topics
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for topic := range b.handlers {
+		if err = ch.QueueBind(q.Name, topic, b.exchange, false, nil); err != nil {
+			return
+		}
+	}
+
+	// Consume
+	if ds, err = ch.Consume(q.Name, "", true, true, false, false, nil); err != nil {
+		return
+	}
+	b.channel = ch
+	b.queue = q.Name
+	return
+}
+
+// Close implements the Broker interface
+func (b *AMQPBroker) Close() (err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.closed = true
+	if err = b.channel.Close(); err != nil {
+		return
+	}
+	if b.conn != nil {
+		err = b.conn.Close()
+	}
+	return
+}
+
+// Publish implements the Broker interface
+func (b *AMQPBroker) Publish(topic string, m BrokerMessage) (err error) {
+	// Marshal
+	var body []byte
+	if body, err = json.Marshal(m); err != nil {
+		return
+	}
+
+	// Publish
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.channel.Publish(b.exchange, topic, false, false, amqp.Publishing{Body: body, ContentType: "application/json"})
+}
+
+// Subscribe implements the Broker interface
+func (b *AMQPBroker) Subscribe(topic string, h BrokerHandler) (err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err = b.channel.QueueBind(b.queue, topic, b.exchange, false, nil); err != nil {
+		return
+	}
+	b.handlers[topic] = h
+	return
+}
+
+// read dispatches deliveries until the channel is closed and reconnects unless the broker has been closed
+func (b *AMQPBroker) read(ds <-chan amqp.Delivery) {
+	for {
+		b.dispatch(ds)
+
+		// Broker has been closed
+		b.mutex.Lock()
+		var closed = b.closed
+		b.mutex.Unlock()
+		if closed {
+			return
+		}
+
+		// Broker can't reconnect
+		if b.dial == nil {
+			b.Logger.Errorf("AMQP channel of queue %s has been closed, no more messages will be received", b.queue)
+			return
+		}
+
+		// Reconnect
+		b.Logger.Errorf("AMQP connection of queue %s has been lost, reconnecting...", b.queue)
+		var ok bool
+		if ds, ok = b.reconnect(); !ok {
+			return
+		}
+		b.Logger.Infof("AMQP connection has been restored with queue %s", b.queue)
+	}
+}
+
+// dispatch dispatches deliveries until the channel is closed
+func (b *AMQPBroker) dispatch(ds <-chan amqp.Delivery) {
+	for d := range ds {
+		// Unmarshal
+		var m BrokerMessage
+		if err := json.Unmarshal(d.Body, &m); err != nil {
+			b.Logger.Errorf("%s while unmarshaling delivery of topic %s", err, d.RoutingKey)
+			continue
+		}
+
+		// Get handler
+		b.mutex.Lock()
+		var h, ok = b.handlers[d.RoutingKey]
+		b.mutex.Unlock()
+
+		// Handle
+		if ok {
+			h(m)
+		}
+	}
+}
+
+// reconnect redials until it succeeds or the broker is closed
+func (b *AMQPBroker) reconnect() (ds <-chan amqp.Delivery, ok bool) {
+	for {
+		// Broker has been closed
+		b.mutex.Lock()
+		var closed = b.closed
+		b.mutex.Unlock()
+		if closed {
+			return
+		}
+
+		// Dial
+		var ch, conn, err = b.dial()
+		if err == nil {
+			if ds, err = b.consume(ch); err == nil {
+				b.mutex.Lock()
+				defer b.mutex.Unlock()
+				if b.conn != nil {
+					b.conn.Close()
+				}
+				b.conn = conn
+
+				// Broker has been closed in the meantime
+				if b.closed {
+					b.channel.Close()
+					if b.conn != nil {
+						b.conn.Close()
+					}
+					return
+				}
+				ok = true
+				return
+			}
+			if conn != nil {
+				conn.Close()
+			}
+		}
+		b.Logger.Errorf("%s while reconnecting to AMQP, retrying in %s", err, b.backoff)
+		time.Sleep(b.backoff)
+	}
+}
@@ -0,0 +1,43 @@
+package astichat
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// BuildInfo represents the build metadata embedded in a client
+// Clients send it to the server when connecting so that operators know which clients are in the wild
+type BuildInfo struct {
+	BuiltAt        time.Time `json:"built_at"` // Time the template the client has been stamped from has been built at
+	Commit         string    `json:"commit,omitempty"`
+	KeyAlgorithm   string    `json:"key_algorithm"`
+	KeyFingerprint string    `json:"key_fingerprint"` // Hex encoded SHA-256 of the client's public key
+	Platform       string    `json:"platform"`
+	ServerHTTPAddr string    `json:"server_http_addr"`
+	ServerQUICAddr string    `json:"server_quic_addr,omitempty"`
+	ServerUDPAddr  string    `json:"server_udp_addr"`
+	StampedAt      time.Time `json:"stamped_at"` // Time the client has been stamped at, when it was downloaded
+	Version        string    `json:"version"`
+}
+
+// KeyAlgorithm returns the algorithm of a public key
+func KeyAlgorithm(k *PublicKey) string {
+	return fmt.Sprintf("RSA-%d", k.key.N.BitLen())
+}
+
+// KeyFingerprint returns the hex encoded SHA-256 of a public key
+func KeyFingerprint(k *PublicKey) (o string, err error) {
+	// Marshal
+	var b []byte
+	if b, err = x509.MarshalPKIXPublicKey(k.key); err != nil {
+		return
+	}
+
+	// Hash
+	var h = sha256.Sum256(b)
+	o = hex.EncodeToString(h[:])
+	return
+}
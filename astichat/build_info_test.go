@@ -0,0 +1,33 @@
+package astichat_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildInfo(t *testing.T) {
+	// Key
+	var prv = astichat.PrivateKey{}
+	var err = prv.UnmarshalText([]byte(prv2String))
+	assert.NoError(t, err)
+	var pub *astichat.PublicKey
+	pub, err = prv.PublicKey()
+	assert.NoError(t, err)
+	assert.Equal(t, "RSA-4096", astichat.KeyAlgorithm(pub))
+	var f string
+	f, err = astichat.KeyFingerprint(pub)
+	assert.NoError(t, err)
+	assert.Equal(t, "cf72837a86b2becf136f3ed720ca25c7e0ac60216bff966e9c1d47d15d672a4c", f)
+
+	// Connect
+	var c astichat.Connect
+	c, err = astichat.ParseConnect([]byte(`{"addrs":[{"IP":"127.0.0.1","Port":1234}],"build":{"platform":"linux","version":"version"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, astichat.Connect{Addrs: []*net.UDPAddr{{IP: net.ParseIP("127.0.0.1"), Port: 1234}}, Build: &astichat.BuildInfo{Platform: "linux", Version: "version"}}, c)
+	c, err = astichat.ParseConnect(astichat.MessageConnect)
+	assert.NoError(t, err)
+	assert.Nil(t, c.Build)
+}
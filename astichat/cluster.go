@@ -0,0 +1,315 @@
+package astichat
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/asticode/go-astilog"
+)
+
+// Cluster topics
+const (
+	clusterTopicPresence = "presence"
+	clusterTopicRelay    = "relay." // Followed by the id of the instance
+)
+
+// Cluster event names
+const (
+	clusterEventNameHeartbeat = "heartbeat"
+	clusterEventNameSync      = "sync"
+)
+
+// ClusterConfiguration represents a cluster configuration
+// Instances that haven't published anything for the heartbeat timeout are considered gone and their peers are
+// purged. A zero heartbeat period disables heartbeats.
+type ClusterConfiguration struct {
+	HeartbeatPeriod  time.Duration `toml:"heartbeat_period"`
+	HeartbeatTimeout time.Duration `toml:"heartbeat_timeout"`
+}
+
+// ClusterListenerFunc handles an event sent by another server instance
+type ClusterListenerFunc func(eventName string, payload json.RawMessage) error
+
+// ClusterRelay represents an event relayed to a peer connected to another server instance
+// The relay's addr is the sender's
+type ClusterRelay struct {
+	Relay
+	To *net.UDPAddr `json:"to"`
+}
+
+// Cluster allows several server instances to share presence and relay events to each other's peers through a
+// broker
+type Cluster struct {
+	broker    Broker
+	c         ClusterConfiguration
+	done      chan struct{}
+	id        string
+	instances map[string]string // Instance ids indexed by peer key
+	listeners map[string]ClusterListenerFunc
+	local     *PeerPool
+	Logger    astilog.Logger
+	mutex     *sync.Mutex
+	once      *sync.Once
+	remote    *PeerPool
+	seenAt    map[string]time.Time // Time the other instances have last published something at, indexed by instance id
+}
+
+// NewCluster creates a new cluster
+func NewCluster(b Broker, c ClusterConfiguration) *Cluster {
+	return &Cluster{
+		broker:    b,
+		c:         c,
+		done:      make(chan struct{}),
+		id:        GenerateToken(),
+		instances: make(map[string]string),
+		listeners: make(map[string]ClusterListenerFunc),
+		local:     NewPeerPool(),
+		Logger:    astilog.NopLogger(),
+		mutex:     &sync.Mutex{},
+		once:      &sync.Once{},
+		remote:    NewPeerPool(),
+		seenAt:    make(map[string]time.Time),
+	}
+}
+
+// Init subscribes to the topics of the instance and asks the other instances for their peers
+func (c *Cluster) Init() (err error) {
+	// Subscribe
+	if err = c.broker.Subscribe(clusterTopicPresence, c.handlePresence); err != nil {
+		return
+	}
+	if err = c.broker.Subscribe(clusterTopicRelay+c.id, c.handleRelay); err != nil {
+		return
+	}
+
+	// Sync
+	if err = c.publish(clusterTopicPresence, clusterEventNameSync, nil); err != nil {
+		return
+	}
+
+	// Heartbeat
+	if c.c.HeartbeatPeriod > 0 {
+		go c.heartbeat()
+	}
+	return
+}
+
+// Close closes the cluster
+func (c *Cluster) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.broker.Close()
+}
+
+// heartbeat publishes heartbeats and purges the instances that have gone silent until the cluster is closed
+func (c *Cluster) heartbeat() {
+	var t = time.NewTicker(c.c.HeartbeatPeriod)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			if err := c.publish(clusterTopicPresence, clusterEventNameHeartbeat, nil); err != nil {
+				c.Logger.Errorf("%s while publishing heartbeat", err)
+			}
+			c.purge(time.Now().Add(-c.c.HeartbeatTimeout))
+		}
+	}
+}
+
+// purge removes the peers of the instances that haven't published anything since a date
+// Local peers are notified as if the peers had disconnected
+func (c *Cluster) purge(since time.Time) {
+	// Get peers
+	var ps []*Peer
+	c.mutex.Lock()
+	for instance, at := range c.seenAt {
+		if at.After(since) {
+			continue
+		}
+		delete(c.seenAt, instance)
+		c.Logger.Errorf("Instance %s has gone silent, purging its peers", instance)
+		for _, p := range c.remote.Peers() {
+			if c.instances[p.Key()] == instance {
+				delete(c.instances, p.Key())
+				ps = append(ps, p)
+			}
+		}
+	}
+	c.mutex.Unlock()
+
+	// Loop through peers
+	for _, p := range ps {
+		// Update pool
+		c.remote.Del(p.Username, p.Device.ID)
+
+		// Dispatch
+		var b, err = json.Marshal(p)
+		if err != nil {
+			c.Logger.Errorf("%s while marshaling %s", err, p)
+			continue
+		}
+		c.dispatch(EventNamePeerDisconnected, b)
+	}
+}
+
+// see records that an instance has published something and returns whether it was unknown
+func (c *Cluster) see(instance string) (unknown bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, known := c.seenAt[instance]
+	c.seenAt[instance] = time.Now()
+	return !known
+}
+
+// ID returns the id of the instance
+func (c *Cluster) ID() string {
+	return c.id
+}
+
+// SetListener sets the listener of an event
+func (c *Cluster) SetListener(eventName string, l ClusterListenerFunc) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.listeners[eventName] = l
+}
+
+// Join announces a peer that has connected to the instance
+func (c *Cluster) Join(p *Peer) error {
+	c.local.Set(p)
+	return c.publish(clusterTopicPresence, EventNamePeerJoined, p)
+}
+
+// Leave announces a peer that has disconnected from the instance
+func (c *Cluster) Leave(p *Peer) error {
+	c.local.Del(p.Username, p.Device.ID)
+	return c.publish(clusterTopicPresence, EventNamePeerDisconnected, p)
+}
+
+// Peers returns the peers connected to the other instances
+func (c *Cluster) Peers() []*Peer {
+	return c.remote.Peers()
+}
+
+// GetByAddr gets a peer connected to another instance based on its addr
+func (c *Cluster) GetByAddr(addr *net.UDPAddr) (*Peer, bool) {
+	return c.remote.GetByAddr(addr)
+}
+
+// Relay relays an event to a peer connected to another instance
+func (c *Cluster) Relay(to *net.UDPAddr, r Relay) (err error) {
+	// Get peer
+	var p, ok = c.remote.GetByAddr(to)
+	if !ok {
+		err = fmt.Errorf("%s is not connected to another instance", to)
+		return
+	}
+
+	// Get instance
+	c.mutex.Lock()
+	var instance = c.instances[p.Key()]
+	c.mutex.Unlock()
+
+	// Publish
+	return c.publish(clusterTopicRelay+instance, EventNamePeerRelayed, ClusterRelay{Relay: r, To: to})
+}
+
+// publish publishes an event on a topic
+func (c *Cluster) publish(topic, eventName string, payload interface{}) (err error) {
+	var m = BrokerMessage{EventName: eventName, Instance: c.id}
+	if payload != nil {
+		if m.Payload, err = json.Marshal(payload); err != nil {
+			return
+		}
+	}
+	return c.broker.Publish(topic, m)
+}
+
+// dispatch executes the listener of an event
+func (c *Cluster) dispatch(eventName string, payload json.RawMessage) {
+	c.mutex.Lock()
+	var l, ok = c.listeners[eventName]
+	c.mutex.Unlock()
+	if !ok {
+		return
+	}
+	if err := l(eventName, payload); err != nil {
+		c.Logger.Errorf("%s while executing cluster listener %s", err, eventName)
+	}
+}
+
+// handlePresence handles the presence events of the other instances
+func (c *Cluster) handlePresence(m BrokerMessage) {
+	// Message has been published by the instance
+	if m.Instance == c.id {
+		return
+	}
+
+	// Update last seen
+	var unknown = c.see(m.Instance)
+
+	// Another instance has started or is heard from again after having been purged
+	switch m.EventName {
+	case clusterEventNameHeartbeat:
+		// Every instance republishes its peers so that both sides get the peers they may have purged
+		if unknown {
+			if err := c.publish(clusterTopicPresence, clusterEventNameSync, nil); err != nil {
+				c.Logger.Errorf("%s while publishing sync", err)
+			}
+		}
+		return
+	case clusterEventNameSync:
+		for _, p := range c.local.Peers() {
+			if err := c.publish(clusterTopicPresence, EventNamePeerJoined, p); err != nil {
+				c.Logger.Errorf("%s while publishing %s", err, p)
+			}
+		}
+		return
+	}
+
+	// Unmarshal
+	var p *Peer
+	if err := json.Unmarshal(m.Payload, &p); err != nil || p == nil {
+		c.Logger.Errorf("Invalid peer published by instance %s", m.Instance)
+		return
+	}
+
+	// Update pool
+	switch m.EventName {
+	case EventNamePeerJoined:
+		// Peers republished when another instance starts are only dispatched once
+		c.mutex.Lock()
+		var known = c.instances[p.Key()] == m.Instance
+		c.instances[p.Key()] = m.Instance
+		c.mutex.Unlock()
+		c.remote.Set(p)
+		if known {
+			return
+		}
+	case EventNamePeerDisconnected:
+		// The peer may have reconnected to another instance in the meantime
+		c.mutex.Lock()
+		var instance = c.instances[p.Key()]
+		if instance == m.Instance {
+			delete(c.instances, p.Key())
+		}
+		c.mutex.Unlock()
+		if instance != m.Instance {
+			return
+		}
+		c.remote.Del(p.Username, p.Device.ID)
+	default:
+		return
+	}
+
+	// Dispatch
+	c.dispatch(m.EventName, m.Payload)
+}
+
+// handleRelay handles the events relayed by the other instances
+func (c *Cluster) handleRelay(m BrokerMessage) {
+	c.dispatch(m.EventName, m.Payload)
+}
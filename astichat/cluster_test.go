@@ -0,0 +1,252 @@
+package astichat_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// standInAMQP is a local stand-in for an AMQP server that routes messages published on direct exchanges
+type standInAMQP struct {
+	bindings map[string][]string // Queue names indexed by exchange and routing key
+	count    int
+	mutex    *sync.Mutex
+	queues   map[string]chan amqp.Delivery
+}
+
+func newStandInAMQP() *standInAMQP {
+	return &standInAMQP{
+		bindings: make(map[string][]string),
+		mutex:    &sync.Mutex{},
+		queues:   make(map[string]chan amqp.Delivery),
+	}
+}
+
+// standInChannel is a channel of the stand-in AMQP server
+type standInChannel struct {
+	queues []string
+	s      *standInAMQP
+}
+
+func (c *standInChannel) Close() error {
+	c.s.mutex.Lock()
+	defer c.s.mutex.Unlock()
+	for _, q := range c.queues {
+		close(c.s.queues[q])
+		delete(c.s.queues, q)
+	}
+	return nil
+}
+
+func (c *standInChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	c.s.mutex.Lock()
+	defer c.s.mutex.Unlock()
+	var q, ok = c.s.queues[queue]
+	if !ok {
+		return nil, fmt.Errorf("unknown queue %s", queue)
+	}
+	return q, nil
+}
+
+func (c *standInChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	if kind != "direct" {
+		return errors.New("only direct exchanges are supported")
+	}
+	return nil
+}
+
+func (c *standInChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.s.mutex.Lock()
+	defer c.s.mutex.Unlock()
+	for _, q := range c.s.bindings[exchange+"/"+key] {
+		if ch, ok := c.s.queues[q]; ok {
+			ch <- amqp.Delivery{Body: msg.Body, ContentType: msg.ContentType, Exchange: exchange, RoutingKey: key}
+		}
+	}
+	return nil
+}
+
+func (c *standInChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	c.s.mutex.Lock()
+	defer c.s.mutex.Unlock()
+	c.s.bindings[exchange+"/"+key] = append(c.s.bindings[exchange+"/"+key], name)
+	return nil
+}
+
+func (c *standInChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	c.s.mutex.Lock()
+	defer c.s.mutex.Unlock()
+	c.s.count++
+	name = fmt.Sprintf("amq.gen-%d", c.s.count)
+	c.s.queues[name] = make(chan amqp.Delivery, 100)
+	c.queues = append(c.queues, name)
+	return amqp.Queue{Name: name}, nil
+}
+
+func listenCluster(ch chan event) astichat.ClusterListenerFunc {
+	return func(eventName string, payload json.RawMessage) error {
+		ch <- event{eventName: eventName, payload: string(payload)}
+		return nil
+	}
+}
+
+func testCluster(t *testing.T, newBroker func() astichat.Broker) {
+	// Init instances
+	var chA, chB, chC = make(chan event, 10), make(chan event, 10), make(chan event, 10)
+	var a, b = astichat.NewCluster(newBroker(), astichat.ClusterConfiguration{}), astichat.NewCluster(newBroker(), astichat.ClusterConfiguration{})
+	for _, i := range []struct {
+		c  *astichat.Cluster
+		ch chan event
+	}{{c: a, ch: chA}, {c: b, ch: chB}} {
+		i.c.SetListener(astichat.EventNamePeerDisconnected, listenCluster(i.ch))
+		i.c.SetListener(astichat.EventNamePeerJoined, listenCluster(i.ch))
+		i.c.SetListener(astichat.EventNamePeerRelayed, listenCluster(i.ch))
+		assert.NoError(t, i.c.Init())
+	}
+	defer a.Close()
+	defer b.Close()
+
+	// Join
+	var pA = astichat.NewPeer(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}, "alice", astichat.Device{ID: "1"})
+	var pB = astichat.NewPeer(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2}, "bob", astichat.Device{ID: "2"})
+	assert.NoError(t, a.Join(pA))
+	var e = wait(t, chB)
+	assert.Equal(t, astichat.EventNamePeerJoined, e.eventName)
+	assert.Contains(t, e.payload, "alice")
+	assert.NoError(t, b.Join(pB))
+	e = wait(t, chA)
+	assert.Equal(t, astichat.EventNamePeerJoined, e.eventName)
+	assert.Contains(t, e.payload, "bob")
+	assert.Len(t, a.Peers(), 1)
+	assert.Len(t, b.Peers(), 1)
+
+	// Instances started later get the peers already connected
+	var c = astichat.NewCluster(newBroker(), astichat.ClusterConfiguration{})
+	c.SetListener(astichat.EventNamePeerJoined, listenCluster(chC))
+	assert.NoError(t, c.Init())
+	defer c.Close()
+	wait(t, chC)
+	wait(t, chC)
+	assert.Len(t, c.Peers(), 2)
+
+	// Relay
+	assert.NoError(t, a.Relay(pB.Addr, astichat.Relay{Addr: pA.Addr, EventName: "test", Payload: json.RawMessage(`"payload"`)}))
+	e = wait(t, chB)
+	assert.Equal(t, astichat.EventNamePeerRelayed, e.eventName)
+	var r astichat.ClusterRelay
+	assert.NoError(t, json.Unmarshal([]byte(e.payload), &r))
+	assert.Equal(t, pA.Addr.String(), r.Addr.String())
+	assert.Equal(t, pB.Addr.String(), r.To.String())
+	assert.Equal(t, "test", r.EventName)
+	assert.Error(t, a.Relay(pA.Addr, astichat.Relay{}))
+
+	// Leave
+	assert.NoError(t, a.Leave(pA))
+	e = wait(t, chB)
+	assert.Equal(t, astichat.EventNamePeerDisconnected, e.eventName)
+	assert.Len(t, b.Peers(), 0)
+}
+
+func TestClusterMemoryBroker(t *testing.T) {
+	var b = astichat.NewMemoryBroker()
+	testCluster(t, func() astichat.Broker { return b })
+}
+
+func TestClusterAMQPBroker(t *testing.T) {
+	var s = newStandInAMQP()
+	testCluster(t, func() astichat.Broker {
+		var b, err = astichat.NewAMQPBrokerWithChannel(&standInChannel{s: s}, "astichat")
+		assert.NoError(t, err)
+		return b
+	})
+}
+
+func TestClusterHeartbeat(t *testing.T) {
+	// Init instance
+	var b = astichat.NewMemoryBroker()
+	var ch, chSync = make(chan event, 10), make(chan event, 10)
+	var a = astichat.NewCluster(b, astichat.ClusterConfiguration{HeartbeatPeriod: 20 * time.Millisecond, HeartbeatTimeout: 100 * time.Millisecond})
+	a.SetListener(astichat.EventNamePeerDisconnected, listenCluster(ch))
+	a.SetListener(astichat.EventNamePeerJoined, listenCluster(ch))
+	assert.NoError(t, a.Init())
+	defer a.Close()
+	b.Subscribe("presence", func(m astichat.BrokerMessage) {
+		if m.Instance == a.ID() && m.EventName == "sync" {
+			chSync <- event{eventName: m.EventName}
+		}
+	})
+
+	// Another instance announces a peer and crashes
+	var p, err = json.Marshal(astichat.NewPeer(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}, "bob", astichat.Device{ID: "2"}))
+	assert.NoError(t, err)
+	assert.NoError(t, b.Publish("presence", astichat.BrokerMessage{EventName: astichat.EventNamePeerJoined, Instance: "crashed", Payload: p}))
+	assert.Equal(t, astichat.EventNamePeerJoined, wait(t, ch).eventName)
+	assert.Len(t, a.Peers(), 1)
+
+	// Peers of the silent instance are purged
+	var e = wait(t, ch)
+	assert.Equal(t, astichat.EventNamePeerDisconnected, e.eventName)
+	assert.Contains(t, e.payload, "bob")
+	assert.Len(t, a.Peers(), 0)
+
+	// Instance asks for the peers of an instance that is heard from again
+	assert.NoError(t, b.Publish("presence", astichat.BrokerMessage{EventName: "heartbeat", Instance: "crashed"}))
+	wait(t, chSync)
+	assert.NoError(t, b.Publish("presence", astichat.BrokerMessage{EventName: "heartbeat", Instance: "crashed"}))
+	select {
+	case <-chSync:
+		t.Error("sync has been published twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestAMQPBrokerReconnect(t *testing.T) {
+	// Init broker
+	var s = newStandInAMQP()
+	var chs []*standInChannel
+	var mutex = &sync.Mutex{}
+	var b, err = astichat.NewAMQPBrokerWithDialFunc(func() (astichat.AMQPChannel, io.Closer, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		var c = &standInChannel{s: s}
+		chs = append(chs, c)
+		return c, nil, nil
+	}, "astichat", 10*time.Millisecond)
+	assert.NoError(t, err)
+	var ch = make(chan event, 100)
+	assert.NoError(t, b.Subscribe("topic", func(m astichat.BrokerMessage) { ch <- event{eventName: m.EventName} }))
+
+	// Connection is lost
+	mutex.Lock()
+	chs[0].Close()
+	mutex.Unlock()
+
+	// Broker reconnects and binds its new queue to the same topics
+	var received bool
+	for i := 0; i < 100 && !received; i++ {
+		assert.NoError(t, b.Publish("topic", astichat.BrokerMessage{EventName: "test"}))
+		select {
+		case e := <-ch:
+			assert.Equal(t, "test", e.eventName)
+			received = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	assert.True(t, received)
+
+	// Broker doesn't reconnect once closed
+	assert.NoError(t, b.Close())
+	time.Sleep(50 * time.Millisecond)
+	mutex.Lock()
+	assert.Len(t, chs, 2)
+	mutex.Unlock()
+}
@@ -0,0 +1,145 @@
+package astichat
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"debug/macho"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// Code signature consts
+// Layouts are described in cs_blobs.h of xnu
+const (
+	codeDirectoryMagic              = 0xfade0c02
+	codeSignatureFlagAdHoc          = 0x2
+	codeSignatureLoadCmd            = 0x1d
+	codeSignatureMagic              = 0xfade0cc0
+	codeSignatureSlotAlternateFirst = 0x1000
+	codeSignatureSlotAlternateLast  = 0x1004
+	codeSignatureSlotCMS            = 0x10000
+	codeSignatureSlotCodeDirectory  = 0
+	codeSignatureVersionCodeLimit64 = 0x20300
+)
+
+// adHocSign updates the code directories of the ad-hoc signature of a Mach-O binary after it has been modified
+// Since the Go linker ad-hoc signs darwin/arm64 binaries and macOS kills processes whose pages don't match their
+// code directory, the hashes of the pages must be computed again. Ad-hoc signatures don't involve any key.
+// Binaries that are not Mach-O or are not signed are left untouched, and binaries signed with a certificate can't be
+// re-signed.
+func adHocSign(b []byte) (err error) {
+	// Parse Mach-O
+	var f *macho.File
+	if f, err = macho.NewFile(bytes.NewReader(b)); err != nil {
+		return nil
+	}
+
+	// Find code signature
+	var off, size uint32
+	var found bool
+	for _, l := range f.Loads {
+		var r = l.Raw()
+		if len(r) >= 16 && f.ByteOrder.Uint32(r) == codeSignatureLoadCmd {
+			off, size, found = f.ByteOrder.Uint32(r[8:]), f.ByteOrder.Uint32(r[12:]), true
+			break
+		}
+	}
+	if !found {
+		return
+	}
+	if uint64(off)+uint64(size) > uint64(len(b)) || size < 12 {
+		return errors.New("Code signature is out of bounds")
+	}
+	var sig = b[off : off+size]
+
+	// Check super blob
+	if binary.BigEndian.Uint32(sig) != codeSignatureMagic {
+		return errors.New("Invalid code signature magic")
+	}
+	var count = binary.BigEndian.Uint32(sig[8:])
+	if 12+8*uint64(count) > uint64(len(sig)) {
+		return errors.New("Code signature index is out of bounds")
+	}
+
+	// Loop through blobs
+	for i := uint32(0); i < count; i++ {
+		var typ, o = binary.BigEndian.Uint32(sig[12+8*i:]), binary.BigEndian.Uint32(sig[16+8*i:])
+		switch {
+		case typ == codeSignatureSlotCMS:
+			// Ad-hoc signatures may have an empty CMS blob
+			if o > uint32(len(sig))-8 || binary.BigEndian.Uint32(sig[o+4:]) > 8 {
+				return errors.New("Binary is signed with a certificate and can't be re-signed")
+			}
+		case typ == codeSignatureSlotCodeDirectory || (typ >= codeSignatureSlotAlternateFirst && typ <= codeSignatureSlotAlternateLast):
+			if o > uint32(len(sig)) {
+				return errors.New("Code directory is out of bounds")
+			}
+			if err = signCodeDirectory(b, sig[o:]); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// signCodeDirectory computes the hashes of the pages of a binary again and writes them in its code directory
+func signCodeDirectory(b, cd []byte) (err error) {
+	// Check header
+	if len(cd) < 40 || binary.BigEndian.Uint32(cd) != codeDirectoryMagic {
+		return errors.New("Invalid code directory")
+	}
+	if binary.BigEndian.Uint32(cd[12:])&codeSignatureFlagAdHoc == 0 {
+		return errors.New("Code directory is not ad-hoc signed")
+	}
+	var version = binary.BigEndian.Uint32(cd[8:])
+	var hashOffset = binary.BigEndian.Uint32(cd[16:])
+	var nCodeSlots = binary.BigEndian.Uint32(cd[28:])
+	var codeLimit = uint64(binary.BigEndian.Uint32(cd[32:]))
+	var hashSize, hashType, pageSizeBits = cd[36], cd[37], cd[39]
+	if version >= codeSignatureVersionCodeLimit64 && len(cd) >= 64 {
+		if l := binary.BigEndian.Uint64(cd[56:]); l > 0 {
+			codeLimit = l
+		}
+	}
+
+	// Get hash
+	var h func() hash.Hash
+	switch hashType {
+	case 1:
+		h = sha1.New
+	case 2:
+		h = sha256.New
+	default:
+		return fmt.Errorf("Hash type %d is not supported", hashType)
+	}
+	if int(hashSize) != h().Size() {
+		return fmt.Errorf("Invalid hash size %d for hash type %d", hashSize, hashType)
+	}
+
+	// Check bounds
+	if pageSizeBits == 0 || pageSizeBits > 30 {
+		return fmt.Errorf("Page size 2^%d is not supported", pageSizeBits)
+	}
+	var pageSize = uint64(1) << pageSizeBits
+	if codeLimit > uint64(len(b)) || (codeLimit+pageSize-1)/pageSize != uint64(nCodeSlots) {
+		return errors.New("Code limit doesn't match the code slots")
+	}
+	if uint64(hashOffset)+uint64(nCodeSlots)*uint64(hashSize) > uint64(len(cd)) {
+		return errors.New("Code slots are out of bounds")
+	}
+
+	// Loop through pages
+	for i := uint64(0); i < uint64(nCodeSlots); i++ {
+		var end = (i + 1) * pageSize
+		if end > codeLimit {
+			end = codeLimit
+		}
+		var ph = h()
+		ph.Write(b[i*pageSize : end])
+		copy(cd[uint64(hashOffset)+i*uint64(hashSize):], ph.Sum(nil))
+	}
+	return
+}
@@ -0,0 +1,25 @@
+package astichat
+
+import "github.com/rs/xid"
+
+// Device represents a device owned by a chatterer
+// Each device has its own client and server keys so that a chatterer can be connected from several binaries at once
+type Device struct {
+	ClientPublicKey  *PublicKey  `bson:"client_public_key" json:"public_key"`
+	ID               string      `bson:"id" json:"id"`
+	ServerPrivateKey *PrivateKey `bson:"server_private_key" json:"-"`
+}
+
+// GenerateDeviceID allows testing functions using it
+var GenerateDeviceID = func() string {
+	return xid.New().String()
+}
+
+// NewDevice creates a new device
+func NewDevice(pubClient *PublicKey, prvServer *PrivateKey) Device {
+	return Device{
+		ClientPublicKey:  pubClient,
+		ID:               GenerateDeviceID(),
+		ServerPrivateKey: prvServer,
+	}
+}
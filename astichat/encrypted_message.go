@@ -5,6 +5,7 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha512"
 )
 
 // EncryptedMessage represents an encrypted message
@@ -14,6 +15,11 @@ type EncryptedMessage struct {
 	Message []byte `json:"message,omitempty"`
 }
 
+// Size returns the size of the encrypted message
+func (m EncryptedMessage) Size() int {
+	return len(m.IV) + len(m.Key) + len(m.Message)
+}
+
 // NewEncryptedMessage encrypts a message
 func NewEncryptedMessage(msg []byte, pubDst *PublicKey) (em EncryptedMessage, err error) {
 	// Generate random key
@@ -40,7 +46,7 @@ func NewEncryptedMessage(msg []byte, pubDst *PublicKey) (em EncryptedMessage, er
 	cfb.XORKeyStream(em.Message, msg)
 
 	// RSA encrypt the AES key
-	if em.Key, err = rsa.EncryptOAEP(pubHash, rand.Reader, pubDst.key, key, nil); err != nil {
+	if em.Key, err = rsa.EncryptOAEP(sha512.New(), rand.Reader, pubDst.key, key, nil); err != nil {
 		return
 	}
 	return
@@ -50,7 +56,7 @@ func NewEncryptedMessage(msg []byte, pubDst *PublicKey) (em EncryptedMessage, er
 func (m EncryptedMessage) Decrypt(prvSrc *PrivateKey) (o []byte, err error) {
 	// RSA decrypt the AES key
 	var key []byte
-	if key, err = rsa.DecryptOAEP(pubHash, rand.Reader, prvSrc.key, m.Key, nil); err != nil {
+	if key, err = rsa.DecryptOAEP(sha512.New(), rand.Reader, prvSrc.key, m.Key, nil); err != nil {
 		return
 	}
 
@@ -0,0 +1,432 @@
+package astichat
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asticode/go-astilog"
+)
+
+// Federation event names
+const (
+	FederationEventNameDevices = "devices"
+	FederationEventNameMessage = "message"
+	FederationEventNamePeers   = "peers"
+)
+
+// Consts
+const (
+	maxFederationEventSize = 2 << 20
+)
+
+// SplitAddress splits an address in the form user@server
+// Addresses of local chatterers have no server
+func SplitAddress(addr string) (username, server string) {
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		return addr[:i], addr[i+1:]
+	}
+	return addr, ""
+}
+
+// JoinAddress joins a username and a server into an address
+func JoinAddress(username, server string) string {
+	if server == "" {
+		return username
+	}
+	return username + "@" + server
+}
+
+// FederationConfiguration represents a federation configuration
+// Federation is only enabled when both a name and a private key are set
+type FederationConfiguration struct {
+	Name       string                          `toml:"name"`
+	PrivateKey *PrivateKey                     `toml:"private_key"`
+	Servers    []FederationServerConfiguration `toml:"servers"`
+	Timeout    time.Duration                   `toml:"timeout"`
+}
+
+// FederationServerConfiguration represents the configuration of a federated server
+type FederationServerConfiguration struct {
+	Addr      string     `toml:"addr"` // HTTP addr
+	Name      string     `toml:"name"`
+	PublicKey *PublicKey `toml:"public_key"`
+}
+
+// FederationMessage represents an end-to-end encrypted message sent to a chatterer of a federated server
+type FederationMessage struct {
+	MessageRequest
+	Sender string `json:"sender"` // Username of the sender on its own server
+}
+
+// FederationListenerFunc handles an event sent by a federated server and returns the payload of the response
+type FederationListenerFunc func(server string, payload json.RawMessage) (interface{}, error)
+
+// federationEvent represents an event exchanged between servers, either a request or its response
+// It's bound to its recipient so that it can't be replayed against another server
+type federationEvent struct {
+	CreatedAt time.Time       `json:"created_at"`
+	Error     string          `json:"error,omitempty"`
+	EventName string          `json:"event_name"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	Recipient string          `json:"recipient"`
+	Sender    string          `json:"sender"`
+}
+
+// federationEnvelope represents a federation event signed by its sender
+type federationEnvelope struct {
+	Event     json.RawMessage `json:"event"`
+	Signature []byte          `json:"signature"`
+}
+
+// Federation allows servers to exchange events over HTTP
+// Servers authenticate each other by signing events with their private key and verifying them with the public keys
+// of the servers they federate with
+type Federation struct {
+	httpClient *http.Client
+	listeners  map[string]FederationListenerFunc
+	Logger     astilog.Logger
+	mutex      *sync.Mutex
+	name       string
+	privateKey *PrivateKey
+	servers    map[string]FederationServerConfiguration // Indexed by name
+}
+
+// NewFederation creates a new federation
+func NewFederation(c FederationConfiguration) (f *Federation) {
+	f = &Federation{
+		httpClient: &http.Client{Timeout: c.Timeout},
+		listeners:  make(map[string]FederationListenerFunc),
+		Logger:     astilog.NopLogger(),
+		mutex:      &sync.Mutex{},
+		name:       c.Name,
+		privateKey: c.PrivateKey,
+		servers:    make(map[string]FederationServerConfiguration),
+	}
+	for _, s := range c.Servers {
+		f.servers[s.Name] = s
+	}
+	return
+}
+
+// Enabled checks whether the federation is enabled
+func (f *Federation) Enabled() bool {
+	return f.name != "" && f.privateKey != nil
+}
+
+// Name returns the name of the server in the federation
+func (f *Federation) Name() string {
+	return f.name
+}
+
+// Servers returns the names of the federated servers
+func (f *Federation) Servers() (o []string) {
+	for n := range f.servers {
+		o = append(o, n)
+	}
+	sort.Strings(o)
+	return
+}
+
+// Local returns the username of an address if it belongs to a local chatterer
+func (f *Federation) Local(addr string) (username string, ok bool) {
+	var server string
+	username, server = SplitAddress(addr)
+	ok = server == "" || server == f.name
+	return
+}
+
+// SetListener sets the listener of an event
+func (f *Federation) SetListener(eventName string, l FederationListenerFunc) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.listeners[eventName] = l
+}
+
+// seal signs a federation event
+func (f *Federation) seal(e federationEvent) (en federationEnvelope, err error) {
+	if en.Event, err = json.Marshal(e); err != nil {
+		return
+	}
+	if en.Signature, err = f.privateKey.Sign(en.Event); err != nil {
+		return
+	}
+	return
+}
+
+// open verifies a federation event signed by a federated server
+func (f *Federation) open(en federationEnvelope, now time.Time) (e federationEvent, err error) {
+	// Unmarshal
+	if err = json.Unmarshal(en.Event, &e); err != nil {
+		return
+	}
+
+	// Check sender
+	var s, ok = f.servers[e.Sender]
+	if !ok {
+		err = fmt.Errorf("Unknown server %s", e.Sender)
+		return
+	}
+
+	// Verify signature
+	if err = s.PublicKey.Verify(en.Event, en.Signature); err != nil {
+		err = fmt.Errorf("Invalid signature of server %s: %s", e.Sender, err)
+		return
+	}
+
+	// Check recipient
+	if e.Recipient != f.name {
+		err = fmt.Errorf("Event of server %s is meant for server %s", e.Sender, e.Recipient)
+		return
+	}
+
+	// Validate the event's creation date
+	if e.CreatedAt.After(now.Add(5*time.Second)) || e.CreatedAt.Before(now.Add(-5*time.Second)) {
+		err = fmt.Errorf("Event creation date %s is invalid compared to now %s", e.CreatedAt, now)
+		return
+	}
+	return
+}
+
+// Send sends an event to a federated server and unmarshals the payload of its response into v if it's not nil
+func (f *Federation) Send(server, eventName string, payload, v interface{}) (err error) {
+	// Get server
+	var s, ok = f.servers[server]
+	if !ok {
+		err = fmt.Errorf("Unknown server %s", server)
+		return
+	}
+
+	// Create event
+	var e = federationEvent{CreatedAt: TimeNow(), EventName: eventName, Recipient: server, Sender: f.name}
+	if e.Payload, err = json.Marshal(payload); err != nil {
+		return
+	}
+
+	// Seal
+	var en federationEnvelope
+	if en, err = f.seal(e); err != nil {
+		return
+	}
+
+	// Marshal
+	var buf = &bytes.Buffer{}
+	if err = json.NewEncoder(buf).Encode(en); err != nil {
+		return
+	}
+
+	// Send request
+	var resp *http.Response
+	if resp, err = f.httpClient.Post(s.Addr+"/federation", "application/json", buf); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	// Check status code
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("Invalid status code %d returned by server %s", resp.StatusCode, server)
+		return
+	}
+
+	// Unmarshal
+	if err = json.NewDecoder(io.LimitReader(resp.Body, maxFederationEventSize)).Decode(&en); err != nil {
+		return
+	}
+
+	// Open
+	if e, err = f.open(en, TimeNow()); err != nil {
+		return
+	}
+
+	// Check response
+	if e.EventName != eventName {
+		err = fmt.Errorf("Expected response to %s but got %s", eventName, e.EventName)
+		return
+	} else if e.Error != "" {
+		err = errors.New(e.Error)
+		return
+	}
+
+	// Unmarshal payload
+	if v != nil {
+		if err = json.Unmarshal(e.Payload, v); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Broadcast sends an event to all federated servers
+func (f *Federation) Broadcast(eventName string, payload interface{}) {
+	for _, s := range f.Servers() {
+		if err := f.Send(s, eventName, payload, nil); err != nil {
+			f.Logger.Errorf("%s while sending %s to server %s", err, eventName, s)
+		}
+	}
+}
+
+// ServeHTTP handles events sent by federated servers
+func (f *Federation) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// Federation is disabled
+	if !f.Enabled() {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Unmarshal
+	var en federationEnvelope
+	var err error
+	if err = json.NewDecoder(io.LimitReader(r.Body, maxFederationEventSize)).Decode(&en); err != nil {
+		f.Logger.Errorf("%s while unmarshaling federation event", err)
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Open
+	var e federationEvent
+	if e, err = f.open(en, TimeNow()); err != nil {
+		f.Logger.Errorf("%s while opening federation event", err)
+		rw.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// Get listener
+	f.mutex.Lock()
+	var l, ok = f.listeners[e.EventName]
+	f.mutex.Unlock()
+
+	// Execute listener
+	var rsp = federationEvent{CreatedAt: TimeNow(), EventName: e.EventName, Recipient: e.Sender, Sender: f.name}
+	var v interface{}
+	if !ok {
+		rsp.Error = fmt.Sprintf("Unknown event %s", e.EventName)
+	} else if v, err = l(e.Sender, e.Payload); err != nil {
+		f.Logger.Errorf("%s while executing federation listener %s for server %s", err, e.EventName, e.Sender)
+		rsp.Error = err.Error()
+	} else if v != nil {
+		if rsp.Payload, err = json.Marshal(v); err != nil {
+			f.Logger.Errorf("%s while marshaling response to %s", err, e.EventName)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Seal
+	if en, err = f.seal(rsp); err != nil {
+		f.Logger.Errorf("%s while sealing response to %s", err, e.EventName)
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// Write
+	rw.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(rw).Encode(en); err != nil {
+		f.Logger.Errorf("%s while writing response to %s", err, e.EventName)
+		return
+	}
+}
+
+// Devices fetches the devices of a chatterer of a federated server
+func (f *Federation) Devices(addr string) (ds []Device, err error) {
+	var username, server = SplitAddress(addr)
+	err = f.Send(server, FederationEventNameDevices, username, &ds)
+	return
+}
+
+// Message sends an end-to-end encrypted message to a chatterer of a federated server
+// Delivery notifications don't cross servers
+func (f *Federation) Message(sender string, mr MessageRequest) (ids []string, err error) {
+	var username, server = SplitAddress(mr.Recipient)
+	mr.Notify = false
+	mr.Recipient = username
+	err = f.Send(server, FederationEventNameMessage, FederationMessage{MessageRequest: mr, Sender: sender}, &ids)
+	return
+}
+
+// NewFederatedPeer creates the peer shared with federated servers
+// Addrs are not shared since federated peers can only be reached through the servers
+func NewFederatedPeer(p *Peer) *Peer {
+	return &Peer{
+		Device:   Device{ClientPublicKey: p.ClientPublicKey, ID: p.Device.ID},
+		Username: p.Username,
+	}
+}
+
+// HandleFederationDevices returns the devices of a local chatterer
+func HandleFederationDevices(stg Storage) FederationListenerFunc {
+	return func(server string, payload json.RawMessage) (v interface{}, err error) {
+		// Unmarshal
+		var username string
+		if err = json.Unmarshal(payload, &username); err != nil {
+			return
+		}
+
+		// Fetch chatterer
+		var c Chatterer
+		if c, err = stg.ChattererFetchByUsername(username); err != nil {
+			return
+		}
+		return c.Devices, nil
+	}
+}
+
+// HandleFederationMessage queues messages sent by chatterers of federated servers for local chatterers
+// fn is executed for each queued message so that it can be delivered right away to devices that are connected
+func HandleFederationMessage(stg Storage, ttl time.Duration, fn func(m Message)) FederationListenerFunc {
+	return func(server string, payload json.RawMessage) (v interface{}, err error) {
+		// Unmarshal
+		var fm FederationMessage
+		if err = json.Unmarshal(payload, &fm); err != nil {
+			return
+		}
+
+		// Recipient exists
+		var rc Chatterer
+		if rc, err = stg.ChattererFetchByUsername(fm.Recipient); err != nil {
+			return
+		}
+
+		// Devices exist
+		// They're all checked before creating any message so that an invalid device doesn't leave part of the
+		// messages queued
+		for device := range fm.Messages {
+			if _, ok := rc.Device(device); !ok {
+				err = fmt.Errorf("Invalid device %s", device)
+				return
+			}
+		}
+
+		// Loop through devices
+		var now = TimeNow()
+		var ids []string
+		for device, em := range fm.Messages {
+			// Create message
+			// The sender is qualified with the server it has been authenticated as
+			var m Message
+			if m, err = stg.MessageCreate(Message{
+				CreatedAt: now,
+				Device:    device,
+				ExpiresAt: now.Add(ttl),
+				Message:   em,
+				Recipient: fm.Recipient,
+				Sender:    JoinAddress(fm.Sender, server),
+			}); err != nil {
+				return
+			}
+			ids = append(ids, m.ID)
+
+			// Custom
+			if fn != nil {
+				fn(m)
+			}
+		}
+		return ids, nil
+	}
+}
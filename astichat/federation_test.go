@@ -0,0 +1,139 @@
+package astichat_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitAddress(t *testing.T) {
+	var u, s = astichat.SplitAddress("bob@b.example.com")
+	assert.Equal(t, "bob", u)
+	assert.Equal(t, "b.example.com", s)
+	u, s = astichat.SplitAddress("bob")
+	assert.Equal(t, "bob", u)
+	assert.Equal(t, "", s)
+	assert.Equal(t, "bob@b", astichat.JoinAddress("bob", "b"))
+	assert.Equal(t, "bob", astichat.JoinAddress("bob", ""))
+}
+
+func TestFederation(t *testing.T) {
+	// Init keys
+	var prvA = &astichat.PrivateKey{}
+	prvA.SetPassphrase("test")
+	var err = prvA.UnmarshalText([]byte(prv1String))
+	assert.NoError(t, err)
+	var pubA *astichat.PublicKey
+	pubA, err = prvA.PublicKey()
+	assert.NoError(t, err)
+	var prvB = &astichat.PrivateKey{}
+	err = prvB.UnmarshalText([]byte(prv2String))
+	assert.NoError(t, err)
+	var pubB *astichat.PublicKey
+	pubB, err = prvB.PublicKey()
+	assert.NoError(t, err)
+
+	// Init storages
+	// Bob's device uses server A's key since only the public part matters here
+	var stgA, stgB = astichat.NewMockedStorage(), astichat.NewMockedStorage()
+	stgB.ChattererCreate("bob", astichat.Device{ClientPublicKey: pubA, ID: "d1"})
+
+	// Init servers
+	var fA, fB *astichat.Federation
+	var sA = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) { fA.ServeHTTP(rw, r) }))
+	defer sA.Close()
+	var sB = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) { fB.ServeHTTP(rw, r) }))
+	defer sB.Close()
+	fA = astichat.NewFederation(astichat.FederationConfiguration{
+		Name:       "a",
+		PrivateKey: prvA,
+		Servers:    []astichat.FederationServerConfiguration{{Addr: sB.URL, Name: "b", PublicKey: pubB}},
+		Timeout:    time.Second,
+	})
+	fA.SetListener(astichat.FederationEventNameDevices, astichat.HandleFederationDevices(stgA))
+	fB = astichat.NewFederation(astichat.FederationConfiguration{
+		Name:       "b",
+		PrivateKey: prvB,
+		Servers:    []astichat.FederationServerConfiguration{{Addr: sA.URL, Name: "a", PublicKey: pubA}},
+		Timeout:    time.Second,
+	})
+	var delivered []astichat.Message
+	fB.SetListener(astichat.FederationEventNameDevices, astichat.HandleFederationDevices(stgB))
+	fB.SetListener(astichat.FederationEventNameMessage, astichat.HandleFederationMessage(stgB, time.Hour, func(m astichat.Message) {
+		delivered = append(delivered, m)
+	}))
+	var joined []string
+	fB.SetListener(astichat.EventNamePeerJoined, func(server string, payload json.RawMessage) (interface{}, error) {
+		var p astichat.Peer
+		if err := json.Unmarshal(payload, &p); err != nil {
+			return nil, err
+		}
+		joined = append(joined, astichat.JoinAddress(p.Username, server))
+		return nil, nil
+	})
+
+	// Local addresses
+	var u, ok = fA.Local("alice@a")
+	assert.True(t, ok)
+	assert.Equal(t, "alice", u)
+	_, ok = fA.Local("bob@b")
+	assert.False(t, ok)
+
+	// Devices
+	var ds []astichat.Device
+	ds, err = fA.Devices("bob@b")
+	assert.NoError(t, err)
+	assert.Len(t, ds, 1)
+	assert.Equal(t, "d1", ds[0].ID)
+	assert.Equal(t, pubA.String(), ds[0].ClientPublicKey.String())
+	_, err = fA.Devices("carol@b")
+	assert.Error(t, err)
+
+	// Message
+	var em astichat.EncryptedMessage
+	em, err = astichat.NewEncryptedMessage([]byte("hello"), ds[0].ClientPublicKey)
+	assert.NoError(t, err)
+	var ids []string
+	ids, err = fA.Message("alice", astichat.MessageRequest{Messages: map[string]astichat.EncryptedMessage{"d1": em}, Notify: true, Recipient: "bob@b"})
+	assert.NoError(t, err)
+	assert.Len(t, ids, 1)
+	assert.Len(t, stgB.Messages, 1)
+	assert.Equal(t, ids[0], stgB.Messages[0].ID)
+	assert.Equal(t, "alice@a", stgB.Messages[0].Sender)
+	assert.Equal(t, "bob", stgB.Messages[0].Recipient)
+	assert.False(t, stgB.Messages[0].Notify)
+	assert.Equal(t, stgB.Messages, delivered)
+	var b []byte
+	b, err = stgB.Messages[0].Message.Decrypt(prvA)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+
+	// Presence
+	err = fA.Send("b", astichat.EventNamePeerJoined, astichat.NewFederatedPeer(astichat.NewPeer(nil, "alice", astichat.Device{ClientPublicKey: pubA, ID: "d2"})), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"alice@a"}, joined)
+
+	// Unknown event
+	err = fA.Send("b", "unknown", nil, nil)
+	assert.EqualError(t, err, "Unknown event unknown")
+
+	// Unknown server
+	err = fA.Send("c", astichat.FederationEventNameDevices, "bob", nil)
+	assert.EqualError(t, err, "Unknown server c")
+
+	// Impersonation
+	var fE = astichat.NewFederation(astichat.FederationConfiguration{
+		Name:       "a",
+		PrivateKey: prvB,
+		Servers:    []astichat.FederationServerConfiguration{{Addr: sB.URL, Name: "b", PublicKey: pubB}},
+		Timeout:    time.Second,
+	})
+	err = fE.Send("b", astichat.FederationEventNameMessage, astichat.FederationMessage{Sender: "eve"}, nil)
+	assert.EqualError(t, err, "Invalid status code 401 returned by server b")
+	assert.Len(t, stgB.Messages, 1)
+}
@@ -0,0 +1,242 @@
+package astichat
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/asticode/go-astiudp"
+	"github.com/rs/xid"
+)
+
+// Transport represents an entity capable of writing events and executing listeners
+type Transport interface {
+	SetListener(eventName string, l astiudp.ListenerFunc)
+	Write(eventName string, payload interface{}, addr *net.UDPAddr) error
+}
+
+// Fragment represents a chunk of a payload too large to fit in one datagram
+type Fragment struct {
+	Count     int    `json:"count"`
+	Data      []byte `json:"data"`
+	EventName string `json:"event_name"`
+	ID        string `json:"id"`
+	Index     int    `json:"index"`
+}
+
+// FragmenterConfiguration represents a fragmenter configuration
+type FragmenterConfiguration struct {
+	ChunkSize      int           `toml:"chunk_size"`
+	MaxBufferSize  int           `toml:"max_buffer_size"`
+	MaxPayloadSize int           `toml:"max_payload_size"`
+	Timeout        time.Duration `toml:"timeout"`
+}
+
+// AllowFunc checks whether an event coming from an addr is allowed
+type AllowFunc func(eventName string, addr *net.UDPAddr) bool
+
+// Fragmenter splits large payloads into fragments and reassembles them on the receiving side
+type Fragmenter struct {
+	Allow          AllowFunc // Optional, fragments it doesn't allow are dropped before being buffered
+	bufferSize     int
+	buffers        map[string]*fragmentBuffer // Indexed by addr + fragment ID
+	chunkSize      int
+	listeners      map[string]astiudp.ListenerFunc
+	maxBufferSize  int
+	maxPayloadSize int
+	mutex          *sync.Mutex
+	timeout        time.Duration
+	t              Transport
+}
+
+// fragmentBuffer represents the fragments of a payload being reassembled
+type fragmentBuffer struct {
+	createdAt time.Time
+	eventName string
+	fragments [][]byte
+	indexes   []bool // Indexes of the fragments that have been received
+	received  int
+	size      int
+}
+
+// NewFragmenter creates a new fragmenter
+func NewFragmenter(t Transport, c FragmenterConfiguration) *Fragmenter {
+	var f = &Fragmenter{
+		buffers:        make(map[string]*fragmentBuffer),
+		chunkSize:      c.ChunkSize,
+		listeners:      make(map[string]astiudp.ListenerFunc),
+		maxBufferSize:  c.MaxBufferSize,
+		maxPayloadSize: c.MaxPayloadSize,
+		mutex:          &sync.Mutex{},
+		timeout:        c.Timeout,
+		t:              t,
+	}
+	if f.chunkSize <= 0 {
+		f.chunkSize = 768
+	}
+	if f.maxBufferSize <= 0 {
+		f.maxBufferSize = 4 << 20
+	}
+	if f.maxPayloadSize <= 0 {
+		f.maxPayloadSize = 1 << 20
+	}
+	if f.timeout <= 0 {
+		f.timeout = 10 * time.Second
+	}
+	t.SetListener(EventNameFragment, f.HandleFragment())
+	return f
+}
+
+// SetListener sets a listener that will be executed for both whole and reassembled payloads
+func (f *Fragmenter) SetListener(eventName string, l astiudp.ListenerFunc) {
+	f.mutex.Lock()
+	f.listeners[eventName] = l
+	f.mutex.Unlock()
+	f.t.SetListener(eventName, l)
+}
+
+// Write writes a payload and splits it into fragments if it's too large
+func (f *Fragmenter) Write(eventName string, payload interface{}, addr *net.UDPAddr) (err error) {
+	// Marshal
+	var b []byte
+	if b, err = json.Marshal(payload); err != nil {
+		return
+	}
+
+	// Payload is small enough
+	if len(b) <= f.chunkSize {
+		return f.t.Write(eventName, json.RawMessage(b), addr)
+	}
+
+	// Payload is too large
+	if len(b) > f.maxPayloadSize {
+		return fmt.Errorf("Payload size %d exceeds max payload size %d", len(b), f.maxPayloadSize)
+	}
+
+	// Loop through chunks
+	var id = xid.New().String()
+	var count = (len(b) + f.chunkSize - 1) / f.chunkSize
+	for i := 0; i < count; i++ {
+		var end = (i + 1) * f.chunkSize
+		if end > len(b) {
+			end = len(b)
+		}
+		if err = f.t.Write(EventNameFragment, Fragment{
+			Count:     count,
+			Data:      b[i*f.chunkSize : end],
+			EventName: eventName,
+			ID:        id,
+			Index:     i,
+		}, addr); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// HandleFragment handles the fragment event
+func (f *Fragmenter) HandleFragment() astiudp.ListenerFunc {
+	return func(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) (err error) {
+		// Fragment is not allowed
+		if f.Allow != nil && !f.Allow(eventName, addr) {
+			return
+		}
+
+		// Unmarshal
+		var fr Fragment
+		if err = json.Unmarshal(payload, &fr); err != nil {
+			return
+		}
+
+		// Add fragment
+		var b []byte
+		var l astiudp.ListenerFunc
+		if b, l, err = f.add(fr, addr); err != nil || b == nil {
+			return
+		}
+
+		// Execute listener
+		return l(s, fr.EventName, json.RawMessage(b), addr)
+	}
+}
+
+// add adds a fragment to its buffer and returns the payload once it's complete
+func (f *Fragmenter) add(fr Fragment, addr *net.UDPAddr) (o []byte, l astiudp.ListenerFunc, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// Validate fragment
+	var ok bool
+	if l, ok = f.listeners[fr.EventName]; !ok {
+		err = fmt.Errorf("No listener for fragmented event %s", fr.EventName)
+		return
+	} else if fr.Count <= 0 || fr.Count*f.chunkSize > f.maxPayloadSize {
+		err = fmt.Errorf("Invalid fragment count %d", fr.Count)
+		return
+	} else if fr.Index < 0 || fr.Index >= fr.Count || len(fr.Data) == 0 || len(fr.Data) > f.chunkSize {
+		err = fmt.Errorf("Invalid fragment %d/%d of size %d", fr.Index, fr.Count, len(fr.Data))
+		return
+	}
+
+	// Purge expired buffers
+	var now = time.Now()
+	for k, fb := range f.buffers {
+		if now.Sub(fb.createdAt) > f.timeout {
+			f.delBuffer(k)
+		}
+	}
+
+	// Get buffer
+	var k = addr.String() + "/" + fr.ID
+	var fb *fragmentBuffer
+	if fb, ok = f.buffers[k]; !ok {
+		fb = &fragmentBuffer{createdAt: now, eventName: fr.EventName, fragments: make([][]byte, fr.Count), indexes: make([]bool, fr.Count)}
+		f.buffers[k] = fb
+	} else if fb.eventName != fr.EventName || len(fb.fragments) != fr.Count {
+		err = fmt.Errorf("Fragment %s doesn't match its buffer", fr.ID)
+		return
+	}
+
+	// Fragment has already been received
+	if fb.indexes[fr.Index] {
+		return
+	}
+
+	// Check memory limit
+	if f.bufferSize+len(fr.Data) > f.maxBufferSize {
+		f.delBuffer(k)
+		err = fmt.Errorf("Max buffer size %d reached", f.maxBufferSize)
+		return
+	}
+
+	// Add fragment
+	fb.fragments[fr.Index] = fr.Data
+	fb.indexes[fr.Index] = true
+	fb.received++
+	fb.size += len(fr.Data)
+	f.bufferSize += len(fr.Data)
+
+	// Buffer is not complete
+	if fb.received < len(fb.fragments) {
+		return
+	}
+
+	// Reassemble
+	o = make([]byte, 0, fb.size)
+	for _, d := range fb.fragments {
+		o = append(o, d...)
+	}
+	f.delBuffer(k)
+	return
+}
+
+// delBuffer deletes a buffer
+// Mutex must be locked
+func (f *Fragmenter) delBuffer(k string) {
+	if fb, ok := f.buffers[k]; ok {
+		f.bufferSize -= fb.size
+		delete(f.buffers, k)
+	}
+}
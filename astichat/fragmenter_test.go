@@ -0,0 +1,117 @@
+package astichat_test
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/asticode/go-astiudp"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockedTransport represents a mocked transport that executes its own listeners on write
+type mockedTransport struct {
+	listeners map[string]astiudp.ListenerFunc
+	writes    []string
+}
+
+func newMockedTransport() *mockedTransport {
+	return &mockedTransport{listeners: make(map[string]astiudp.ListenerFunc)}
+}
+
+func (t *mockedTransport) SetListener(eventName string, l astiudp.ListenerFunc) {
+	t.listeners[eventName] = l
+}
+
+func (t *mockedTransport) Write(eventName string, payload interface{}, addr *net.UDPAddr) (err error) {
+	var b []byte
+	if b, err = json.Marshal(payload); err != nil {
+		return
+	}
+	t.writes = append(t.writes, eventName)
+	if l, ok := t.listeners[eventName]; ok {
+		return l(nil, eventName, b, addr)
+	}
+	return
+}
+
+func TestFragmenter(t *testing.T) {
+	// Init
+	var tr = newMockedTransport()
+	var f = astichat.NewFragmenter(tr, astichat.FragmenterConfiguration{ChunkSize: 10, MaxBufferSize: 25, MaxPayloadSize: 100, Timeout: time.Minute})
+	var received []string
+	f.SetListener("event", func(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) error {
+		var v string
+		json.Unmarshal(payload, &v)
+		received = append(received, v)
+		return nil
+	})
+	var addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+
+	// Small payload
+	var err = f.Write("event", "small", addr)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"small"}, received)
+	assert.Equal(t, []string{"event"}, tr.writes)
+
+	// Large payload
+	tr.writes = []string{}
+	err = f.Write("event", "this payload is large", addr)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"small", "this payload is large"}, received)
+	assert.Equal(t, []string{astichat.EventNameFragment, astichat.EventNameFragment, astichat.EventNameFragment}, tr.writes)
+
+	// Payload exceeds max payload size
+	err = f.Write("event", strings.Repeat("a", 100), addr)
+	assert.Error(t, err)
+
+	// Out of order fragments with duplicates
+	var l = tr.listeners[astichat.EventNameFragment]
+	var fr = func(i int, d string) json.RawMessage {
+		b, _ := json.Marshal(astichat.Fragment{Count: 2, Data: []byte(d), EventName: "event", ID: "1", Index: i})
+		return b
+	}
+	err = l(nil, astichat.EventNameFragment, fr(1, `ed"`), addr)
+	assert.NoError(t, err)
+	err = l(nil, astichat.EventNameFragment, fr(1, `ed"`), addr)
+	assert.NoError(t, err)
+	err = l(nil, astichat.EventNameFragment, fr(0, `"reorder`), addr)
+	assert.NoError(t, err)
+	assert.Equal(t, "reordered", received[len(received)-1])
+
+	// Empty fragments are rejected so that resending them can't complete a buffer with missing chunks
+	var n = len(received)
+	for _, d := range [][]byte{nil, {}, {}} {
+		b, _ := json.Marshal(astichat.Fragment{Count: 2, Data: d, EventName: "event", ID: "2", Index: 0})
+		err = l(nil, astichat.EventNameFragment, b, addr)
+		assert.Error(t, err)
+	}
+	b, _ := json.Marshal(astichat.Fragment{Count: 2, Data: []byte(`"a"`), EventName: "event", ID: "2", Index: 1})
+	err = l(nil, astichat.EventNameFragment, b, addr)
+	assert.NoError(t, err)
+	assert.Len(t, received, n)
+
+	// Memory limit
+	for i := 0; i < 3; i++ {
+		b, _ := json.Marshal(astichat.Fragment{Count: 3, Data: []byte("0123456789"), EventName: "event", ID: string(rune('a' + i)), Index: 0})
+		err = l(nil, astichat.EventNameFragment, b, addr)
+	}
+	assert.Error(t, err)
+
+	// Fragments not allowed are dropped before being buffered
+	var count int
+	f.Allow = func(eventName string, addr *net.UDPAddr) bool {
+		count++
+		return false
+	}
+	err = l(nil, astichat.EventNameFragment, fr(1, `ed"`), addr)
+	assert.NoError(t, err)
+	err = l(nil, astichat.EventNameFragment, fr(0, `"reorder`), addr)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, "reordered", received[len(received)-1])
+	assert.Len(t, received, 3)
+}
@@ -0,0 +1,260 @@
+package astichat
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/asticode/go-astilog"
+)
+
+// Hook event names
+const (
+	HookEventNameAuthFailed          = "auth.failed"
+	HookEventNameChattererDownloaded = "chatterer.downloaded"
+	HookEventNameChattererUpgraded   = "chatterer.upgraded"
+	HookEventNameDeviceRevoked       = "device.revoked"
+	HookEventNamePeerJoined          = "peer.joined"
+	HookEventNamePeerLeft            = "peer.left"
+	HookEventNameTokenIssued         = "token.issued"
+)
+
+// Webhook headers
+const (
+	WebhookHeaderDelivery  = "X-Astichat-Delivery"
+	WebhookHeaderEvent     = "X-Astichat-Event"
+	WebhookHeaderSignature = "X-Astichat-Signature"
+)
+
+// HookEvent represents an event emitted by the server
+// Only the fields relevant to the event are set
+type HookEvent struct {
+	Addr      string     `json:"addr,omitempty"`
+	Build     *BuildInfo `json:"build,omitempty"` // Build metadata of the client of a joined peer
+	CreatedAt time.Time  `json:"created_at"`
+	Device    string     `json:"device,omitempty"`
+	Name      string     `json:"name"`
+	OS        string     `json:"os,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	Username  string     `json:"username,omitempty"`
+}
+
+// NewHookEvent creates a new hook event
+func NewHookEvent(name string) HookEvent {
+	return HookEvent{CreatedAt: TimeNow(), Name: name}
+}
+
+// Hook represents an object reacting to events emitted by the server
+// HandleEvent is executed in the server's goroutines and must not block
+type Hook interface {
+	HandleEvent(e HookEvent)
+}
+
+// HookFunc allows using a func as a hook
+type HookFunc func(e HookEvent)
+
+// HandleEvent implements the Hook interface
+func (f HookFunc) HandleEvent(e HookEvent) {
+	f(e)
+}
+
+// Hooks dispatches events to several hooks
+type Hooks []Hook
+
+// HandleEvent implements the Hook interface
+func (hs Hooks) HandleEvent(e HookEvent) {
+	for _, h := range hs {
+		h.HandleEvent(e)
+	}
+}
+
+// NopHook implements the Hook interface
+type NopHook struct{}
+
+// HandleEvent implements the Hook interface
+func (h NopHook) HandleEvent(e HookEvent) {}
+
+// WebhookConfiguration represents a webhook configuration
+// The webhook is only enabled when an URL is set
+type WebhookConfiguration struct {
+	Backoff     time.Duration `toml:"backoff"`
+	MaxAttempts int           `toml:"max_attempts"`
+	QueueSize   int           `toml:"queue_size"`
+	Secret      string        `toml:"secret"`
+	Timeout     time.Duration `toml:"timeout"`
+	URL         string        `toml:"url"`
+}
+
+// Webhook is a hook that posts events to an URL
+// Bodies are signed with HMAC-SHA256 so that receivers can check they come from the server, and deliveries are
+// retried with an exponential backoff
+type Webhook struct {
+	c          WebhookConfiguration
+	cancel     context.CancelFunc
+	channel    chan HookEvent
+	closed     bool
+	ctx        context.Context // Cancelled when the remaining events must be dropped
+	httpClient *http.Client
+	Logger     astilog.Logger
+	mutex      *sync.Mutex
+	wg         *sync.WaitGroup
+}
+
+// NewWebhook creates a new webhook
+func NewWebhook(c WebhookConfiguration) (w *Webhook) {
+	w = &Webhook{
+		c:          c,
+		channel:    make(chan HookEvent, c.QueueSize),
+		httpClient: &http.Client{Timeout: c.Timeout},
+		Logger:     astilog.NopLogger(),
+		mutex:      &sync.Mutex{},
+		wg:         &sync.WaitGroup{},
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	return
+}
+
+// SignWebhook returns the signature of a webhook body
+func SignWebhook(secret string, body []byte) string {
+	var h = hmac.New(sha256.New, []byte(secret))
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// VerifyWebhook checks the signature of a webhook body
+func VerifyWebhook(secret string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhook(secret, body)), []byte(signature))
+}
+
+// Start starts delivering events
+func (w *Webhook) Start() {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		for e := range w.channel {
+			if w.ctx.Err() != nil {
+				w.Logger.Errorf("Dropping %s since the webhook has been cancelled", e.Name)
+				continue
+			}
+			w.deliver(e)
+		}
+	}()
+}
+
+// Close stops accepting events and waits for the queued ones to be delivered until the context is done
+// Once it's done, the delivery in progress is aborted and the events still queued are dropped
+func (w *Webhook) Close(ctx context.Context) {
+	// Stop accepting events
+	w.mutex.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.channel)
+	}
+	w.mutex.Unlock()
+
+	// Wait
+	var done = make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		w.cancel()
+		<-done
+	}
+	w.cancel()
+}
+
+// HandleEvent implements the Hook interface
+// Events are dropped when the queue is full so that the server is never slowed down by the receiver
+func (w *Webhook) HandleEvent(e HookEvent) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		w.Logger.Debugf("Dropping %s since the webhook is closed", e.Name)
+		return
+	}
+	select {
+	case w.channel <- e:
+	default:
+		w.Logger.Errorf("Dropping %s since the webhook queue is full", e.Name)
+	}
+}
+
+// deliver delivers an event, retrying until it's accepted or the max attempts have been reached
+func (w *Webhook) deliver(e HookEvent) {
+	// Marshal
+	var b []byte
+	var err error
+	if b, err = json.Marshal(e); err != nil {
+		w.Logger.Errorf("%s while marshaling %s", err, e.Name)
+		return
+	}
+
+	// Loop through attempts
+	// The delivery id is the same for all attempts so that receivers can deduplicate events
+	var id = GenerateToken()
+	var delay = w.c.Backoff
+	for attempt := 1; attempt <= w.c.MaxAttempts; attempt++ {
+		// Send
+		var retry bool
+		if retry, err = w.send(id, e.Name, b); err == nil {
+			return
+		}
+		w.Logger.Errorf("%s while delivering %s to webhook, attempt #%d", err, e.Name, attempt)
+
+		// Don't retry
+		if !retry || attempt == w.c.MaxAttempts {
+			break
+		}
+
+		// Back off
+		select {
+		case <-time.After(delay):
+		case <-w.ctx.Done():
+			return
+		}
+		delay *= 2
+	}
+	w.Logger.Errorf("Webhook delivery %s of %s has failed", id, e.Name)
+}
+
+// send sends an event once and indicates whether it's worth retrying in case of error
+func (w *Webhook) send(id, eventName string, b []byte) (retry bool, err error) {
+	// Create request
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodPost, w.c.URL, bytes.NewReader(b)); err != nil {
+		return
+	}
+	req = req.WithContext(w.ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookHeaderDelivery, id)
+	req.Header.Set(WebhookHeaderEvent, eventName)
+	req.Header.Set(WebhookHeaderSignature, SignWebhook(w.c.Secret, b))
+
+	// Send request
+	var resp *http.Response
+	if resp, err = w.httpClient.Do(req); err != nil {
+		retry = true
+		return
+	}
+	resp.Body.Close()
+
+	// Check status code
+	// Client errors won't go away by retrying, except for rate limiting
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = fmt.Errorf("Invalid status code %d", resp.StatusCode)
+		retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return
+	}
+	return
+}
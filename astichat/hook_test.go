@@ -0,0 +1,148 @@
+package astichat_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHooks(t *testing.T) {
+	var es []string
+	var h = astichat.Hooks{astichat.NopHook{}, astichat.HookFunc(func(e astichat.HookEvent) {
+		es = append(es, e.Name)
+	})}
+	h.HandleEvent(astichat.NewHookEvent(astichat.HookEventNamePeerJoined))
+	assert.Equal(t, []string{astichat.HookEventNamePeerJoined}, es)
+}
+
+func TestWebhook(t *testing.T) {
+	// Init receiver
+	// The first attempt of each delivery fails, and events of bob are rejected
+	var m = &sync.Mutex{}
+	var attempts = make(map[string]int)
+	var received []astichat.HookEvent
+	var s = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// Check signature
+		var b, _ = ioutil.ReadAll(r.Body)
+		if !astichat.VerifyWebhook("secret", b, r.Header.Get(astichat.WebhookHeaderSignature)) {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// Unmarshal
+		var e astichat.HookEvent
+		if err := json.Unmarshal(b, &e); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// Fail first attempt
+		m.Lock()
+		defer m.Unlock()
+		var id = r.Header.Get(astichat.WebhookHeaderDelivery)
+		attempts[id]++
+		if e.Username == "bob" {
+			rw.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		} else if attempts[id] == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, e.Name, r.Header.Get(astichat.WebhookHeaderEvent))
+		received = append(received, e)
+	}))
+	defer s.Close()
+
+	// Init webhook
+	var w = astichat.NewWebhook(astichat.WebhookConfiguration{
+		Backoff:     time.Millisecond,
+		MaxAttempts: 3,
+		QueueSize:   10,
+		Secret:      "secret",
+		Timeout:     time.Second,
+		URL:         s.URL,
+	})
+	w.Start()
+
+	// Handle events
+	var e1 = astichat.NewHookEvent(astichat.HookEventNamePeerJoined)
+	e1.Username = "alice"
+	w.HandleEvent(e1)
+	var e2 = astichat.NewHookEvent(astichat.HookEventNamePeerLeft)
+	e2.Username = "bob"
+	w.HandleEvent(e2)
+	var e3 = astichat.NewHookEvent(astichat.HookEventNameAuthFailed)
+	e3.Reason = "invalid"
+	w.HandleEvent(e3)
+	w.Close(context.Background())
+
+	// Events handled after closing are dropped
+	w.HandleEvent(e1)
+
+	// Assert
+	assert.Len(t, received, 2)
+	assert.Equal(t, e1.Name, received[0].Name)
+	assert.Equal(t, "alice", received[0].Username)
+	assert.Equal(t, e3.Name, received[1].Name)
+	assert.Equal(t, "invalid", received[1].Reason)
+	var as []int
+	for _, a := range attempts {
+		as = append(as, a)
+	}
+	sort.Ints(as)
+	assert.Equal(t, []int{1, 2, 2}, as)
+
+	// Signature
+	assert.True(t, astichat.VerifyWebhook("secret", []byte("body"), astichat.SignWebhook("secret", []byte("body"))))
+	assert.False(t, astichat.VerifyWebhook("other", []byte("body"), astichat.SignWebhook("secret", []byte("body"))))
+}
+
+func TestWebhookClose(t *testing.T) {
+	// Init receiver
+	// Requests hang until the end of the test
+	var m = &sync.Mutex{}
+	var requests int
+	var release = make(chan bool)
+	var s = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		requests++
+		m.Unlock()
+		<-release
+	}))
+	defer s.Close()
+	defer close(release)
+
+	// Init webhook
+	var w = astichat.NewWebhook(astichat.WebhookConfiguration{
+		Backoff:     time.Second,
+		MaxAttempts: 3,
+		QueueSize:   10,
+		Timeout:     time.Minute,
+		URL:         s.URL,
+	})
+	w.Start()
+
+	// Handle events
+	for i := 0; i < 3; i++ {
+		w.HandleEvent(astichat.NewHookEvent(astichat.HookEventNamePeerJoined))
+	}
+
+	// Close doesn't wait for the remaining events once its context is done
+	var ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var start = time.Now()
+	w.Close(ctx)
+	assert.True(t, time.Since(start) < time.Second)
+	m.Lock()
+	assert.Equal(t, 1, requests)
+	m.Unlock()
+}
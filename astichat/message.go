@@ -0,0 +1,29 @@
+package astichat
+
+import "time"
+
+// Message represents an end-to-end encrypted message queued for an offline chatterer
+type Message struct {
+	CreatedAt time.Time        `json:"created_at"`
+	Device    string           `json:"device"`
+	ExpiresAt time.Time        `json:"-"`
+	ID        string           `json:"id"`
+	Message   EncryptedMessage `json:"message"`
+	Notify    bool             `json:"-"`
+	Recipient string           `json:"recipient"`
+	Sender    string           `json:"sender"`
+}
+
+// MessageRequest represents a request to queue a message for an offline chatterer
+// The message is encrypted for each of the recipient's devices
+type MessageRequest struct {
+	Messages  map[string]EncryptedMessage `json:"messages"` // Indexed by device ID
+	Notify    bool                        `json:"notify,omitempty"`
+	Recipient string                      `json:"recipient"`
+}
+
+// MessageDelivery represents the notification sent to the sender once a queued message has been delivered
+type MessageDelivery struct {
+	ID        string `json:"id"`
+	Recipient string `json:"recipient"`
+}
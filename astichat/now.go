@@ -32,6 +32,13 @@ func (n *Now) update() {
 	}
 }
 
+// Set sets the time
+func (n *Now) Set(t time.Time) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.time = t
+}
+
 // Time returns the time
 func (n *Now) Time() time.Time {
 	n.mutex.Lock()
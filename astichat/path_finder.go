@@ -0,0 +1,202 @@
+package astichat
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Vars
+var (
+	ErrNoPath = errors.New("no working path")
+)
+
+// Consts
+const (
+	maxCandidateAddrs = 8
+)
+
+// Probe represents a path probe
+type Probe struct {
+	ID string `json:"id"`
+}
+
+// ProbeFunc writes a probe to a candidate addr
+type ProbeFunc func(pr Probe, addr *net.UDPAddr) error
+
+// PathFunc is executed once a working path has been found or once all attempts have failed
+type PathFunc func(addr *net.UDPAddr, err error)
+
+// PathFinderConfiguration represents a path finder configuration
+type PathFinderConfiguration struct {
+	Interval    time.Duration `toml:"interval"`
+	MaxAttempts int           `toml:"max_attempts"`
+}
+
+// PathFinder chooses a working path among candidate addrs by probing all of them and keeping the first one that
+// answers
+type PathFinder struct {
+	interval    time.Duration
+	maxAttempts int
+	mutex       *sync.Mutex
+	pending     map[string]*path // Indexed by probe ID
+}
+
+// path represents a path being probed
+type path struct {
+	addr *net.UDPAddr
+	ch   chan *net.UDPAddr
+	ids  []string
+}
+
+// NewPathFinder creates a new path finder
+func NewPathFinder(c PathFinderConfiguration) *PathFinder {
+	var f = &PathFinder{
+		interval:    c.Interval,
+		maxAttempts: c.MaxAttempts,
+		mutex:       &sync.Mutex{},
+		pending:     make(map[string]*path),
+	}
+	if f.interval <= 0 {
+		f.interval = 500 * time.Millisecond
+	}
+	if f.maxAttempts <= 0 {
+		f.maxAttempts = 3
+	}
+	return f
+}
+
+// Find probes all candidate addrs and executes the path func with the first one that answers
+func (f *PathFinder) Find(addrs []*net.UDPAddr, probe ProbeFunc, fn PathFunc) {
+	// Register probes
+	var ch = make(chan *net.UDPAddr, 1)
+	var ps []*path
+	var ids []string
+	f.mutex.Lock()
+	for _, addr := range addrs {
+		var p = &path{addr: addr, ch: ch}
+		var id = GeneratePacketID()
+		f.pending[id] = p
+		ids = append(ids, id)
+		ps = append(ps, p)
+	}
+	for _, p := range ps {
+		p.ids = ids
+	}
+	f.mutex.Unlock()
+
+	// Probe
+	go func() {
+		for attempt := 0; attempt < f.maxAttempts; attempt++ {
+			// Loop through paths
+			// Errors are ignored since some paths are expected not to work (e.g. IPv6 on an IPv4 only host)
+			for i, p := range ps {
+				probe(Probe{ID: ids[i]}, p.addr)
+			}
+
+			// Wait
+			select {
+			case addr := <-ch:
+				if fn != nil {
+					fn(addr, nil)
+				}
+				return
+			case <-time.After(f.interval * time.Duration(1<<uint(attempt))):
+			}
+		}
+
+		// No path answered
+		f.mutex.Lock()
+		for _, id := range ids {
+			delete(f.pending, id)
+		}
+		f.mutex.Unlock()
+		if fn != nil {
+			fn(nil, ErrNoPath)
+		}
+	}()
+}
+
+// Resolve marks the path of a probe as working
+// It should only be called once the probe's answer has been authenticated
+func (f *PathFinder) Resolve(id string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// Get path
+	var p, ok = f.pending[id]
+	if !ok {
+		return false
+	}
+
+	// Other paths are not needed anymore
+	for _, id := range p.ids {
+		delete(f.pending, id)
+	}
+	p.ch <- p.addr
+	return true
+}
+
+// InterfaceAddrs allows testing functions using it
+var InterfaceAddrs = func() ([]net.Addr, error) {
+	return net.InterfaceAddrs()
+}
+
+// CandidateAddrs returns the addrs a socket bound to the local addr can be reached at
+// If the local addr is unspecified, all interface addrs of the matching IP families are returned
+func CandidateAddrs(local *net.UDPAddr) (o []*net.UDPAddr, err error) {
+	// Local addr is specified
+	if local.IP != nil && !local.IP.IsUnspecified() {
+		o = append(o, local)
+		return
+	}
+
+	// Get interface addrs
+	var as []net.Addr
+	if as, err = InterfaceAddrs(); err != nil {
+		return
+	}
+
+	// Loop through interface addrs
+	var v4Only = local.IP != nil && local.IP.To4() != nil
+	for _, a := range as {
+		// Get IP
+		var ip net.IP
+		switch v := a.(type) {
+		case *net.IPNet:
+			ip = v.IP
+		case *net.IPAddr:
+			ip = v.IP
+		default:
+			continue
+		}
+
+		// Link local addrs need a zone and multicast addrs are irrelevant
+		if ip.IsLinkLocalUnicast() || ip.IsMulticast() || ip.IsUnspecified() || (v4Only && ip.To4() == nil) {
+			continue
+		}
+		o = AppendAddr(o, &net.UDPAddr{IP: ip, Port: local.Port})
+	}
+	return
+}
+
+// AppendAddr appends an addr if it's valid, not already present and the max number of candidate addrs has not
+// been reached
+// Limiting candidate addrs prevents peers from using others as a probe amplifier
+func AppendAddr(addrs []*net.UDPAddr, addr *net.UDPAddr) []*net.UDPAddr {
+	if addr == nil || addr.IP == nil || addr.Port == 0 || addr.IP.IsUnspecified() || addr.IP.IsMulticast() || len(addrs) >= maxCandidateAddrs {
+		return addrs
+	}
+	for _, a := range addrs {
+		if equalAddr(a, addr) {
+			return addrs
+		}
+	}
+	return append(addrs, addr)
+}
+
+// equalAddr checks whether two addrs are the same
+func equalAddr(a, b *net.UDPAddr) bool {
+	return a != nil && b != nil && a.IP.Equal(b.IP) && a.Port == b.Port && a.Zone == b.Zone
+}
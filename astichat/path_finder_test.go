@@ -0,0 +1,108 @@
+package astichat_test
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/asticode/go-astiudp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPathFinder(t *testing.T) {
+	// Init peer listening on IPv6 loopback only
+	var p = astiudp.NewServer()
+	var err = p.Init("[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback is not available: %s", err)
+	}
+	defer p.Close()
+	p.SetListener(astichat.EventNamePeerProbe, func(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) error {
+		return s.Write(astichat.EventNamePeerProbed, payload, addr)
+	})
+	go p.ListenAndRead()
+
+	// Init dual-stack client
+	var c = astiudp.NewServer()
+	err = c.Init("[::]:0")
+	assert.NoError(t, err)
+	defer c.Close()
+	var f = astichat.NewPathFinder(astichat.PathFinderConfiguration{Interval: 50 * time.Millisecond, MaxAttempts: 3})
+	c.SetListener(astichat.EventNamePeerProbed, func(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) error {
+		var pr astichat.Probe
+		json.Unmarshal(payload, &pr)
+		f.Resolve(pr.ID)
+		return nil
+	})
+	go c.ListenAndRead()
+
+	// IPv4 candidate doesn't answer since the peer only listens on IPv6
+	var port = p.Conn.LocalAddr().(*net.UDPAddr).Port
+	var v4 = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	var v6 = &net.UDPAddr{IP: net.IPv6loopback, Port: port}
+	var probe = func(pr astichat.Probe, addr *net.UDPAddr) error {
+		return c.Write(astichat.EventNamePeerProbe, pr, addr)
+	}
+	var ch = make(chan *net.UDPAddr, 1)
+	f.Find([]*net.UDPAddr{v4, v6}, probe, func(addr *net.UDPAddr, err error) {
+		assert.NoError(t, err)
+		ch <- addr
+	})
+	select {
+	case addr := <-ch:
+		assert.Equal(t, v6, addr)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no path found")
+	}
+
+	// No candidate answers
+	var chErr = make(chan error, 1)
+	f.Find([]*net.UDPAddr{v4}, probe, func(addr *net.UDPAddr, err error) {
+		chErr <- err
+	})
+	select {
+	case err = <-chErr:
+		assert.Equal(t, astichat.ErrNoPath, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("path finder didn't give up")
+	}
+	assert.False(t, f.Resolve("invalid"))
+}
+
+func TestCandidateAddrs(t *testing.T) {
+	// Init
+	astichat.InterfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.IPv4(127, 0, 0, 1)},
+			&net.IPNet{IP: net.IPv6loopback},
+			&net.IPNet{IP: net.ParseIP("fe80::1")},
+			&net.IPNet{IP: net.ParseIP("2001:db8::1")},
+		}, nil
+	}
+	defer func() {
+		astichat.InterfaceAddrs = net.InterfaceAddrs
+	}()
+
+	// Specified addr
+	var as, err = astichat.CandidateAddrs(&net.UDPAddr{IP: net.IPv6loopback, Port: 1234})
+	assert.NoError(t, err)
+	assert.Equal(t, []*net.UDPAddr{{IP: net.IPv6loopback, Port: 1234}}, as)
+
+	// Dual-stack
+	as, err = astichat.CandidateAddrs(&net.UDPAddr{IP: net.IPv6unspecified, Port: 1234})
+	assert.NoError(t, err)
+	assert.Equal(t, []*net.UDPAddr{{IP: net.IPv4(127, 0, 0, 1), Port: 1234}, {IP: net.IPv6loopback, Port: 1234}, {IP: net.ParseIP("2001:db8::1"), Port: 1234}}, as)
+
+	// IPv4 only
+	as, err = astichat.CandidateAddrs(&net.UDPAddr{IP: net.IPv4zero, Port: 1234})
+	assert.NoError(t, err)
+	assert.Equal(t, []*net.UDPAddr{{IP: net.IPv4(127, 0, 0, 1), Port: 1234}}, as)
+}
+
+func TestPeerSetCandidates(t *testing.T) {
+	var p = astichat.NewPeer(&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1}, "bob", astichat.Device{})
+	p.SetCandidates([]*net.UDPAddr{{IP: net.IPv6loopback, Port: 2}, {IP: net.IPv4(1, 2, 3, 4), Port: 1}, {IP: net.IPv6unspecified, Port: 3}, {IP: net.IPv6loopback}})
+	assert.Equal(t, []*net.UDPAddr{{IP: net.IPv4(1, 2, 3, 4), Port: 1}, {IP: net.IPv6loopback, Port: 2}}, p.Addrs)
+}
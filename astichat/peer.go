@@ -7,19 +7,65 @@ import (
 
 // Peer represents a peer
 type Peer struct {
-	Addr *net.UDPAddr `json:"addr"`
-	Chatterer
+	Addr  *net.UDPAddr   `json:"addr"`
+	Addrs []*net.UDPAddr `json:"addrs,omitempty"` // Candidate addrs the peer can be reached at
+	Device
+	Relayed  bool   `json:"relayed,omitempty"` // The peer can only be reached through the server
+	Username string `json:"username"`
 }
 
 // NewPeer creates a new peer
-func NewPeer(addr *net.UDPAddr, c Chatterer) *Peer {
+func NewPeer(addr *net.UDPAddr, username string, d Device) *Peer {
 	return &Peer{
-		Addr:      addr,
-		Chatterer: c,
+		Addr:     addr,
+		Device:   d,
+		Username: username,
 	}
 }
 
+// SetCandidates sets the candidate addrs of the peer
+// The addr the peer has been seen from always comes first
+func (p *Peer) SetCandidates(addrs []*net.UDPAddr) {
+	p.Addrs = AppendAddr([]*net.UDPAddr{}, p.Addr)
+	for _, a := range addrs {
+		p.Addrs = AppendAddr(p.Addrs, a)
+	}
+}
+
+// HasAddr checks whether the addr is the one the peer is reached at or one of its candidate addrs
+func (p Peer) HasAddr(addr *net.UDPAddr) bool {
+	if equalAddr(p.Addr, addr) {
+		return true
+	}
+	for _, a := range p.Addrs {
+		if equalAddr(a, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Key returns the key identifying the peer among all the devices of all the chatterers
+func (p Peer) Key() string {
+	return peerKey(p.Username, p.Device.ID)
+}
+
+// peerKey returns the key identifying a chatterer's device
+func peerKey(username, device string) string {
+	return username + "/" + device
+}
+
+// Federated checks whether the peer is connected to another server
+// Federated peers can only be reached through the servers
+func (p Peer) Federated() bool {
+	_, server := SplitAddress(p.Username)
+	return server != ""
+}
+
 // String allows Peer to implement the Stringer interface
 func (p Peer) String() string {
+	if p.Addr == nil {
+		return p.Username
+	}
 	return fmt.Sprintf("%s@%s", p.Username, p.Addr)
 }
@@ -1,11 +1,14 @@
 package astichat
 
-import "sync"
+import (
+	"net"
+	"sync"
+)
 
 // PeerPool represents a pool of peers
 type PeerPool struct {
 	mutex *sync.Mutex
-	pool  map[string]*Peer // The pool is indexed by username
+	pool  map[string]*Peer // The pool is indexed by username and device ID
 }
 
 // NewPeerPool creates a new peer pool
@@ -17,17 +20,29 @@ func NewPeerPool() *PeerPool {
 }
 
 // Del deletes a peer from the pool
-func (pp *PeerPool) Del(username string) {
+func (pp *PeerPool) Del(username, device string) {
 	pp.mutex.Lock()
 	defer pp.mutex.Unlock()
-	delete(pp.pool, username)
+	delete(pp.pool, peerKey(username, device))
 }
 
 // Get gets a peer from the pool
-func (pp *PeerPool) Get(username string) (p *Peer, ok bool) {
+func (pp *PeerPool) Get(username, device string) (p *Peer, ok bool) {
 	pp.mutex.Lock()
 	defer pp.mutex.Unlock()
-	p, ok = pp.pool[username]
+	p, ok = pp.pool[peerKey(username, device)]
+	return
+}
+
+// GetByAddr gets a peer from the pool based on its addr
+func (pp *PeerPool) GetByAddr(addr *net.UDPAddr) (p *Peer, ok bool) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	for _, v := range pp.pool {
+		if v.Addr.String() == addr.String() {
+			return v, true
+		}
+	}
 	return
 }
 
@@ -48,9 +63,36 @@ func (pp *PeerPool) Peers() (o []*Peer) {
 	return
 }
 
+// PeersByUsername returns the peers in the pool matching all the devices of a username
+func (pp *PeerPool) PeersByUsername(username string) (o []*Peer) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	for _, p := range pp.pool {
+		if p.Username == username {
+			o = append(o, p)
+		}
+	}
+	return
+}
+
+// SetAddr sets the addr of a peer in the pool
+// The peer is copied so that the addr is not updated under the feet of those already using it
+func (pp *PeerPool) SetAddr(username, device string, addr *net.UDPAddr) (ok bool) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	var p *Peer
+	if p, ok = pp.pool[peerKey(username, device)]; !ok {
+		return
+	}
+	var c = *p
+	c.Addr = addr
+	pp.pool[c.Key()] = &c
+	return
+}
+
 // Set sets a peer in the pool
 func (pp *PeerPool) Set(p *Peer) {
 	pp.mutex.Lock()
 	defer pp.mutex.Unlock()
-	pp.pool[p.Username] = p
+	pp.pool[p.Key()] = p
 }
@@ -10,15 +10,26 @@ import (
 
 func TestPeerPool(t *testing.T) {
 	var pp = astichat.NewPeerPool()
-	var p1 = astichat.NewPeer(&net.UDPAddr{}, astichat.Chatterer{Username: "bob"})
+	var p1 = astichat.NewPeer(&net.UDPAddr{}, "bob", astichat.Device{ID: "laptop"})
 	assert.Equal(t, 0, pp.Len())
 	pp.Set(p1)
 	assert.Equal(t, 1, pp.Len())
-	var p2, ok = pp.Get("invalid")
+	var p2, ok = pp.Get("invalid", "laptop")
 	assert.False(t, ok)
-	p2, ok = pp.Get("bob")
+	p2, ok = pp.Get("bob", "laptop")
 	assert.True(t, ok)
 	assert.Equal(t, p2, p1)
-	pp.Del("bob")
-	assert.Equal(t, 0, pp.Len())
+	var p3 = astichat.NewPeer(&net.UDPAddr{}, "bob", astichat.Device{ID: "desktop"})
+	pp.Set(p3)
+	assert.Equal(t, 2, pp.Len())
+	assert.Len(t, pp.PeersByUsername("bob"), 2)
+	pp.Del("bob", "laptop")
+	assert.Equal(t, 1, pp.Len())
+	assert.Equal(t, []*astichat.Peer{p3}, pp.PeersByUsername("bob"))
+	var addr = &net.UDPAddr{IP: net.IPv6loopback, Port: 1234}
+	assert.False(t, pp.SetAddr("bob", "laptop", addr))
+	assert.True(t, pp.SetAddr("bob", "desktop", addr))
+	p2, _ = pp.Get("bob", "desktop")
+	assert.Equal(t, addr, p2.Addr)
+	assert.Equal(t, &net.UDPAddr{}, p3.Addr)
 }
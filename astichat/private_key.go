@@ -1,8 +1,10 @@
 package astichat
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
@@ -137,3 +139,9 @@ func (p PrivateKey) PublicKey() (o *PublicKey, err error) {
 	o = NewPublicKey(pub)
 	return
 }
+
+// Sign signs a message
+func (p PrivateKey) Sign(msg []byte) ([]byte, error) {
+	var h = sha256.Sum256(msg)
+	return rsa.SignPSS(rand.Reader, p.key, crypto.SHA256, h[:], nil)
+}
@@ -1,7 +1,9 @@
 package astichat
 
 import (
+	"crypto"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"fmt"
 
@@ -87,3 +89,9 @@ func (p *PublicKey) SetBSON(raw bson.Raw) (err error) {
 	}
 	return p.UnmarshalText(b)
 }
+
+// Verify verifies the signature of a message
+func (p PublicKey) Verify(msg, sig []byte) error {
+	var h = sha256.Sum256(msg)
+	return rsa.VerifyPSS(p.key, crypto.SHA256, h[:], sig, nil)
+}
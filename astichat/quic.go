@@ -0,0 +1,278 @@
+package astichat
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/asticode/go-astilog"
+	"github.com/quic-go/quic-go"
+)
+
+// Consts
+const (
+	// Transfers are read in memory so their number is limited
+	maxQUICTransfers = 4
+	quicProtocol     = "astichat"
+)
+
+// QUICConfiguration represents a QUIC configuration
+// Servers use the cert and key files or generate a self-signed certificate if none is provided.
+// Clients verify the certificate of the server against the system roots or the CA file, unless its SHA-256
+// fingerprint is pinned, which is the only way to reach a server using a self-signed certificate since bodies are
+// end-to-end encrypted but event names and usernames are not
+type QUICConfiguration struct {
+	Addr            string        `toml:"addr"`
+	CAFile          string        `toml:"ca_file"`
+	CertFile        string        `toml:"cert_file"`
+	CertFingerprint string        `toml:"cert_fingerprint"` // Hex encoded SHA-256 of the server's certificate
+	KeepAlivePeriod time.Duration `toml:"keep_alive_period"`
+	KeyFile         string        `toml:"key_file"`
+}
+
+// quicConfig returns the QUIC config
+func (c QUICConfiguration) quicConfig() *quic.Config {
+	return &quic.Config{
+		KeepAlivePeriod:       c.KeepAlivePeriod,
+		MaxIncomingUniStreams: maxQUICTransfers,
+	}
+}
+
+// tlsConfig returns the TLS config used by clients to verify the server
+func (c QUICConfiguration) tlsConfig(addr string) (t *tls.Config, err error) {
+	t = &tls.Config{NextProtos: []string{quicProtocol}}
+
+	// Pin certificate
+	// The chain is not verified since the certificate may be self-signed
+	if c.CertFingerprint != "" {
+		t.InsecureSkipVerify = true
+		t.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || CertificateFingerprint(rawCerts[0]) != strings.ToLower(c.CertFingerprint) {
+				return errors.New("QUIC certificate doesn't match the pinned fingerprint")
+			}
+			return nil
+		}
+		return
+	}
+
+	// Server name
+	if t.ServerName, _, err = net.SplitHostPort(addr); err != nil {
+		return
+	}
+
+	// Add CA
+	if c.CAFile != "" {
+		var b []byte
+		if b, err = ioutil.ReadFile(c.CAFile); err != nil {
+			return
+		}
+		t.RootCAs = x509.NewCertPool()
+		if !t.RootCAs.AppendCertsFromPEM(b) {
+			err = fmt.Errorf("No certificate found in CA file %s", c.CAFile)
+			return
+		}
+	}
+	return
+}
+
+// CertificateFingerprint returns the hex encoded SHA-256 of a DER encoded certificate
+func CertificateFingerprint(der []byte) string {
+	var h = sha256.Sum256(der)
+	return hex.EncodeToString(h[:])
+}
+
+// quicStream represents the control stream of a QUIC connection that closes its connection when it's closed
+// Transfers are written on unidirectional streams of the same connection
+type quicStream struct {
+	quic.Stream
+	conn quic.Connection
+}
+
+// newQUICStreamConn creates a stream conn on top of the control stream of a QUIC connection
+func newQUICStreamConn(st quic.Stream, conn quic.Connection) *StreamConn {
+	var s = quicStream{Stream: st, conn: conn}
+	var c = newStreamConn(s, conn.RemoteAddr(), nil)
+	c.mux = s
+	return c
+}
+
+// Close implements the io.Closer interface
+func (s quicStream) Close() error {
+	s.Stream.Close()
+	return s.conn.CloseWithError(0, "")
+}
+
+// acceptTransfer implements the streamMultiplexer interface
+func (s quicStream) acceptTransfer() (r io.ReadCloser, err error) {
+	var st quic.ReceiveStream
+	if st, err = s.conn.AcceptUniStream(context.Background()); err != nil {
+		return
+	}
+	r = quicReceiveStream{ReceiveStream: st}
+	return
+}
+
+// openTransfer implements the streamMultiplexer interface
+func (s quicStream) openTransfer() (io.WriteCloser, error) {
+	return s.conn.OpenUniStreamSync(context.Background())
+}
+
+// quicReceiveStream represents a QUIC receive stream that stops reading when it's closed
+type quicReceiveStream struct {
+	quic.ReceiveStream
+}
+
+// Close implements the io.Closer interface
+func (s quicReceiveStream) Close() error {
+	s.CancelRead(0)
+	return nil
+}
+
+// QUICServer accepts QUIC connections and serves them with the stream server
+// Events go through the control stream opened by the client, except transfers which get their own unidirectional
+// stream. Peers are identified by the addr their connection was accepted from, which doesn't change while the
+// connection lives: a client that roams to another network and loses its connection dials a new one and connects
+// again, which moves its peer to the new addr
+type QUICServer struct {
+	fingerprint string
+	listener    *quic.Listener
+	Logger      astilog.Logger
+	stream      *StreamServer
+}
+
+// NewQUICServer creates a new QUIC server
+func NewQUICServer(s *StreamServer) *QUICServer {
+	return &QUICServer{
+		Logger: astilog.NopLogger(),
+		stream: s,
+	}
+}
+
+// Init initializes the QUIC server
+func (s *QUICServer) Init(c QUICConfiguration) (err error) {
+	// Load certificate
+	var cert tls.Certificate
+	if c.CertFile != "" {
+		if cert, err = tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+			return
+		}
+	} else if cert, err = selfSignedCertificate(); err != nil {
+		return
+	}
+	s.fingerprint = CertificateFingerprint(cert.Certificate[0])
+
+	// Listen
+	if s.listener, err = quic.ListenAddr(c.Addr, &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{quicProtocol}}, c.quicConfig()); err != nil {
+		return
+	}
+	return
+}
+
+// Addr returns the addr the QUIC server is listening on
+func (s *QUICServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Fingerprint returns the fingerprint of the certificate of the QUIC server that clients can pin
+func (s *QUICServer) Fingerprint() string {
+	return s.fingerprint
+}
+
+// Close closes the QUIC server
+func (s *QUICServer) Close() error {
+	return s.listener.Close()
+}
+
+// Serve accepts QUIC connections until the QUIC server is closed
+func (s *QUICServer) Serve() {
+	for {
+		// Accept connection
+		var conn quic.Connection
+		var err error
+		if conn, err = s.listener.Accept(context.Background()); err != nil {
+			s.Logger.Debugf("%s while accepting QUIC connection", err)
+			return
+		}
+
+		// Serve connection
+		go s.serve(conn)
+	}
+}
+
+// serve serves the control stream of a QUIC connection and its transfers
+func (s *QUICServer) serve(conn quic.Connection) {
+	// Accept control stream
+	var st quic.Stream
+	var err error
+	if st, err = conn.AcceptStream(context.Background()); err != nil {
+		s.Logger.Debugf("%s while accepting control stream of %s", err, conn.RemoteAddr())
+		conn.CloseWithError(0, "")
+		return
+	}
+
+	// Serve
+	s.stream.Serve(newQUICStreamConn(st, conn))
+}
+
+// DialQUIC opens a QUIC connection to the server and returns its control stream
+func DialQUIC(addr string, c QUICConfiguration, timeout time.Duration) (sc *StreamConn, err error) {
+	// Get TLS config
+	var t *tls.Config
+	if t, err = c.tlsConfig(addr); err != nil {
+		return
+	}
+
+	// Dial
+	var ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var conn quic.Connection
+	if conn, err = quic.DialAddr(ctx, addr, t, c.quicConfig()); err != nil {
+		return
+	}
+
+	// Open control stream
+	var st quic.Stream
+	if st, err = conn.OpenStreamSync(ctx); err != nil {
+		conn.CloseWithError(0, "")
+		return
+	}
+	sc = newQUICStreamConn(st, conn)
+	return
+}
+
+// selfSignedCertificate generates a self-signed certificate
+func selfSignedCertificate() (c tls.Certificate, err error) {
+	// Generate key
+	var k *ecdsa.PrivateKey
+	if k, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return
+	}
+
+	// Create certificate
+	var t = &x509.Certificate{
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		NotBefore:    time.Now().Add(-time.Hour),
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: quicProtocol},
+	}
+	var b []byte
+	if b, err = x509.CreateCertificate(rand.Reader, t, t, &k.PublicKey, k); err != nil {
+		return
+	}
+	c = tls.Certificate{Certificate: [][]byte{b}, PrivateKey: k}
+	return
+}
@@ -0,0 +1,147 @@
+package astichat_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQUIC(t *testing.T) {
+	// Init server
+	var s = astichat.NewStreamServer(newMockedTransport())
+	defer s.Close()
+	var chServer = make(chan event, 10)
+	s.SetListener("event", listen(chServer))
+	var q = astichat.NewQUICServer(s)
+	var err = q.Init(astichat.QUICConfiguration{Addr: "127.0.0.1:0"})
+	assert.NoError(t, err)
+	defer q.Close()
+	go q.Serve()
+
+	// Self-signed certificate is refused unless its fingerprint is pinned
+	_, err = astichat.DialQUIC(q.Addr().String(), astichat.QUICConfiguration{}, time.Second)
+	assert.Error(t, err)
+	_, err = astichat.DialQUIC(q.Addr().String(), astichat.QUICConfiguration{CertFingerprint: astichat.CertificateFingerprint([]byte("invalid"))}, time.Second)
+	assert.Error(t, err)
+
+	// Dial
+	var c *astichat.StreamConn
+	c, err = astichat.DialQUIC(q.Addr().String(), astichat.QUICConfiguration{CertFingerprint: q.Fingerprint()}, time.Second)
+	assert.NoError(t, err)
+	var serverAddr = &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+	var r = astichat.NewRelayTransport(newMockedTransport(), serverAddr)
+	var chClient = make(chan event, 10)
+	r.SetListener("event", listen(chClient))
+	r.SetStream(c)
+
+	// Client to server
+	err = r.Write("event", "hello", serverAddr)
+	assert.NoError(t, err)
+	var e = wait(t, chServer)
+	assert.Equal(t, `"hello"`, e.payload)
+	addr, _ := net.ResolveUDPAddr("udp", e.addr)
+	assert.True(t, s.Has(addr))
+
+	// Server to client
+	err = s.Write("event", "world", addr)
+	assert.NoError(t, err)
+	assert.Equal(t, event{addr: serverAddr.String(), eventName: "event", payload: `"world"`}, wait(t, chClient))
+}
+
+// dialQUIC dials the QUIC server and sends an event so that the server knows the addr of the conn
+func dialQUIC(t *testing.T, q *astichat.QUICServer, chServer, chClient chan event) (c *astichat.StreamConn, r *astichat.RelayTransport, addr *net.UDPAddr) {
+	var err error
+	c, err = astichat.DialQUIC(q.Addr().String(), astichat.QUICConfiguration{CertFingerprint: q.Fingerprint()}, time.Second)
+	assert.NoError(t, err)
+	r = astichat.NewRelayTransport(newMockedTransport(), &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234})
+	r.SetListener("event", listen(chClient))
+	r.SetStream(c)
+	err = r.Write("event", "hello", &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234})
+	assert.NoError(t, err)
+	addr, _ = net.ResolveUDPAddr("udp", wait(t, chServer).addr)
+	return
+}
+
+func TestQUICTransfers(t *testing.T) {
+	// Init server
+	var s = astichat.NewStreamServer(newMockedTransport())
+	defer s.Close()
+	var chServer = make(chan event, 10)
+	s.SetListener("event", listen(chServer))
+	var q = astichat.NewQUICServer(s)
+	var err = q.Init(astichat.QUICConfiguration{Addr: "127.0.0.1:0"})
+	assert.NoError(t, err)
+	defer q.Close()
+	go q.Serve()
+	var serverAddr = &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+	var big = strings.Repeat("a", 4<<20) // Too big for the control stream
+
+	// Unauthenticated conns can't send transfers
+	var chClient = make(chan event, 10)
+	c, r, addr := dialQUIC(t, q, chServer, chClient)
+	defer c.Close()
+	err = r.Write("event", big, serverAddr)
+	assert.NoError(t, err)
+	for i := 0; i < 100 && s.Has(addr); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(t, s.Has(addr))
+	assert.Len(t, chServer, 0)
+
+	// Transfers go through their own stream and don't hold the control stream
+	c, r, addr = dialQUIC(t, q, chServer, chClient)
+	defer c.Close()
+	s.Authenticate(addr)
+	err = r.Write("event", big, serverAddr)
+	assert.NoError(t, err)
+	err = r.Write("event", "world", serverAddr)
+	assert.NoError(t, err)
+	var payloads = []string{wait(t, chServer).payload, wait(t, chServer).payload}
+	if payloads[0] != `"world"` {
+		payloads[0], payloads[1] = payloads[1], payloads[0]
+	}
+	assert.Equal(t, []string{`"world"`, `"` + big + `"`}, payloads)
+	assert.True(t, s.Has(addr))
+
+	// Server to client
+	err = s.Write("event", big, addr)
+	assert.NoError(t, err)
+	assert.Equal(t, event{addr: serverAddr.String(), eventName: "event", payload: `"` + big + `"`}, wait(t, chClient))
+}
+
+func TestQUICRoaming(t *testing.T) {
+	// Init server
+	var s = astichat.NewStreamServer(newMockedTransport())
+	defer s.Close()
+	var chServer = make(chan event, 10)
+	s.SetListener("event", listen(chServer))
+	var q = astichat.NewQUICServer(s)
+	var err = q.Init(astichat.QUICConfiguration{Addr: "127.0.0.1:0"})
+	assert.NoError(t, err)
+	defer q.Close()
+	go q.Serve()
+
+	// Client loses its connection when it roams to another network
+	var chClient1 = make(chan event, 10)
+	c1, _, addr1 := dialQUIC(t, q, chServer, chClient1)
+	c1.Close()
+	for i := 0; i < 100 && s.Has(addr1); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(t, s.Has(addr1))
+
+	// Client is reached through its new connection
+	var chClient2 = make(chan event, 10)
+	c2, _, addr2 := dialQUIC(t, q, chServer, chClient2)
+	defer c2.Close()
+	assert.NotEqual(t, addr1.String(), addr2.String())
+	assert.True(t, s.Has(addr2))
+	err = s.Write("event", "world", addr2)
+	assert.NoError(t, err)
+	assert.Equal(t, `"world"`, wait(t, chClient2).payload)
+	assert.Len(t, chClient1, 0)
+}
@@ -0,0 +1,186 @@
+package astichat
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiterConfiguration represents a rate limiter configuration
+type RateLimiterConfiguration struct {
+	BanDuration  time.Duration `toml:"ban_duration"`
+	BanThreshold int           `toml:"ban_threshold"`
+	Burst        int           `toml:"burst"`
+	Rate         float64       `toml:"rate"`
+}
+
+// RateLimiterCounters represents rate limiter counters
+type RateLimiterCounters struct {
+	Allowed  int64 `json:"allowed"`
+	Banned   int   `json:"banned"`
+	Bans     int64 `json:"bans"`
+	Offenses int64 `json:"offenses"`
+	Rejected int64 `json:"rejected"`
+	Tracked  int   `json:"tracked"`
+}
+
+// RateLimiter limits the rate at which keys are allowed using token buckets and temporarily bans keys that offend
+// too often
+type RateLimiter struct {
+	banDuration  time.Duration
+	banThreshold int
+	bans         map[string]time.Time
+	buckets      map[string]*bucket
+	burst        float64
+	counters     RateLimiterCounters
+	mutex        *sync.Mutex
+	purgedAt     time.Time
+	rate         float64
+}
+
+// bucket represents a token bucket
+type bucket struct {
+	offenses   int
+	offensesAt time.Time
+	tokens     float64
+	updatedAt  time.Time
+}
+
+// NewRateLimiter creates a new rate limiter
+func NewRateLimiter(c RateLimiterConfiguration) *RateLimiter {
+	var r = &RateLimiter{
+		banDuration:  c.BanDuration,
+		banThreshold: c.BanThreshold,
+		bans:         make(map[string]time.Time),
+		buckets:      make(map[string]*bucket),
+		burst:        float64(c.Burst),
+		mutex:        &sync.Mutex{},
+		rate:         c.Rate,
+	}
+	if r.banDuration <= 0 {
+		r.banDuration = 10 * time.Minute
+	}
+	if r.banThreshold <= 0 {
+		r.banThreshold = 10
+	}
+	if r.burst <= 0 {
+		r.burst = 5
+	}
+	if r.rate <= 0 {
+		r.rate = 1
+	}
+	return r
+}
+
+// Allow checks whether the key is allowed and consumes a token
+func (r *RateLimiter) Allow(key string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Purge
+	var now = TimeNow()
+	r.purge(now)
+
+	// Key is banned
+	if t, ok := r.bans[key]; ok {
+		if now.Before(t) {
+			r.counters.Rejected++
+			return false
+		}
+		delete(r.bans, key)
+	}
+
+	// Get bucket
+	var b, ok = r.buckets[key]
+	if !ok {
+		b = &bucket{tokens: r.burst, updatedAt: now}
+		r.buckets[key] = b
+	}
+
+	// Refill
+	b.tokens += now.Sub(b.updatedAt).Seconds() * r.rate
+	if b.tokens > r.burst {
+		b.tokens = r.burst
+	}
+	b.updatedAt = now
+
+	// No token left
+	if b.tokens < 1 {
+		r.counters.Rejected++
+		r.offend(key, b, now)
+		return false
+	}
+
+	// Consume token
+	b.tokens--
+	r.counters.Allowed++
+	return true
+}
+
+// Penalize records an offense such as an authentication failure for the key
+func (r *RateLimiter) Penalize(key string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var now = TimeNow()
+	var b, ok = r.buckets[key]
+	if !ok {
+		b = &bucket{tokens: r.burst, updatedAt: now}
+		r.buckets[key] = b
+	}
+	r.offend(key, b, now)
+}
+
+// offend records an offense and bans the key if it has offended too often
+// Mutex must be locked
+func (r *RateLimiter) offend(key string, b *bucket, now time.Time) {
+	// Reset offenses that are too old
+	if now.Sub(b.offensesAt) > r.banDuration {
+		b.offenses = 0
+		b.offensesAt = now
+	}
+
+	// Offend
+	b.offenses++
+	r.counters.Offenses++
+
+	// Ban
+	if b.offenses >= r.banThreshold {
+		b.offenses = 0
+		r.bans[key] = now.Add(r.banDuration)
+		r.counters.Bans++
+	}
+}
+
+// purge purges expired bans and idle buckets every minute
+// Mutex must be locked
+func (r *RateLimiter) purge(now time.Time) {
+	// Only purge every minute
+	if now.Sub(r.purgedAt) < time.Minute {
+		return
+	}
+	r.purgedAt = now
+
+	// Purge bans
+	for k, t := range r.bans {
+		if now.After(t) {
+			delete(r.bans, k)
+		}
+	}
+
+	// Purge buckets that are full again and whose offenses are too old
+	var idle = time.Duration(r.burst/r.rate*float64(time.Second)) + r.banDuration
+	for k, b := range r.buckets {
+		if now.Sub(b.updatedAt) > idle && now.Sub(b.offensesAt) > r.banDuration {
+			delete(r.buckets, k)
+		}
+	}
+}
+
+// Counters returns the rate limiter counters
+func (r *RateLimiter) Counters() (c RateLimiterCounters) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	c = r.counters
+	c.Banned = len(r.bans)
+	c.Tracked = len(r.buckets)
+	return
+}
@@ -0,0 +1,46 @@
+package astichat_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	// Init
+	var now = time.Unix(100, 0)
+	astichat.TimeNow = func() time.Time {
+		return now
+	}
+	defer func() {
+		astichat.TimeNow = time.Now
+	}()
+	var r = astichat.NewRateLimiter(astichat.RateLimiterConfiguration{BanDuration: time.Minute, BanThreshold: 3, Burst: 2, Rate: 1})
+
+	// Burst
+	assert.True(t, r.Allow("a"))
+	assert.True(t, r.Allow("a"))
+	assert.False(t, r.Allow("a"))
+	assert.True(t, r.Allow("b"))
+
+	// Refill
+	now = now.Add(time.Second)
+	assert.True(t, r.Allow("a"))
+	assert.False(t, r.Allow("a"))
+
+	// Ban
+	r.Penalize("a")
+	now = now.Add(10 * time.Second)
+	assert.False(t, r.Allow("a"))
+	now = now.Add(time.Minute)
+	assert.True(t, r.Allow("a"))
+
+	// Counters
+	var c = r.Counters()
+	assert.Equal(t, int64(5), c.Allowed)
+	assert.Equal(t, int64(1), c.Bans)
+	assert.Equal(t, int64(3), c.Offenses)
+	assert.Equal(t, int64(3), c.Rejected)
+}
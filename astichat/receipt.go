@@ -0,0 +1,40 @@
+package astichat
+
+import (
+	"encoding/json"
+
+	"github.com/rs/xid"
+)
+
+// Typed represents a message typed by a peer
+type Typed struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+// GenerateTypedID allows testing functions using it
+var GenerateTypedID = func() string {
+	return xid.New().String()
+}
+
+// NewTyped creates a new typed message
+func NewTyped(text string) Typed {
+	return Typed{
+		ID:   GenerateTypedID(),
+		Text: text,
+	}
+}
+
+// ParseTyped parses a typed message
+// Older clients send the raw text without any ID
+func ParseTyped(msg []byte) (t Typed) {
+	if err := json.Unmarshal(msg, &t); err != nil || t.ID == "" {
+		t = Typed{Text: string(msg)}
+	}
+	return
+}
+
+// Receipt represents a read receipt acknowledging that all messages up to the message ID have been read
+type Receipt struct {
+	ID string `json:"id"`
+}
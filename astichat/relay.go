@@ -0,0 +1,188 @@
+package astichat
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/asticode/go-astilog"
+	"github.com/asticode/go-astiudp"
+)
+
+// Relay represents an event relayed by the server between a peer that can't use UDP and the others
+// When sent to the server, the addr is the recipient's. When sent by the server, the addr is the sender's.
+type Relay struct {
+	Addr      *net.UDPAddr    `json:"addr"`
+	EventName string          `json:"event_name"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// RelayTransport is a transport that writes events directly over UDP when possible and relays them through the
+// server otherwise
+// Once a stream conn has been set, all events go through it
+type RelayTransport struct {
+	listeners map[string]astiudp.ListenerFunc
+	Logger    astilog.Logger
+	mutex     *sync.Mutex
+	relayed   map[string]bool // Indexed by addr
+	server    *net.UDPAddr
+	stream    *StreamConn
+	udp       Transport
+}
+
+// NewRelayTransport creates a new relay transport
+func NewRelayTransport(udp Transport, server *net.UDPAddr) (t *RelayTransport) {
+	t = &RelayTransport{
+		listeners: make(map[string]astiudp.ListenerFunc),
+		Logger:    astilog.NopLogger(),
+		mutex:     &sync.Mutex{},
+		relayed:   make(map[string]bool),
+		server:    server,
+		udp:       udp,
+	}
+	udp.SetListener(EventNamePeerRelayed, t.handleRelayed)
+	return
+}
+
+// SetListener implements the Transport interface
+func (t *RelayTransport) SetListener(eventName string, l astiudp.ListenerFunc) {
+	t.udp.SetListener(eventName, l)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.listeners[eventName] = l
+}
+
+// SetRelayed marks the addr as only reachable through the server
+func (t *RelayTransport) SetRelayed(addr *net.UDPAddr) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.relayed[addr.String()] = true
+}
+
+// Streaming checks whether events go through a stream conn
+func (t *RelayTransport) Streaming() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.stream != nil
+}
+
+// SetStream makes all events go through the stream conn and starts reading it
+func (t *RelayTransport) SetStream(c *StreamConn) {
+	t.mutex.Lock()
+	t.stream = c
+	t.mutex.Unlock()
+	go t.read(c)
+}
+
+// Write implements the Transport interface
+func (t *RelayTransport) Write(eventName string, payload interface{}, addr *net.UDPAddr) (err error) {
+	// Get stream
+	t.mutex.Lock()
+	var s = t.stream
+	var relayed = t.relayed[addr.String()]
+	t.mutex.Unlock()
+
+	// Event needs to be relayed by the server
+	if addr.String() != t.server.String() && (s != nil || relayed) {
+		var r = Relay{Addr: addr, EventName: eventName}
+		if r.Payload, err = json.Marshal(payload); err != nil {
+			return
+		}
+		eventName = EventNamePeerRelay
+		payload = r
+		addr = t.server
+	}
+
+	// Write
+	if s != nil {
+		return s.WriteEvent(eventName, payload)
+	}
+	return t.udp.Write(eventName, payload, addr)
+}
+
+// read reads events from the stream conn until it's closed
+func (t *RelayTransport) read(c *StreamConn) {
+	// Read transfers
+	if c.mux != nil {
+		go c.readTransfers(func() time.Time { return time.Time{} }, func() uint32 { return maxStreamTransferSize }, func(eventName string, payload json.RawMessage, err error) {
+			if err != nil {
+				t.Logger.Errorf("%s while reading transfer of stream conn", err)
+				return
+			}
+			t.handle(eventName, payload)
+		})
+	}
+
+	// Read
+	for {
+		// Read event
+		var eventName string
+		var payload json.RawMessage
+		var err error
+		if eventName, payload, err = c.ReadEvent(); err != nil {
+			if err != io.EOF {
+				t.Logger.Errorf("%s while reading stream conn", err)
+			}
+			t.mutex.Lock()
+			if t.stream == c {
+				t.stream = nil
+			}
+			t.mutex.Unlock()
+			return
+		}
+
+		// Handle event
+		t.handle(eventName, payload)
+	}
+}
+
+// handle handles an event read from the stream conn
+func (t *RelayTransport) handle(eventName string, payload json.RawMessage) {
+	// Relayed event
+	var err error
+	if eventName == EventNamePeerRelayed {
+		err = t.handleRelayed(nil, eventName, payload, t.server)
+	} else {
+		err = t.dispatch(eventName, payload, t.server)
+	}
+	if err != nil {
+		t.Logger.Errorf("%s while executing listener %s", err, eventName)
+	}
+}
+
+// dispatch executes the listener of an event
+func (t *RelayTransport) dispatch(eventName string, payload json.RawMessage, addr *net.UDPAddr) error {
+	t.mutex.Lock()
+	var l, ok = t.listeners[eventName]
+	t.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	return l(nil, eventName, payload, addr)
+}
+
+// handleRelayed handles events relayed by the server
+func (t *RelayTransport) handleRelayed(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) (err error) {
+	// Only the server can relay events
+	if addr.String() != t.server.String() {
+		return fmt.Errorf("Relayed event received from %s which is not the server", addr)
+	}
+
+	// Unmarshal
+	var r Relay
+	if err = json.Unmarshal(payload, &r); err != nil {
+		return
+	}
+	if r.Addr == nil || r.EventName == EventNamePeerRelayed {
+		return fmt.Errorf("Invalid relayed event %s", r.EventName)
+	}
+
+	// Answers to the sender need to be relayed as well
+	t.SetRelayed(r.Addr)
+
+	// Dispatch
+	return t.dispatch(r.EventName, r.Payload, r.Addr)
+}
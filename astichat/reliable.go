@@ -0,0 +1,218 @@
+package astichat
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/asticode/go-astiudp"
+	"github.com/rs/xid"
+)
+
+// Vars
+var (
+	ErrNotDelivered = errors.New("not delivered")
+)
+
+// Writer represents an entity capable of writing events to an addr
+type Writer interface {
+	Write(eventName string, payload interface{}, addr *net.UDPAddr) error
+}
+
+// DeliveryFunc is executed once a packet has been acknowledged or once all attempts have failed
+type DeliveryFunc func(err error)
+
+// Packet represents a packet that needs to be acknowledged
+type Packet struct {
+	ID      string          `json:"id"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Ack represents an acknowledgement
+type Ack struct {
+	ID string `json:"id"`
+}
+
+// ReliableConfiguration represents a reliable configuration
+type ReliableConfiguration struct {
+	Backoff     time.Duration `toml:"backoff"`
+	MaxAttempts int           `toml:"max_attempts"`
+}
+
+// Reliable adds acknowledgements, retransmission and duplicate suppression on top of UDP
+type Reliable struct {
+	backoff     time.Duration
+	maxAttempts int
+	mutex       *sync.Mutex
+	pending     map[string]pendingPacket // Indexed by packet ID
+	received    map[string]time.Time     // Indexed by addr + packet ID
+	w           Writer
+}
+
+// pendingPacket represents a packet waiting for its ack
+// Only the addr the packet has been written to can acknowledge it
+type pendingPacket struct {
+	addr *net.UDPAddr
+	ch   chan bool
+}
+
+// NewReliable creates a new reliable
+func NewReliable(w Writer, c ReliableConfiguration) *Reliable {
+	var r = &Reliable{
+		backoff:     c.Backoff,
+		maxAttempts: c.MaxAttempts,
+		mutex:       &sync.Mutex{},
+		pending:     make(map[string]pendingPacket),
+		received:    make(map[string]time.Time),
+		w:           w,
+	}
+	if r.backoff <= 0 {
+		r.backoff = 500 * time.Millisecond
+	}
+	if r.maxAttempts <= 0 {
+		r.maxAttempts = 4
+	}
+	return r
+}
+
+// GeneratePacketID allows testing functions using it
+var GeneratePacketID = func() string {
+	return xid.New().String()
+}
+
+// Write writes a payload and retransmits it with an exponential backoff until it is acknowledged or the max number
+// of attempts is reached. fn can be nil.
+func (r *Reliable) Write(eventName string, payload interface{}, addr *net.UDPAddr, fn DeliveryFunc) (err error) {
+	// Create packet
+	var p = Packet{ID: GeneratePacketID()}
+	if p.Payload, err = json.Marshal(payload); err != nil {
+		return
+	}
+
+	// Add to pending packets
+	var ch = make(chan bool, 1)
+	r.mutex.Lock()
+	r.pending[p.ID] = pendingPacket{addr: addr, ch: ch}
+	r.mutex.Unlock()
+
+	// Write
+	if err = r.w.Write(eventName, p, addr); err != nil {
+		r.delPending(p.ID)
+		return
+	}
+
+	// Retransmit
+	go r.retransmit(eventName, p, addr, ch, fn)
+	return
+}
+
+// retransmit retransmits a packet until it is acknowledged or the max number of attempts is reached
+func (r *Reliable) retransmit(eventName string, p Packet, addr *net.UDPAddr, ch chan bool, fn DeliveryFunc) {
+	var err = r.wait(eventName, p, addr, ch)
+	if fn != nil {
+		fn(err)
+	}
+}
+
+// wait waits for the ack and retransmits the packet each time the delay expires
+func (r *Reliable) wait(eventName string, p Packet, addr *net.UDPAddr, ch chan bool) (err error) {
+	defer r.delPending(p.ID)
+	var delay = r.backoff
+	for attempt := 1; attempt < r.maxAttempts; attempt++ {
+		// Wait
+		select {
+		case <-ch:
+			return
+		case <-time.After(delay):
+		}
+
+		// Write
+		if err = r.w.Write(eventName, p, addr); err != nil {
+			return
+		}
+		delay *= 2
+	}
+
+	// Wait for the last attempt
+	select {
+	case <-ch:
+	case <-time.After(delay):
+		err = ErrNotDelivered
+	}
+	return
+}
+
+// delPending deletes a pending packet
+func (r *Reliable) delPending(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.pending, id)
+}
+
+// HandleAck handles the ack event
+func (r *Reliable) HandleAck() astiudp.ListenerFunc {
+	return func(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) (err error) {
+		// Unmarshal
+		var a Ack
+		if err = json.Unmarshal(payload, &a); err != nil {
+			return
+		}
+
+		// Notify pending packet
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if p, ok := r.pending[a.ID]; ok && equalAddr(p.addr, addr) {
+			p.ch <- true
+			delete(r.pending, a.ID)
+		}
+		return
+	}
+}
+
+// Listen wraps a listener so that packets are acknowledged and duplicates are dropped
+func (r *Reliable) Listen(l astiudp.ListenerFunc) astiudp.ListenerFunc {
+	return func(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) (err error) {
+		// Unmarshal
+		var p Packet
+		if err = json.Unmarshal(payload, &p); err != nil {
+			return
+		}
+
+		// Acknowledge
+		// Duplicates are acknowledged as well since the previous ack may have been lost
+		if err = r.w.Write(EventNameAck, Ack{ID: p.ID}, addr); err != nil {
+			return
+		}
+
+		// Duplicate
+		if r.isDuplicate(p.ID, addr) {
+			return
+		}
+		return l(s, eventName, p.Payload, addr)
+	}
+}
+
+// isDuplicate checks whether a packet has already been received and purges old entries
+func (r *Reliable) isDuplicate(id string, addr *net.UDPAddr) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Purge entries that can't be retransmitted anymore
+	var now = time.Now()
+	var ttl = r.backoff * time.Duration(1<<uint(r.maxAttempts))
+	for k, t := range r.received {
+		if now.Sub(t) > ttl {
+			delete(r.received, k)
+		}
+	}
+
+	// Check
+	var k = addr.String() + "/" + id
+	if _, ok := r.received[k]; ok {
+		return true
+	}
+	r.received[k] = now
+	return false
+}
@@ -0,0 +1,94 @@
+package astichat_test
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/asticode/go-astiudp"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockedWriter represents a mocked writer
+type mockedWriter struct {
+	mutex  *sync.Mutex
+	events []string
+	acks   []string
+}
+
+func newMockedWriter() *mockedWriter {
+	return &mockedWriter{mutex: &sync.Mutex{}}
+}
+
+func (w *mockedWriter) Write(eventName string, payload interface{}, addr *net.UDPAddr) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if a, ok := payload.(astichat.Ack); ok {
+		w.acks = append(w.acks, a.ID)
+	} else {
+		w.events = append(w.events, eventName)
+	}
+	return nil
+}
+
+func (w *mockedWriter) count() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(w.events)
+}
+
+func TestReliable(t *testing.T) {
+	// Init
+	var w = newMockedWriter()
+	var r = astichat.NewReliable(w, astichat.ReliableConfiguration{Backoff: 10 * time.Millisecond, MaxAttempts: 3})
+	var addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	var generatePacketID = astichat.GeneratePacketID
+	astichat.GeneratePacketID = func() string {
+		return "id"
+	}
+	defer func() {
+		astichat.GeneratePacketID = generatePacketID
+	}()
+
+	// Not acknowledged
+	var ch = make(chan error, 1)
+	var err = r.Write("event", "payload", addr, func(err error) { ch <- err })
+	assert.NoError(t, err)
+	assert.Equal(t, astichat.ErrNotDelivered, <-ch)
+	assert.Equal(t, 3, w.count())
+
+	// Acknowledged
+	w = newMockedWriter()
+	r = astichat.NewReliable(w, astichat.ReliableConfiguration{Backoff: time.Second, MaxAttempts: 3})
+	err = r.Write("event", "payload", addr, func(err error) { ch <- err })
+	assert.NoError(t, err)
+	err = r.HandleAck()(nil, astichat.EventNameAck, json.RawMessage(`{"id":"id"}`), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1235})
+	assert.NoError(t, err)
+	select {
+	case <-ch:
+		t.Fatal("packet has been acknowledged by another addr")
+	default:
+	}
+	err = r.HandleAck()(nil, astichat.EventNameAck, json.RawMessage(`{"id":"id"}`), addr)
+	assert.NoError(t, err)
+	assert.NoError(t, <-ch)
+	assert.Equal(t, 1, w.count())
+
+	// Duplicates
+	var received []string
+	var l = r.Listen(func(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) error {
+		received = append(received, string(payload))
+		return nil
+	})
+	err = l(nil, "event", json.RawMessage(`{"id":"1","payload":"a"}`), addr)
+	assert.NoError(t, err)
+	err = l(nil, "event", json.RawMessage(`{"id":"1","payload":"a"}`), addr)
+	assert.NoError(t, err)
+	err = l(nil, "event", json.RawMessage(`{"id":"2","payload":"b"}`), addr)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`"a"`, `"b"`}, received)
+	assert.Equal(t, []string{"1", "1", "2"}, w.acks)
+}
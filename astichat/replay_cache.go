@@ -0,0 +1,44 @@
+package astichat
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// ReplayCache remembers the bodies that have been processed until they're not valid anymore so that they can't be
+// replayed
+// Bodies are identified by their encrypted key, which is random for each body
+type ReplayCache struct {
+	mutex *sync.Mutex
+	seen  map[[sha256.Size]byte]time.Time // Indexed by digest of the encrypted key, values are creation dates
+}
+
+// NewReplayCache creates a new replay cache
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{
+		mutex: &sync.Mutex{},
+		seen:  make(map[[sha256.Size]byte]time.Time),
+	}
+}
+
+// Seen checks whether a valid body has already been seen and remembers it otherwise
+func (c *ReplayCache) Seen(b Body, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Purge bodies that don't pass validation anymore
+	for k, t := range c.seen {
+		if t.Before(now.Add(-bodyValidity)) {
+			delete(c.seen, k)
+		}
+	}
+
+	// Check
+	var k = sha256.Sum256(b.Request.Message.Key)
+	if _, ok := c.seen[k]; ok {
+		return true
+	}
+	c.seen[k] = b.Request.CreatedAt
+	return false
+}
@@ -0,0 +1,27 @@
+package astichat_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayCache(t *testing.T) {
+	// Init
+	var c = astichat.NewReplayCache()
+	var now = time.Now()
+	var b = func(key string, createdAt time.Time) astichat.Body {
+		return astichat.Body{Request: &astichat.BodyRequest{CreatedAt: createdAt, Message: astichat.EncryptedMessage{Key: []byte(key)}}}
+	}
+
+	// Bodies are only seen once
+	assert.False(t, c.Seen(b("1", now), now))
+	assert.True(t, c.Seen(b("1", now), now))
+	assert.False(t, c.Seen(b("2", now), now))
+
+	// Bodies are forgotten once they're not valid anymore
+	assert.True(t, c.Seen(b("1", now), now.Add(5*time.Second)))
+	assert.False(t, c.Seen(b("1", now), now.Add(6*time.Second)))
+}
@@ -0,0 +1,54 @@
+package astichat
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+)
+
+// Errors
+var (
+	ErrInvalidSignature = errors.New("Invalid signature")
+)
+
+// SignatureExtension is the extension of detached signature files
+const SignatureExtension = ".sig"
+
+// SignFile returns the base64 encoded detached signature of a file
+func SignFile(path string, k *PrivateKey) (o string, err error) {
+	// Read file
+	var b []byte
+	if b, err = ioutil.ReadFile(path); err != nil {
+		return
+	}
+
+	// Sign
+	var sig []byte
+	if sig, err = k.Sign(b); err != nil {
+		return
+	}
+	o = b64.EncodeToString(sig)
+	return
+}
+
+// VerifyFile verifies the base64 encoded detached signature of a file
+// Surrounding whitespaces of the signature are ignored so that it can be read from a signature file as is
+func VerifyFile(path string, sig []byte, k *PublicKey) (err error) {
+	// Decode signature
+	var s []byte
+	if s, err = b64.DecodeString(string(bytes.TrimSpace(sig))); err != nil {
+		return ErrInvalidSignature
+	}
+
+	// Read file
+	var b []byte
+	if b, err = ioutil.ReadFile(path); err != nil {
+		return
+	}
+
+	// Verify
+	if err = k.Verify(b, s); err != nil {
+		return ErrInvalidSignature
+	}
+	return
+}
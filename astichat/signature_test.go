@@ -0,0 +1,38 @@
+package astichat_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignFile(t *testing.T) {
+	// Init
+	var f, err = ioutil.TempFile("", "astichat")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.Write([]byte("binary"))
+	f.Close()
+	var prv = astichat.PrivateKey{}
+	err = prv.UnmarshalText([]byte(prv2String))
+	assert.NoError(t, err)
+	var pub *astichat.PublicKey
+	pub, err = prv.PublicKey()
+	assert.NoError(t, err)
+
+	// Sign
+	var sig string
+	sig, err = astichat.SignFile(f.Name(), &prv)
+	assert.NoError(t, err)
+
+	// Verify
+	assert.NoError(t, astichat.VerifyFile(f.Name(), []byte(sig+"\n"), pub))
+	assert.Equal(t, astichat.ErrInvalidSignature, astichat.VerifyFile(f.Name(), []byte("invalid"), pub))
+
+	// Tampered
+	ioutil.WriteFile(f.Name(), []byte("tampered"), 0600)
+	assert.Equal(t, astichat.ErrInvalidSignature, astichat.VerifyFile(f.Name(), []byte(sig), pub))
+}
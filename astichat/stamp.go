@@ -0,0 +1,137 @@
+package astichat
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Stamp consts
+const (
+	StampMagic        = "ASTICHAT-STAMP:"
+	stampChecksumSize = 2 * sha256.Size
+	stampPaddingChar  = " "
+)
+
+// Template binaries reserve a fixed-size region filled with the placeholder which is overwritten by the stamp of each
+// user. The placeholder is built at compile time so that it's stored as is in the binary.
+const (
+	stampPlaceholder16    = "################"
+	stampPlaceholder256   = stampPlaceholder16 + stampPlaceholder16 + stampPlaceholder16 + stampPlaceholder16 + stampPlaceholder16 + stampPlaceholder16 + stampPlaceholder16 + stampPlaceholder16 + stampPlaceholder16 + stampPlaceholder16 + stampPlaceholder16 + stampPlaceholder16 + stampPlaceholder16 + stampPlaceholder16 + stampPlaceholder16 + stampPlaceholder16
+	stampPlaceholder4096  = stampPlaceholder256 + stampPlaceholder256 + stampPlaceholder256 + stampPlaceholder256 + stampPlaceholder256 + stampPlaceholder256 + stampPlaceholder256 + stampPlaceholder256 + stampPlaceholder256 + stampPlaceholder256 + stampPlaceholder256 + stampPlaceholder256 + stampPlaceholder256 + stampPlaceholder256 + stampPlaceholder256 + stampPlaceholder256
+	stampPlaceholder16384 = stampPlaceholder4096 + stampPlaceholder4096 + stampPlaceholder4096 + stampPlaceholder4096
+	StampPlaceholder      = StampMagic + stampPlaceholder16384
+	StampSize             = len(StampPlaceholder)
+)
+
+// Errors
+var (
+	ErrStampMissing = errors.New("binary has not been stamped")
+	ErrStampInvalid = errors.New("stamp integrity check failed")
+)
+
+// Stamp represents the user specific values written in a template binary
+type Stamp struct {
+	Build            BuildInfo `json:"build"`
+	ClientPrivateKey string    `json:"client_private_key"`
+	DeviceID         string    `json:"device_id"`
+	ServerHTTPAddr   string    `json:"server_http_addr"`
+	ServerPublicKey  string    `json:"server_public_key"`
+	ServerQUICAddr   string    `json:"server_quic_addr"`
+	ServerUDPAddr    string    `json:"server_udp_addr"`
+	Username         string    `json:"username"`
+}
+
+// Region returns the region of the stamp which is made of the magic, the checksum of the payload and the payload padded
+// to the stamp size
+// The checksum is an unkeyed SHA-256 which only detects accidental corruption: anyone tampering with the stamp can
+// recompute it. Only the signature of the binary proves it hasn't been tampered with.
+func (s Stamp) Region() (o []byte, err error) {
+	// Marshal
+	var b []byte
+	if b, err = json.Marshal(s); err != nil {
+		return
+	}
+
+	// Check size
+	if len(StampMagic)+stampChecksumSize+len(b) > StampSize {
+		err = fmt.Errorf("Stamp of %d bytes exceeds the stamp size", len(b))
+		return
+	}
+
+	// Build region
+	var h = sha256.Sum256(b)
+	o = make([]byte, 0, StampSize)
+	o = append(o, StampMagic...)
+	o = append(o, hex.EncodeToString(h[:])...)
+	o = append(o, b...)
+	o = append(o, strings.Repeat(stampPaddingChar, StampSize-len(o))...)
+	return
+}
+
+// ParseStamp parses and checks the integrity of the region of a stamped binary
+// The integrity check doesn't authenticate the stamp, see Region
+// The region is not compared to the placeholder since the comparison could point to the same stamped data
+func ParseStamp(region string) (s Stamp, err error) {
+	// Check size
+	if len(region) != StampSize || !strings.HasPrefix(region, StampMagic) {
+		err = ErrStampInvalid
+		return
+	}
+	region = region[len(StampMagic):]
+
+	// Decode checksum
+	var h []byte
+	if h, err = hex.DecodeString(region[:stampChecksumSize]); err != nil {
+		err = ErrStampMissing
+		return
+	}
+
+	// Check payload
+	var b = []byte(strings.TrimRight(region[stampChecksumSize:], stampPaddingChar))
+	if c := sha256.Sum256(b); !bytes.Equal(h, c[:]) {
+		err = ErrStampInvalid
+		return
+	}
+
+	// Unmarshal
+	if err = json.Unmarshal(b, &s); err != nil {
+		err = ErrStampInvalid
+		return
+	}
+	return
+}
+
+// StampBinary writes the stamp in the reserved regions of a template binary
+// Mach-O binaries are ad-hoc signed again since their signature covers the regions
+func StampBinary(b []byte, s Stamp) (err error) {
+	// Get region
+	var r []byte
+	if r, err = s.Region(); err != nil {
+		return
+	}
+
+	// Loop through placeholders
+	var p, n = []byte(StampPlaceholder), 0
+	for i := bytes.Index(b, p); i >= 0; i = bytes.Index(b, p) {
+		copy(b[i:], r)
+		n++
+	}
+
+	// No placeholder
+	if n == 0 {
+		err = errors.New("No stamp placeholder found in binary")
+		return
+	}
+
+	// Sign
+	if err = adHocSign(b); err != nil {
+		err = fmt.Errorf("%s while ad-hoc signing binary", err)
+		return
+	}
+	return
+}
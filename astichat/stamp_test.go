@@ -0,0 +1,135 @@
+package astichat_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"debug/macho"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStamp(t *testing.T) {
+	// Unstamped
+	var _, err = astichat.ParseStamp(astichat.StampPlaceholder)
+	assert.Equal(t, astichat.ErrStampMissing, err)
+
+	// Stamp binary
+	var b = []byte("header" + astichat.StampPlaceholder + "footer")
+	var s = astichat.Stamp{
+		ClientPrivateKey: "client_private_key",
+		DeviceID:         "device",
+		ServerHTTPAddr:   "server_http_addr",
+		ServerPublicKey:  "server_public_key",
+		ServerQUICAddr:   "server_quic_addr",
+		ServerUDPAddr:    "server_udp_addr",
+		Username:         "bob",
+	}
+	err = astichat.StampBinary(b, s)
+	assert.NoError(t, err)
+	assert.Len(t, b, len("header")+astichat.StampSize+len("footer"))
+	assert.True(t, bytes.HasPrefix(b, []byte("header")))
+	assert.True(t, bytes.HasSuffix(b, []byte("footer")))
+
+	// Parse stamp
+	var region = string(b[len("header") : len("header")+astichat.StampSize])
+	var p astichat.Stamp
+	p, err = astichat.ParseStamp(region)
+	assert.NoError(t, err)
+	assert.Equal(t, s, p)
+
+	// Tampered
+	_, err = astichat.ParseStamp(strings.Replace(region, "bob", "eve", 1))
+	assert.Equal(t, astichat.ErrStampInvalid, err)
+
+	// Binary already stamped
+	err = astichat.StampBinary(b, s)
+	assert.Error(t, err)
+
+	// Stamp too large
+	s.Username = strings.Repeat("a", astichat.StampSize)
+	err = astichat.StampBinary([]byte(astichat.StampPlaceholder), s)
+	assert.Error(t, err)
+}
+
+// validCodeDirectory checks that the pages of a Mach-O binary match the hashes of its code directory
+func validCodeDirectory(t *testing.T, b []byte) bool {
+	// Parse Mach-O
+	var f, err = macho.NewFile(bytes.NewReader(b))
+	assert.NoError(t, err)
+
+	// Get code directory
+	var cd []byte
+	for _, l := range f.Loads {
+		if r := l.Raw(); f.ByteOrder.Uint32(r) == 0x1d {
+			var sig = b[f.ByteOrder.Uint32(r[8:]):]
+			for i := uint32(0); i < binary.BigEndian.Uint32(sig[8:]); i++ {
+				if binary.BigEndian.Uint32(sig[12+8*i:]) == 0 {
+					cd = sig[binary.BigEndian.Uint32(sig[16+8*i:]):]
+				}
+			}
+		}
+	}
+	if !assert.NotNil(t, cd) || !assert.Equal(t, uint8(sha256.Size), cd[36]) {
+		return false
+	}
+
+	// Loop through pages
+	var hashOffset, nCodeSlots, codeLimit = binary.BigEndian.Uint32(cd[16:]), binary.BigEndian.Uint32(cd[28:]), int(binary.BigEndian.Uint32(cd[32:]))
+	var pageSize = 1 << cd[39]
+	for i := 0; i < int(nCodeSlots); i++ {
+		var end = (i + 1) * pageSize
+		if end > codeLimit {
+			end = codeLimit
+		}
+		var h = sha256.Sum256(b[i*pageSize : end])
+		if !bytes.Equal(h[:], cd[int(hashOffset)+i*sha256.Size:int(hashOffset)+(i+1)*sha256.Size]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStampMachO(t *testing.T) {
+	// Go is needed to build a darwin/arm64 binary which the Go linker ad-hoc signs
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go is not installed")
+	}
+
+	// Build binary
+	var dir, err = ioutil.TempDir("", "astichat")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte("module stamp\n"), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n\nvar stamp = "+strconv.Quote(astichat.StampPlaceholder)+"\n\nfunc main() { println(stamp) }\n"), 0600))
+	var cmd = exec.Command("go", "build", "-o", "bin", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GOARCH=arm64", "GOFLAGS=", "GOOS=darwin")
+	var o []byte
+	o, err = cmd.CombinedOutput()
+	if !assert.NoError(t, err, string(o)) {
+		return
+	}
+	var b []byte
+	b, err = ioutil.ReadFile(filepath.Join(dir, "bin"))
+	assert.NoError(t, err)
+	assert.True(t, validCodeDirectory(t, b))
+
+	// Stamp binary
+	err = astichat.StampBinary(b, astichat.Stamp{Username: "bob"})
+	assert.NoError(t, err)
+	assert.True(t, validCodeDirectory(t, b))
+
+	// Pages that don't match their hash are detected
+	var i = bytes.Index(b, []byte(astichat.StampMagic))
+	b[i+len(astichat.StampMagic)] ^= 1
+	assert.False(t, validCodeDirectory(t, b))
+}
@@ -2,36 +2,67 @@ package astichat
 
 import (
 	"errors"
+	"sync"
 	"time"
 )
 
 // Vars
 var (
-	ErrNotFoundInStorage = errors.New("not found in storage")
+	ErrAlreadyExistsInStorage = errors.New("already exists in storage")
+	ErrNotFoundInStorage      = errors.New("not found in storage")
 )
 
 // Chatterer represents an entity willing to chat
 type Chatterer struct {
-	ClientPublicKey  *PublicKey  `json:"public_key"`
-	ID               string      `json:"-"`
-	ServerPrivateKey *PrivateKey `json:"-"`
-	Token            string      `json:"-"`
-	TokenAt          time.Time   `json:"-"`
-	Username         string      `json:"username"`
+	Devices  []Device  `json:"devices"`
+	ID       string    `json:"-"`
+	Token    string    `json:"-"`
+	TokenAt  time.Time `json:"-"`
+	Username string    `json:"username"`
+}
+
+// Device returns the chatterer's device with the specified id
+func (c Chatterer) Device(id string) (d Device, ok bool) {
+	for _, d = range c.Devices {
+		if d.ID == id {
+			ok = true
+			return
+		}
+	}
+	d = Device{}
+	return
 }
 
 // Storage represents a storage interface
+// ChattererCreate returns ErrAlreadyExistsInStorage if the username is already used. ChattererAddDevice adds a device
+// unless the chatterer already has the max number of devices, which it always has when the max is lower than 1,
+// ChattererConsumeToken clears a token unless it has already been consumed and ChattererRemoveDevice removes a device
+// unless it's the chatterer's last one, all atomically, and they return ErrNotFoundInStorage otherwise.
+// Chatterers are never written as a whole so that concurrent changes to their devices can't be overwritten.
 type Storage interface {
-	ChattererCreate(username string, pubClient *PublicKey, prvServer *PrivateKey) (Chatterer, error)
+	ChattererAddDevice(username string, d Device, max int) error
+	ChattererConsumeToken(username, token string) error
+	ChattererCreate(username string, d Device) (Chatterer, error)
 	ChattererDeleteByUsername(username string) error
 	ChattererFetchByUsername(username string) (Chatterer, error)
-	ChattererUpdate(i Chatterer) error
+	ChattererRemoveDevice(username, id string) error
+	ChattererSetToken(username, token string, at time.Time) error
+	Close() error
+	MessageCreate(m Message) (Message, error)
+	MessageDelete(id string) error
+	MessageFetchByRecipient(username, device string) ([]Message, error)
 }
 
 // NopStorage implements the Storage interface
 type NopStorage struct{}
 
-func (s NopStorage) ChattererCreate(username string, pubClient *PublicKey, prvServer *PrivateKey) (Chatterer, error) {
+func (s NopStorage) ChattererAddDevice(username string, d Device, max int) error {
+	return nil
+}
+func (s NopStorage) ChattererConsumeToken(username, token string) error {
+	return nil
+}
+func (s NopStorage) ChattererCreate(username string, d Device) (Chatterer, error) {
 	return Chatterer{}, nil
 }
 func (s NopStorage) ChattererDeleteByUsername(username string) error {
@@ -40,13 +71,32 @@ func (s NopStorage) ChattererDeleteByUsername(username string) error {
 func (s NopStorage) ChattererFetchByUsername(username string) (Chatterer, error) {
 	return Chatterer{}, nil
 }
-func (s NopStorage) ChattererUpdate(i Chatterer) error {
+func (s NopStorage) ChattererRemoveDevice(username, id string) error {
+	return nil
+}
+func (s NopStorage) ChattererSetToken(username, token string, at time.Time) error {
 	return nil
 }
+func (s NopStorage) Close() error {
+	return nil
+}
+func (s NopStorage) MessageCreate(m Message) (Message, error) {
+	return Message{}, nil
+}
+func (s NopStorage) MessageDelete(id string) error {
+	return nil
+}
+func (s NopStorage) MessageFetchByRecipient(username, device string) ([]Message, error) {
+	return []Message{}, nil
+}
 
 // MockedStorage represents a mocked storage
+// It's safe for concurrent use so that it can back servers in tests
 type MockedStorage struct {
 	Chatterers []Chatterer
+	Closed     bool
+	Messages   []Message
+	mutex      sync.Mutex
 }
 
 // NewMockedStorage creates a new mocked storage
@@ -54,12 +104,44 @@ func NewMockedStorage() *MockedStorage {
 	return &MockedStorage{}
 }
 
-func (s *MockedStorage) ChattererCreate(username string, pubClient *PublicKey, prvServer *PrivateKey) (c Chatterer, err error) {
-	c = Chatterer{ClientPublicKey: pubClient, ID: "1234", ServerPrivateKey: prvServer, Username: username}
+func (s *MockedStorage) ChattererAddDevice(username string, d Device, max int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for index, c := range s.Chatterers {
+		if c.Username == username && len(c.Devices) < max {
+			s.Chatterers[index].Devices = append(append([]Device{}, c.Devices...), d)
+			return nil
+		}
+	}
+	return ErrNotFoundInStorage
+}
+func (s *MockedStorage) ChattererConsumeToken(username, token string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for index, c := range s.Chatterers {
+		if c.Username == username && c.Token != "" && c.Token == token {
+			s.Chatterers[index].Token = ""
+			s.Chatterers[index].TokenAt = time.Time{}
+			return nil
+		}
+	}
+	return ErrNotFoundInStorage
+}
+func (s *MockedStorage) ChattererCreate(username string, d Device) (c Chatterer, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range s.Chatterers {
+		if c.Username == username {
+			return Chatterer{}, ErrAlreadyExistsInStorage
+		}
+	}
+	c = Chatterer{Devices: []Device{d}, ID: "1234", Username: username}
 	s.Chatterers = append(s.Chatterers, c)
 	return c, nil
 }
 func (s *MockedStorage) ChattererDeleteByUsername(username string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	for i, c := range s.Chatterers {
 		if username == c.Username {
 			s.Chatterers = append(s.Chatterers[:i], s.Chatterers[i+1:]...)
@@ -67,7 +149,9 @@ func (s *MockedStorage) ChattererDeleteByUsername(username string) error {
 	}
 	return nil
 }
-func (s MockedStorage) ChattererFetchByUsername(username string) (Chatterer, error) {
+func (s *MockedStorage) ChattererFetchByUsername(username string) (Chatterer, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	for _, c := range s.Chatterers {
 		if username == c.Username {
 			return c, nil
@@ -75,7 +159,37 @@ func (s MockedStorage) ChattererFetchByUsername(username string) (Chatterer, err
 	}
 	return Chatterer{}, ErrNotFoundInStorage
 }
+func (s *MockedStorage) ChattererRemoveDevice(username, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for index, c := range s.Chatterers {
+		if c.Username != username || len(c.Devices) <= 1 {
+			continue
+		}
+		for i, d := range c.Devices {
+			if d.ID == id {
+				s.Chatterers[index].Devices = append(append([]Device{}, c.Devices[:i]...), c.Devices[i+1:]...)
+				return nil
+			}
+		}
+	}
+	return ErrNotFoundInStorage
+}
+func (s *MockedStorage) ChattererSetToken(username, token string, at time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for index, c := range s.Chatterers {
+		if c.Username == username {
+			s.Chatterers[index].Token = token
+			s.Chatterers[index].TokenAt = at
+			return nil
+		}
+	}
+	return ErrNotFoundInStorage
+}
 func (s *MockedStorage) ChattererUpdate(i Chatterer) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	for index, c := range s.Chatterers {
 		if c.ID == i.ID {
 			s.Chatterers[index] = i
@@ -84,3 +198,38 @@ func (s *MockedStorage) ChattererUpdate(i Chatterer) error {
 	}
 	return ErrNotFoundInStorage
 }
+func (s *MockedStorage) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Closed = true
+	return nil
+}
+func (s *MockedStorage) MessageCreate(m Message) (Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m.ID = GenerateToken()
+	s.Messages = append(s.Messages, m)
+	return m, nil
+}
+func (s *MockedStorage) MessageDelete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for i, m := range s.Messages {
+		if id == m.ID {
+			s.Messages = append(s.Messages[:i], s.Messages[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFoundInStorage
+}
+func (s *MockedStorage) MessageFetchByRecipient(username, device string) (ms []Message, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var now = TimeNow()
+	for _, m := range s.Messages {
+		if username == m.Recipient && device == m.Device && m.ExpiresAt.After(now) {
+			ms = append(ms, m)
+		}
+	}
+	return
+}
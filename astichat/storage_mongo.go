@@ -1,6 +1,7 @@
 package astichat
 
 import (
+	"fmt"
 	"time"
 
 	"gopkg.in/mgo.v2"
@@ -10,14 +11,16 @@ import (
 // Constants
 const (
 	collectionNameChatterer = "chatterer"
+	collectionNameMessage   = "message"
 	databaseName            = "astichat"
 )
 
 // ChattererMgo represents a mongo chatterer
 type ChattererMgo struct {
-	ClientPublicKey  *PublicKey    `bson:"client_public_key"`
+	ClientPublicKey  *PublicKey    `bson:"client_public_key,omitempty"` // Deprecated: only set before devices existed
+	Devices          []Device      `bson:"devices"`
 	ID               bson.ObjectId `bson:"_id"`
-	ServerPrivateKey *PrivateKey   `bson:"server_private_key"`
+	ServerPrivateKey *PrivateKey   `bson:"server_private_key,omitempty"` // Deprecated: only set before devices existed
 	Token            string        `bson:"token"`
 	TokenAt          time.Time     `bson:"token_at"`
 	Username         string        `bson:"username"`
@@ -26,25 +29,30 @@ type ChattererMgo struct {
 // NewChattererMgoFromChatterer creates a mongo chatterer based on a chatterer
 func NewChattererMgoFromChatterer(c Chatterer) ChattererMgo {
 	return ChattererMgo{
-		ClientPublicKey:  c.ClientPublicKey,
-		ID:               bson.ObjectIdHex(c.ID),
-		ServerPrivateKey: c.ServerPrivateKey,
-		Token:            c.Token,
-		TokenAt:          c.TokenAt,
-		Username:         c.Username,
+		Devices:  c.Devices,
+		ID:       bson.ObjectIdHex(c.ID),
+		Token:    c.Token,
+		TokenAt:  c.TokenAt,
+		Username: c.Username,
 	}
 }
 
 // Chatterer creates a chatterer from the mongo chatterer
 func (c ChattererMgo) Chatterer() Chatterer {
-	return Chatterer{
-		ClientPublicKey:  c.ClientPublicKey,
-		ID:               c.ID.Hex(),
-		ServerPrivateKey: c.ServerPrivateKey,
-		Token:            c.Token,
-		TokenAt:          c.TokenAt,
-		Username:         c.Username,
+	var o = Chatterer{
+		Devices:  c.Devices,
+		ID:       c.ID.Hex(),
+		Token:    c.Token,
+		TokenAt:  c.TokenAt,
+		Username: c.Username,
 	}
+
+	// Chatterers created before devices existed own a single device with an empty id, which is what their binaries
+	// send
+	if c.ClientPublicKey != nil && c.ServerPrivateKey != nil {
+		o.Devices = append(o.Devices, Device{ClientPublicKey: c.ClientPublicKey, ServerPrivateKey: c.ServerPrivateKey})
+	}
+	return o
 }
 
 // StorageMongo represents a mongo storage
@@ -59,16 +67,80 @@ func NewStorageMongo(s *mgo.Session) *StorageMongo {
 	}
 }
 
-// ChattererCreate creates a chatterer based on a username and a public key
-func (s *StorageMongo) ChattererCreate(username string, pubClient *PublicKey, prvServer *PrivateKey) (c Chatterer, err error) {
+// Init creates the indexes of the mongo storage
+// Expired messages are removed by mongo thanks to a TTL index on their expiration date, with a delay of up to a minute
+// Usernames are unique so that concurrent signups can't create the same chatterer twice
+func (s *StorageMongo) Init() (err error) {
+	if err = s.mongo.DB(databaseName).C(collectionNameMessage).EnsureIndex(mgo.Index{
+		ExpireAfter: time.Second,
+		Key:         []string{"expires_at"},
+	}); err != nil {
+		return
+	}
+	if err = s.mongo.DB(databaseName).C(collectionNameChatterer).EnsureIndex(mgo.Index{
+		Key:    []string{"username"},
+		Unique: true,
+	}); err != nil {
+		return
+	}
+	return
+}
+
+// ChattererAddDevice pushes a device to a chatterer unless it already has the max number of devices
+// The device of chatterers created before devices existed counts as well
+func (s *StorageMongo) ChattererAddDevice(username string, d Device, max int) (err error) {
+	// No device can be added
+	if max < 1 {
+		return ErrNotFoundInStorage
+	}
+
+	// Build conditions
+	var cs = []bson.M{{
+		"client_public_key":              bson.M{"$exists": false},
+		fmt.Sprintf("devices.%d", max-1): bson.M{"$exists": false},
+	}}
+	if max > 1 {
+		cs = append(cs, bson.M{
+			"client_public_key":              bson.M{"$exists": true},
+			fmt.Sprintf("devices.%d", max-2): bson.M{"$exists": false},
+		})
+	}
+
+	// Update
+	if err = s.mongo.DB(databaseName).C(collectionNameChatterer).Update(bson.M{
+		"$or":      cs,
+		"username": username,
+	}, bson.M{"$push": bson.M{"devices": d}}); err == mgo.ErrNotFound {
+		err = ErrNotFoundInStorage
+	}
+	return
+}
+
+// ChattererConsumeToken clears the token of a chatterer unless it has already been consumed
+func (s *StorageMongo) ChattererConsumeToken(username, token string) (err error) {
+	if token == "" {
+		return ErrNotFoundInStorage
+	}
+	if err = s.mongo.DB(databaseName).C(collectionNameChatterer).Update(bson.M{
+		"token":    token,
+		"username": username,
+	}, bson.M{"$set": bson.M{"token": "", "token_at": time.Time{}}}); err == mgo.ErrNotFound {
+		err = ErrNotFoundInStorage
+	}
+	return
+}
+
+// ChattererCreate creates a chatterer based on a username and its first device
+func (s *StorageMongo) ChattererCreate(username string, d Device) (c Chatterer, err error) {
 	var mc = ChattererMgo{
-		ClientPublicKey:  pubClient,
-		ID:               bson.NewObjectId(),
-		ServerPrivateKey: prvServer,
-		Username:         username,
+		Devices:  []Device{d},
+		ID:       bson.NewObjectId(),
+		Username: username,
 	}
 	c = mc.Chatterer()
-	err = s.mongo.DB(databaseName).C(collectionNameChatterer).Insert(&mc)
+	if err = s.mongo.DB(databaseName).C(collectionNameChatterer).Insert(&mc); mgo.IsDup(err) {
+		err = ErrAlreadyExistsInStorage
+	}
 	return
 }
 
@@ -89,8 +161,127 @@ func (s *StorageMongo) ChattererFetchByUsername(username string) (c Chatterer, e
 	return
 }
 
-// ChattererUpdate updates a chatterer
+// ChattererRemoveDevice pulls a device from a chatterer unless it's the chatterer's last device
+// The device of chatterers created before devices existed has an empty id and is stored in the deprecated keys, which
+// are unset, unless the chatterer has been updated as a whole since
+func (s *StorageMongo) ChattererRemoveDevice(username, id string) (err error) {
+	var cl = s.mongo.DB(databaseName).C(collectionNameChatterer)
+	if id == "" {
+		if err = cl.Update(bson.M{
+			"client_public_key": bson.M{"$exists": true},
+			"devices.0":         bson.M{"$exists": true},
+			"username":          username,
+		}, bson.M{"$unset": bson.M{"client_public_key": "", "server_private_key": ""}}); err != mgo.ErrNotFound {
+			return
+		}
+	}
+	if err = cl.Update(bson.M{
+		"$or": []bson.M{
+			{"client_public_key": bson.M{"$exists": true}},
+			{"devices.1": bson.M{"$exists": true}},
+		},
+		"devices.id": id,
+		"username":   username,
+	}, bson.M{"$pull": bson.M{"devices": bson.M{"id": id}}}); err == mgo.ErrNotFound {
+		err = ErrNotFoundInStorage
+	}
+	return
+}
+
+// ChattererSetToken sets the token of a chatterer
+func (s *StorageMongo) ChattererSetToken(username, token string, at time.Time) (err error) {
+	if err = s.mongo.DB(databaseName).C(collectionNameChatterer).Update(bson.M{
+		"username": username,
+	}, bson.M{"$set": bson.M{"token": token, "token_at": at}}); err == mgo.ErrNotFound {
+		err = ErrNotFoundInStorage
+	}
+	return
+}
+
+// ChattererUpdate replaces a chatterer as a whole
+// It must not be used where devices may be added or removed concurrently since their changes would be overwritten
 func (s *StorageMongo) ChattererUpdate(c Chatterer) error {
+	if !bson.IsObjectIdHex(c.ID) {
+		return ErrNotFoundInStorage
+	}
 	var mc = NewChattererMgoFromChatterer(c)
 	return s.mongo.DB(databaseName).C(collectionNameChatterer).UpdateId(mc.ID, mc)
 }
+
+// Close closes the mongo session
+func (s *StorageMongo) Close() error {
+	s.mongo.Close()
+	return nil
+}
+
+// MessageMgo represents a mongo message
+type MessageMgo struct {
+	CreatedAt        time.Time        `bson:"created_at"`
+	Device           string           `bson:"device"`
+	EncryptedMessage EncryptedMessage `bson:"message"`
+	ExpiresAt        time.Time        `bson:"expires_at"`
+	ID               bson.ObjectId    `bson:"_id"`
+	Notify           bool             `bson:"notify"`
+	Recipient        string           `bson:"recipient"`
+	Sender           string           `bson:"sender"`
+}
+
+// Message creates a message from the mongo message
+func (m MessageMgo) Message() Message {
+	return Message{
+		CreatedAt: m.CreatedAt,
+		Device:    m.Device,
+		ExpiresAt: m.ExpiresAt,
+		ID:        m.ID.Hex(),
+		Message:   m.EncryptedMessage,
+		Notify:    m.Notify,
+		Recipient: m.Recipient,
+		Sender:    m.Sender,
+	}
+}
+
+// MessageCreate creates a message
+func (s *StorageMongo) MessageCreate(m Message) (o Message, err error) {
+	var mm = MessageMgo{
+		CreatedAt:        m.CreatedAt,
+		Device:           m.Device,
+		EncryptedMessage: m.Message,
+		ExpiresAt:        m.ExpiresAt,
+		ID:               bson.NewObjectId(),
+		Notify:           m.Notify,
+		Recipient:        m.Recipient,
+		Sender:           m.Sender,
+	}
+	o = mm.Message()
+	err = s.mongo.DB(databaseName).C(collectionNameMessage).Insert(&mm)
+	return
+}
+
+// MessageDelete deletes a message by its id
+func (s *StorageMongo) MessageDelete(id string) (err error) {
+	if !bson.IsObjectIdHex(id) {
+		return ErrNotFoundInStorage
+	}
+	if err = s.mongo.DB(databaseName).C(collectionNameMessage).RemoveId(bson.ObjectIdHex(id)); err == mgo.ErrNotFound {
+		err = ErrNotFoundInStorage
+	}
+	return
+}
+
+// MessageFetchByRecipient fetches the messages of a recipient's device that have not expired yet ordered by creation
+// date
+// Messages that have expired but haven't been removed by the TTL index yet are skipped
+func (s *StorageMongo) MessageFetchByRecipient(username, device string) (ms []Message, err error) {
+	var mms []MessageMgo
+	if err = s.mongo.DB(databaseName).C(collectionNameMessage).Find(bson.M{
+		"device":     device,
+		"expires_at": bson.M{"$gt": TimeNow()},
+		"recipient":  username,
+	}).Sort("created_at").All(&mms); err != nil {
+		return
+	}
+	for _, mm := range mms {
+		ms = append(ms, mm.Message())
+	}
+	return
+}
@@ -0,0 +1,33 @@
+package astichat_test
+
+import (
+	"testing"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChattererAddDevice(t *testing.T) {
+	// Init
+	var s = astichat.NewMockedStorage()
+	s.ChattererCreate("alice", astichat.Device{ID: "d1"})
+
+	// No device can be added when the max is lower than 1
+	assert.Equal(t, astichat.ErrNotFoundInStorage, s.ChattererAddDevice("alice", astichat.Device{ID: "d2"}, 0))
+	assert.Equal(t, astichat.ErrNotFoundInStorage, s.ChattererAddDevice("alice", astichat.Device{ID: "d2"}, -1))
+
+	// Devices are added until the max is reached
+	assert.NoError(t, s.ChattererAddDevice("alice", astichat.Device{ID: "d2"}, 2))
+	assert.Equal(t, astichat.ErrNotFoundInStorage, s.ChattererAddDevice("alice", astichat.Device{ID: "d3"}, 2))
+	var c, _ = s.ChattererFetchByUsername("alice")
+	assert.Len(t, c.Devices, 2)
+
+	// The device of chatterers created before devices existed counts as well
+	c = astichat.ChattererMgo{
+		ClientPublicKey:  &astichat.PublicKey{},
+		Devices:          []astichat.Device{{ID: "d1"}},
+		ServerPrivateKey: &astichat.PrivateKey{},
+	}.Chatterer()
+	assert.Len(t, c.Devices, 2)
+	assert.Equal(t, "", c.Devices[1].ID)
+}
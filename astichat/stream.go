@@ -0,0 +1,539 @@
+package astichat
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/asticode/go-astilog"
+	"github.com/asticode/go-astiudp"
+)
+
+// Consts
+const (
+	maxStreamFrameSize = 2 << 20
+	// Unauthenticated conns only send fragments and connect events which are much smaller
+	maxStreamFrameSizeUnauthenticated = 16 << 10
+	streamProtocol                    = "astichat"
+	// Frames bigger than this are written on their own stream when the stream conn can multiplex
+	streamTransferThreshold = 16 << 10
+	maxStreamTransferSize   = 8 << 20
+)
+
+// StreamConfiguration represents a stream configuration
+// Conns that haven't authenticated within the auth timeout or that stay idle for longer than the idle timeout are
+// closed. Timeouts and the max number of conns per IP are disabled when they're 0
+type StreamConfiguration struct {
+	AuthTimeout   time.Duration `toml:"auth_timeout"`
+	IdleTimeout   time.Duration `toml:"idle_timeout"`
+	MaxConnsPerIP int           `toml:"max_conns_per_ip"`
+}
+
+// streamEvent represents an event sent over a stream
+type streamEvent struct {
+	Name    string          `json:"name"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// streamMultiplexer opens and accepts the streams dedicated to transfers alongside the control stream
+type streamMultiplexer interface {
+	acceptTransfer() (io.ReadCloser, error)
+	openTransfer() (io.WriteCloser, error)
+}
+
+// StreamConn sends and receives events over a stream connection using length-prefixed frames
+// When the stream conn can multiplex, frames too big for the control stream are sent as transfers: each of them is
+// written on its own stream so that it doesn't hold the events behind it, which lets them be bigger as well
+type StreamConn struct {
+	addr          net.Addr
+	authenticated bool // Protected by the mutex of the stream server
+	connectedAt   time.Time
+	mutex         *sync.Mutex
+	mux           streamMultiplexer // Nil when the stream conn can't multiplex
+	r             *bufio.Reader
+	rwc           io.ReadWriteCloser
+}
+
+// NewStreamConn creates a new stream conn
+func NewStreamConn(c net.Conn, r *bufio.Reader) *StreamConn {
+	return newStreamConn(c, c.RemoteAddr(), r)
+}
+
+// newStreamConn creates a new stream conn on top of any stream
+func newStreamConn(rwc io.ReadWriteCloser, addr net.Addr, r *bufio.Reader) *StreamConn {
+	if r == nil {
+		r = bufio.NewReader(rwc)
+	}
+	return &StreamConn{
+		addr:        addr,
+		connectedAt: time.Now(),
+		mutex:       &sync.Mutex{},
+		r:           r,
+		rwc:         rwc,
+	}
+}
+
+// Addr returns the remote addr of the stream conn as an UDP addr so that it can be used like any other peer addr
+func (c *StreamConn) Addr() *net.UDPAddr {
+	switch a := c.addr.(type) {
+	case *net.TCPAddr:
+		return &net.UDPAddr{IP: a.IP, Port: a.Port, Zone: a.Zone}
+	case *net.UDPAddr:
+		return a
+	}
+	return &net.UDPAddr{}
+}
+
+// Close closes the stream conn
+func (c *StreamConn) Close() error {
+	return c.rwc.Close()
+}
+
+// setReadDeadline sets the read deadline of the stream conn if the underlying stream supports it
+func (c *StreamConn) setReadDeadline(t time.Time) {
+	setReadDeadline(c.rwc, t)
+}
+
+// setReadDeadline sets the read deadline of a stream if it supports it
+func setReadDeadline(r io.Reader, t time.Time) {
+	if d, ok := r.(interface {
+		SetReadDeadline(time.Time) error
+	}); ok {
+		d.SetReadDeadline(t)
+	}
+}
+
+// ReadEvent reads the next event
+func (c *StreamConn) ReadEvent() (eventName string, payload json.RawMessage, err error) {
+	return c.readEvent(func() uint32 { return maxStreamFrameSize })
+}
+
+// readEvent reads the next event whose frame can't exceed the max size
+func (c *StreamConn) readEvent(maxFn func() uint32) (eventName string, payload json.RawMessage, err error) {
+	return readStreamEvent(c.r, maxFn)
+}
+
+// readStreamEvent reads the next event of a stream whose frame can't exceed the max size
+// The max size is retrieved once the frame size has been read since it may have changed in the meantime
+func readStreamEvent(r io.Reader, maxFn func() uint32) (eventName string, payload json.RawMessage, err error) {
+	// Read frame size
+	var s uint32
+	if err = binary.Read(r, binary.BigEndian, &s); err != nil {
+		return
+	}
+	if max := maxFn(); s > max {
+		err = fmt.Errorf("Frame size %d exceeds max frame size %d", s, max)
+		return
+	}
+
+	// Read frame
+	var b = make([]byte, s)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return
+	}
+
+	// Unmarshal
+	var e streamEvent
+	if err = json.Unmarshal(b, &e); err != nil {
+		return
+	}
+	return e.Name, e.Payload, nil
+}
+
+// WriteEvent writes an event
+func (c *StreamConn) WriteEvent(eventName string, payload interface{}) (err error) {
+	// Marshal
+	var e = streamEvent{Name: eventName}
+	if e.Payload, err = json.Marshal(payload); err != nil {
+		return
+	}
+	var b []byte
+	if b, err = json.Marshal(e); err != nil {
+		return
+	}
+	var max = maxStreamFrameSize
+	if c.mux != nil {
+		max = maxStreamTransferSize
+	}
+	if len(b) > max {
+		err = fmt.Errorf("Frame size %d exceeds max frame size %d", len(b), max)
+		return
+	}
+
+	// Create frame
+	var f = make([]byte, 4+len(b))
+	binary.BigEndian.PutUint32(f, uint32(len(b)))
+	copy(f[4:], b)
+
+	// Write transfer
+	if c.mux != nil && len(b) > streamTransferThreshold {
+		return c.writeTransfer(f)
+	}
+
+	// Write
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, err = c.rwc.Write(f)
+	return
+}
+
+// writeTransfer writes a frame on its own stream
+func (c *StreamConn) writeTransfer(f []byte) (err error) {
+	// Open stream
+	var w io.WriteCloser
+	if w, err = c.mux.openTransfer(); err != nil {
+		return
+	}
+
+	// Write
+	if _, err = w.Write(f); err != nil {
+		w.Close()
+		return
+	}
+	return w.Close()
+}
+
+// readTransfers accepts transfers until the stream conn is closed and reads the event of each of them
+// The read deadline and the max size are retrieved for each transfer
+func (c *StreamConn) readTransfers(deadlineFn func() time.Time, maxFn func() uint32, fn func(eventName string, payload json.RawMessage, err error)) {
+	for {
+		// Accept transfer
+		var r io.ReadCloser
+		var err error
+		if r, err = c.mux.acceptTransfer(); err != nil {
+			return
+		}
+
+		// Read event
+		go func() {
+			defer r.Close()
+			setReadDeadline(r, deadlineFn())
+			fn(readStreamEvent(r, maxFn))
+		}()
+	}
+}
+
+// DialStream opens a stream conn on the HTTP server by upgrading an HTTP connection
+func DialStream(serverHTTPAddr string, timeout time.Duration) (c *StreamConn, err error) {
+	// Parse URL
+	var u *url.URL
+	if u, err = url.Parse(serverHTTPAddr + "/stream"); err != nil {
+		return
+	}
+
+	// Get host
+	var host = u.Host
+	if u.Port() == "" {
+		var port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	// Dial
+	var conn net.Conn
+	var d = &net.Dialer{Timeout: timeout}
+	if u.Scheme == "https" {
+		conn, err = tls.DialWithDialer(d, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = d.Dial("tcp", host)
+	}
+	if err != nil {
+		return
+	}
+
+	// Make sure the conn is closed in case of error
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+
+	// Send upgrade request
+	conn.SetDeadline(time.Now().Add(timeout))
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodGet, u.String(), nil); err != nil {
+		return
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", streamProtocol)
+	if err = req.Write(conn); err != nil {
+		return
+	}
+
+	// Read response
+	var r = bufio.NewReader(conn)
+	var resp *http.Response
+	if resp, err = http.ReadResponse(r, req); err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		err = fmt.Errorf("Invalid status code %d while upgrading to stream", resp.StatusCode)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	c = NewStreamConn(conn, r)
+	return
+}
+
+// StreamServer is a transport that sends events over the stream conns of the clients that couldn't use UDP and
+// over UDP for the others
+// Listeners are executed with a nil *astiudp.Server for events read from stream conns and must answer through the
+// transport instead
+// Conns are not authenticated until the server authenticates their peer: until then their frames are limited to a
+// much smaller size and they're closed if they don't authenticate in time. Frames of events without listeners close
+// the conn since they wouldn't go through the rate limiters of the listeners
+type StreamServer struct {
+	c         StreamConfiguration
+	conns     map[string]*StreamConn // Indexed by addr
+	listeners map[string]astiudp.ListenerFunc
+	Logger    astilog.Logger
+	mutex     *sync.Mutex
+	udp       Transport
+}
+
+// NewStreamServer creates a new stream server
+func NewStreamServer(udp Transport) *StreamServer {
+	return &StreamServer{
+		conns:     make(map[string]*StreamConn),
+		listeners: make(map[string]astiudp.ListenerFunc),
+		Logger:    astilog.NopLogger(),
+		mutex:     &sync.Mutex{},
+		udp:       udp,
+	}
+}
+
+// Init initializes the stream server
+func (s *StreamServer) Init(c StreamConfiguration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.c = c
+}
+
+// Authenticate marks the stream conn of an addr as authenticated
+// The auth timeout doesn't apply to it anymore
+func (s *StreamServer) Authenticate(addr *net.UDPAddr) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if c, ok := s.conns[addr.String()]; ok {
+		c.authenticated = true
+		c.setReadDeadline(s.deadline(c))
+	}
+}
+
+// deadline returns the read deadline of a stream conn
+// It must be called while holding the mutex
+func (s *StreamServer) deadline(c *StreamConn) (t time.Time) {
+	if c.authenticated {
+		if s.c.IdleTimeout > 0 {
+			t = time.Now().Add(s.c.IdleTimeout)
+		}
+	} else if s.c.AuthTimeout > 0 {
+		t = c.connectedAt.Add(s.c.AuthTimeout)
+	}
+	return
+}
+
+// maxFrameSize returns the max frame size of a stream conn
+func (s *StreamServer) maxFrameSize(c *StreamConn) uint32 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if c.authenticated {
+		return maxStreamFrameSize
+	}
+	return maxStreamFrameSizeUnauthenticated
+}
+
+// maxTransferSize returns the max frame size of a transfer of a stream conn
+// Unauthenticated conns can't send transfers
+func (s *StreamServer) maxTransferSize(c *StreamConn) uint32 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if c.authenticated {
+		return maxStreamTransferSize
+	}
+	return 0
+}
+
+// SetListener implements the Transport interface
+func (s *StreamServer) SetListener(eventName string, l astiudp.ListenerFunc) {
+	s.udp.SetListener(eventName, l)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.listeners[eventName] = l
+}
+
+// Write implements the Transport interface
+func (s *StreamServer) Write(eventName string, payload interface{}, addr *net.UDPAddr) error {
+	s.mutex.Lock()
+	var c, ok = s.conns[addr.String()]
+	s.mutex.Unlock()
+	if ok {
+		return c.WriteEvent(eventName, payload)
+	}
+	return s.udp.Write(eventName, payload, addr)
+}
+
+// Has checks whether the addr is reached through a stream conn
+func (s *StreamServer) Has(addr *net.UDPAddr) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, ok := s.conns[addr.String()]
+	return ok
+}
+
+// Close closes all stream conns
+func (s *StreamServer) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for k, c := range s.conns {
+		c.Close()
+		delete(s.conns, k)
+	}
+}
+
+// ServeHTTP upgrades the HTTP connection and serves the stream conn
+func (s *StreamServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// Check upgrade
+	if r.Header.Get("Upgrade") != streamProtocol {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// Hijack
+	var h, ok = rw.(http.Hijacker)
+	if !ok {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var conn net.Conn
+	var brw *bufio.ReadWriter
+	var err error
+	if conn, brw, err = h.Hijack(); err != nil {
+		s.Logger.Errorf("%s while hijacking stream conn", err)
+		return
+	}
+
+	// Switch protocols
+	if _, err = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + streamProtocol + "\r\n\r\n")); err != nil {
+		s.Logger.Errorf("%s while switching protocols", err)
+		conn.Close()
+		return
+	}
+
+	// Serve
+	s.Serve(NewStreamConn(conn, brw.Reader))
+}
+
+// Serve reads events from the stream conn until it's closed
+func (s *StreamServer) Serve(c *StreamConn) {
+	// Add conn
+	var addr = c.Addr()
+	if err := s.add(c); err != nil {
+		s.Logger.Errorf("%s while adding stream conn %s", err, addr)
+		c.Close()
+		return
+	}
+	s.Logger.Debugf("Serving stream conn %s", addr)
+
+	// Remove conn
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, addr.String())
+		s.mutex.Unlock()
+		c.Close()
+		s.Logger.Debugf("Stream conn %s is closed", addr)
+	}()
+
+	// Read transfers
+	if c.mux != nil {
+		go c.readTransfers(func() time.Time {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			return s.deadline(c)
+		}, func() uint32 { return s.maxTransferSize(c) }, func(eventName string, payload json.RawMessage, err error) {
+			if err != nil {
+				s.Logger.Debugf("%s while reading transfer of stream conn %s", err, addr)
+				c.Close()
+				return
+			}
+			if !s.dispatch(eventName, payload, addr) {
+				c.Close()
+			}
+		})
+	}
+
+	// Read
+	var maxFn = func() uint32 { return s.maxFrameSize(c) }
+	for {
+		// Set read deadline
+		s.mutex.Lock()
+		c.setReadDeadline(s.deadline(c))
+		s.mutex.Unlock()
+
+		// Read event
+		var eventName string
+		var payload json.RawMessage
+		var err error
+		if eventName, payload, err = c.readEvent(maxFn); err != nil {
+			if err != io.EOF {
+				s.Logger.Debugf("%s while reading stream conn %s", err, addr)
+			}
+			return
+		}
+
+		// Dispatch
+		if !s.dispatch(eventName, payload, addr) {
+			return
+		}
+	}
+}
+
+// dispatch executes the listener of an event read from a stream conn
+// It returns false when there's no listener for the event, in which case the stream conn must be closed
+func (s *StreamServer) dispatch(eventName string, payload json.RawMessage, addr *net.UDPAddr) bool {
+	// Get listener
+	s.mutex.Lock()
+	var l, ok = s.listeners[eventName]
+	s.mutex.Unlock()
+	if !ok {
+		s.Logger.Debugf("No listener for event %s of stream conn %s", eventName, addr)
+		return false
+	}
+
+	// Execute listener
+	if err := l(nil, eventName, payload, addr); err != nil {
+		s.Logger.Errorf("%s while executing listener %s for stream conn %s", err, eventName, addr)
+	}
+	return true
+}
+
+// add adds a stream conn unless its IP has too many conns already
+func (s *StreamServer) add(c *StreamConn) (err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var addr = c.Addr()
+	if s.c.MaxConnsPerIP > 0 {
+		var n int
+		for _, sc := range s.conns {
+			if sc.Addr().IP.Equal(addr.IP) {
+				n++
+			}
+		}
+		if n >= s.c.MaxConnsPerIP {
+			return fmt.Errorf("IP %s has reached the max number of stream conns %d", addr.IP, s.c.MaxConnsPerIP)
+		}
+	}
+	s.conns[addr.String()] = c
+	return
+}
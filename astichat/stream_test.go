@@ -0,0 +1,183 @@
+package astichat_test
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/asticode/go-astiudp"
+	"github.com/stretchr/testify/assert"
+)
+
+// event represents a received event
+type event struct {
+	addr      string
+	eventName string
+	payload   string
+}
+
+func listen(ch chan event) astiudp.ListenerFunc {
+	return func(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) error {
+		ch <- event{addr: addr.String(), eventName: eventName, payload: string(payload)}
+		return nil
+	}
+}
+
+func wait(t *testing.T, ch chan event) (e event) {
+	select {
+	case e = <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+	return
+}
+
+func TestStream(t *testing.T) {
+	// Init server
+	var udp = newMockedTransport()
+	var s = astichat.NewStreamServer(udp)
+	defer s.Close()
+	var chServer = make(chan event, 10)
+	s.SetListener("event", listen(chServer))
+	s.SetListener(astichat.EventNamePeerRelay, listen(chServer))
+	var ts = httptest.NewServer(s)
+	defer ts.Close()
+
+	// Dial
+	var c, err = astichat.DialStream(ts.URL, time.Second)
+	assert.NoError(t, err)
+	var serverAddr = &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1234}
+	var r = astichat.NewRelayTransport(newMockedTransport(), serverAddr)
+	var chClient = make(chan event, 10)
+	r.SetListener("event", listen(chClient))
+	r.SetStream(c)
+	assert.True(t, r.Streaming())
+
+	// Client to server
+	err = r.Write("event", "hello", serverAddr)
+	assert.NoError(t, err)
+	var e = wait(t, chServer)
+	assert.Equal(t, "event", e.eventName)
+	assert.Equal(t, `"hello"`, e.payload)
+	addr, _ := net.ResolveUDPAddr("udp", e.addr)
+	assert.True(t, s.Has(addr))
+
+	// Server to client
+	err = s.Write("event", "world", addr)
+	assert.NoError(t, err)
+	e = wait(t, chClient)
+	assert.Equal(t, event{addr: serverAddr.String(), eventName: "event", payload: `"world"`}, e)
+
+	// Server to UDP addr
+	err = s.Write("event", "udp", &net.UDPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"event"}, udp.writes)
+	assert.Equal(t, `"udp"`, wait(t, chServer).payload)
+
+	// Client to peer is relayed
+	var peerAddr = &net.UDPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 1}
+	err = r.Write("event", "peer", peerAddr)
+	assert.NoError(t, err)
+	e = wait(t, chServer)
+	assert.Equal(t, astichat.EventNamePeerRelay, e.eventName)
+	var rl astichat.Relay
+	err = json.Unmarshal([]byte(e.payload), &rl)
+	assert.NoError(t, err)
+	assert.Equal(t, astichat.Relay{Addr: peerAddr, EventName: "event", Payload: json.RawMessage(`"peer"`)}, rl)
+
+	// Peer to client is relayed
+	err = s.Write(astichat.EventNamePeerRelayed, astichat.Relay{Addr: peerAddr, EventName: "event", Payload: json.RawMessage(`"relayed"`)}, addr)
+	assert.NoError(t, err)
+	e = wait(t, chClient)
+	assert.Equal(t, event{addr: peerAddr.String(), eventName: "event", payload: `"relayed"`}, e)
+}
+
+func TestRelayTransport(t *testing.T) {
+	// Init
+	var udp = newMockedTransport()
+	var serverAddr = &net.UDPAddr{IP: net.IPv6loopback, Port: 1234}
+	var peerAddr = &net.UDPAddr{IP: net.IPv6loopback, Port: 5678}
+	var r = astichat.NewRelayTransport(udp, serverAddr)
+	var ch = make(chan event, 10)
+	r.SetListener("event", listen(ch))
+
+	// Direct
+	err := r.Write("event", "direct", peerAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"event"}, udp.writes)
+	assert.Equal(t, `"direct"`, wait(t, ch).payload)
+
+	// Relayed events are only accepted from the server
+	var l = udp.listeners[astichat.EventNamePeerRelayed]
+	b, _ := json.Marshal(astichat.Relay{Addr: peerAddr, EventName: "event", Payload: json.RawMessage(`"relayed"`)})
+	err = l(nil, astichat.EventNamePeerRelayed, b, peerAddr)
+	assert.Error(t, err)
+	err = l(nil, astichat.EventNamePeerRelayed, b, serverAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, event{addr: peerAddr.String(), eventName: "event", payload: `"relayed"`}, wait(t, ch))
+
+	// Answers are relayed
+	udp.writes = []string{}
+	err = r.Write("event", "answer", peerAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{astichat.EventNamePeerRelay}, udp.writes)
+}
+
+func TestStreamServerLimits(t *testing.T) {
+	// Init server
+	var s = astichat.NewStreamServer(newMockedTransport())
+	defer s.Close()
+	s.Init(astichat.StreamConfiguration{AuthTimeout: 200 * time.Millisecond, MaxConnsPerIP: 2})
+	var ch = make(chan event, 10)
+	s.SetListener("event", listen(ch))
+	var ts = httptest.NewServer(s)
+	defer ts.Close()
+	var closed = func(c *astichat.StreamConn) bool {
+		var _, _, err = c.ReadEvent()
+		return err != nil
+	}
+
+	// Unauthenticated conns can't send large frames
+	var c1, err = astichat.DialStream(ts.URL, time.Second)
+	assert.NoError(t, err)
+	defer c1.Close()
+	var large = strings.Repeat("a", 32<<10)
+	assert.NoError(t, c1.WriteEvent("event", large))
+	assert.True(t, closed(c1))
+
+	// Authenticated conns can
+	var c2 *astichat.StreamConn
+	c2, err = astichat.DialStream(ts.URL, time.Second)
+	assert.NoError(t, err)
+	defer c2.Close()
+	assert.NoError(t, c2.WriteEvent("event", "small"))
+	var e = wait(t, ch)
+	addr, _ := net.ResolveUDPAddr("udp", e.addr)
+	s.Authenticate(addr)
+	assert.NoError(t, c2.WriteEvent("event", large))
+	assert.Equal(t, `"`+large+`"`, wait(t, ch).payload)
+
+	// Conns of an IP are capped
+	var c3 *astichat.StreamConn
+	c3, err = astichat.DialStream(ts.URL, time.Second)
+	assert.NoError(t, err)
+	defer c3.Close()
+	var c4 *astichat.StreamConn
+	c4, err = astichat.DialStream(ts.URL, time.Second)
+	assert.NoError(t, err)
+	defer c4.Close()
+	assert.True(t, closed(c4))
+
+	// Unauthenticated conns are closed after the auth timeout while authenticated conns are kept
+	assert.True(t, closed(c3))
+	assert.NoError(t, c2.WriteEvent("event", "still there"))
+	assert.Equal(t, `"still there"`, wait(t, ch).payload)
+
+	// Events without listeners close the conn
+	assert.NoError(t, c2.WriteEvent("unknown", "event"))
+	assert.True(t, closed(c2))
+}
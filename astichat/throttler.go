@@ -0,0 +1,50 @@
+package astichat
+
+import (
+	"sync"
+	"time"
+)
+
+// Throttler allows an action at most once per interval for each key
+type Throttler struct {
+	interval time.Duration
+	last     map[string]time.Time // Indexed by key
+	mutex    *sync.Mutex
+}
+
+// NewThrottler creates a new throttler
+func NewThrottler(interval time.Duration) *Throttler {
+	return &Throttler{
+		interval: interval,
+		last:     make(map[string]time.Time),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+// Allow checks whether the action is allowed for the key
+func (t *Throttler) Allow(key string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// Purge keys whose interval has elapsed
+	var now = TimeNow()
+	for k, l := range t.last {
+		if now.Sub(l) >= t.interval {
+			delete(t.last, k)
+		}
+	}
+
+	// Throttle
+	if _, ok := t.last[key]; ok {
+		return false
+	}
+	t.last[key] = now
+	return true
+}
+
+// Reset allows the next action for the key
+func (t *Throttler) Reset(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.last, key)
+}
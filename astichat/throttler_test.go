@@ -0,0 +1,47 @@
+package astichat_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThrottler(t *testing.T) {
+	// Init
+	var now = time.Unix(100, 0)
+	astichat.TimeNow = func() time.Time {
+		return now
+	}
+	defer func() {
+		astichat.TimeNow = time.Now
+	}()
+	var th = astichat.NewThrottler(3 * time.Second)
+
+	// Throttle
+	assert.True(t, th.Allow("a"))
+	assert.False(t, th.Allow("a"))
+	assert.True(t, th.Allow("b"))
+	now = now.Add(2 * time.Second)
+	assert.False(t, th.Allow("a"))
+	now = now.Add(time.Second)
+	assert.True(t, th.Allow("a"))
+
+	// Reset
+	th.Reset("a")
+	assert.True(t, th.Allow("a"))
+}
+
+func TestParseTyped(t *testing.T) {
+	var generateTypedID = astichat.GenerateTypedID
+	astichat.GenerateTypedID = func() string {
+		return "1"
+	}
+	defer func() { astichat.GenerateTypedID = generateTypedID }()
+	var ty = astichat.NewTyped("hello")
+	assert.Equal(t, astichat.Typed{ID: "1", Text: "hello"}, ty)
+	assert.Equal(t, ty, astichat.ParseTyped([]byte(`{"id":"1","text":"hello"}`)))
+	assert.Equal(t, astichat.Typed{Text: "raw text"}, astichat.ParseTyped([]byte("raw text")))
+	assert.Equal(t, astichat.Typed{Text: `{"text":"no id"}`}, astichat.ParseTyped([]byte(`{"text":"no id"}`)))
+}
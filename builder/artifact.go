@@ -0,0 +1,238 @@
+package builder
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"text/template"
+
+	"github.com/asticode/go-astichat/astichat"
+)
+
+// Package formats
+const (
+	PackageFormatNone  = ""
+	PackageFormatTarGz = "tar.gz"
+	PackageFormatZip   = "zip"
+)
+
+// Content types
+const (
+	contentTypeBinary = "application/octet-stream"
+	contentTypeTarGz  = "application/gzip"
+	contentTypeZip    = "application/zip"
+)
+
+// Vars
+var (
+	regexpFilename = regexp.MustCompile("[^a-zA-Z0-9._-]+")
+	readme         = template.Must(template.New("readme").Parse(`Astichat client of {{.Username}} for {{.Platform.Name}}
+Version {{.Version}}
+
+Your binary IS your private key: keep it safe and never share it.
+
+Run it from a terminal:
+{{if eq .Platform.GOOS "windows"}}    {{.Binary}}{{else}}    chmod +x {{.Binary}}
+    ./{{.Binary}}{{end}}
+{{if .Signed}}
+Check that it has been built by your server and hasn't been tampered with, using the fingerprint of the signing key
+published by your server's operator:
+{{if eq .Platform.GOOS "windows"}}    {{.Binary}} verify -fingerprint <fingerprint>{{else}}    ./{{.Binary}} verify -fingerprint <fingerprint>{{end}}
+{{end}}`))
+)
+
+// Artifact represents a client ready to be downloaded
+type Artifact struct {
+	Checksum    string `json:"checksum"` // Hex encoded SHA-256 of the file
+	ContentType string `json:"content_type"`
+	Filename    string `json:"filename"`
+	Path        string `json:"-"`
+	Signature   string `json:"signature,omitempty"` // Base64 encoded detached signature of the file
+}
+
+// IsValidPackageFormat checks whether the package format is valid for the builder
+func IsValidPackageFormat(f string) bool {
+	return f == PackageFormatNone || f == PackageFormatTarGz || f == PackageFormatZip
+}
+
+// Filename returns the filename of the client of a user
+func Filename(p Platform, username, version string) string {
+	return basename(p, username, version) + p.Extension
+}
+
+// basename returns the filename of the client of a user without extension
+// Characters that could be misinterpreted by browsers or file systems are replaced
+func basename(p Platform, username, version string) string {
+	return regexpFilename.ReplaceAllString(fmt.Sprintf("astichat-%s-%s-%s", username, version, p.OS), "_")
+}
+
+// Package turns a client into an artifact, packaging it with a README if a package format is provided
+// If the builder has a signing key, the artifact is signed and archives contain the signature of the client as well so
+// that it can verify itself once extracted
+// The client is removed once it has been packaged and the artifact is removed if packaging fails
+func (b *base) Package(path, outputOS, username, format string) (a Artifact, err error) {
+	// Get platform
+	var p, ok = PlatformByOS(outputOS)
+	if !ok {
+		err = fmt.Errorf("Invalid os %s", outputOS)
+		return
+	}
+
+	// Init artifact
+	var binary = Filename(p, username, b.version)
+	a = Artifact{ContentType: contentTypeBinary, Filename: binary, Path: path}
+	defer func() {
+		if err != nil && a.Path != path {
+			os.Remove(a.Path)
+		}
+	}()
+
+	// Package
+	if format != PackageFormatNone {
+		// Switch on format
+		var fn func(path string, es []packageEntry) error
+		switch format {
+		case PackageFormatTarGz:
+			a.ContentType = contentTypeTarGz
+			fn = packageTarGz
+		case PackageFormatZip:
+			a.ContentType = contentTypeZip
+			fn = packageZip
+		default:
+			err = fmt.Errorf("Invalid package format %s", format)
+			return
+		}
+		a.Filename = basename(p, username, b.version) + "." + format
+		a.Path = path + "." + format
+
+		// Read client
+		// The client is executable
+		var es = []packageEntry{{mode: 0755, name: binary}}
+		if es[0].b, err = ioutil.ReadFile(path); err != nil {
+			return
+		}
+
+		// Sign client
+		if b.signingKey != nil {
+			var sig string
+			if sig, err = astichat.SignFile(path, b.signingKey); err != nil {
+				return
+			}
+			es = append(es, packageEntry{b: []byte(sig + "\n"), mode: 0644, name: binary + astichat.SignatureExtension})
+		}
+
+		// Execute readme
+		var buf = &bytes.Buffer{}
+		if err = readme.Execute(buf, map[string]interface{}{"Binary": binary, "Platform": p, "Signed": b.signingKey != nil, "Username": username, "Version": b.version}); err != nil {
+			return
+		}
+		es = append(es, packageEntry{b: buf.Bytes(), mode: 0644, name: "README.txt"})
+
+		// Package
+		if err = fn(a.Path, es); err != nil {
+			return
+		}
+		os.Remove(path)
+	}
+
+	// Compute checksum
+	if a.Checksum, err = checksum(a.Path); err != nil {
+		return
+	}
+
+	// Sign artifact
+	if b.signingKey != nil {
+		if a.Signature, err = astichat.SignFile(a.Path, b.signingKey); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// checksum returns the hex encoded SHA-256 of a file
+func checksum(path string) (o string, err error) {
+	// Open file
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+	defer f.Close()
+
+	// Hash
+	var h = sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return
+	}
+	o = hex.EncodeToString(h.Sum(nil))
+	return
+}
+
+// packageEntry represents a file added to a package
+type packageEntry struct {
+	b    []byte
+	mode int64
+	name string
+}
+
+// packageTarGz packages files in a .tar.gz archive
+func packageTarGz(path string, es []packageEntry) (err error) {
+	// Create archive
+	var f *os.File
+	if f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600); err != nil {
+		return
+	}
+	defer f.Close()
+	var gw = gzip.NewWriter(f)
+	var tw = tar.NewWriter(gw)
+
+	// Add files
+	var now = astichat.TimeNow()
+	for _, e := range es {
+		if err = tw.WriteHeader(&tar.Header{ModTime: now, Mode: e.mode, Name: e.name, Size: int64(len(e.b)), Typeflag: tar.TypeReg}); err != nil {
+			return
+		}
+		if _, err = tw.Write(e.b); err != nil {
+			return
+		}
+	}
+
+	// Close
+	if err = tw.Close(); err != nil {
+		return
+	}
+	return gw.Close()
+}
+
+// packageZip packages files in a .zip archive
+func packageZip(path string, es []packageEntry) (err error) {
+	// Create archive
+	var f *os.File
+	if f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600); err != nil {
+		return
+	}
+	defer f.Close()
+	var zw = zip.NewWriter(f)
+
+	// Add files
+	var now = astichat.TimeNow()
+	for _, e := range es {
+		var h = &zip.FileHeader{Method: zip.Deflate, Modified: now, Name: e.name}
+		h.SetMode(os.FileMode(e.mode))
+		var w io.Writer
+		if w, err = zw.CreateHeader(h); err != nil {
+			return
+		}
+		if _, err = w.Write(e.b); err != nil {
+			return
+		}
+	}
+	return zw.Close()
+}
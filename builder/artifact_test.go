@@ -0,0 +1,142 @@
+package builder_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/asticode/go-astichat/builder"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilename(t *testing.T) {
+	var p, _ = builder.PlatformByOS(builder.OSWindows)
+	assert.Equal(t, "astichat-bob-v1.0.0-windows.exe", builder.Filename(p, "bob", "v1.0.0"))
+	p, _ = builder.PlatformByOS(builder.OSLinuxARM64)
+	assert.Equal(t, "astichat-b_b_.._-version-linux_arm64", builder.Filename(p, "b\"b/../", "version"))
+}
+
+func TestPackage(t *testing.T) {
+	// Init
+	var dir, err = ioutil.TempDir("", "astichat")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	var b = builder.New(builder.Configuration{Version: "version", WorkingDirectoryPath: dir})
+	var h = sha256.Sum256([]byte("binary"))
+
+	// Binary
+	ioutil.WriteFile(dir+"/binary", []byte("binary"), 0700)
+	var a builder.Artifact
+	a, err = b.Package(dir+"/binary", builder.OSWindows, "bob", builder.PackageFormatNone)
+	assert.NoError(t, err)
+	assert.Equal(t, builder.Artifact{Checksum: hex.EncodeToString(h[:]), ContentType: "application/octet-stream", Filename: "astichat-bob-version-windows.exe", Path: dir + "/binary"}, a)
+
+	// Zip
+	a, err = b.Package(dir+"/binary", builder.OSWindows, "bob", builder.PackageFormatZip)
+	assert.NoError(t, err)
+	assert.Equal(t, "application/zip", a.ContentType)
+	assert.Equal(t, "astichat-bob-version-windows.zip", a.Filename)
+	assert.Equal(t, dir+"/binary.zip", a.Path)
+	_, err = os.Stat(dir + "/binary")
+	assert.True(t, os.IsNotExist(err))
+	var zr *zip.ReadCloser
+	zr, err = zip.OpenReader(a.Path)
+	assert.NoError(t, err)
+	defer zr.Close()
+	assert.Len(t, zr.File, 2)
+	assert.Equal(t, "astichat-bob-version-windows.exe", zr.File[0].Name)
+	assert.Equal(t, os.FileMode(0755), zr.File[0].Mode())
+	assert.Equal(t, "README.txt", zr.File[1].Name)
+
+	// Tar.gz
+	ioutil.WriteFile(dir+"/binary", []byte("binary"), 0700)
+	a, err = b.Package(dir+"/binary", builder.OSLinux, "bob", builder.PackageFormatTarGz)
+	assert.NoError(t, err)
+	assert.Equal(t, "application/gzip", a.ContentType)
+	assert.Equal(t, "astichat-bob-version-linux.tar.gz", a.Filename)
+	var f *os.File
+	f, err = os.Open(a.Path)
+	assert.NoError(t, err)
+	defer f.Close()
+	var gr *gzip.Reader
+	gr, err = gzip.NewReader(f)
+	assert.NoError(t, err)
+	var tr = tar.NewReader(gr)
+	var th *tar.Header
+	th, err = tr.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "astichat-bob-version-linux", th.Name)
+	assert.Equal(t, int64(0755), th.Mode)
+	var c []byte
+	c, err = ioutil.ReadAll(tr)
+	assert.NoError(t, err)
+	assert.Equal(t, "binary", string(c))
+	th, err = tr.Next()
+	assert.NoError(t, err)
+	assert.Equal(t, "README.txt", th.Name)
+	c, err = ioutil.ReadAll(tr)
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(string(c), "./astichat-bob-version-linux"))
+
+	// Invalid
+	_, err = b.Package(dir+"/binary", builder.OSLinux, "bob", "invalid")
+	assert.Error(t, err)
+	assert.False(t, builder.IsValidPackageFormat("invalid"))
+}
+
+func TestPackageSigned(t *testing.T) {
+	// Init
+	var dir, err = ioutil.TempDir("", "astichat")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	var prv *astichat.PrivateKey
+	prv, err = astichat.NewPrivateKey("")
+	assert.NoError(t, err)
+	var pub *astichat.PublicKey
+	pub, err = prv.PublicKey()
+	assert.NoError(t, err)
+	var b = builder.New(builder.Configuration{SigningKey: prv, Version: "version", WorkingDirectoryPath: dir})
+
+	// Binary
+	ioutil.WriteFile(dir+"/binary", []byte("binary"), 0700)
+	var a builder.Artifact
+	a, err = b.Package(dir+"/binary", builder.OSLinux, "bob", builder.PackageFormatNone)
+	assert.NoError(t, err)
+	assert.NoError(t, astichat.VerifyFile(a.Path, []byte(a.Signature), pub))
+
+	// Zip
+	// The archive contains the signature of the client
+	a, err = b.Package(dir+"/binary", builder.OSLinux, "bob", builder.PackageFormatZip)
+	assert.NoError(t, err)
+	assert.NoError(t, astichat.VerifyFile(a.Path, []byte(a.Signature), pub))
+	var zr *zip.ReadCloser
+	zr, err = zip.OpenReader(a.Path)
+	assert.NoError(t, err)
+	defer zr.Close()
+	assert.Len(t, zr.File, 3)
+	assert.Equal(t, "astichat-bob-version-linux.sig", zr.File[1].Name)
+	var rc io.ReadCloser
+	rc, err = zr.File[1].Open()
+	assert.NoError(t, err)
+	var sig []byte
+	sig, err = ioutil.ReadAll(rc)
+	rc.Close()
+	assert.NoError(t, err)
+	ioutil.WriteFile(dir+"/extracted", []byte("binary"), 0700)
+	assert.NoError(t, astichat.VerifyFile(dir+"/extracted", sig, pub))
+	rc, err = zr.File[2].Open()
+	assert.NoError(t, err)
+	var c []byte
+	c, err = ioutil.ReadAll(rc)
+	rc.Close()
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(string(c), "./astichat-bob-version-linux verify"))
+}
@@ -2,39 +2,191 @@ package builder
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
-	"strings"
+	"path/filepath"
+	"runtime/debug"
+	"time"
 
 	"github.com/asticode/go-astichat/astichat"
-	"github.com/asticode/go-astitools/slice"
 	"github.com/rs/xid"
 )
 
-// OS
+// Consts
 const (
-	OSLinux     = "linux"
-	OSMaxOSX    = "macosx"
-	OSWindows   = "windows"
-	OSWindows32 = "windows_32"
-	repoName    = "github.com/asticode/go-astichat"
+	templatePrefix = "template-"
+	versionDevel   = "devel"
 )
 
-// Builder represents a builder
-type Builder struct {
-	workingDirectoryPath string
+// Builder builds and packages clients
+type Builder interface {
+	Build(ctx context.Context, os, username, deviceID string, prvClient *astichat.PrivateKey, pubServer *astichat.PublicKey) (string, error)
+	Package(path, os, username, format string) (Artifact, error)
+	Version() string
+}
+
+// New returns the builder of the configuration
+// Templates are fetched from a remote worker if its addr is provided, otherwise they're built locally
+func New(c Configuration) Builder {
+	if c.Remote.Addr != "" {
+		return NewRemote(c)
+	}
+	return NewLocal(c)
+}
+
+// base represents the part shared by builders: templates are stamped and packaged locally whoever built them
+type base struct {
+	buildID              string
+	commit               string
+	lock                 chan bool // Holds a value while a template is being built or fetched
 	serverHTTPAddr       string
+	serverQUICAddr       string
 	serverUDPAddr        string
+	signingKey           *astichat.PrivateKey
+	template             func(ctx context.Context, outputOS string) (string, error)
+	version              string
+	workingDirectoryPath string
 }
 
-// New returns a new builder
-func New(c Configuration) *Builder {
-	return &Builder{
-		workingDirectoryPath: c.WorkingDirectoryPath,
+// newBase creates a new base
+func newBase(c Configuration) *base {
+	var b = &base{
+		buildID:              BuildID(),
+		commit:               buildCommit(),
+		lock:                 make(chan bool, 1),
 		serverHTTPAddr:       c.ServerHTTPAddr,
+		serverQUICAddr:       c.ServerQUICAddr,
 		serverUDPAddr:        c.ServerUDPAddr,
+		signingKey:           c.SigningKey,
+		version:              c.Version,
+		workingDirectoryPath: c.WorkingDirectoryPath,
+	}
+	if b.version == "" {
+		b.version = buildVersion()
+	}
+	return b
+}
+
+// Local represents a builder building templates with the local go tool
+type Local struct {
+	*base
+	buildTimeout time.Duration
+	goCache      string
+	moduleRoot   string
+}
+
+// NewLocal returns a new local builder
+// The client is built from the module root, which must have been validated, and the go cache defaults to a directory
+// of the working directory
+func NewLocal(c Configuration) *Local {
+	var b = &Local{
+		base:         newBase(c),
+		buildTimeout: c.BuildTimeout,
+		goCache:      c.GoCache,
+		moduleRoot:   c.ModuleRoot,
+	}
+	b.base.template = b.Template
+	if b.goCache == "" {
+		b.goCache = filepath.Join(c.WorkingDirectoryPath, "cache")
+	}
+	if p, err := filepath.Abs(b.goCache); err == nil {
+		// The go tool only accepts an absolute go cache
+		b.goCache = p
+	}
+	return b
+}
+
+// ReadBuildInfo allows testing functions using it
+var ReadBuildInfo = func() (*debug.BuildInfo, bool) {
+	return debug.ReadBuildInfo()
+}
+
+// buildVersion returns the version of the running binary based on its build info
+// The vcs revision is preferred over the module version which is "(devel)" when built from a checkout
+func buildVersion() string {
+	// Read build info
+	var i, ok = ReadBuildInfo()
+	if !ok {
+		return versionDevel
+	}
+
+	// Loop through settings
+	var revision, modified string
+	for _, s := range i.Settings {
+		switch s.Key {
+		case "vcs.modified":
+			modified = s.Value
+		case "vcs.revision":
+			revision = s.Value
+		}
+	}
+
+	// Revision
+	if revision != "" {
+		if modified == "true" {
+			revision += "-dirty"
+		}
+		return revision
+	}
+
+	// Module version
+	if i.Main.Version != "" && i.Main.Version != "(devel)" {
+		return i.Main.Version
 	}
+	return versionDevel
+}
+
+// BuildID allows testing functions using it
+// It returns a short hash of the running binary so that a rebuilt binary doesn't reuse the templates of the previous
+// build when its version hasn't changed, which is always the case without vcs info
+var BuildID = func() string {
+	// Get executable
+	var p, err = os.Executable()
+	if err != nil {
+		return ""
+	}
+
+	// Open
+	var f *os.File
+	if f, err = os.Open(p); err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	// Hash
+	var h = sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// buildCommit returns the vcs revision of the running binary if any
+func buildCommit() string {
+	// Read build info
+	var i, ok = ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+
+	// Loop through settings
+	for _, s := range i.Settings {
+		if s.Key == "vcs.revision" {
+			return s.Value
+		}
+	}
+	return ""
+}
+
+// Version returns the version of the clients built by the builder
+func (b *base) Version() string {
+	return b.version
 }
 
 // RandomID allows testing functions using it
@@ -43,20 +195,27 @@ var RandomID = func() string {
 }
 
 // ExecCmd allows testing functions using it
+// The cmd is killed when the context it has been created with is done
 var ExecCmd = func(cmd *exec.Cmd) ([]byte, error) {
 	return cmd.CombinedOutput()
 }
 
 // Build builds the client
-func (b *Builder) Build(os, username string, prvClient *astichat.PrivateKey, pubServer *astichat.PublicKey) (o string, err error) {
-	// Retrieve git version
-	var v []byte
-	if v, err = b.gitVersion(); err != nil {
+// The template binary of the OS is built once per version and each client is a copy of it stamped with the user
+// specific values so that no go build is needed per download
+// Nothing is left in the working directory if the build fails
+func (b *base) Build(ctx context.Context, outputOS, username, deviceID string, prvClient *astichat.PrivateKey, pubServer *astichat.PublicKey) (o string, err error) {
+	// Make sure the working directory is private
+	// Clients contain their private key therefore they must never be readable by other users of the build host
+	if err = mkdirPrivate(b.workingDirectoryPath); err != nil {
 		return
 	}
 
-	// Init output path
-	o = fmt.Sprintf("%s/%s", b.workingDirectoryPath, RandomID())
+	// Get template
+	var t string
+	if t, err = b.template(ctx, outputOS); err != nil {
+		return
+	}
 
 	// Marshal client's private key
 	var prvClientBytes []byte
@@ -70,57 +229,237 @@ func (b *Builder) Build(os, username string, prvClient *astichat.PrivateKey, pub
 		return
 	}
 
-	// Init ldflags
-	var ldflags = []string{
-		"-X main.ClientPrivateKey=" + string(prvClientBytes),
-		"-X main.ServerHTTPAddr=" + b.serverHTTPAddr,
-		"-X main.ServerPublicKey=" + string(pubServerBytes),
-		"-X main.ServerUDPAddr=" + b.serverUDPAddr,
-		"-X main.Username=" + username,
-		"-X main.Version=" + string(v),
+	// Get client's public key
+	var pubClient *astichat.PublicKey
+	if pubClient, err = prvClient.PublicKey(); err != nil {
+		return
+	}
+
+	// Get client's key fingerprint
+	var fingerprint string
+	if fingerprint, err = astichat.KeyFingerprint(pubClient); err != nil {
+		return
+	}
+
+	// Stat template
+	// The template has been built when it was last modified
+	var fi os.FileInfo
+	if fi, err = os.Stat(t); err != nil {
+		return
+	}
+
+	// Read template
+	var bin []byte
+	if bin, err = ioutil.ReadFile(t); err != nil {
+		return
+	}
+
+	// Stamp
+	if err = astichat.StampBinary(bin, astichat.Stamp{
+		Build: astichat.BuildInfo{
+			BuiltAt:        fi.ModTime().UTC(),
+			Commit:         b.commit,
+			KeyAlgorithm:   astichat.KeyAlgorithm(pubClient),
+			KeyFingerprint: fingerprint,
+			Platform:       outputOS,
+			ServerHTTPAddr: b.serverHTTPAddr,
+			ServerQUICAddr: b.serverQUICAddr,
+			ServerUDPAddr:  b.serverUDPAddr,
+			StampedAt:      astichat.TimeNow().UTC(),
+			Version:        b.version,
+		},
+		ClientPrivateKey: string(prvClientBytes),
+		DeviceID:         deviceID,
+		ServerHTTPAddr:   b.serverHTTPAddr,
+		ServerPublicKey:  string(pubServerBytes),
+		ServerQUICAddr:   b.serverQUICAddr,
+		ServerUDPAddr:    b.serverUDPAddr,
+		Username:         username,
+	}); err != nil {
+		return
+	}
+
+	// Write client
+	var path = fmt.Sprintf("%s/%s", b.workingDirectoryPath, RandomID())
+	if err = writeFile(path, bytes.NewReader(bin)); err != nil {
+		return
+	}
+	o = path
+	return
+}
+
+// mkdirPrivate creates a directory if it doesn't exist and makes sure other users can't access it
+func mkdirPrivate(path string) (err error) {
+	if err = os.MkdirAll(path, 0700); err != nil {
+		return
+	}
+	return os.Chmod(path, 0700)
+}
+
+// writeFile writes the content of a reader in a new executable file only accessible by its owner
+// The file must not exist so that an existing file or link can't be used to read its content, and it's removed if the
+// write fails
+func writeFile(path string, r io.Reader) (err error) {
+	// Create file
+	var f *os.File
+	if f, err = os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0700); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	defer f.Close()
+
+	// Copy
+	if _, err = io.Copy(f, r); err != nil {
+		return
+	}
+	return f.Close()
+}
+
+// lockTemplates waits until no other template is being built or fetched, or until the context is done
+// The returned func must be called to unlock
+func (b *base) lockTemplates(ctx context.Context, outputOS string) (unlock func(), err error) {
+	select {
+	case b.lock <- true:
+		unlock = func() { <-b.lock }
+	case <-ctx.Done():
+		err = newBuildError(ctx, outputOS, ctx.Err(), nil)
+	}
+	return
+}
+
+// templatePath returns the path of the template binary of an OS
+// Templates are specific to the version and the build of the running binary
+func (b *base) templatePath(outputOS string) string {
+	var p = fmt.Sprintf("%s/%s%s-%s", b.workingDirectoryPath, templatePrefix, outputOS, b.version)
+	if b.buildID != "" {
+		p += "-" + b.buildID
+	}
+	return p
+}
+
+// templateReady moves a new template to its path and removes the templates of the OS left by other versions or builds
+func (b *base) templateReady(outputOS, path string) (o string, err error) {
+	// Move template
+	if err = os.Rename(path, b.templatePath(outputOS)); err != nil {
+		return
+	}
+	o = b.templatePath(outputOS)
+
+	// Get stale templates
+	var ps []string
+	if ps, err = filepath.Glob(fmt.Sprintf("%s/%s%s-*", b.workingDirectoryPath, templatePrefix, outputOS)); err != nil {
+		return
+	}
+
+	// Remove stale templates
+	for _, p := range ps {
+		if p == o {
+			continue
+		}
+		if err = os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return
+		}
+	}
+	err = nil
+	return
+}
+
+// Template returns the path of the template binary of an OS and builds it if it doesn't exist yet
+// The build is killed if the context is done or if it exceeds the build timeout
+func (b *Local) Template(ctx context.Context, outputOS string) (o string, err error) {
+	// Get platform
+	var p, ok = PlatformByOS(outputOS)
+	if !ok {
+		err = fmt.Errorf("Invalid os %s", outputOS)
+		return
+	}
+
+	// Lock so that the template is built only once
+	var unlock func()
+	if unlock, err = b.lockTemplates(ctx, outputOS); err != nil {
+		return
+	}
+	defer unlock()
+
+	// Template already exists
+	o = b.templatePath(outputOS)
+	if _, err = os.Stat(o); err == nil {
+		return
+	} else if !os.IsNotExist(err) {
+		return
+	}
+
+	// Add build timeout
+	if b.buildTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.buildTimeout)
+		defer cancel()
 	}
 
 	// Init cmd
-	var cmd = exec.Command("go", "build", "-o", o, "-ldflags", strings.Join(ldflags, " "), repoName+"/client")
-	cmd.Env = b.buildEnv(os)
+	// The template is built in a temporary path so that a failed build doesn't leave a broken template behind
+	var path string
+	if path, err = filepath.Abs(fmt.Sprintf("%s/%s", b.workingDirectoryPath, RandomID())); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	var cmd = exec.CommandContext(ctx, "go", "build", "-o", path, "-ldflags", "-X main.Version="+b.version, "./client")
+	cmd.Dir = b.moduleRoot
+	cmd.Env = b.buildEnv(p)
 
 	// Exec
 	var co []byte
 	if co, err = ExecCmd(cmd); err != nil {
-		err = fmt.Errorf("%s: %s", err, string(co))
+		err = newBuildError(ctx, outputOS, err, co)
 		return
 	}
+
+	// Template is ready
+	o, err = b.templateReady(outputOS, path)
 	return
 }
 
 // buildEnv returns the build environment variables
-// TODO Test cross platform
-func (b *Builder) buildEnv(outputOS string) (o []string) {
-	o = []string{"GOPATH=" + os.Getenv("GOPATH"), "PATH=" + os.Getenv("PATH")}
-	switch outputOS {
-	case OSMaxOSX:
-		o = append(o, "GOOS=darwin", "GOARCH=amd64")
-	case OSWindows:
-		o = append(o, "GOOS=windows", "GOARCH=amd64")
-	case OSWindows32:
-		o = append(o, "GOOS=windows", "GOARCH=386")
-	default:
-		o = append(o, "GOOS=linux", "GOARCH=amd64")
+// Only the variables the go tool needs are forwarded so that the server's environment doesn't leak into the build.
+// Dependencies are taken from the vendor directory when the module root has one.
+func (b *Local) buildEnv(p Platform) (o []string) {
+	// Go path is where the module cache is stored
+	var goPath = os.Getenv("GOPATH")
+	if goPath == "" {
+		goPath, _ = filepath.Abs(filepath.Join(b.workingDirectoryPath, "gopath"))
 	}
-	return
-}
 
-// GitVersion retrieves the project's git version
-func (b *Builder) gitVersion() (o []byte, err error) {
-	var cmd = exec.Command("git", "--git-dir", fmt.Sprintf("%s/src/%s/.git", os.Getenv("GOPATH"), repoName), "rev-parse", "HEAD")
-	if o, err = ExecCmd(cmd); err != nil {
-		return
+	// Go flags
+	var goFlags = "-mod=readonly -trimpath"
+	if fi, err := os.Stat(filepath.Join(b.moduleRoot, "vendor")); err == nil && fi.IsDir() {
+		goFlags = "-mod=vendor -trimpath"
+	}
+
+	// Init env
+	o = []string{
+		"CGO_ENABLED=0",
+		"GOCACHE=" + b.goCache,
+		"GOFLAGS=" + goFlags,
+		"GOPATH=" + goPath,
+		"PATH=" + os.Getenv("PATH"),
+	}
+	o = append(o, "GOOS="+p.GOOS, "GOARCH="+p.GOARCH)
+	if p.GOARM != "" {
+		o = append(o, "GOARM="+p.GOARM)
 	}
-	o = bytes.TrimSpace(o)
 	return
 }
 
 // IsValidOS checks whether the OS is valid for the builder
 func IsValidOS(os string) bool {
-	return astislice.InStringSlice(os, []string{OSLinux, OSMaxOSX, OSWindows, OSWindows32})
+	_, ok := PlatformByOS(os)
+	return ok
 }
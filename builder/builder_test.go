@@ -1,11 +1,16 @@
 package builder_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"runtime/debug"
 	"strings"
 	"testing"
-
-	"os"
+	"time"
 
 	"github.com/asticode/go-astichat/astichat"
 	"github.com/asticode/go-astichat/builder"
@@ -20,10 +25,25 @@ var (
 
 func TestBuilder(t *testing.T) {
 	// Init
-	var b = builder.New(builder.Configuration{WorkingDirectoryPath: "/working/directory/path", ServerHTTPAddr: "server_http_addr", ServerUDPAddr: "server_udp_addr"})
+	var dir, err = ioutil.TempDir("", "astichat")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	var now = time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	var builtAt = time.Date(2017, 1, 1, 3, 4, 5, 0, time.UTC)
+	astichat.TimeNow = func() time.Time { return now }
+	defer func() { astichat.TimeNow = time.Now }()
+	builder.ReadBuildInfo = func() (*debug.BuildInfo, bool) {
+		return &debug.BuildInfo{Settings: []debug.BuildSetting{{Key: "vcs.revision", Value: "commit"}}}, true
+	}
+	defer func() { builder.ReadBuildInfo = debug.ReadBuildInfo }()
+	var buildID = builder.BuildID
+	builder.BuildID = func() string { return "build" }
+	defer func() { builder.BuildID = buildID }()
+	var c = builder.Configuration{ModuleRoot: dir + "/module", WorkingDirectoryPath: dir, ServerHTTPAddr: "server_http_addr", ServerQUICAddr: "server_quic_addr", ServerUDPAddr: "server_udp_addr", Version: "version"}
+	var b = builder.New(c)
 	var prv = astichat.PrivateKey{}
 	prv.SetPassphrase("")
-	var err = prv.UnmarshalText([]byte(prvString))
+	err = prv.UnmarshalText([]byte(prvString))
 	assert.NoError(t, err)
 	var pub *astichat.PublicKey
 	pub, err = prv.PublicKey()
@@ -32,34 +52,303 @@ func TestBuilder(t *testing.T) {
 	os.Setenv("GOPATH", "/go/path")
 	os.Setenv("PATH", "/path")
 	builder.ExecCmd = func(cmd *exec.Cmd) ([]byte, error) {
-		cmds = append(cmds, strings.Join(append(cmd.Args, cmd.Env...), " "))
-		if cmd.Args[0] == "git" {
-			return []byte("version"), nil
+		cmds = append(cmds, strings.Join(append(append(cmd.Args, cmd.Dir), cmd.Env...), " "))
+		if err := ioutil.WriteFile(cmd.Args[3], []byte("header"+astichat.StampPlaceholder+"footer"), 0700); err != nil {
+			return nil, err
 		}
-		return []byte{}, nil
+		return []byte{}, os.Chtimes(cmd.Args[3], builtAt, builtAt)
 	}
+	var id int
 	builder.RandomID = func() string {
-		return "random_id"
+		id++
+		return fmt.Sprintf("random_id_%d", id)
 	}
 
 	// Linux
-	_, err = b.Build(builder.OSLinux, "bob", &prv, pub)
-	assert.Equal(t, []string{"git --git-dir /go/path/src/github.com/asticode/go-astichat/.git rev-parse HEAD", "go build -o /working/directory/path/random_id -ldflags -X main.ClientPrivateKey=" + prvString + " -X main.ServerHTTPAddr=server_http_addr -X main.ServerPublicKey=" + pubString + " -X main.ServerUDPAddr=server_udp_addr -X main.Username=bob -X main.Version=version github.com/asticode/go-astichat/client GOPATH=/go/path PATH=/path GOOS=linux GOARCH=amd64"}, cmds)
+	var o string
+	o, err = b.Build(context.Background(), builder.OSLinux, "bob", "device", &prv, pub)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"go build -o " + dir + "/random_id_1 -ldflags -X main.Version=version ./client " + dir + "/module CGO_ENABLED=0 GOCACHE=" + dir + "/cache GOFLAGS=-mod=readonly -trimpath GOPATH=/go/path PATH=/path GOOS=linux GOARCH=amd64"}, cmds)
+	assert.Equal(t, dir+"/random_id_2", o)
+	var bin []byte
+	bin, err = ioutil.ReadFile(o)
+	assert.NoError(t, err)
+	var s astichat.Stamp
+	s, err = astichat.ParseStamp(string(bin[len("header") : len("header")+astichat.StampSize]))
+	assert.NoError(t, err)
+	assert.Equal(t, astichat.Stamp{Build: astichat.BuildInfo{BuiltAt: builtAt, Commit: "commit", KeyAlgorithm: "RSA-4096", KeyFingerprint: "cf72837a86b2becf136f3ed720ca25c7e0ac60216bff966e9c1d47d15d672a4c", Platform: builder.OSLinux, ServerHTTPAddr: "server_http_addr", ServerQUICAddr: "server_quic_addr", ServerUDPAddr: "server_udp_addr", StampedAt: now, Version: "version"}, ClientPrivateKey: prvString, DeviceID: "device", ServerHTTPAddr: "server_http_addr", ServerPublicKey: pubString, ServerQUICAddr: "server_quic_addr", ServerUDPAddr: "server_udp_addr", Username: "bob"}, s)
+
+	// Linux template is only built once
+	cmds = []string{}
+	o, err = b.Build(context.Background(), builder.OSLinux, "alice", "device", &prv, pub)
+	assert.NoError(t, err)
+	assert.Len(t, cmds, 0)
+	assert.Equal(t, dir+"/random_id_3", o)
 
 	// MacOSx
+	// Dependencies are taken from the vendor directory
+	os.MkdirAll(dir+"/module/vendor", 0700)
 	cmds = []string{}
-	_, err = b.Build(builder.OSMaxOSX, "bob", &prv, pub)
-	assert.Equal(t, []string{"git --git-dir /go/path/src/github.com/asticode/go-astichat/.git rev-parse HEAD", "go build -o /working/directory/path/random_id -ldflags -X main.ClientPrivateKey=" + prvString + " -X main.ServerHTTPAddr=server_http_addr -X main.ServerPublicKey=" + pubString + " -X main.ServerUDPAddr=server_udp_addr -X main.Username=bob -X main.Version=version github.com/asticode/go-astichat/client GOPATH=/go/path PATH=/path GOOS=darwin GOARCH=amd64"}, cmds)
+	_, err = b.Build(context.Background(), builder.OSMaxOSX, "bob", "device", &prv, pub)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"go build -o " + dir + "/random_id_4 -ldflags -X main.Version=version ./client " + dir + "/module CGO_ENABLED=0 GOCACHE=" + dir + "/cache GOFLAGS=-mod=vendor -trimpath GOPATH=/go/path PATH=/path GOOS=darwin GOARCH=amd64"}, cmds)
+	os.RemoveAll(dir + "/module")
 
 	// Windows
 	cmds = []string{}
-	_, err = b.Build(builder.OSWindows, "bob", &prv, pub)
-	assert.Equal(t, []string{"git --git-dir /go/path/src/github.com/asticode/go-astichat/.git rev-parse HEAD", "go build -o /working/directory/path/random_id -ldflags -X main.ClientPrivateKey=" + prvString + " -X main.ServerHTTPAddr=server_http_addr -X main.ServerPublicKey=" + pubString + " -X main.ServerUDPAddr=server_udp_addr -X main.Username=bob -X main.Version=version github.com/asticode/go-astichat/client GOPATH=/go/path PATH=/path GOOS=windows GOARCH=amd64"}, cmds)
+	_, err = b.Build(context.Background(), builder.OSWindows, "bob", "device", &prv, pub)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"go build -o " + dir + "/random_id_6 -ldflags -X main.Version=version ./client " + dir + "/module CGO_ENABLED=0 GOCACHE=" + dir + "/cache GOFLAGS=-mod=readonly -trimpath GOPATH=/go/path PATH=/path GOOS=windows GOARCH=amd64"}, cmds)
 
 	// Windows 32bits
 	cmds = []string{}
-	_, err = b.Build(builder.OSWindows32, "bob", &prv, pub)
-	assert.Equal(t, []string{"git --git-dir /go/path/src/github.com/asticode/go-astichat/.git rev-parse HEAD", "go build -o /working/directory/path/random_id -ldflags -X main.ClientPrivateKey=" + prvString + " -X main.ServerHTTPAddr=server_http_addr -X main.ServerPublicKey=" + pubString + " -X main.ServerUDPAddr=server_udp_addr -X main.Username=bob -X main.Version=version github.com/asticode/go-astichat/client GOPATH=/go/path PATH=/path GOOS=windows GOARCH=386"}, cmds)
+	_, err = b.Build(context.Background(), builder.OSWindows32, "bob", "device", &prv, pub)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"go build -o " + dir + "/random_id_8 -ldflags -X main.Version=version ./client " + dir + "/module CGO_ENABLED=0 GOCACHE=" + dir + "/cache GOFLAGS=-mod=readonly -trimpath GOPATH=/go/path PATH=/path GOOS=windows GOARCH=386"}, cmds)
+
+	// Failed builds don't leave a template behind
+	c.Version = "other_version"
+	b = builder.New(c)
+	builder.ExecCmd = func(cmd *exec.Cmd) ([]byte, error) {
+		return []byte("output"), errors.New("failed")
+	}
+	_, err = b.Build(context.Background(), builder.OSLinux, "bob", "device", &prv, pub)
+	assert.EqualError(t, err, "Build for os linux has failed: failed")
+	assert.Equal(t, &builder.BuildError{Code: builder.BuildErrorCodeFailed, Err: errors.New("failed"), OS: builder.OSLinux, Output: "output"}, err)
+	var fs []os.FileInfo
+	fs, err = ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, fs, 9)
+
+	// A rebuilt binary doesn't reuse the templates of the previous build and removes them
+	c.Version = "version"
+	builder.BuildID = func() string { return "other_build" }
+	b = builder.New(c)
+	cmds = []string{}
+	builder.ExecCmd = func(cmd *exec.Cmd) ([]byte, error) {
+		cmds = append(cmds, cmd.Args[3])
+		return []byte{}, ioutil.WriteFile(cmd.Args[3], []byte("header"+astichat.StampPlaceholder+"footer"), 0700)
+	}
+	_, err = b.Build(context.Background(), builder.OSLinux, "bob", "device", &prv, pub)
+	assert.NoError(t, err)
+	assert.Len(t, cmds, 1)
+	_, err = os.Stat(dir + "/template-linux-version-other_build")
+	assert.NoError(t, err)
+	_, err = os.Stat(dir + "/template-linux-version-build")
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dir + "/template-macosx-version-build")
+	assert.NoError(t, err)
+}
+
+func TestBuilderCancel(t *testing.T) {
+	// Init
+	var dir, err = ioutil.TempDir("", "astichat")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	var prv = astichat.PrivateKey{}
+	err = prv.UnmarshalText([]byte(prvString))
+	assert.NoError(t, err)
+	var pub *astichat.PublicKey
+	pub, err = prv.PublicKey()
+	assert.NoError(t, err)
+	builder.RandomID = func() string { return "random_id" }
+
+	// The go tool writes part of the template and blocks until it's killed
+	// It's replaced by the test binary, which doesn't need to be looked up in the PATH
+	var started = make(chan bool, 1)
+	builder.ExecCmd = func(cmd *exec.Cmd) ([]byte, error) {
+		ioutil.WriteFile(cmd.Args[3], []byte("partial"), 0700)
+		started <- true
+		cmd.Err, cmd.Path, cmd.Args = nil, os.Args[0], []string{os.Args[0], "-test.run=TestHelperProcess"}
+		cmd.Env = append(cmd.Env, "ASTICHAT_HELPER_PROCESS=1")
+		return cmd.CombinedOutput()
+	}
+
+	// Timeout
+	var b = builder.New(builder.Configuration{BuildTimeout: 50 * time.Millisecond, ModuleRoot: dir, Version: "version", WorkingDirectoryPath: dir})
+	_, err = b.Build(context.Background(), builder.OSLinux, "bob", "device", &prv, pub)
+	<-started
+	assert.Equal(t, builder.BuildErrorCodeTimeout, err.(*builder.BuildError).Code)
+	var fs []os.FileInfo
+	fs, err = ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, fs, 0)
+
+	// Cancel
+	b = builder.New(builder.Configuration{ModuleRoot: dir, Version: "version", WorkingDirectoryPath: dir})
+	var ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+	_, err = b.Build(ctx, builder.OSLinux, "bob", "device", &prv, pub)
+	assert.Equal(t, builder.BuildErrorCodeCanceled, err.(*builder.BuildError).Code)
+	fs, err = ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, fs, 0)
+
+	// Waiting for another template to be built is canceled as well
+	_, err = b.Build(ctx, builder.OSLinux, "bob", "device", &prv, pub)
+	assert.Equal(t, builder.BuildErrorCodeCanceled, err.(*builder.BuildError).Code)
+}
+
+func TestBuilderSecrets(t *testing.T) {
+	// Init
+	// The working directory doesn't exist yet
+	var dir, err = ioutil.TempDir("", "astichat")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	var b = builder.New(builder.Configuration{ModuleRoot: dir, Version: "version", WorkingDirectoryPath: dir + "/working_directory"})
+	var prv = astichat.PrivateKey{}
+	err = prv.UnmarshalText([]byte(prvString))
+	assert.NoError(t, err)
+	var pub *astichat.PublicKey
+	pub, err = prv.PublicKey()
+	assert.NoError(t, err)
+	var cmds []*exec.Cmd
+	builder.ExecCmd = func(cmd *exec.Cmd) ([]byte, error) {
+		cmds = append(cmds, cmd)
+		return []byte{}, ioutil.WriteFile(cmd.Args[3], []byte(astichat.StampPlaceholder), 0700)
+	}
+	var id int
+	builder.RandomID = func() string {
+		id++
+		return fmt.Sprintf("random_id_%d", id)
+	}
+
+	// Loop through platforms
+	var os1 string
+	for _, p := range builder.Platforms {
+		var o string
+		o, err = b.Build(context.Background(), p.OS, "bob", "device", &prv, pub)
+		assert.NoError(t, err)
+		if os1 == "" {
+			os1 = o
+		}
+	}
+	assert.Len(t, cmds, len(builder.Platforms))
+
+	// The private key is never given to the go tool
+	for _, cmd := range cmds {
+		for _, v := range append(append(append([]string{}, cmd.Args...), cmd.Env...), cmd.Dir) {
+			assert.False(t, strings.Contains(v, prvString), v)
+			assert.False(t, strings.Contains(v, "ClientPrivateKey"), v)
+		}
+	}
+
+	// The private key is in the client which is only accessible by its owner
+	var bin []byte
+	bin, err = ioutil.ReadFile(os1)
+	assert.NoError(t, err)
+	assert.True(t, strings.Contains(string(bin), prvString))
+	var fi os.FileInfo
+	fi, err = os.Stat(os1)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+	fi, err = os.Stat(dir + "/working_directory")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+
+	// Existing files are not overwritten
+	// The linux template has been built in random_id_1 and its client has been written in random_id_2
+	id = 1
+	_, err = b.Build(context.Background(), builder.OSLinux, "bob", "device", &prv, pub)
+	assert.Error(t, err)
+}
+
+// TestHelperProcess is executed instead of the go tool by tests needing a build that never ends
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("ASTICHAT_HELPER_PROCESS") != "1" {
+		return
+	}
+	time.Sleep(time.Minute)
+	os.Exit(0)
+}
+
+func TestBuilderVersion(t *testing.T) {
+	// Configured
+	assert.Equal(t, "version", builder.New(builder.Configuration{Version: "version"}).Version())
+
+	// Build info
+	var i = &debug.BuildInfo{Main: debug.Module{Version: "(devel)"}}
+	builder.ReadBuildInfo = func() (*debug.BuildInfo, bool) { return i, true }
+	defer func() { builder.ReadBuildInfo = debug.ReadBuildInfo }()
+	assert.Equal(t, "devel", builder.New(builder.Configuration{}).Version())
+	i.Main.Version = "v1.0.0"
+	assert.Equal(t, "v1.0.0", builder.New(builder.Configuration{}).Version())
+	i.Settings = []debug.BuildSetting{{Key: "vcs.revision", Value: "revision"}}
+	assert.Equal(t, "revision", builder.New(builder.Configuration{}).Version())
+	i.Settings = append(i.Settings, debug.BuildSetting{Key: "vcs.modified", Value: "true"})
+	assert.Equal(t, "revision-dirty", builder.New(builder.Configuration{}).Version())
+}
+
+func TestConfigurationValidate(t *testing.T) {
+	// Init
+	var dir, err = ioutil.TempDir("", "astichat")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Module root is required by local builds
+	assert.EqualError(t, builder.Configuration{}.Validate(), "Module root is empty: set it to the directory of the module's go.mod so that clients can be built")
+	assert.Error(t, builder.Configuration{ModuleRoot: dir}.Validate())
+	ioutil.WriteFile(dir+"/go.mod", []byte("module github.com/asticode/go-astichat"), 0600)
+	assert.NoError(t, builder.Configuration{ModuleRoot: dir}.Validate())
+
+	// Remote builds don't need it
+	assert.NoError(t, builder.Configuration{Remote: builder.RemoteConfiguration{Addr: "https://worker"}}.Validate())
+
+	// Remote addr must use HTTPS
+	assert.EqualError(t, builder.Configuration{Remote: builder.RemoteConfiguration{Addr: "http://worker"}}.Validate(), "Remote addr http://worker doesn't use HTTPS")
+}
+
+func TestBuilderPlatforms(t *testing.T) {
+	// Init
+	var dir, err = ioutil.TempDir("", "astichat")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	var b = builder.New(builder.Configuration{ModuleRoot: dir, WorkingDirectoryPath: dir, Version: "version"})
+	var prv = astichat.PrivateKey{}
+	prv.SetPassphrase("")
+	err = prv.UnmarshalText([]byte(prvString))
+	assert.NoError(t, err)
+	var pub *astichat.PublicKey
+	pub, err = prv.PublicKey()
+	assert.NoError(t, err)
+	var envs = make(map[string]string)
+	builder.ExecCmd = func(cmd *exec.Cmd) ([]byte, error) {
+		var e []string
+		for _, v := range cmd.Env {
+			if strings.HasPrefix(v, "GOOS=") || strings.HasPrefix(v, "GOARCH=") || strings.HasPrefix(v, "GOARM=") {
+				e = append(e, v)
+			}
+		}
+		envs[cmd.Args[3]] = strings.Join(e, " ")
+		return []byte{}, ioutil.WriteFile(cmd.Args[3], []byte(astichat.StampPlaceholder), 0700)
+	}
+	var id string
+	builder.RandomID = func() string { return id }
+
+	// Loop through platforms
+	for os, env := range map[string]string{
+		builder.OSFreeBSD:     "GOOS=freebsd GOARCH=amd64",
+		builder.OSLinux:       "GOOS=linux GOARCH=amd64",
+		builder.OSLinuxARM:    "GOOS=linux GOARCH=arm GOARM=7",
+		builder.OSLinuxARM64:  "GOOS=linux GOARCH=arm64",
+		builder.OSMaxOSX:      "GOOS=darwin GOARCH=amd64",
+		builder.OSMaxOSXARM64: "GOOS=darwin GOARCH=arm64",
+		builder.OSWindows:     "GOOS=windows GOARCH=amd64",
+		builder.OSWindows32:   "GOOS=windows GOARCH=386",
+	} {
+		id = os
+		_, err = b.Build(context.Background(), os, "bob", "device", &prv, pub)
+		assert.NoError(t, err)
+		assert.Equal(t, env, envs[dir+"/"+os], os)
+	}
+	assert.Len(t, envs, len(builder.Platforms))
+
+	// Invalid OS
+	_, err = b.Build(context.Background(), "invalid", "bob", "device", &prv, pub)
+	assert.Error(t, err)
 }
 
 func TestIsValidOS(t *testing.T) {
@@ -67,5 +356,9 @@ func TestIsValidOS(t *testing.T) {
 	assert.True(t, builder.IsValidOS(builder.OSMaxOSX))
 	assert.True(t, builder.IsValidOS(builder.OSWindows))
 	assert.True(t, builder.IsValidOS(builder.OSWindows32))
+	assert.True(t, builder.IsValidOS(builder.OSLinuxARM64))
+	assert.True(t, builder.IsValidOS(builder.OSLinuxARM))
+	assert.True(t, builder.IsValidOS(builder.OSMaxOSXARM64))
+	assert.True(t, builder.IsValidOS(builder.OSFreeBSD))
 	assert.False(t, builder.IsValidOS("invalid"))
 }
@@ -1,26 +1,87 @@
 package builder
 
-import "flag"
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+)
 
 // Flags
 var (
+	ModuleRoot           = flag.String("module-root", "", "the path of the module the client is built from")
 	ServerHTTPAddr       = flag.String("server-http-addr", "", "the HTTP server addr")
+	ServerQUICAddr       = flag.String("server-quic-addr", "", "the QUIC server addr")
 	ServerUDPAddr        = flag.String("server-ud-addr", "", "the UDP server addr")
 	WorkingDirectoryPath = flag.String("working-directory", "", "the working directory path")
 )
 
 // Configuration represents a configuration
+// Built clients are artifacts kept in the working directory until they're downloaded or they expire
 type Configuration struct {
-	ServerHTTPAddr       string `toml:"server_http_addr"`
-	ServerUDPAddr        string `toml:"server_udp_addr"`
-	WorkingDirectoryPath string `toml:"working_directory_path"`
+	ArtifactTTL          time.Duration        `toml:"artifact_ttl"`
+	BuildTimeout         time.Duration        `toml:"build_timeout"` // Go builds exceeding it are killed
+	GoCache              string               `toml:"go_cache"`
+	ModuleRoot           string               `toml:"module_root"`  // Directory containing the go.mod and go.sum files, and optionally the vendor directory. Required by local builds.
+	PollTimeout          time.Duration        `toml:"poll_timeout"` // Jobs that are not polled for longer are canceled, disabled if 0
+	QueueSize            int                  `toml:"queue_size"`
+	Remote               RemoteConfiguration  `toml:"remote"`
+	ServerHTTPAddr       string               `toml:"server_http_addr"`
+	ServerQUICAddr       string               `toml:"server_quic_addr"`
+	ServerUDPAddr        string               `toml:"server_udp_addr"`
+	SigningKey           *astichat.PrivateKey `toml:"signing_key"` // Artifacts are not signed if empty
+	Version              string               `toml:"version"`     // Overrides the version read from the build info
+	WorkingDirectoryPath string               `toml:"working_directory_path"`
+	Workers              int                  `toml:"workers"`
 }
 
 // FlagConfig returns a configuration based on flags
 func FlagConfig() Configuration {
 	return Configuration{
+		ModuleRoot:           *ModuleRoot,
 		ServerHTTPAddr:       *ServerHTTPAddr,
+		ServerQUICAddr:       *ServerQUICAddr,
 		ServerUDPAddr:        *ServerUDPAddr,
 		WorkingDirectoryPath: *WorkingDirectoryPath,
 	}
 }
+
+// Validate checks that templates can be built or fetched with the configuration
+// Local builds need the module the client is built from: the go tool runs in readonly mode and can't build without its
+// go.mod and go.sum
+func (c Configuration) Validate() error {
+	// Templates are fetched from a worker
+	// Templates end up in signed clients, therefore they must not go through the network in clear
+	if c.Remote.Addr != "" {
+		if u, err := url.Parse(c.Remote.Addr); err != nil {
+			return fmt.Errorf("%s while parsing remote addr %s", err, c.Remote.Addr)
+		} else if u.Scheme != "https" {
+			return fmt.Errorf("Remote addr %s doesn't use HTTPS", c.Remote.Addr)
+		}
+		return nil
+	}
+
+	// Module root is required
+	if c.ModuleRoot == "" {
+		return errors.New("Module root is empty: set it to the directory of the module's go.mod so that clients can be built")
+	}
+
+	// Module root has a go.mod
+	if _, err := os.Stat(filepath.Join(c.ModuleRoot, "go.mod")); err != nil {
+		return fmt.Errorf("%s while checking the go.mod of module root %s", err, c.ModuleRoot)
+	}
+	return nil
+}
+
+// RemoteConfiguration represents the configuration of the worker building the templates of a remote builder
+type RemoteConfiguration struct {
+	Addr            string        `toml:"addr"` // Must use HTTPS
+	MaxTemplateSize int64         `toml:"max_template_size"`
+	Secret          string        `toml:"secret"` // Shared with the worker which authenticates templates with it
+	Timeout         time.Duration `toml:"timeout"`
+}
@@ -0,0 +1,47 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+)
+
+// Build error codes
+const (
+	BuildErrorCodeCanceled = "canceled"
+	BuildErrorCodeFailed   = "failed"
+	BuildErrorCodeTimeout  = "timeout"
+)
+
+// BuildError represents an error that occurred while building a template
+// Its message doesn't contain the output of the go tool since it may disclose paths and sources of the build host: the
+// output must only be logged
+type BuildError struct {
+	Code   string
+	Err    error
+	OS     string
+	Output string
+}
+
+// newBuildError creates a new build error whose code depends on the context the build was executed with
+func newBuildError(ctx context.Context, outputOS string, err error, output []byte) *BuildError {
+	var e = &BuildError{Code: BuildErrorCodeFailed, Err: err, OS: outputOS, Output: string(output)}
+	switch ctx.Err() {
+	case context.Canceled:
+		e.Code = BuildErrorCodeCanceled
+	case context.DeadlineExceeded:
+		e.Code = BuildErrorCodeTimeout
+	}
+	return e
+}
+
+// Error implements the error interface
+func (e *BuildError) Error() string {
+	var s = "has failed"
+	switch e.Code {
+	case BuildErrorCodeCanceled:
+		s = "has been canceled"
+	case BuildErrorCodeTimeout:
+		s = "has timed out"
+	}
+	return fmt.Sprintf("Build for os %s %s: %s", e.OS, s, e.Err)
+}
@@ -0,0 +1,45 @@
+package builder
+
+// OS
+const (
+	OSFreeBSD     = "freebsd"
+	OSLinux       = "linux"
+	OSLinuxARM    = "linux_arm"
+	OSLinuxARM64  = "linux_arm64"
+	OSMaxOSX      = "macosx"
+	OSMaxOSXARM64 = "macosx_arm64"
+	OSWindows     = "windows"
+	OSWindows32   = "windows_32"
+)
+
+// Platform represents a platform the client can be built for
+type Platform struct {
+	Extension string // Extension of the binary, including the dot
+	GOARCH    string
+	GOARM     string
+	GOOS      string
+	Name      string // Name displayed to users
+	OS        string // Identifier of the platform sent by users
+}
+
+// Platforms are the platforms the client can be built for, in the order they're displayed to users
+var Platforms = []Platform{
+	{GOARCH: "amd64", GOOS: "linux", Name: "Linux", OS: OSLinux},
+	{GOARCH: "arm64", GOOS: "linux", Name: "Linux ARM 64 bits", OS: OSLinuxARM64},
+	{GOARCH: "arm", GOARM: "7", GOOS: "linux", Name: "Linux ARM (Raspberry Pi)", OS: OSLinuxARM},
+	{GOARCH: "amd64", GOOS: "darwin", Name: "Mac OSX Intel", OS: OSMaxOSX},
+	{GOARCH: "arm64", GOOS: "darwin", Name: "Mac OSX Apple Silicon", OS: OSMaxOSXARM64},
+	{Extension: ".exe", GOARCH: "amd64", GOOS: "windows", Name: "Windows", OS: OSWindows},
+	{Extension: ".exe", GOARCH: "386", GOOS: "windows", Name: "Windows 32 bits", OS: OSWindows32},
+	{GOARCH: "amd64", GOOS: "freebsd", Name: "FreeBSD", OS: OSFreeBSD},
+}
+
+// PlatformByOS returns the platform of an OS identifier
+func PlatformByOS(os string) (p Platform, ok bool) {
+	for _, p = range Platforms {
+		if p.OS == os {
+			return p, true
+		}
+	}
+	return Platform{}, false
+}
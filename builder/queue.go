@@ -0,0 +1,330 @@
+package builder
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/asticode/go-astilog"
+)
+
+// Job statuses
+const (
+	JobStatusBuilding = "building"
+	JobStatusDone     = "done"
+	JobStatusFailed   = "failed"
+	JobStatusQueued   = "queued"
+)
+
+// Errors
+var (
+	ErrQueueClosed = errors.New("queue is closed")
+	ErrQueueFull   = errors.New("queue is full")
+)
+
+// errJobAbandoned is the error of the jobs that have been abandoned
+const errJobAbandoned = "Download has been abandoned"
+
+// GenerateJobID allows testing functions using it
+// Job ids give access to the artifacts, which are private keys, therefore they must not be guessable
+var GenerateJobID = func() (id string, err error) {
+	var b = make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	id = hex.EncodeToString(b)
+	return
+}
+
+// JobFunc builds an artifact
+// The context is canceled when the queue is closed or when the job is abandoned
+type JobFunc func(ctx context.Context) (a Artifact, err error)
+
+// Job represents a build job
+// A job is abandoned when it hasn't been polled for longer than the poll timeout while queued or building
+type Job struct {
+	abandoned bool
+	Artifact  *Artifact `json:"artifact,omitempty"`
+	cancel    context.CancelFunc
+	CreatedAt time.Time `json:"created_at"`
+	ctx       context.Context
+	Error     string `json:"error,omitempty"`
+	fn        JobFunc
+	ID        string `json:"id"`
+	polledAt  time.Time
+	Status    string    `json:"status"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Queue executes build jobs with a bounded number of workers and keeps their artifacts until they expire
+type Queue struct {
+	c       Configuration
+	cancel  context.CancelFunc
+	channel chan *Job
+	closed  bool
+	ctx     context.Context
+	jobs    map[string]*Job // Indexed by id
+	Logger  astilog.Logger
+	mutex   *sync.Mutex
+	quit    chan bool
+	wg      *sync.WaitGroup
+}
+
+// NewQueue creates a new queue
+func NewQueue(c Configuration) *Queue {
+	var ctx, cancel = context.WithCancel(context.Background())
+	return &Queue{
+		c:       c,
+		cancel:  cancel,
+		channel: make(chan *Job, c.QueueSize),
+		ctx:     ctx,
+		jobs:    make(map[string]*Job),
+		Logger:  astilog.NopLogger(),
+		mutex:   &sync.Mutex{},
+		quit:    make(chan bool),
+		wg:      &sync.WaitGroup{},
+	}
+}
+
+// Start starts the workers and the cleaner
+func (q *Queue) Start() {
+	// Workers
+	for i := 0; i < q.c.Workers; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for j := range q.channel {
+				q.execute(j)
+			}
+		}()
+	}
+
+	// Cleaner
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		var t = time.NewTicker(q.cleanInterval())
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				q.Clean()
+			case <-q.quit:
+				return
+			}
+		}
+	}()
+}
+
+// cleanInterval returns the interval between 2 cleanings
+// Abandoned jobs are detected by the cleaner, therefore it must run at least once per poll timeout
+func (q *Queue) cleanInterval() (d time.Duration) {
+	d = time.Minute
+	for _, v := range []time.Duration{q.c.ArtifactTTL, q.c.PollTimeout} {
+		if v > 0 && v < d {
+			d = v
+		}
+	}
+	return
+}
+
+// Close stops accepting jobs, fails the queued ones and cancels the ones being built
+func (q *Queue) Close() {
+	q.mutex.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.channel)
+		close(q.quit)
+		q.cancel()
+	}
+	q.mutex.Unlock()
+	q.wg.Wait()
+}
+
+// Enqueue adds a job to the queue
+func (q *Queue) Enqueue(fn JobFunc) (j Job, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// Queue is closed
+	if q.closed {
+		err = ErrQueueClosed
+		return
+	}
+
+	// Generate id
+	// A predictable id must never be issued
+	var id string
+	if id, err = GenerateJobID(); err != nil {
+		err = fmt.Errorf("%s while generating job id", err)
+		return
+	}
+
+	// Create job
+	var now = astichat.TimeNow()
+	var pj = &Job{
+		CreatedAt: now,
+		fn:        fn,
+		ID:        id,
+		polledAt:  now,
+		Status:    JobStatusQueued,
+		UpdatedAt: now,
+	}
+	pj.ctx, pj.cancel = context.WithCancel(q.ctx)
+
+	// Add job
+	select {
+	case q.channel <- pj:
+		q.jobs[pj.ID] = pj
+		j = *pj
+	default:
+		pj.cancel()
+		err = ErrQueueFull
+	}
+	return
+}
+
+// Get returns a job based on its id
+func (q *Queue) Get(id string) (j Job, ok bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var pj *Job
+	if pj, ok = q.jobs[id]; ok {
+		j = *pj
+	}
+	return
+}
+
+// Poll returns a job based on its id and keeps it from being abandoned
+func (q *Queue) Poll(id string) (j Job, ok bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var pj *Job
+	if pj, ok = q.jobs[id]; ok {
+		pj.polledAt = astichat.TimeNow()
+		j = *pj
+	}
+	return
+}
+
+// Remove removes a job and its artifact
+func (q *Queue) Remove(id string) (err error) {
+	// Delete job
+	q.mutex.Lock()
+	var j, ok = q.jobs[id]
+	delete(q.jobs, id)
+	q.mutex.Unlock()
+
+	// Remove artifact
+	if ok && j.Artifact != nil {
+		err = os.Remove(j.Artifact.Path)
+	}
+	return
+}
+
+// update updates a job
+func (q *Queue) update(j *Job, fn func(j *Job)) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	fn(j)
+	j.UpdatedAt = astichat.TimeNow()
+}
+
+// execute executes a job
+func (q *Queue) execute(j *Job) {
+	defer j.cancel()
+
+	// Queue has been closed or the job has been abandoned while the job was waiting
+	q.mutex.Lock()
+	var closed, abandoned = q.closed, j.abandoned
+	q.mutex.Unlock()
+	if closed {
+		q.update(j, func(j *Job) {
+			j.Error = "Server is shutting down"
+			j.Status = JobStatusFailed
+		})
+		return
+	} else if abandoned {
+		q.update(j, func(j *Job) {
+			j.Error = errJobAbandoned
+			j.Status = JobStatusFailed
+		})
+		return
+	}
+
+	// Build
+	q.update(j, func(j *Job) { j.Status = JobStatusBuilding })
+	var a, err = j.fn(j.ctx)
+	q.update(j, func(j *Job) {
+		if err != nil {
+			j.Error = err.Error()
+			if j.abandoned {
+				j.Error = errJobAbandoned
+			}
+			j.Status = JobStatusFailed
+			return
+		}
+		j.Artifact = &a
+		j.Status = JobStatusDone
+	})
+}
+
+// Clean cancels the jobs that have been abandoned and removes the jobs and artifacts that have expired, as well as the
+// artifacts left in the working directory by a previous run
+func (q *Queue) Clean() {
+	var now = astichat.TimeNow()
+
+	// Loop through jobs
+	var ps = make(map[string]bool)
+	q.mutex.Lock()
+	for id, j := range q.jobs {
+		if (j.Status == JobStatusQueued || j.Status == JobStatusBuilding) && q.c.PollTimeout > 0 && !j.abandoned && now.Sub(j.polledAt) > q.c.PollTimeout {
+			q.Logger.Debugf("Canceling job %s which hasn't been polled since %s", id, j.polledAt)
+			j.abandoned = true
+			j.cancel()
+		}
+		if j.Status == JobStatusDone || j.Status == JobStatusFailed {
+			if now.Sub(j.UpdatedAt) > q.c.ArtifactTTL {
+				delete(q.jobs, id)
+				if j.Artifact != nil {
+					if err := os.Remove(j.Artifact.Path); err != nil && !os.IsNotExist(err) {
+						q.Logger.Errorf("%s while removing artifact %s", err, j.Artifact.Path)
+					}
+				}
+				continue
+			}
+		}
+		if j.Artifact != nil {
+			ps[j.Artifact.Path] = true
+		}
+	}
+	q.mutex.Unlock()
+
+	// Read working directory
+	var fs []os.FileInfo
+	var err error
+	if fs, err = ioutil.ReadDir(q.c.WorkingDirectoryPath); err != nil {
+		q.Logger.Errorf("%s while reading working directory %s", err, q.c.WorkingDirectoryPath)
+		return
+	}
+
+	// Loop through files
+	// Templates are kept
+	for _, f := range fs {
+		var p = fmt.Sprintf("%s/%s", q.c.WorkingDirectoryPath, f.Name())
+		if f.IsDir() || ps[p] || strings.HasPrefix(f.Name(), templatePrefix) || now.Sub(f.ModTime()) <= q.c.ArtifactTTL {
+			continue
+		}
+		if err = os.Remove(p); err != nil {
+			q.Logger.Errorf("%s while removing %s", err, p)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package builder_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/asticode/go-astichat/builder"
+	"github.com/stretchr/testify/assert"
+)
+
+// waitJob waits for a job to reach a status
+func waitJob(t *testing.T, q *builder.Queue, id, status string) (j builder.Job) {
+	var ok bool
+	for i := 0; i < 100; i++ {
+		if j, ok = q.Get(id); ok && j.Status == status {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s didn't reach status %s", id, status)
+	return
+}
+
+func TestQueue(t *testing.T) {
+	// Init
+	var dir, err = ioutil.TempDir("", "astichat")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	var now = time.Now()
+	astichat.TimeNow = func() time.Time { return now }
+	defer func() { astichat.TimeNow = time.Now }()
+	var q = builder.NewQueue(builder.Configuration{ArtifactTTL: time.Hour, QueueSize: 1, WorkingDirectoryPath: dir, Workers: 1})
+	q.Start()
+	defer q.Close()
+
+	// Enqueue jobs
+	// The first job blocks the only worker so that the second one stays in the queue
+	var block = make(chan bool)
+	var j1 builder.Job
+	j1, err = q.Enqueue(func(ctx context.Context) (builder.Artifact, error) {
+		<-block
+		return builder.Artifact{Path: dir + "/artifact"}, ioutil.WriteFile(dir+"/artifact", []byte("artifact"), 0600)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, builder.JobStatusQueued, j1.Status)
+	waitJob(t, q, j1.ID, builder.JobStatusBuilding)
+	var j2 builder.Job
+	j2, err = q.Enqueue(func(ctx context.Context) (builder.Artifact, error) { return builder.Artifact{}, errors.New("failed") })
+	assert.NoError(t, err)
+	_, err = q.Enqueue(func(ctx context.Context) (builder.Artifact, error) { return builder.Artifact{}, nil })
+	assert.Equal(t, builder.ErrQueueFull, err)
+	var j builder.Job
+	j, _ = q.Get(j2.ID)
+	assert.Equal(t, builder.JobStatusQueued, j.Status)
+	_, ok := q.Get("invalid")
+	assert.False(t, ok)
+
+	// Unblock
+	close(block)
+	j = waitJob(t, q, j1.ID, builder.JobStatusDone)
+	assert.Equal(t, dir+"/artifact", j.Artifact.Path)
+	j = waitJob(t, q, j2.ID, builder.JobStatusFailed)
+	assert.Equal(t, "failed", j.Error)
+
+	// Clean
+	// Templates and artifacts of jobs that have not expired yet are kept, files left by a previous run are removed
+	ioutil.WriteFile(dir+"/template-linux-version", []byte("template"), 0600)
+	ioutil.WriteFile(dir+"/previous_run", []byte("artifact"), 0600)
+	os.Chtimes(dir+"/previous_run", now.Add(-2*time.Hour), now.Add(-2*time.Hour))
+	q.Clean()
+	var fs []os.FileInfo
+	fs, err = ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, fs, 2)
+	_, ok = q.Get(j1.ID)
+	assert.True(t, ok)
+
+	// Expire
+	now = now.Add(2 * time.Hour)
+	q.Clean()
+	_, ok = q.Get(j1.ID)
+	assert.False(t, ok)
+	_, ok = q.Get(j2.ID)
+	assert.False(t, ok)
+	fs, err = ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, fs, 1)
+
+	// Remove
+	var j3 builder.Job
+	j3, err = q.Enqueue(func(ctx context.Context) (builder.Artifact, error) {
+		return builder.Artifact{Path: dir + "/artifact"}, ioutil.WriteFile(dir+"/artifact", []byte("artifact"), 0600)
+	})
+	assert.NoError(t, err)
+	waitJob(t, q, j3.ID, builder.JobStatusDone)
+	assert.NoError(t, q.Remove(j3.ID))
+	_, ok = q.Get(j3.ID)
+	assert.False(t, ok)
+	_, err = os.Stat(dir + "/artifact")
+	assert.True(t, os.IsNotExist(err))
+
+	// Job id can't be generated
+	var generateJobID = builder.GenerateJobID
+	builder.GenerateJobID = func() (string, error) { return "", errors.New("no entropy") }
+	defer func() { builder.GenerateJobID = generateJobID }()
+	_, err = q.Enqueue(func(ctx context.Context) (builder.Artifact, error) { return builder.Artifact{}, nil })
+	assert.EqualError(t, err, "no entropy while generating job id")
+
+	// Closed
+	q.Close()
+	_, err = q.Enqueue(func(ctx context.Context) (builder.Artifact, error) { return builder.Artifact{}, nil })
+	assert.Equal(t, builder.ErrQueueClosed, err)
+}
+
+func TestQueueClose(t *testing.T) {
+	// Init
+	var q = builder.NewQueue(builder.Configuration{QueueSize: 1, Workers: 1})
+	q.Start()
+
+	// Jobs being built are canceled
+	var j, err = q.Enqueue(func(ctx context.Context) (builder.Artifact, error) {
+		<-ctx.Done()
+		return builder.Artifact{}, ctx.Err()
+	})
+	assert.NoError(t, err)
+	waitJob(t, q, j.ID, builder.JobStatusBuilding)
+	q.Close()
+	j, _ = q.Get(j.ID)
+	assert.Equal(t, builder.JobStatusFailed, j.Status)
+	assert.Equal(t, context.Canceled.Error(), j.Error)
+}
+
+func TestQueueAbandoned(t *testing.T) {
+	// Init
+	var now = time.Now()
+	var mutex = &sync.Mutex{}
+	astichat.TimeNow = func() time.Time {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return now
+	}
+	defer func() { astichat.TimeNow = time.Now }()
+	var q = builder.NewQueue(builder.Configuration{PollTimeout: time.Minute, QueueSize: 1, Workers: 1})
+	q.Start()
+	defer q.Close()
+
+	// Enqueue jobs
+	// The first job blocks the only worker so that the second one stays in the queue
+	var canceled = make(chan bool)
+	var j1, err = q.Enqueue(func(ctx context.Context) (builder.Artifact, error) {
+		<-ctx.Done()
+		close(canceled)
+		return builder.Artifact{}, ctx.Err()
+	})
+	assert.NoError(t, err)
+	waitJob(t, q, j1.ID, builder.JobStatusBuilding)
+	var j2 builder.Job
+	j2, err = q.Enqueue(func(ctx context.Context) (builder.Artifact, error) {
+		t.Error("abandoned job has been executed")
+		return builder.Artifact{}, nil
+	})
+	assert.NoError(t, err)
+
+	// Polled jobs are not canceled
+	mutex.Lock()
+	now = now.Add(50 * time.Second)
+	mutex.Unlock()
+	_, ok := q.Poll(j1.ID)
+	assert.True(t, ok)
+	mutex.Lock()
+	now = now.Add(50 * time.Second)
+	mutex.Unlock()
+	q.Clean()
+	j, _ := q.Get(j1.ID)
+	assert.Equal(t, builder.JobStatusBuilding, j.Status)
+
+	// Jobs that are not polled anymore are canceled, whether they're building or queued
+	mutex.Lock()
+	now = now.Add(time.Hour)
+	mutex.Unlock()
+	q.Clean()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatal("abandoned job has not been canceled")
+	}
+	j = waitJob(t, q, j1.ID, builder.JobStatusFailed)
+	assert.Equal(t, "Download has been abandoned", j.Error)
+	j = waitJob(t, q, j2.ID, builder.JobStatusFailed)
+	assert.Equal(t, "Download has been abandoned", j.Error)
+}
@@ -0,0 +1,171 @@
+package builder
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Worker protocol
+// The remote builder fetches the template of an OS with GET /templates/<os>?version=<version> and the secret as a
+// bearer token over HTTPS. The worker answers with the template binary, authenticated by the hex HMAC-SHA256 of the OS,
+// the version and the template keyed with the secret in the X-Template-Signature header, or with a text error and the
+// following status codes:
+//   - 400 if the OS is invalid
+//   - 401 if the secret is invalid
+//   - 409 if the worker doesn't build the requested version
+//   - 500 if the build has failed
+//   - 503 if the build has been canceled
+//   - 504 if the build has timed out
+const (
+	defaultMaxTemplateSize  = 256 << 20
+	headerTemplateSignature = "X-Template-Signature"
+	workerPathTemplates     = "/templates/"
+)
+
+// templateMAC returns the hash authenticating the template of an OS and a version
+func templateMAC(secret, outputOS, version string) (h hash.Hash) {
+	h = hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(outputOS + "\n" + version + "\n"))
+	return
+}
+
+// Remote represents a builder fetching templates from a worker
+// Only templates, which contain no secret, go through the network: clients are stamped, packaged and signed locally
+type Remote struct {
+	*base
+	addr            string
+	httpClient      *http.Client
+	maxTemplateSize int64
+	secret          string
+}
+
+// NewRemoteHTTPClient allows testing functions using it
+var NewRemoteHTTPClient = func(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout}
+}
+
+// NewRemote returns a new remote builder
+// The remote addr must have been validated
+func NewRemote(c Configuration) *Remote {
+	var b = &Remote{
+		base:            newBase(c),
+		addr:            strings.TrimSuffix(c.Remote.Addr, "/"),
+		httpClient:      NewRemoteHTTPClient(c.Remote.Timeout),
+		maxTemplateSize: c.Remote.MaxTemplateSize,
+		secret:          c.Remote.Secret,
+	}
+	b.base.template = b.Template
+	if b.maxTemplateSize <= 0 {
+		b.maxTemplateSize = defaultMaxTemplateSize
+	}
+	return b
+}
+
+// Template returns the path of the template binary of an OS and fetches it from the worker if it doesn't exist yet
+// The worker stops building the template if the context is done
+func (b *Remote) Template(ctx context.Context, outputOS string) (o string, err error) {
+	// OS is valid
+	if _, ok := PlatformByOS(outputOS); !ok {
+		err = fmt.Errorf("Invalid os %s", outputOS)
+		return
+	}
+
+	// Lock so that the template is fetched only once
+	var unlock func()
+	if unlock, err = b.lockTemplates(ctx, outputOS); err != nil {
+		return
+	}
+	defer unlock()
+
+	// Template already exists
+	o = b.templatePath(outputOS)
+	if _, err = os.Stat(o); err == nil {
+		return
+	} else if !os.IsNotExist(err) {
+		return
+	}
+
+	// Create request
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodGet, b.addr+workerPathTemplates+outputOS+"?version="+url.QueryEscape(b.version), nil); err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer "+b.secret)
+
+	// Send request
+	var resp *http.Response
+	if resp, err = b.httpClient.Do(req); err != nil {
+		if ctx.Err() != nil {
+			err = newBuildError(ctx, outputOS, err, nil)
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	// Worker has failed
+	if resp.StatusCode != http.StatusOK {
+		var msg, _ = ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("Worker %s returned status code %d: %s", b.addr, resp.StatusCode, strings.TrimSpace(string(msg)))
+		switch resp.StatusCode {
+		case http.StatusInternalServerError:
+			err = &BuildError{Code: BuildErrorCodeFailed, Err: err, OS: outputOS}
+		case http.StatusServiceUnavailable:
+			err = &BuildError{Code: BuildErrorCodeCanceled, Err: err, OS: outputOS}
+		case http.StatusGatewayTimeout:
+			err = &BuildError{Code: BuildErrorCodeTimeout, Err: err, OS: outputOS}
+		}
+		return
+	}
+
+	// Write template
+	// The template is written in a temporary path so that a failed download doesn't leave a broken template behind
+	// One more byte than the max size is read so that oversized templates are detected
+	var path = fmt.Sprintf("%s/%s", b.workingDirectoryPath, RandomID())
+	var h = templateMAC(b.secret, outputOS, b.version)
+	var r = &io.LimitedReader{R: io.TeeReader(resp.Body, h), N: b.maxTemplateSize + 1}
+	if err = writeFile(path, r); err != nil {
+		if ctx.Err() != nil {
+			err = newBuildError(ctx, outputOS, err, nil)
+		}
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	// Check size
+	if r.N <= 0 {
+		err = fmt.Errorf("Template returned by worker %s exceeds %d bytes", b.addr, b.maxTemplateSize)
+		return
+	}
+
+	// Authenticate template
+	// Otherwise a tampered template would be stamped and signed as a legitimate client
+	if sig, errDecode := hex.DecodeString(resp.Header.Get(headerTemplateSignature)); errDecode != nil || !hmac.Equal(sig, h.Sum(nil)) {
+		err = fmt.Errorf("Template returned by worker %s has an invalid signature", b.addr)
+		return
+	}
+
+	// The template has been built when the worker has last modified it
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		os.Chtimes(path, t, t)
+	}
+
+	// Template is ready
+	o, err = b.templateReady(outputOS, path)
+	return
+}
@@ -0,0 +1,119 @@
+package builder
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/asticode/go-astilog"
+)
+
+// Worker serves the templates built by a local builder to remote builders
+type Worker struct {
+	b      *Local
+	Logger astilog.Logger
+	secret string
+}
+
+// NewWorker creates a new worker
+func NewWorker(b *Local, secret string) *Worker {
+	return &Worker{
+		b:      b,
+		Logger: astilog.NopLogger(),
+		secret: secret,
+	}
+}
+
+// ServeHTTP implements the http.Handler interface
+func (w *Worker) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	// Check method and path
+	if r.Method != http.MethodGet || !strings.HasPrefix(r.URL.Path, workerPathTemplates) {
+		http.NotFound(rw, r)
+		return
+	}
+
+	// Check secret
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+w.secret)) != 1 {
+		w.Logger.Errorf("Invalid secret from %s", r.RemoteAddr)
+		http.Error(rw, "Invalid secret", http.StatusUnauthorized)
+		return
+	}
+
+	// Check OS
+	var outputOS = strings.TrimPrefix(r.URL.Path, workerPathTemplates)
+	if !IsValidOS(outputOS) {
+		http.Error(rw, "Invalid OS", http.StatusBadRequest)
+		return
+	}
+
+	// Check version
+	// Remote builders must not mix up versions
+	if v := r.URL.Query().Get("version"); v != w.b.version {
+		w.Logger.Errorf("Version %s requested by %s doesn't match version %s", v, r.RemoteAddr, w.b.version)
+		http.Error(rw, "Worker builds version "+w.b.version, http.StatusConflict)
+		return
+	}
+
+	// Build template
+	// The build is canceled if the remote builder goes away
+	var p, err = w.b.Template(r.Context(), outputOS)
+	if err != nil {
+		w.Logger.Errorf("%s while building template for os %s", err, outputOS)
+		var code, msg = http.StatusInternalServerError, "Build has failed"
+		if e, ok := err.(*BuildError); ok {
+			if e.Output != "" {
+				w.Logger.Errorf("Output of the build for os %s: %s", outputOS, e.Output)
+			}
+			switch e.Code {
+			case BuildErrorCodeCanceled:
+				code, msg = http.StatusServiceUnavailable, "Build has been canceled"
+			case BuildErrorCodeTimeout:
+				code, msg = http.StatusGatewayTimeout, "Build has timed out"
+			}
+		}
+		http.Error(rw, msg, code)
+		return
+	}
+
+	// Open template
+	var f *os.File
+	if f, err = os.Open(p); err != nil {
+		w.Logger.Errorf("%s while opening template %s", err, p)
+		http.Error(rw, "Build has failed", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// Stat template
+	var fi os.FileInfo
+	if fi, err = f.Stat(); err != nil {
+		w.Logger.Errorf("%s while stating template %s", err, p)
+		http.Error(rw, "Build has failed", http.StatusInternalServerError)
+		return
+	}
+
+	// Sign template
+	var h = templateMAC(w.secret, outputOS, w.b.version)
+	if _, err = io.Copy(h, f); err != nil {
+		w.Logger.Errorf("%s while signing template %s", err, p)
+		http.Error(rw, "Build has failed", http.StatusInternalServerError)
+		return
+	} else if _, err = f.Seek(0, io.SeekStart); err != nil {
+		w.Logger.Errorf("%s while seeking template %s", err, p)
+		http.Error(rw, "Build has failed", http.StatusInternalServerError)
+		return
+	}
+
+	// Write
+	// The modification time is forwarded so that clients know when their template has been built
+	rw.Header().Set("Content-Type", contentTypeBinary)
+	rw.Header().Set(headerTemplateSignature, hex.EncodeToString(h.Sum(nil)))
+	rw.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+	if _, err = io.Copy(rw, f); err != nil {
+		w.Logger.Errorf("%s while writing template %s", err, p)
+		return
+	}
+}
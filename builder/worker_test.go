@@ -0,0 +1,148 @@
+package builder_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/asticode/go-astichat/builder"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorker(t *testing.T) {
+	// Init
+	var dir, err = ioutil.TempDir("", "astichat")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	os.Mkdir(dir+"/worker", 0700)
+	os.Mkdir(dir+"/server", 0700)
+	var count int
+	var builtAt = time.Date(2017, 1, 1, 3, 4, 5, 0, time.UTC)
+	builder.ExecCmd = func(cmd *exec.Cmd) ([]byte, error) {
+		count++
+		if err := ioutil.WriteFile(cmd.Args[3], []byte("header"+astichat.StampPlaceholder+"footer"), 0700); err != nil {
+			return nil, err
+		}
+		return []byte{}, os.Chtimes(cmd.Args[3], builtAt, builtAt)
+	}
+	var buildID = builder.BuildID
+	builder.BuildID = func() string { return "build" }
+	defer func() { builder.BuildID = buildID }()
+	var id int
+	builder.RandomID = func() string {
+		id++
+		return fmt.Sprintf("random_id_%d", id)
+	}
+	var w = builder.NewWorker(builder.NewLocal(builder.Configuration{WorkingDirectoryPath: dir + "/worker", Version: "version"}), "secret")
+	var reqs []string
+	var s = httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var b, _ = httputil.DumpRequest(r, true)
+		reqs = append(reqs, string(b))
+		w.ServeHTTP(rw, r)
+	}))
+	defer s.Close()
+	var newRemoteHTTPClient = builder.NewRemoteHTTPClient
+	builder.NewRemoteHTTPClient = func(timeout time.Duration) *http.Client { return s.Client() }
+	defer func() { builder.NewRemoteHTTPClient = newRemoteHTTPClient }()
+	var c = builder.Configuration{Remote: builder.RemoteConfiguration{Addr: s.URL, Secret: "secret"}, ServerHTTPAddr: "server_http_addr", Version: "version", WorkingDirectoryPath: dir + "/server"}
+	var b = builder.New(c)
+	_, ok := b.(*builder.Remote)
+	assert.True(t, ok)
+	var prv = astichat.PrivateKey{}
+	err = prv.UnmarshalText([]byte(prvString))
+	assert.NoError(t, err)
+	var pub *astichat.PublicKey
+	pub, err = prv.PublicKey()
+	assert.NoError(t, err)
+
+	// Build
+	// The template is built by the worker and stamped by the remote builder
+	var o string
+	o, err = b.Build(context.Background(), builder.OSLinux, "bob", "device", &prv, pub)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	assert.True(t, strings.HasPrefix(o, dir+"/server/"))
+	var bin []byte
+	bin, err = ioutil.ReadFile(o)
+	assert.NoError(t, err)
+	var st astichat.Stamp
+	st, err = astichat.ParseStamp(string(bin[len("header") : len("header")+astichat.StampSize]))
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", st.Username)
+	assert.Equal(t, "server_http_addr", st.ServerHTTPAddr)
+	assert.Equal(t, builtAt, st.Build.BuiltAt)
+	_, err = os.Stat(dir + "/server/template-linux-version-build")
+	assert.NoError(t, err)
+
+	// Private key is never sent to the worker
+	assert.Len(t, reqs, 1)
+	assert.False(t, strings.Contains(reqs[0], prvString))
+	assert.True(t, strings.Contains(string(bin), prvString))
+
+	// Template is only fetched once
+	_, err = b.Build(context.Background(), builder.OSLinux, "alice", "device", &prv, pub)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// Package
+	var a builder.Artifact
+	a, err = b.Package(o, builder.OSLinux, "bob", builder.PackageFormatNone)
+	assert.NoError(t, err)
+	assert.Equal(t, "astichat-bob-version-linux", a.Filename)
+
+	// Invalid secret
+	c.Remote.Secret = "invalid"
+	_, err = builder.New(c).Build(context.Background(), builder.OSWindows, "bob", "device", &prv, pub)
+	assert.EqualError(t, err, "Worker "+s.URL+" returned status code 401: Invalid secret")
+
+	// Invalid version
+	c.Remote.Secret = "secret"
+	c.Version = "other_version"
+	_, err = builder.New(c).Build(context.Background(), builder.OSWindows, "bob", "device", &prv, pub)
+	assert.EqualError(t, err, "Worker "+s.URL+" returned status code 409: Worker builds version version")
+
+	// Failed build
+	c.Version = "version"
+	builder.ExecCmd = func(cmd *exec.Cmd) ([]byte, error) { return []byte("output"), os.ErrInvalid }
+	_, err = builder.New(c).Build(context.Background(), builder.OSWindows, "bob", "device", &prv, pub)
+	assert.EqualError(t, err, "Build for os windows has failed: Worker "+s.URL+" returned status code 500: Build has failed")
+	_, err = os.Stat(dir + "/server/template-windows-version-build")
+	assert.True(t, os.IsNotExist(err))
+
+	// Template exceeds the max size
+	builder.ExecCmd = func(cmd *exec.Cmd) ([]byte, error) {
+		return []byte{}, ioutil.WriteFile(cmd.Args[3], []byte("header"+astichat.StampPlaceholder+"footer"), 0700)
+	}
+	c.Remote.MaxTemplateSize = 10
+	_, err = builder.New(c).Build(context.Background(), builder.OSWindows, "bob", "device", &prv, pub)
+	assert.EqualError(t, err, "Template returned by worker "+s.URL+" exceeds 10 bytes")
+	_, err = os.Stat(dir + "/server/template-windows-version-build")
+	assert.True(t, os.IsNotExist(err))
+
+	// Template has been tampered with
+	c.Remote.MaxTemplateSize = 0
+	var ts = httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var rec = httptest.NewRecorder()
+		w.ServeHTTP(rec, r)
+		for k, v := range rec.HeaderMap {
+			rw.Header()[k] = v
+		}
+		rw.Write(append(rec.Body.Bytes(), []byte("backdoor")...))
+	}))
+	defer ts.Close()
+	builder.NewRemoteHTTPClient = func(timeout time.Duration) *http.Client { return ts.Client() }
+	c.Remote.Addr = ts.URL
+	_, err = builder.New(c).Build(context.Background(), builder.OSWindows, "bob", "device", &prv, pub)
+	assert.EqualError(t, err, "Template returned by worker "+ts.URL+" has an invalid signature")
+	_, err = os.Stat(dir + "/server/template-windows-version-build")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -3,9 +3,11 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -19,33 +21,63 @@ import (
 
 // Client represents a client
 type Client struct {
-	channelQuit     chan bool
-	httpClient      *http.Client
-	logger          astilog.Logger
-	now             *astichat.Now
-	peerPool        *astichat.PeerPool
-	privateKey      *astichat.PrivateKey
-	server          *astiudp.Server
-	serverHTTPAddr  string
-	serverPublicKey *astichat.PublicKey
-	serverUDPAddr   *net.UDPAddr
-	startedAt       time.Time
-	username        string
-	version         string
+	channelConnected       chan bool
+	channelQuit            chan bool
+	deviceID               string
+	fallbackTimeout        time.Duration
+	fellBack               bool
+	fragmenter             *astichat.Fragmenter
+	heartbeatInterval      time.Duration
+	httpClient             *http.Client
+	logger                 astilog.Logger
+	mutex                  *sync.Mutex
+	now                    *astichat.Now
+	pathFinder             *astichat.PathFinder
+	peerPool               *astichat.PeerPool
+	pingNonces             []string // Nonces of the last pings
+	privateKey             *astichat.PrivateKey
+	quic                   astichat.QUICConfiguration
+	reconnectConfiguration ConfigurationReconnect
+	relay                  *astichat.RelayTransport
+	reliable               *astichat.Reliable
+	sent                   map[string]string // Text of the messages sent indexed by ID
+	sentIDs                []string
+	server                 *astiudp.Server
+	serverHTTPAddr         string
+	serverPublicKey        *astichat.PublicKey
+	serverQUICAddr         string
+	serverUDPAddr          *net.UDPAddr
+	stamp                  astichat.Stamp
+	startedAt              time.Time
+	state                  string
+	stdout                 io.Writer
+	terminalState          *terminal.State
+	transport              string
+	typingPrintThrottler   *astichat.Throttler
+	typingThrottler        *astichat.Throttler
+	unread                 map[string]string // ID of the last unread message indexed by peer key
+	username               string
 }
 
 // NewClient returns a new client
-func NewClient(l astilog.Logger) *Client {
+func NewClient(l astilog.Logger, s astichat.Stamp) *Client {
 	l.Debug("Starting client")
 	return &Client{
-		channelQuit: make(chan bool),
-		httpClient:  &http.Client{Timeout: 5 * time.Second},
-		logger:      l,
-		peerPool:    astichat.NewPeerPool(),
-		server:      astiudp.NewServer(),
-		startedAt:   time.Now(),
-		username:    Username,
-		version:     Version,
+		channelConnected: make(chan bool, 1),
+		channelQuit:      make(chan bool),
+		deviceID:         s.DeviceID,
+		httpClient:       &http.Client{Timeout: 5 * time.Second},
+		logger:           l,
+		mutex:            &sync.Mutex{},
+		peerPool:         astichat.NewPeerPool(),
+		sent:             make(map[string]string),
+		server:           astiudp.NewServer(),
+		stamp:            s,
+		startedAt:        time.Now(),
+		state:            stateConnecting,
+		stdout:           os.Stdout,
+		unread:           make(map[string]string),
+		username:         s.Username,
 	}
 }
 
@@ -57,18 +89,56 @@ func (cl *Client) Init(c Configuration) (err error) {
 		return
 	}
 
-	// Set up server listeners
-	cl.server.SetListener(astiudp.EventNameStart, cl.HandleStart())
-	cl.server.SetListener(astichat.EventNamePeerDisconnected, cl.HandlePeerDisconnected())
-	cl.server.SetListener(astichat.EventNamePeerConnected, cl.HandlePeerConnected())
-	cl.server.SetListener(astichat.EventNamePeerJoined, cl.HandlePeerJoined())
-	cl.server.SetListener(astichat.EventNamePeerTyped, cl.HandlePeerTyped())
-
 	// Resolve server addr
-	cl.serverHTTPAddr = ServerHTTPAddr
-	if cl.serverUDPAddr, err = net.ResolveUDPAddr("udp4", ServerUDPAddr); err != nil {
+	// The server may be reached over IPv4 or IPv6 since the client listens on both
+	cl.serverHTTPAddr = cl.stamp.ServerHTTPAddr
+	cl.serverQUICAddr = cl.stamp.ServerQUICAddr
+	if cl.serverUDPAddr, err = net.ResolveUDPAddr("udp", cl.stamp.ServerUDPAddr); err != nil {
+		return
+	}
+
+	// Init transport
+	switch c.Transport {
+	case transportQUIC, transportStream, transportUDP:
+		cl.transport = c.Transport
+	default:
+		err = fmt.Errorf("Invalid transport %s", c.Transport)
 		return
 	}
+	cl.quic = c.QUIC
+
+	// Init typing throttlers
+	// Peers are notified at most once per interval and received notifications are printed at most once per interval
+	cl.typingPrintThrottler = astichat.NewThrottler(c.TypingInterval)
+	cl.typingThrottler = astichat.NewThrottler(c.TypingInterval)
+
+	// Init relay, fragmenter, reliable and path finder
+	// Events go through the relay so that the client can fall back to a stream conn when UDP is blocked
+	cl.fallbackTimeout = c.FallbackTimeout
+	cl.heartbeatInterval = c.HeartbeatInterval
+	cl.reconnectConfiguration = c.Reconnect
+	cl.relay = astichat.NewRelayTransport(cl.server, cl.serverUDPAddr)
+	cl.relay.Logger = cl.logger
+	cl.fragmenter = astichat.NewFragmenter(cl.relay, c.Fragmenter)
+	cl.reliable = astichat.NewReliable(cl.fragmenter, c.Reliable)
+	cl.pathFinder = astichat.NewPathFinder(c.PathFinder)
+
+	// Set up server listeners
+	cl.server.SetListener(astiudp.EventNameStart, cl.HandleStart())
+	cl.fragmenter.SetListener(astichat.EventNameAck, cl.reliable.HandleAck())
+	cl.fragmenter.SetListener(astichat.EventNameMessageDelivered, cl.reliable.Listen(cl.HandleMessageDelivered()))
+	cl.fragmenter.SetListener(astichat.EventNameMessageQueued, cl.reliable.Listen(cl.HandleMessageQueued()))
+	cl.fragmenter.SetListener(astichat.EventNamePeerDisconnected, cl.reliable.Listen(cl.HandlePeerDisconnected()))
+	cl.fragmenter.SetListener(astichat.EventNamePeerConnected, cl.reliable.Listen(cl.HandlePeerConnected()))
+	cl.fragmenter.SetListener(astichat.EventNamePeerJoined, cl.reliable.Listen(cl.HandlePeerJoined()))
+	cl.fragmenter.SetListener(astichat.EventNamePeerMessaged, cl.reliable.Listen(cl.HandlePeerMessaged()))
+	cl.fragmenter.SetListener(astichat.EventNamePeerProbe, cl.HandlePeerProbe())
+	cl.fragmenter.SetListener(astichat.EventNamePeerProbed, cl.HandlePeerProbed())
+	cl.fragmenter.SetListener(astichat.EventNamePeerRead, cl.reliable.Listen(cl.HandlePeerRead()))
+	cl.fragmenter.SetListener(astichat.EventNamePeerTyped, cl.reliable.Listen(cl.HandlePeerTyped()))
+	cl.fragmenter.SetListener(astichat.EventNamePeerTyping, cl.HandlePeerTyping())
+	cl.fragmenter.SetListener(astichat.EventNamePeerUnknown, cl.HandlePeerUnknown())
+	cl.fragmenter.SetListener(astichat.EventNameServerShutdown, cl.reliable.Listen(cl.HandleServerShutdown()))
 
 	// We're getting the hour from the server and incrementing it manually so that we don't have to trust local
 	// time that could be modified by the user
@@ -86,13 +156,13 @@ func (cl *Client) Init(c Configuration) (err error) {
 	cl.privateKey.SetPassphrase(string(bytes.TrimSpace(b)))
 
 	// Unmarshal client's private key
-	if err = cl.privateKey.UnmarshalText([]byte(ClientPrivateKey)); err != nil {
+	if err = cl.privateKey.UnmarshalText([]byte(cl.stamp.ClientPrivateKey)); err != nil {
 		return
 	}
 
 	// Unmarshal server's public key
 	cl.serverPublicKey = &astichat.PublicKey{}
-	if err = cl.serverPublicKey.UnmarshalText([]byte(ServerPublicKey)); err != nil {
+	if err = cl.serverPublicKey.UnmarshalText([]byte(cl.stamp.ServerPublicKey)); err != nil {
 		return
 	}
 
@@ -105,6 +175,9 @@ func (cl *Client) Init(c Configuration) (err error) {
 func (c *Client) Close() {
 	c.Disconnect()
 	c.server.Close()
+	if c.terminalState != nil {
+		terminal.Restore(int(os.Stdin.Fd()), c.terminalState)
+	}
 	c.logger.Debug("Stopping client")
 }
 
@@ -121,8 +194,15 @@ func (c *Client) HandleSignals() {
 }
 
 // Stop stops the client
+// It may be called several times, for instance on both Ctrl+C and a signal
 func (c *Client) Stop() {
-	close(c.channelQuit)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	select {
+	case <-c.channelQuit:
+	default:
+		close(c.channelQuit)
+	}
 }
 
 // Wait is a blocking pattern
@@ -134,3 +214,12 @@ func (c *Client) Wait() {
 		}
 	}
 }
+
+// newBody creates a new body on behalf of the client's device
+func (c *Client) newBody(msg []byte, pubDst *astichat.PublicKey) (b astichat.Body, err error) {
+	if b, err = astichat.NewBody(msg, c.now.Time(), c.username, pubDst); err != nil {
+		return
+	}
+	b.Request.Device = c.deviceID
+	return
+}
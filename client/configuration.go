@@ -2,8 +2,10 @@ package main
 
 import (
 	"flag"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/asticode/go-astichat/astichat"
 	"github.com/asticode/go-astilog"
 	"github.com/imdario/mergo"
 	"github.com/rs/xlog"
@@ -11,14 +13,43 @@ import (
 
 // Flags
 var (
-	configPath = flag.String("c", "", "the config path")
-	listenAddr = flag.String("l", "", "the listen addr")
+	configPath  = flag.String("c", "", "the config path")
+	device      = flag.String("device", "", "the device id revoked by the revoke subcommand")
+	fingerprint = flag.String("fingerprint", "", "the fingerprint of the signing key used by the verify subcommand, as published by the server's operator")
+	jsonOutput  = flag.Bool("json", false, "whether the version subcommand prints the build metadata as JSON")
+	listenAddr  = flag.String("l", "", "the listen addr")
+	signature   = flag.String("signature", "", "the signature path used by the verify subcommand, defaults to the binary path followed by .sig")
+	transport   = flag.String("t", "", "the transport (udp, stream or quic)")
+)
+
+// Transports
+const (
+	transportQUIC   = "quic"
+	transportStream = "stream"
+	transportUDP    = "udp"
 )
 
 // Configuration represents a configuration
 type Configuration struct {
-	ListenAddr string                `toml:"listen_addr"`
-	Logger     astilog.Configuration `toml:"logger"`
+	FallbackTimeout   time.Duration                    `toml:"fallback_timeout"`
+	Fragmenter        astichat.FragmenterConfiguration `toml:"fragmenter"`
+	HeartbeatInterval time.Duration                    `toml:"heartbeat_interval"`
+	ListenAddr        string                           `toml:"listen_addr"`
+	Logger            astilog.Configuration            `toml:"logger"`
+	PathFinder        astichat.PathFinderConfiguration `toml:"path_finder"`
+	QUIC              astichat.QUICConfiguration       `toml:"quic"`
+	Reconnect         ConfigurationReconnect           `toml:"reconnect"`
+	Reliable          astichat.ReliableConfiguration   `toml:"reliable"`
+	Transport         string                           `toml:"transport"`
+	TypingInterval    time.Duration                    `toml:"typing_interval"`
+}
+
+// ConfigurationReconnect represents a reconnect configuration
+// The delay between attempts doubles after each attempt until it reaches the max backoff
+type ConfigurationReconnect struct {
+	Backoff     time.Duration `toml:"backoff"`
+	MaxAttempts int           `toml:"max_attempts"`
+	MaxBackoff  time.Duration `toml:"max_backoff"`
 }
 
 // TOMLDecodeFile allows testing functions using it
@@ -30,10 +61,32 @@ var TOMLDecodeFile = func(fpath string, v interface{}) (toml.MetaData, error) {
 func NewConfiguration() Configuration {
 	// Global config
 	var gc = Configuration{
-		ListenAddr: ":",
+		FallbackTimeout: 5 * time.Second,
+		Fragmenter: astichat.FragmenterConfiguration{
+			ChunkSize:      768,
+			MaxBufferSize:  4 << 20,
+			MaxPayloadSize: 1 << 20,
+			Timeout:        10 * time.Second,
+		},
+		HeartbeatInterval: 15 * time.Second,
+		ListenAddr:        ":",
 		Logger: astilog.Configuration{
 			AppName: "go-astichat-client",
 		},
+		PathFinder: astichat.PathFinderConfiguration{
+			Interval:    500 * time.Millisecond,
+			MaxAttempts: 3,
+		},
+		QUIC: astichat.QUICConfiguration{
+			KeepAlivePeriod: 15 * time.Second,
+		},
+		Reconnect: ConfigurationReconnect{
+			Backoff:     time.Second,
+			MaxAttempts: 10,
+			MaxBackoff:  time.Minute,
+		},
+		Transport:      transportUDP,
+		TypingInterval: 3 * time.Second,
 	}
 
 	// Local config
@@ -48,6 +101,7 @@ func NewConfiguration() Configuration {
 	var c = Configuration{
 		ListenAddr: *listenAddr,
 		Logger:     astilog.FlagConfig(),
+		Transport:  *transport,
 	}
 
 	// Merge configs
@@ -13,7 +13,7 @@ import (
 func (c *Client) sendHTTP(method, pattern string, msg []byte) (o []byte, err error) {
 	// Create new body
 	var b astichat.Body
-	if b, err = astichat.NewBody(msg, c.now.Time(), Username, c.serverPublicKey); err != nil {
+	if b, err = c.newBody(msg, c.serverPublicKey); err != nil {
 		return
 	}
 
@@ -52,6 +52,19 @@ func (c *Client) sendHTTP(method, pattern string, msg []byte) (o []byte, err err
 
 // Now generates a new now
 func (c *Client) Now() (now *astichat.Now, err error) {
+	// Get server time
+	var t time.Time
+	if t, err = c.serverTime(); err != nil {
+		return
+	}
+
+	// Create now
+	now = astichat.NewNow(t)
+	return
+}
+
+// serverTime fetches the server time
+func (c *Client) serverTime() (t time.Time, err error) {
 	// Create request
 	var req *http.Request
 	if req, err = http.NewRequest(http.MethodGet, c.serverHTTPAddr+"/now", nil); err != nil {
@@ -66,13 +79,9 @@ func (c *Client) Now() (now *astichat.Now, err error) {
 	defer resp.Body.Close()
 
 	// Unmarshal
-	var t time.Time
 	if err = json.NewDecoder(resp.Body).Decode(&t); err != nil {
 		return
 	}
-
-	// Create now
-	now = astichat.NewNow(t)
 	return
 }
 
@@ -90,3 +99,60 @@ func (c *Client) Token() (o string, err error) {
 	}
 	return
 }
+
+// Queue queues an end-to-end encrypted message on the server for an offline chatterer
+func (c *Client) Queue(username string, msg []byte) (err error) {
+	// Fetch recipient's devices
+	var b []byte
+	if b, err = c.sendHTTP(http.MethodPost, "/public_keys", []byte(username)); err != nil {
+		return
+	}
+	var ds []astichat.Device
+	if err = json.Unmarshal(b, &ds); err != nil {
+		return
+	}
+
+	// Encrypt message for each of the recipient's devices
+	var r = astichat.MessageRequest{Messages: make(map[string]astichat.EncryptedMessage), Notify: true, Recipient: username}
+	for _, d := range ds {
+		if r.Messages[d.ID], err = astichat.NewEncryptedMessage(msg, d.ClientPublicKey); err != nil {
+			return
+		}
+	}
+
+	// Marshal
+	if b, err = json.Marshal(r); err != nil {
+		return
+	}
+
+	// Send
+	if _, err = c.sendHTTP(http.MethodPost, "/messages", b); err != nil {
+		return
+	}
+	return
+}
+
+// Devices returns the IDs of the chatterer's devices
+func (c *Client) Devices() (o []string, err error) {
+	// Send
+	var b []byte
+	if b, err = c.sendHTTP(http.MethodPost, "/public_keys", []byte(c.username)); err != nil {
+		return
+	}
+
+	// Unmarshal
+	var ds []astichat.Device
+	if err = json.Unmarshal(b, &ds); err != nil {
+		return
+	}
+	for _, d := range ds {
+		o = append(o, d.ID)
+	}
+	return
+}
+
+// Revoke revokes one of the chatterer's devices
+func (c *Client) Revoke(device string) (err error) {
+	_, err = c.sendHTTP(http.MethodPost, "/devices/revoke", []byte(device))
+	return
+}
@@ -1,24 +1,26 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"time"
 
+	"github.com/asticode/go-astichat/astichat"
 	"github.com/asticode/go-astilog"
 	"github.com/asticode/go-astitools/flag"
 )
 
 // LDFlags
 var (
-	ClientPrivateKey string
-	ServerHTTPAddr   string
-	ServerPublicKey  string
-	ServerUDPAddr    string
-	Username         string
-	Version          string
+	Version string
 )
 
+// stamp is the region of the template binary where the builder writes the user specific values
+var stamp = astichat.StampPlaceholder
+
 // TODO Use UI instead + think about go-mobile
 // TODO One should be able to choose between client-2-server or client-2-client connections
 // TODO Remove the configuration via flags and force using the UI
@@ -33,12 +35,47 @@ func main() {
 	// Init logger
 	var l = astilog.New(c.Logger)
 
+	// Parse stamp
+	// The binary is refused if it has been tampered with
+	var st, err = astichat.ParseStamp(stamp)
+	if err != nil {
+		l.Fatal(err)
+	}
+
+	// Print version
+	// Build metadata is printed as JSON if requested
+	if s == "version" {
+		if !*jsonOutput {
+			printVersion(os.Stdout, st.Build)
+			return
+		}
+		var e = json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		if err = e.Encode(st.Build); err != nil {
+			l.Fatal(err)
+		}
+		return
+	}
+
+	// Verify the binary
+	// It doesn't need the client to be initialized so that it can be run before trusting the binary with the passphrase
+	if s == "verify" {
+		var path string
+		if path, err = os.Executable(); err != nil {
+			l.Fatal(err)
+		}
+		if err = verify(path, st, *signature, *fingerprint); err != nil {
+			l.Fatal(err)
+		}
+		fmt.Fprintln(os.Stdout, "Binary has been signed by", st.ServerHTTPAddr)
+		return
+	}
+
 	// Create client
-	var cl = NewClient(l)
+	var cl = NewClient(l, st)
 	defer cl.Close()
 
 	// Init client
-	var err error
 	if err = cl.Init(c); err != nil {
 		l.Fatal(err)
 	}
@@ -48,6 +85,22 @@ func main() {
 
 	// Switch on subcommand
 	switch s {
+	case "devices":
+		var ds []string
+		if ds, err = cl.Devices(); err != nil {
+			l.Fatal(err)
+		}
+		for _, d := range ds {
+			if d == cl.deviceID {
+				d += " (current)"
+			}
+			fmt.Fprintln(os.Stdout, d)
+		}
+	case "revoke":
+		if err = cl.Revoke(*device); err != nil {
+			l.Fatal(err)
+		}
+		fmt.Fprintln(os.Stdout, "Device", *device, "has been revoked")
 	case "token":
 		var token string
 		if token, err = cl.Token(); err != nil {
@@ -56,8 +109,6 @@ func main() {
 		fmt.Fprintln(os.Stdout, token)
 	case "username":
 		fmt.Fprintln(os.Stdout, cl.username)
-	case "version":
-		fmt.Fprintln(os.Stdout, cl.version)
 	default:
 		// Listen and read
 		go cl.server.ListenAndRead()
@@ -66,3 +117,25 @@ func main() {
 		cl.Wait()
 	}
 }
+
+// printVersion prints the key fields of the build metadata
+// The version set with ldflags is printed if the binary has not been stamped with one
+func printVersion(w io.Writer, b astichat.BuildInfo) {
+	var v = b.Version
+	if v == "" {
+		v = Version
+	}
+	fmt.Fprintf(w, "Version: %s\n", v)
+	if b.Commit != "" {
+		fmt.Fprintf(w, "Commit: %s\n", b.Commit)
+	}
+	if !b.BuiltAt.IsZero() {
+		fmt.Fprintf(w, "Built at: %s\n", b.BuiltAt.Format(time.RFC3339))
+	}
+	if b.Platform != "" {
+		fmt.Fprintf(w, "Platform: %s\n", b.Platform)
+	}
+	if b.KeyFingerprint != "" {
+		fmt.Fprintf(w, "Key fingerprint: %s\n", b.KeyFingerprint)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintVersion(t *testing.T) {
+	// Stamped binary
+	var buf = &bytes.Buffer{}
+	printVersion(buf, astichat.BuildInfo{
+		BuiltAt:        time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC),
+		Commit:         "commit",
+		KeyFingerprint: "fingerprint",
+		Platform:       "linux/amd64",
+		Version:        "version",
+	})
+	assert.Equal(t, "Version: version\nCommit: commit\nBuilt at: 2017-01-02T03:04:05Z\nPlatform: linux/amd64\nKey fingerprint: fingerprint\n", buf.String())
+
+	// Binary stamped without build metadata
+	defer func(v string) { Version = v }(Version)
+	Version = "ldflags"
+	buf.Reset()
+	printVersion(buf, astichat.BuildInfo{})
+	assert.Equal(t, "Version: ldflags\n", buf.String())
+}
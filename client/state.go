@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/asticode/go-astiudp"
+)
+
+// States
+const (
+	stateConnected    = "connected"
+	stateConnecting   = "connecting"
+	stateOffline      = "offline"
+	stateReconnecting = "reconnecting"
+)
+
+// Max number of ping nonces remembered
+const maxPingNonces = 3
+
+// setState sets the connection state
+func (c *Client) setState(s string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.logger.Debugf("Switching from state %s to state %s", c.state, s)
+	c.state = s
+}
+
+// getState returns the connection state
+func (c *Client) getState() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.state
+}
+
+// lost is called when the client has detected that the server can't be reached anymore
+func (c *Client) lost() {
+	if s := c.getState(); s == stateConnected || s == stateConnecting {
+		go c.reconnect()
+	}
+}
+
+// reconnect re-authenticates with the server with an exponential backoff until the client is connected
+func (c *Client) reconnect() {
+	// Client is already reconnecting
+	c.mutex.Lock()
+	if c.state == stateReconnecting {
+		c.mutex.Unlock()
+		return
+	}
+	c.logger.Debugf("Switching from state %s to state %s", c.state, stateReconnecting)
+	c.state = stateReconnecting
+	c.mutex.Unlock()
+	fmt.Fprintln(c.stdout, "Connection to the server has been lost, reconnecting...")
+
+	// Drain previous connections
+	select {
+	case <-c.channelConnected:
+	default:
+	}
+
+	// Loop through attempts
+	var delay = c.reconnectConfiguration.Backoff
+	for attempt := 1; attempt <= c.reconnectConfiguration.MaxAttempts; attempt++ {
+		// Attempt
+		c.logger.Debugf("Reconnecting to the server, attempt #%d", attempt)
+		if err := c.reconnectAttempt(); err != nil {
+			c.logger.Errorf("%s while reconnecting to the server", err)
+		}
+
+		// Wait
+		select {
+		case <-c.channelConnected:
+			return
+		case <-c.channelQuit:
+			return
+		case <-time.After(delay):
+		}
+
+		// Back off
+		if delay *= 2; delay > c.reconnectConfiguration.MaxBackoff {
+			delay = c.reconnectConfiguration.MaxBackoff
+		}
+	}
+
+	// Client is offline
+	c.setState(stateOffline)
+	fmt.Fprintln(c.stdout, "You're now offline, restart the client to reconnect")
+}
+
+// reconnectAttempt re-fetches the time and sends peer.connect again
+func (c *Client) reconnectAttempt() (err error) {
+	// The server may have moved in time, or the client may have been asleep
+	var t time.Time
+	if t, err = c.serverTime(); err != nil {
+		return
+	}
+	c.now.Set(t)
+
+	// Open transport
+	if err = c.open(); err != nil {
+		return
+	}
+
+	// Connect
+	return c.connect()
+}
+
+// heartbeat pings the server periodically so that loss of the server is detected
+func (c *Client) heartbeat() {
+	var t = time.NewTicker(c.heartbeatInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.channelQuit:
+			return
+		case <-t.C:
+			// Only ping when connected
+			if c.getState() != stateConnected {
+				continue
+			}
+
+			// Ping
+			c.ping()
+		}
+	}
+}
+
+// ping sends peer.ping to the server
+func (c *Client) ping() {
+	// Generate nonce
+	var p astichat.Ping
+	var err error
+	if p.Nonce, err = c.newPingNonce(); err != nil {
+		c.logger.Errorf("%s while generating ping nonce", err)
+		return
+	}
+
+	// Marshal
+	var msg []byte
+	if msg, err = json.Marshal(p); err != nil {
+		c.logger.Errorf("%s while marshaling ping", err)
+		return
+	}
+
+	// Create body
+	var b astichat.Body
+	if b, err = c.newBody(msg, c.serverPublicKey); err != nil {
+		c.logger.Errorf("%s while creating ping body", err)
+		return
+	}
+
+	// Write
+	c.logger.Debugf("Sending peer.ping to %s", c.serverUDPAddr)
+	if err = c.reliable.Write(astichat.EventNamePeerPing, b, c.serverUDPAddr, func(err error) {
+		if err != nil {
+			c.lost()
+		}
+	}); err != nil {
+		c.logger.Errorf("%s while sending peer.ping", err)
+		c.lost()
+	}
+}
+
+// newPingNonce generates the nonce of a ping and remembers it
+func (c *Client) newPingNonce() (n string, err error) {
+	// Generate
+	var b = make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	n = hex.EncodeToString(b)
+
+	// Remember
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.pingNonces = append(c.pingNonces, n)
+	if len(c.pingNonces) > maxPingNonces {
+		c.pingNonces = c.pingNonces[1:]
+	}
+	return
+}
+
+// pinged checks whether the nonce has been sent in one of the last pings
+func (c *Client) pinged(n string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, pn := range c.pingNonces {
+		if pn == n {
+			return true
+		}
+	}
+	return false
+}
+
+// HandlePeerUnknown handles the peer.unknown event
+func (c *Client) HandlePeerUnknown() astiudp.ListenerFunc {
+	return func(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) (err error) {
+		// Only the server knows its peers
+		if addr.String() != c.serverUDPAddr.String() {
+			err = fmt.Errorf("%s received from %s which is not the server", eventName, addr)
+			return
+		}
+
+		// Unmarshal
+		var b astichat.Body
+		if err = json.Unmarshal(payload, &b); err != nil {
+			return
+		}
+
+		// Process body
+		var msg []byte
+		if msg, err = b.Process(c.now.Time(), c.privateKey); err != nil {
+			return
+		}
+
+		// Unmarshal
+		var p astichat.Ping
+		if err = json.Unmarshal(msg, &p); err != nil {
+			return
+		}
+
+		// Only the server can decrypt pings, so peer.unknown is authentic if it contains the nonce of a recent ping
+		if p.Nonce == "" || !c.pinged(p.Nonce) {
+			err = fmt.Errorf("%s contains an unknown ping nonce", eventName)
+			return
+		}
+
+		// The server has most likely restarted
+		c.lost()
+		return
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/stretchr/testify/assert"
+)
+
+// newNowServer creates an HTTP server returning its time
+func newNowServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(rw).Encode(time.Now())
+	}))
+}
+
+// waitFor waits for a condition to be true
+func waitFor(t *testing.T, fn func() bool) {
+	var deadline = time.Now().Add(5 * time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition is not true in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// filter returns the writes of an event
+func filter(ws []write, eventName string) (o []write) {
+	for _, w := range ws {
+		if w.eventName == eventName {
+			o = append(o, w)
+		}
+	}
+	return
+}
+
+// serverPayload creates the payload of an event sent by the server to the client
+func serverPayload(t *testing.T, c *Client, v interface{}) []byte {
+	var _, pub = testKey(t)
+	var msg, err = json.Marshal(v)
+	assert.NoError(t, err)
+	var b astichat.Body
+	b, err = astichat.NewBody(msg, c.now.Time(), "", pub)
+	assert.NoError(t, err)
+	var payload []byte
+	payload, err = json.Marshal(b)
+	assert.NoError(t, err)
+	return payload
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	// Init
+	var c, tr = newTestClient(t)
+	defer c.server.Close()
+	var ts = newNowServer()
+	defer ts.Close()
+	c.serverHTTPAddr = ts.URL
+	c.reconnectConfiguration = ConfigurationReconnect{Backoff: 100 * time.Millisecond, MaxAttempts: 3, MaxBackoff: 150 * time.Millisecond}
+	c.setState(stateConnected)
+
+	// Reconnect
+	c.reconnect()
+
+	// Delay doubles until it reaches the max backoff
+	var ws = filter(tr.flush(), astichat.EventNamePeerConnect)
+	assert.Len(t, ws, 3)
+	if len(ws) == 3 {
+		assert.True(t, ws[1].at.Sub(ws[0].at) >= 100*time.Millisecond)
+		assert.True(t, ws[2].at.Sub(ws[1].at) >= 150*time.Millisecond)
+		assert.True(t, ws[2].at.Sub(ws[1].at) < 200*time.Millisecond)
+	}
+
+	// Client is offline once all attempts have failed
+	assert.Equal(t, stateOffline, c.getState())
+	assert.Equal(t, "Connection to the server has been lost, reconnecting...\nYou're now offline, restart the client to reconnect\n", c.stdout.(*bytes.Buffer).String())
+}
+
+func TestReconnectAfterShutdown(t *testing.T) {
+	// Init
+	var c, tr = newTestClient(t)
+	defer c.server.Close()
+	defer c.Stop()
+	var ts = newNowServer()
+	defer ts.Close()
+	c.serverHTTPAddr = ts.URL
+	c.reconnectConfiguration = ConfigurationReconnect{Backoff: 50 * time.Millisecond, MaxAttempts: 100, MaxBackoff: 50 * time.Millisecond}
+	c.setState(stateConnected)
+	addPeer(t, c, "bob", "d2", 1)
+
+	// Server shuts down
+	assert.NoError(t, c.HandleServerShutdown()(nil, astichat.EventNameServerShutdown, serverPayload(t, c, astichat.Shutdown{ReconnectAfter: 100 * time.Millisecond}), c.serverUDPAddr))
+	assert.Equal(t, stateOffline, c.getState())
+	assert.Len(t, c.peerPool.Peers(), 0)
+
+	// Client reconnects after the delay requested by the server
+	waitFor(t, func() bool { return c.getState() == stateReconnecting })
+	waitFor(t, func() bool { return len(filter(tr.flush(), astichat.EventNamePeerConnect)) > 0 })
+
+	// A peer is left over from before the reconnection
+	addPeer(t, c, "bob", "d2", 1)
+
+	// Pool is rebuilt from scratch once connected
+	var carol = astichat.NewPeer(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}, "carol", astichat.Device{ID: "d3"})
+	carol.Relayed = true
+	assert.NoError(t, c.HandlePeerConnected()(nil, astichat.EventNamePeerConnected, serverPayload(t, c, []*astichat.Peer{carol}), c.serverUDPAddr))
+	assert.Equal(t, stateConnected, c.getState())
+	var ps = c.peerPool.Peers()
+	assert.Len(t, ps, 1)
+	if len(ps) == 1 {
+		assert.Equal(t, "carol", ps[0].Username)
+	}
+
+	// Client stops reconnecting
+	time.Sleep(100 * time.Millisecond)
+	tr.flush()
+	time.Sleep(200 * time.Millisecond)
+	assert.Len(t, filter(tr.flush(), astichat.EventNamePeerConnect), 0)
+}
+
+func TestHandlePeerUnknown(t *testing.T) {
+	// Init
+	var c, tr = newTestClient(t)
+	defer c.server.Close()
+	defer c.Stop()
+	var ts = newNowServer()
+	defer ts.Close()
+	c.serverHTTPAddr = ts.URL
+	c.reconnectConfiguration = ConfigurationReconnect{Backoff: time.Minute, MaxAttempts: 1, MaxBackoff: time.Minute}
+	c.setState(stateConnected)
+	var l = c.HandlePeerUnknown()
+
+	// Ping
+	c.ping()
+	var ws = filter(tr.flush(), astichat.EventNamePeerPing)
+	assert.Len(t, ws, 1)
+	var p astichat.Packet
+	assert.NoError(t, json.Unmarshal(ws[0].payload, &p))
+	var b astichat.Body
+	assert.NoError(t, json.Unmarshal(p.Payload, &b))
+	var prv, _ = testKey(t)
+	var msg, err = b.Process(c.now.Time(), prv)
+	assert.NoError(t, err)
+	var ping astichat.Ping
+	assert.NoError(t, json.Unmarshal(msg, &ping))
+	assert.NotEqual(t, "", ping.Nonce)
+
+	// Only the server knows its peers
+	err = l(nil, astichat.EventNamePeerUnknown, serverPayload(t, c, ping), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	assert.Error(t, err)
+
+	// peer.unknown must be encrypted for the client
+	err = l(nil, astichat.EventNamePeerUnknown, []byte("null"), c.serverUDPAddr)
+	assert.Error(t, err)
+
+	// peer.unknown must answer a recent ping
+	err = l(nil, astichat.EventNamePeerUnknown, serverPayload(t, c, astichat.Ping{Nonce: "invalid"}), c.serverUDPAddr)
+	assert.Error(t, err)
+	err = l(nil, astichat.EventNamePeerUnknown, serverPayload(t, c, astichat.Ping{}), c.serverUDPAddr)
+	assert.Error(t, err)
+	assert.Equal(t, stateConnected, c.getState())
+
+	// Client reconnects
+	err = l(nil, astichat.EventNamePeerUnknown, serverPayload(t, c, ping), c.serverUDPAddr)
+	assert.NoError(t, err)
+	waitFor(t, func() bool { return c.getState() == stateReconnecting })
+}
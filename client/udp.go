@@ -2,31 +2,141 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/asticode/go-astichat/astichat"
 	"github.com/asticode/go-astiudp"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 // HandleStart handles the start event
 func (c *Client) HandleStart() astiudp.ListenerFunc {
 	return func(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) (err error) {
-		// Create body
-		var b astichat.Body
-		if b, err = astichat.NewBody(astichat.MessageConnect, c.now.Time(), c.username, c.serverPublicKey); err != nil {
+		// Detect loss of the server
+		go c.heartbeat()
+
+		// Open transport
+		c.setState(stateConnecting)
+		if err = c.open(); err != nil {
+			fmt.Fprintf(c.stdout, "Server could not be reached over %s\n", c.transport)
+			c.lost()
 			return
 		}
+		return c.connect()
+	}
+}
 
-		// Write
-		c.logger.Debugf("Sending peer.connect to %s", c.serverUDPAddr)
-		if err = s.Write(astichat.EventNamePeerConnect, b, c.serverUDPAddr); err != nil {
-			return
+// open opens the stream conn of the configured transport if it's not opened yet
+// UDP doesn't need anything since it uses the client's server unless the client has fallen back to a stream conn
+func (c *Client) open() (err error) {
+	// Stream conn is already opened
+	if c.relay.Streaming() {
+		return
+	}
+
+	// Dial
+	c.mutex.Lock()
+	var fellBack = c.fellBack
+	c.mutex.Unlock()
+	var sc *astichat.StreamConn
+	switch {
+	case c.transport == transportQUIC:
+		sc, err = astichat.DialQUIC(c.serverQUICAddr, c.quic, c.httpClient.Timeout)
+	case c.transport == transportStream || fellBack:
+		sc, err = astichat.DialStream(c.serverHTTPAddr, c.httpClient.Timeout)
+	}
+	if err != nil {
+		return
+	} else if sc != nil {
+		c.relay.SetStream(sc)
+	}
+	return
+}
+
+// connect sends peer.connect to the server and falls back to a stream conn if the client is not connected in time
+func (c *Client) connect() (err error) {
+	// Create body
+	var b astichat.Body
+	if b, err = c.newBody(c.connectMessage(), c.serverPublicKey); err != nil {
+		return
+	}
+
+	// Write
+	var streaming = c.relay.Streaming()
+	c.logger.Debugf("Sending peer.connect to %s", c.serverUDPAddr)
+	if err = c.reliable.Write(astichat.EventNamePeerConnect, b, c.serverUDPAddr, func(err error) {
+		if err != nil {
+			if streaming {
+				c.lost()
+				return
+			}
+			c.fallback()
 		}
+	}); err != nil {
 		return
 	}
+
+	// Fall back if peer.connected doesn't arrive in time
+	if !streaming {
+		time.AfterFunc(c.fallbackTimeout, c.fallback)
+	}
+	return
+}
+
+// fallback switches to a stream conn on the HTTP server for networks that block UDP
+func (c *Client) fallback() {
+	// Client is already connected or has already fallen back
+	c.mutex.Lock()
+	if c.state == stateConnected || c.fellBack {
+		c.mutex.Unlock()
+		return
+	}
+	c.fellBack = true
+	c.mutex.Unlock()
+
+	// Dial
+	c.logger.Debugf("peer.connected didn't arrive in time, falling back to a stream conn on %s", c.serverHTTPAddr)
+	var sc *astichat.StreamConn
+	var err error
+	if sc, err = astichat.DialStream(c.serverHTTPAddr, c.httpClient.Timeout); err != nil {
+		c.logger.Errorf("%s while dialing stream conn on %s", err, c.serverHTTPAddr)
+		c.lost()
+		return
+	}
+	c.relay.SetStream(sc)
+
+	// Connect
+	if err = c.connect(); err != nil {
+		c.logger.Errorf("%s while connecting through stream conn", err)
+	}
+}
+
+// connectMessage returns the connect message advertising the candidate addrs the client can be reached at and its
+// build metadata
+func (c *Client) connectMessage() []byte {
+	// Get candidate addrs
+	var cm = astichat.Connect{Build: &c.stamp.Build}
+	var err error
+	if cm.Addrs, err = astichat.CandidateAddrs(c.server.Conn.LocalAddr().(*net.UDPAddr)); err != nil {
+		c.logger.Errorf("%s while getting candidate addrs", err)
+		return astichat.MessageConnect
+	}
+
+	// Marshal
+	var b []byte
+	if b, err = json.Marshal(cm); err != nil {
+		c.logger.Errorf("%s while marshaling connect message", err)
+		return astichat.MessageConnect
+	}
+	return b
 }
 
 // Disconnect disconnects from the server
@@ -34,13 +144,13 @@ func (c *Client) Disconnect() (err error) {
 	if c.serverPublicKey != nil && c.privateKey != nil {
 		// Create body
 		var b astichat.Body
-		if b, err = astichat.NewBody(astichat.MessageDisconnect, c.now.Time(), c.username, c.serverPublicKey); err != nil {
+		if b, err = c.newBody(astichat.MessageDisconnect, c.serverPublicKey); err != nil {
 			return
 		}
 
 		// Write
 		c.logger.Debugf("Sending peer.disconnect to %s", c.serverUDPAddr)
-		if err = c.server.Write(astichat.EventNamePeerDisconnect, b, c.serverUDPAddr); err != nil {
+		if err = c.reliable.Write(astichat.EventNamePeerDisconnect, b, c.serverUDPAddr, nil); err != nil {
 			return
 		}
 	}
@@ -69,10 +179,10 @@ func (c *Client) HandlePeerDisconnected() astiudp.ListenerFunc {
 		}
 
 		// Delete peer from pool
-		c.peerPool.Del(p.Username)
+		c.peerPool.Del(p.Username, p.Device.ID)
 
 		// Print
-		fmt.Fprintf(os.Stdout, "%s has left\n", p)
+		fmt.Fprintf(c.stdout, "%s has left\n", p)
 		return
 	}
 }
@@ -98,16 +208,31 @@ func (c *Client) HandlePeerConnected() astiudp.ListenerFunc {
 			return
 		}
 
+		// Update state
+		c.setState(stateConnected)
+		select {
+		case c.channelConnected <- true:
+		default:
+		}
+
 		// Print
-		fmt.Fprintln(os.Stdout, "You're now connected")
+		fmt.Fprintln(c.stdout, "You're now connected")
+
+		// Rebuild pool from scratch since peers may have changed while the client was reconnecting
+		for _, p := range c.peerPool.Peers() {
+			c.peerPool.Del(p.Username, p.Device.ID)
+		}
 
 		// Loop through peers
 		for _, p := range ps {
 			// Add peer to pool
 			c.peerPool.Set(p)
 
+			// Set up the route to the peer
+			c.route(p)
+
 			// Print
-			fmt.Fprintf(os.Stdout, "%s is already here\n", p)
+			fmt.Fprintf(c.stdout, "%s is already here\n", p)
 		}
 		return
 	}
@@ -137,40 +262,444 @@ func (c *Client) HandlePeerJoined() astiudp.ListenerFunc {
 		// Add peer to pool
 		c.peerPool.Set(p)
 
+		// Set up the route to the peer
+		c.route(p)
+
 		// Print
-		fmt.Fprintf(os.Stdout, "%s has joined\n", p)
+		fmt.Fprintf(c.stdout, "%s has joined\n", p)
+		return
+	}
+}
+
+// route sets up how events reach a peer
+func (c *Client) route(p *astichat.Peer) {
+	// Peer of a federated server can only be reached with messages queued on the servers
+	if p.Federated() {
+		return
+	}
+
+	// Peer can only be reached through the server
+	if p.Relayed {
+		c.relay.SetRelayed(p.Addr)
+		return
+	}
+
+	// Client can only reach peers through the server
+	if c.relay.Streaming() {
 		return
 	}
+
+	// Find a working path to the peer
+	c.findPath(p)
 }
 
+// findPath probes the candidate addrs of a peer and switches to the first one that answers
+// Until then, the addr the server has seen the peer from is used
+func (c *Client) findPath(p *astichat.Peer) {
+	// Nothing to choose from
+	if len(p.Addrs) <= 1 {
+		return
+	}
+
+	// Find
+	c.pathFinder.Find(p.Addrs, func(pr astichat.Probe, addr *net.UDPAddr) (err error) {
+		// Marshal
+		var msg []byte
+		if msg, err = json.Marshal(pr); err != nil {
+			return
+		}
+
+		// Create body
+		var b astichat.Body
+		if b, err = c.newBody(msg, p.ClientPublicKey); err != nil {
+			return
+		}
+
+		// Write
+		c.logger.Debugf("Sending %s to %s via %s", astichat.EventNamePeerProbe, p, addr)
+		return c.fragmenter.Write(astichat.EventNamePeerProbe, b, addr)
+	}, func(addr *net.UDPAddr, err error) {
+		if err != nil {
+			c.logger.Debugf("%s while finding a path to %s", err, p)
+			return
+		}
+		if c.peerPool.SetAddr(p.Username, p.Device.ID, addr) {
+			c.logger.Debugf("Using %s to reach %s", addr, p.Username)
+		}
+	})
+}
+
+// HandlePeerProbe handles the peer.probe event
+// The probe is sent back encrypted with the sender's public key so that only the real sender can read it
+func (c *Client) HandlePeerProbe() astiudp.ListenerFunc {
+	return func(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) (err error) {
+		// Unmarshal
+		var b astichat.Body
+		if err = json.Unmarshal(payload, &b); err != nil {
+			return
+		}
+
+		// Get peer from pool
+		// Probes come from the addrs being tested so they can't be matched against the peer's addrs, but the answer
+		// can only be read by the peer anyway
+		if b.Request == nil {
+			return
+		}
+		if p, ok := c.peerPool.Get(b.Request.Username, b.Request.Device); ok {
+			// Process body
+			var msg []byte
+			if msg, err = b.Process(c.now.Time(), c.privateKey); err != nil {
+				return
+			}
+
+			// Create body
+			if b, err = c.newBody(msg, p.ClientPublicKey); err != nil {
+				return
+			}
+
+			// Write
+			c.logger.Debugf("Sending %s to %s via %s", astichat.EventNamePeerProbed, p, addr)
+			if err = c.fragmenter.Write(astichat.EventNamePeerProbed, b, addr); err != nil {
+				return
+			}
+		}
+		return
+	}
+}
+
+// HandlePeerProbed handles the peer.probed event
+func (c *Client) HandlePeerProbed() astiudp.ListenerFunc {
+	return func(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) (err error) {
+		// Unmarshal
+		var b astichat.Body
+		if err = json.Unmarshal(payload, &b); err != nil {
+			return
+		}
+
+		// Process body
+		var msg []byte
+		if msg, err = b.Process(c.now.Time(), c.privateKey); err != nil {
+			return
+		}
+
+		// Unmarshal
+		var pr astichat.Probe
+		if err = json.Unmarshal(msg, &pr); err != nil {
+			return
+		}
+
+		// Resolve
+		c.pathFinder.Resolve(pr.ID)
+		return
+	}
+}
+
+// Commands
+const (
+	commandMessage = "/msg"
+)
+
+// Consts
+const (
+	keyCtrlC        = 3
+	maxSentMessages = 100
+)
+
 // Type captures typing and send it encrypted to all peers
+// When stdin is a terminal, keystrokes are captured as well so that peers are notified that the user is typing
 func (c *Client) Type() {
-	var s = bufio.NewScanner(bufio.NewReader(os.Stdin))
-	s.Split(bufio.ScanLines)
-	for s.Scan() {
-		// Execute the rest in a goroutine
-		go func(line []byte) {
-			// Loop through peers
-			var err error
-			for _, p := range c.peerPool.Peers() {
-				// Create body
-				var b astichat.Body
-				if b, err = astichat.NewBody(line, c.now.Time(), c.username, p.ClientPublicKey); err != nil {
-					return
-				}
-
-				// Write message
-				c.logger.Debugf("Sending peer.typed to %s", p)
-				if err = c.server.Write(astichat.EventNamePeerTyped, b, p.Addr); err != nil {
-					c.logger.Errorf("%s while sending peer.typed to %s", p)
-					continue
-				}
+	// Stdin is not a terminal
+	var fd = int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		var s = bufio.NewScanner(bufio.NewReader(os.Stdin))
+		s.Split(bufio.ScanLines)
+		for s.Scan() {
+			go c.handleLine(append([]byte{}, s.Bytes()...))
+		}
+		return
+	}
+
+	// Make terminal raw
+	var err error
+	if c.terminalState, err = terminal.MakeRaw(fd); err != nil {
+		c.logger.Errorf("%s while making terminal raw", err)
+		return
+	}
+
+	// Init terminal
+	var t = terminal.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "> ")
+	t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		// Ctrl+C
+		if key == keyCtrlC {
+			c.Stop()
+			return "", 0, false
+		}
+
+		// The line is the one before the key is applied, which would leak that a private message is being written
+		// when its first key is typed. Other keys are not part of the line
+		if unicode.IsPrint(key) {
+			go c.typing(applyKey(line, pos, key))
+		}
+		return "", 0, false
+	}
+	c.stdout = t
+
+	// Read lines
+	for {
+		var line string
+		if line, err = t.ReadLine(); err != nil {
+			if err != io.EOF {
+				c.logger.Errorf("%s while reading line", err)
 			}
-		}(s.Bytes())
+			c.Stop()
+			return
+		}
+		go c.handleLine([]byte(line))
 	}
 }
 
-// HandlePeerDisconnected handles the peer.disconnected event
+// applyKey returns the line once the key has been inserted at the position
+// The position is expressed in runes
+func applyKey(line string, pos int, key rune) string {
+	var rs = []rune(line)
+	if pos < 0 || pos > len(rs) {
+		pos = len(rs)
+	}
+	return string(rs[:pos]) + string(key) + string(rs[pos:])
+}
+
+// handleLine handles a line typed by the user
+func (c *Client) handleLine(line []byte) {
+	// The user is active, which means messages have been read
+	c.sendReceipts()
+
+	// Private message
+	if bytes.HasPrefix(line, []byte(commandMessage+" ")) {
+		c.message(line)
+		return
+	}
+
+	// Loop through peers
+	// Peers of federated servers only receive private messages
+	var msg = c.newTyped(line)
+	for _, p := range c.peerPool.Peers() {
+		if p.Federated() {
+			continue
+		}
+		c.typingThrottler.Reset(p.Key())
+		if err := c.writePeer(astichat.EventNamePeerTyped, msg, p, c.printUndelivered(p)); err != nil {
+			c.logger.Errorf("%s while sending %s to %s", err, astichat.EventNamePeerTyped, p)
+			continue
+		}
+	}
+}
+
+// newTyped creates a typed message and remembers it so that read receipts can refer to it
+func (c *Client) newTyped(line []byte) (msg []byte) {
+	// Create typed message
+	var t = astichat.NewTyped(string(line))
+
+	// Remember it
+	c.mutex.Lock()
+	c.sent[t.ID] = t.Text
+	c.sentIDs = append(c.sentIDs, t.ID)
+	if len(c.sentIDs) > maxSentMessages {
+		delete(c.sent, c.sentIDs[0])
+		c.sentIDs = c.sentIDs[1:]
+	}
+	c.mutex.Unlock()
+
+	// Marshal
+	var err error
+	if msg, err = json.Marshal(t); err != nil {
+		c.logger.Errorf("%s while marshaling typed message", err)
+		return line
+	}
+	return
+}
+
+// typing notifies peers that the user is typing
+// Notifications are throttled so that the network is not flooded on each keystroke
+func (c *Client) typing(line string) {
+	// Get peers
+	var ps []*astichat.Peer
+	if strings.HasPrefix(line, commandMessage+" ") {
+		// Only notify the recipient of a private message once the message has been started
+		var items = strings.SplitN(strings.TrimPrefix(line, commandMessage+" "), " ", 2)
+		if len(items) < 2 || items[1] == "" {
+			return
+		}
+		ps = c.peerPool.PeersByUsername(items[0])
+	} else if !strings.HasPrefix(line, "/") {
+		ps = c.peerPool.Peers()
+	}
+
+	// Loop through peers
+	for _, p := range ps {
+		// Peers of federated servers are not notified
+		if p.Federated() {
+			continue
+		}
+
+		// Throttle
+		if !c.typingThrottler.Allow(p.Key()) {
+			continue
+		}
+
+		// Create body
+		var b astichat.Body
+		var err error
+		if b, err = c.newBody(astichat.MessageTyping, p.ClientPublicKey); err != nil {
+			c.logger.Errorf("%s while creating body for %s", err, p)
+			continue
+		}
+
+		// Write
+		// Typing notifications are not worth being retransmitted
+		c.logger.Debugf("Sending %s to %s", astichat.EventNamePeerTyping, p)
+		if err = c.fragmenter.Write(astichat.EventNamePeerTyping, b, p.Addr); err != nil {
+			c.logger.Errorf("%s while sending %s to %s", err, astichat.EventNamePeerTyping, p)
+			continue
+		}
+	}
+}
+
+// markUnread marks a message received from a peer as unread
+func (c *Client) markUnread(p *astichat.Peer, id string) {
+	if id == "" {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.unread[p.Key()] = id
+}
+
+// sendReceipts sends read receipts for the last message received from each peer
+func (c *Client) sendReceipts() {
+	// Get unread messages
+	c.mutex.Lock()
+	var unread = c.unread
+	c.unread = make(map[string]string)
+	c.mutex.Unlock()
+
+	// Loop through peers
+	for _, p := range c.peerPool.Peers() {
+		// No unread message
+		var id, ok = unread[p.Key()]
+		if !ok {
+			continue
+		}
+
+		// Marshal
+		var msg []byte
+		var err error
+		if msg, err = json.Marshal(astichat.Receipt{ID: id}); err != nil {
+			c.logger.Errorf("%s while marshaling receipt", err)
+			continue
+		}
+
+		// Write
+		if err = c.writePeer(astichat.EventNamePeerRead, msg, p, nil); err != nil {
+			c.logger.Errorf("%s while sending %s to %s", err, astichat.EventNamePeerRead, p)
+			continue
+		}
+	}
+}
+
+// message sends a private message to all the devices of a single chatterer
+// The expected format is "/msg <username> <message>"
+func (c *Client) message(line []byte) {
+	// Parse line
+	var items = bytes.SplitN(bytes.TrimSpace(bytes.TrimPrefix(line, []byte(commandMessage))), []byte(" "), 2)
+	if len(items) < 2 || len(bytes.TrimSpace(items[1])) == 0 {
+		fmt.Fprintf(c.stdout, "Usage: %s <username> <message>\n", commandMessage)
+		return
+	}
+	var username = string(items[0])
+
+	// Chatterer is not connected or is a chatterer of a federated server, queue the message on the server
+	// Usernames in the form user@server are relayed by the server to the chatterer's server
+	var ps = c.peerPool.PeersByUsername(username)
+	if len(ps) == 0 || ps[0].Federated() {
+		if err := c.Queue(username, items[1]); err != nil {
+			c.logger.Errorf("%s while queuing message for %s", err, username)
+			fmt.Fprintf(c.stdout, "(could not queue message for %s)\n", username)
+			return
+		}
+		if len(ps) == 0 {
+			fmt.Fprintf(c.stdout, "(%s is offline, message queued)\n", username)
+		} else {
+			fmt.Fprintf(c.stdout, "(message relayed to %s)\n", username)
+		}
+		return
+	}
+
+	// Loop through devices
+	var msg = c.newTyped(items[1])
+	for _, p := range ps {
+		// Write message
+		c.typingThrottler.Reset(p.Key())
+		if err := c.writePeer(astichat.EventNamePeerMessaged, msg, p, c.printDelivery(p)); err != nil {
+			c.logger.Errorf("%s while sending %s to %s", err, astichat.EventNamePeerMessaged, p)
+			continue
+		}
+	}
+}
+
+// printDelivery returns a delivery func that prints the delivery status of a message sent to a peer
+func (c *Client) printDelivery(p *astichat.Peer) astichat.DeliveryFunc {
+	return func(err error) {
+		if err != nil {
+			c.printUndelivered(p)(err)
+			return
+		}
+		fmt.Fprintf(c.stdout, "(delivered to %s)\n", p)
+	}
+}
+
+// printUndelivered returns a delivery func that prints messages that could not be delivered to a peer
+func (c *Client) printUndelivered(p *astichat.Peer) astichat.DeliveryFunc {
+	return func(err error) {
+		if err != nil {
+			c.logger.Debugf("%s while delivering message to %s", err, p)
+			fmt.Fprintf(c.stdout, "(not delivered to %s)\n", p)
+		}
+	}
+}
+
+// writePeer encrypts a message for a peer and writes it
+func (c *Client) writePeer(eventName string, msg []byte, p *astichat.Peer, fn astichat.DeliveryFunc) (err error) {
+	// Create body
+	var b astichat.Body
+	if b, err = c.newBody(msg, p.ClientPublicKey); err != nil {
+		return
+	}
+
+	// Write
+	c.logger.Debugf("Sending %s to %s", eventName, p)
+	if err = c.reliable.Write(eventName, b, p.Addr, fn); err != nil {
+		return
+	}
+	return
+}
+
+// peerFromBody gets the peer that has sent a body from the pool
+// Bodies are not signed by peers, so a body is only accepted if it comes from one of the addrs of the peer it claims
+// to come from. Relayed bodies come with the addr the server has seen the peer from.
+func (c *Client) peerFromBody(b astichat.Body, addr *net.UDPAddr) (p *astichat.Peer, ok bool) {
+	if b.Request == nil {
+		return
+	}
+	if p, ok = c.peerPool.Get(b.Request.Username, b.Request.Device); !ok || !p.HasAddr(addr) {
+		return nil, false
+	}
+	return
+}
+
+// HandlePeerTyped handles the peer.typed event
 func (c *Client) HandlePeerTyped() astiudp.ListenerFunc {
 	return func(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) (err error) {
 		// Unmarshal
@@ -180,16 +709,226 @@ func (c *Client) HandlePeerTyped() astiudp.ListenerFunc {
 		}
 
 		// Get peer from pool
-		if p, ok := c.peerPool.Get(b.Request.Username); ok {
+		if p, ok := c.peerFromBody(b, addr); ok {
+			// Process body
+			var msg []byte
+			if msg, err = b.Process(c.now.Time(), c.privateKey); err != nil {
+				return
+			}
+
+			// Print
+			var t = astichat.ParseTyped(msg)
+			fmt.Fprintf(c.stdout, "%s: %s\n", p, t.Text)
+
+			// Mark as unread
+			c.markUnread(p, t.ID)
+			c.typingPrintThrottler.Reset(p.Key())
+		}
+		return
+	}
+}
+
+// HandlePeerMessaged handles the peer.messaged event
+func (c *Client) HandlePeerMessaged() astiudp.ListenerFunc {
+	return func(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) (err error) {
+		// Unmarshal
+		var b astichat.Body
+		if err = json.Unmarshal(payload, &b); err != nil {
+			return
+		}
+
+		// Get peer from pool
+		if p, ok := c.peerFromBody(b, addr); ok {
+			// Process body
+			var msg []byte
+			if msg, err = b.Process(c.now.Time(), c.privateKey); err != nil {
+				return
+			}
+
+			// Print
+			var t = astichat.ParseTyped(msg)
+			fmt.Fprintf(c.stdout, "[private] %s: %s\n", p, t.Text)
+
+			// Mark as unread
+			c.markUnread(p, t.ID)
+			c.typingPrintThrottler.Reset(p.Key())
+		}
+		return
+	}
+}
+
+// HandleMessageQueued handles the message.queued event
+func (c *Client) HandleMessageQueued() astiudp.ListenerFunc {
+	return func(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) (err error) {
+		// Unmarshal
+		var b astichat.Body
+		if err = json.Unmarshal(payload, &b); err != nil {
+			return
+		}
+
+		// Process body
+		var msg []byte
+		if msg, err = b.Process(c.now.Time(), c.privateKey); err != nil {
+			return
+		}
+
+		// Unmarshal
+		var m astichat.Message
+		if err = json.Unmarshal(msg, &m); err != nil {
+			return
+		}
+
+		// Decrypt message
+		if msg, err = m.Message.Decrypt(c.privateKey); err != nil {
+			return
+		}
+
+		// Print
+		fmt.Fprintf(c.stdout, "[offline] %s at %s: %s\n", m.Sender, m.CreatedAt.Format("2006-01-02 15:04:05"), string(msg))
+		return
+	}
+}
+
+// HandleMessageDelivered handles the message.delivered event
+func (c *Client) HandleMessageDelivered() astiudp.ListenerFunc {
+	return func(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) (err error) {
+		// Unmarshal
+		var b astichat.Body
+		if err = json.Unmarshal(payload, &b); err != nil {
+			return
+		}
+
+		// Process body
+		var msg []byte
+		if msg, err = b.Process(c.now.Time(), c.privateKey); err != nil {
+			return
+		}
+
+		// Unmarshal
+		var d astichat.MessageDelivery
+		if err = json.Unmarshal(msg, &d); err != nil {
+			return
+		}
+
+		// Print
+		fmt.Fprintf(c.stdout, "(queued message delivered to %s)\n", d.Recipient)
+		return
+	}
+}
+
+// HandlePeerTyping handles the peer.typing event
+func (c *Client) HandlePeerTyping() astiudp.ListenerFunc {
+	return func(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) (err error) {
+		// Unmarshal
+		var b astichat.Body
+		if err = json.Unmarshal(payload, &b); err != nil {
+			return
+		}
+
+		// Get peer from pool
+		if p, ok := c.peerFromBody(b, addr); ok {
 			// Process body
 			var msg []byte
 			if msg, err = b.Process(c.now.Time(), c.privateKey); err != nil {
 				return
 			}
 
+			// Validate message
+			if err = astichat.ValidateMessage(msg, astichat.MessageTyping); err != nil {
+				return
+			}
+
 			// Print
-			fmt.Fprintf(os.Stdout, "%s: %s\n", p, string(msg))
+			// Printing is throttled as well so that the screen is not flooded
+			if c.typingPrintThrottler.Allow(p.Key()) {
+				fmt.Fprintf(c.stdout, "(%s is typing...)\n", p)
+			}
 		}
 		return
 	}
 }
+
+// HandlePeerRead handles the peer.read event
+func (c *Client) HandlePeerRead() astiudp.ListenerFunc {
+	return func(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) (err error) {
+		// Unmarshal
+		var b astichat.Body
+		if err = json.Unmarshal(payload, &b); err != nil {
+			return
+		}
+
+		// Get peer from pool
+		if p, ok := c.peerFromBody(b, addr); ok {
+			// Process body
+			var msg []byte
+			if msg, err = b.Process(c.now.Time(), c.privateKey); err != nil {
+				return
+			}
+
+			// Unmarshal
+			var r astichat.Receipt
+			if err = json.Unmarshal(msg, &r); err != nil {
+				return
+			}
+
+			// Print
+			c.mutex.Lock()
+			var text, ok = c.sent[r.ID]
+			c.mutex.Unlock()
+			if ok {
+				fmt.Fprintf(c.stdout, "(read by %s up to \"%s\")\n", p, text)
+			} else {
+				fmt.Fprintf(c.stdout, "(read by %s)\n", p)
+			}
+		}
+		return
+	}
+}
+
+// HandleServerShutdown handles the server.shutdown event
+func (c *Client) HandleServerShutdown() astiudp.ListenerFunc {
+	return func(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) (err error) {
+		// Only the server can shut itself down
+		if addr.String() != c.serverUDPAddr.String() {
+			err = fmt.Errorf("%s received from %s which is not the server", eventName, addr)
+			return
+		}
+
+		// Unmarshal
+		var b astichat.Body
+		if err = json.Unmarshal(payload, &b); err != nil {
+			return
+		}
+
+		// Process body
+		var msg []byte
+		if msg, err = b.Process(c.now.Time(), c.privateKey); err != nil {
+			return
+		}
+
+		// Unmarshal
+		var sd astichat.Shutdown
+		if err = json.Unmarshal(msg, &sd); err != nil {
+			return
+		}
+
+		// Update state
+		c.setState(stateOffline)
+
+		// Empty pool
+		for _, p := range c.peerPool.Peers() {
+			c.peerPool.Del(p.Username, p.Device.ID)
+		}
+
+		// Print
+		var reconnectAfter = c.reconnectConfiguration.Backoff
+		if sd.ReconnectAfter > reconnectAfter {
+			reconnectAfter = sd.ReconnectAfter
+		}
+		fmt.Fprintf(c.stdout, "Server is shutting down, you're now offline (reconnecting in %s)\n", reconnectAfter)
+
+		// Reconnect
+		time.AfterFunc(reconnectAfter, c.reconnect)
+		return
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/asticode/go-astilog"
+	"github.com/asticode/go-astiudp"
+	"github.com/stretchr/testify/assert"
+)
+
+// Vars
+var (
+	onceKey sync.Once
+	prvKey  *astichat.PrivateKey
+	pubKey  *astichat.PublicKey
+)
+
+// testKey returns the key used by the client and its peers, it's generated once since it's slow
+func testKey(t *testing.T) (*astichat.PrivateKey, *astichat.PublicKey) {
+	onceKey.Do(func() {
+		var err error
+		prvKey, err = astichat.NewPrivateKey("")
+		assert.NoError(t, err)
+		pubKey, err = prvKey.PublicKey()
+		assert.NoError(t, err)
+	})
+	return prvKey, pubKey
+}
+
+// write represents a write of the mocked transport
+type write struct {
+	addr      string
+	at        time.Time
+	eventName string
+	payload   []byte
+}
+
+// mockedTransport represents a mocked transport that records its writes
+type mockedTransport struct {
+	mutex  *sync.Mutex
+	writes []write
+}
+
+func newMockedTransport() *mockedTransport {
+	return &mockedTransport{mutex: &sync.Mutex{}}
+}
+
+func (t *mockedTransport) SetListener(eventName string, l astiudp.ListenerFunc) {}
+
+func (t *mockedTransport) Write(eventName string, payload interface{}, addr *net.UDPAddr) (err error) {
+	var b []byte
+	if b, err = json.Marshal(payload); err != nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.writes = append(t.writes, write{addr: addr.String(), at: time.Now(), eventName: eventName, payload: b})
+	return
+}
+
+// flush returns the writes and resets them
+func (t *mockedTransport) flush() (ws []write) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	ws = t.writes
+	t.writes = []write{}
+	return
+}
+
+// newTestClient creates a client writing to a mocked transport
+func newTestClient(t *testing.T) (c *Client, tr *mockedTransport) {
+	var prv, pub = testKey(t)
+	c = NewClient(astilog.NopLogger(), astichat.Stamp{DeviceID: "d1", Username: "alice"})
+	c.fallbackTimeout = time.Hour
+	c.now = astichat.NewNow(time.Now())
+	c.pathFinder = astichat.NewPathFinder(astichat.PathFinderConfiguration{})
+	c.privateKey = prv
+	c.serverPublicKey = pub
+	c.serverUDPAddr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4000}
+	c.stdout = &bytes.Buffer{}
+	c.transport = transportUDP
+	c.typingPrintThrottler = astichat.NewThrottler(time.Minute)
+	c.typingThrottler = astichat.NewThrottler(time.Minute)
+	assert.NoError(t, c.server.Init("127.0.0.1:0"))
+	tr = newMockedTransport()
+	c.relay = astichat.NewRelayTransport(tr, c.serverUDPAddr)
+	c.fragmenter = astichat.NewFragmenter(c.relay, astichat.FragmenterConfiguration{ChunkSize: 1 << 20, MaxPayloadSize: 1 << 20})
+	c.reliable = astichat.NewReliable(c.fragmenter, astichat.ReliableConfiguration{Backoff: time.Minute, MaxAttempts: 1})
+	return
+}
+
+// addPeer adds a peer to the pool of the client
+func addPeer(t *testing.T, c *Client, username, device string, port int) (p *astichat.Peer) {
+	var _, pub = testKey(t)
+	p = astichat.NewPeer(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}, username, astichat.Device{ClientPublicKey: pub, ID: device})
+	c.peerPool.Set(p)
+	return
+}
+
+func TestApplyKey(t *testing.T) {
+	assert.Equal(t, "/", applyKey("", 0, '/'))
+	assert.Equal(t, "abc", applyKey("ac", 1, 'b'))
+	assert.Equal(t, "héllo", applyKey("hé", 2, 'l')+"lo")
+	assert.Equal(t, "ab", applyKey("a", 10, 'b'))
+}
+
+func TestTyping(t *testing.T) {
+	// Init
+	var c, tr = newTestClient(t)
+	var bob = addPeer(t, c, "bob", "d2", 1)
+	var carol = addPeer(t, c, "carol", "d3", 2)
+	var addrs = func(ws []write) (o []string) {
+		for _, w := range ws {
+			assert.Equal(t, astichat.EventNamePeerTyping, w.eventName)
+			o = append(o, w.addr)
+		}
+		return
+	}
+
+	// First key of a command
+	c.typing(applyKey("", 0, '/'))
+	assert.Len(t, tr.flush(), 0)
+
+	// Private message is not started yet
+	c.typing("/msg bob")
+	c.typing("/msg bob ")
+	assert.Len(t, tr.flush(), 0)
+
+	// Private message
+	c.typing("/msg bob h")
+	assert.Equal(t, []string{bob.Addr.String()}, addrs(tr.flush()))
+
+	// Notifications are throttled
+	c.typing("hello")
+	assert.Equal(t, []string{carol.Addr.String()}, addrs(tr.flush()))
+	c.typing("hello again")
+	assert.Len(t, tr.flush(), 0)
+}
+
+func TestReceipts(t *testing.T) {
+	// Init
+	var c, tr = newTestClient(t)
+	var prv, _ = testKey(t)
+	var bob = addPeer(t, c, "bob", "d2", 1)
+	var carol = addPeer(t, c, "carol", "d3", 2)
+
+	// Only the last message of each peer is acknowledged
+	c.markUnread(bob, "1")
+	c.markUnread(bob, "2")
+	c.markUnread(carol, "")
+	c.sendReceipts()
+	var ws = tr.flush()
+	assert.Len(t, ws, 1)
+	assert.Equal(t, astichat.EventNamePeerRead, ws[0].eventName)
+	assert.Equal(t, bob.Addr.String(), ws[0].addr)
+	var p astichat.Packet
+	assert.NoError(t, json.Unmarshal(ws[0].payload, &p))
+	var b astichat.Body
+	assert.NoError(t, json.Unmarshal(p.Payload, &b))
+	var msg, err = b.Process(c.now.Time(), prv)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"id":"2"}`, string(msg))
+
+	// Receipts are sent once
+	c.sendReceipts()
+	assert.Len(t, tr.flush(), 0)
+}
+
+func TestNewTyped(t *testing.T) {
+	// Init
+	var c, _ = newTestClient(t)
+	var count int
+	var generateTypedID = astichat.GenerateTypedID
+	astichat.GenerateTypedID = func() string {
+		count++
+		return string(rune('a'+count/26)) + string(rune('a'+count%26))
+	}
+	defer func() { astichat.GenerateTypedID = generateTypedID }()
+
+	// Sent messages are remembered
+	var msg = c.newTyped([]byte("hello"))
+	var ty = astichat.ParseTyped(msg)
+	assert.Equal(t, "hello", ty.Text)
+	assert.Equal(t, "hello", c.sent[ty.ID])
+
+	// Oldest messages are evicted
+	for i := 0; i < maxSentMessages; i++ {
+		c.newTyped([]byte("text"))
+	}
+	assert.Len(t, c.sent, maxSentMessages)
+	assert.Len(t, c.sentIDs, maxSentMessages)
+	var _, ok = c.sent[ty.ID]
+	assert.False(t, ok)
+}
+
+func TestHandleServerShutdown(t *testing.T) {
+	// Init
+	var c, _ = newTestClient(t)
+	var _, pub = testKey(t)
+	var buf = &bytes.Buffer{}
+	c.stdout = buf
+	c.reconnectConfiguration = ConfigurationReconnect{Backoff: time.Second}
+	c.setState(stateConnected)
+	addPeer(t, c, "bob", "d2", 1)
+	var msg, _ = json.Marshal(astichat.Shutdown{ReconnectAfter: time.Hour})
+	var b, err = astichat.NewBody(msg, c.now.Time(), "", pub)
+	assert.NoError(t, err)
+	var payload, _ = json.Marshal(b)
+	var l = c.HandleServerShutdown()
+
+	// Only the server can shut itself down
+	err = l(nil, astichat.EventNameServerShutdown, payload, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	assert.Error(t, err)
+	assert.Equal(t, stateConnected, c.getState())
+	assert.Len(t, c.peerPool.Peers(), 1)
+
+	// Client goes offline and reconnects after the delay requested by the server
+	err = l(nil, astichat.EventNameServerShutdown, payload, c.serverUDPAddr)
+	assert.NoError(t, err)
+	assert.Equal(t, stateOffline, c.getState())
+	assert.Len(t, c.peerPool.Peers(), 0)
+	assert.Equal(t, "Server is shutting down, you're now offline (reconnecting in 1h0m0s)\n", buf.String())
+}
+
+func TestMessage(t *testing.T) {
+	// Init
+	var c, tr = newTestClient(t)
+	var prv, _ = testKey(t)
+	var buf = &bytes.Buffer{}
+	c.stdout = buf
+	var bob1 = addPeer(t, c, "bob", "d2", 1)
+	var bob2 = addPeer(t, c, "bob", "d3", 2)
+	addPeer(t, c, "carol", "d4", 3)
+
+	// Missing message
+	for _, line := range []string{"/msg", "/msg bob", "/msg bob  "} {
+		c.message([]byte(line))
+		assert.Equal(t, "Usage: /msg <username> <message>\n", buf.String(), line)
+		assert.Len(t, tr.flush(), 0, line)
+		buf.Reset()
+	}
+
+	// Message is sent to all the devices of the recipient only and keeps its spaces
+	c.handleLine([]byte("/msg bob hello  world"))
+	var ws = tr.flush()
+	var addrs []string
+	for _, w := range ws {
+		assert.Equal(t, astichat.EventNamePeerMessaged, w.eventName)
+		addrs = append(addrs, w.addr)
+		var p astichat.Packet
+		assert.NoError(t, json.Unmarshal(w.payload, &p))
+		var b astichat.Body
+		assert.NoError(t, json.Unmarshal(p.Payload, &b))
+		var msg, err = b.Process(c.now.Time(), prv)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello  world", astichat.ParseTyped(msg).Text)
+	}
+	sort.Strings(addrs)
+	assert.Equal(t, []string{bob1.Addr.String(), bob2.Addr.String()}, addrs)
+}
+
+func TestHandlePeerMessaged(t *testing.T) {
+	// Init
+	var c, _ = newTestClient(t)
+	var _, pub = testKey(t)
+	var buf = &bytes.Buffer{}
+	c.stdout = buf
+	var bob = addPeer(t, c, "bob", "d2", 1)
+	bob.SetCandidates([]*net.UDPAddr{{IP: net.IPv4(192, 168, 1, 2), Port: 1}})
+	var b, err = astichat.NewBody(c.newTyped([]byte("hello")), c.now.Time(), "bob", pub)
+	assert.NoError(t, err)
+	b.Request.Device = "d2"
+	var payload, _ = json.Marshal(b)
+	var l = c.HandlePeerMessaged()
+
+	// Body without request
+	assert.NoError(t, l(nil, astichat.EventNamePeerMessaged, []byte("{}"), bob.Addr))
+	assert.Equal(t, "", buf.String())
+
+	// Body doesn't come from the peer it claims to come from
+	assert.NoError(t, l(nil, astichat.EventNamePeerMessaged, payload, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2}))
+	assert.Equal(t, "", buf.String())
+
+	// Body comes from the addr of the peer
+	assert.NoError(t, l(nil, astichat.EventNamePeerMessaged, payload, bob.Addr))
+	assert.Equal(t, "[private] bob@127.0.0.1:1: hello\n", buf.String())
+	buf.Reset()
+
+	// Body comes from a candidate addr of the peer
+	assert.NoError(t, l(nil, astichat.EventNamePeerMessaged, payload, bob.Addrs[1]))
+	assert.Equal(t, "[private] bob@127.0.0.1:1: hello\n", buf.String())
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+)
+
+// verifyHTTPClient is the HTTP client fetching the signing key
+var verifyHTTPClient = &http.Client{Timeout: 5 * time.Second}
+
+// verify checks that a binary has been signed by the server it connects to
+// Everything read from the binary, its stamp included, can be tampered with, therefore the signing key is checked
+// against the fingerprint the user got from the server's operator through a trusted channel
+func verify(path string, s astichat.Stamp, signaturePath, fingerprint string) (err error) {
+	// Fingerprint is required
+	if fingerprint == "" {
+		err = errors.New("Fingerprint is empty, get the fingerprint of the signing key from your server's operator")
+		return
+	}
+
+	// Signing key must be fetched over HTTPS
+	var u *url.URL
+	if u, err = url.Parse(s.ServerHTTPAddr); err != nil {
+		return
+	} else if u.Scheme != "https" {
+		err = fmt.Errorf("Server addr %s doesn't use HTTPS", s.ServerHTTPAddr)
+		return
+	}
+
+	// Read signature
+	if signaturePath == "" {
+		signaturePath = path + astichat.SignatureExtension
+	}
+	var sig []byte
+	if sig, err = ioutil.ReadFile(signaturePath); err != nil {
+		return
+	}
+
+	// Fetch signing key
+	var k *astichat.PublicKey
+	if k, err = signingKey(s.ServerHTTPAddr); err != nil {
+		return
+	}
+
+	// Check fingerprint
+	var f string
+	if f, err = astichat.KeyFingerprint(k); err != nil {
+		return
+	} else if f != strings.ToLower(strings.TrimSpace(fingerprint)) {
+		err = fmt.Errorf("Signing key served by %s has fingerprint %s instead of %s", s.ServerHTTPAddr, f, fingerprint)
+		return
+	}
+
+	// Verify
+	if err = astichat.VerifyFile(path, sig, k); err != nil {
+		err = fmt.Errorf("%s: binary %s has not been signed by %s", err, path, s.ServerHTTPAddr)
+		return
+	}
+	return
+}
+
+// signingKey fetches the public key verifying the signature of the clients
+func signingKey(addr string) (k *astichat.PublicKey, err error) {
+	// Send request
+	var resp *http.Response
+	if resp, err = verifyHTTPClient.Get(addr + "/signing_key"); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	// Server doesn't sign clients
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("Server %s returned status code %d while fetching signing key", addr, resp.StatusCode)
+		return
+	}
+
+	// Read
+	var b []byte
+	if b, err = ioutil.ReadAll(resp.Body); err != nil {
+		return
+	}
+
+	// Unmarshal
+	k = &astichat.PublicKey{}
+	err = k.UnmarshalText(b)
+	return
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/asticode/go-astichat/astichat"
+	"github.com/stretchr/testify/assert"
+)
+
+// newSigningKeyServer creates a TLS server serving a signing key
+func newSigningKeyServer(k *astichat.PublicKey) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(k.String()))
+	}))
+}
+
+// stampAndSign writes a stamped binary and its signature
+func stampAndSign(t *testing.T, path string, s astichat.Stamp, k *astichat.PrivateKey) {
+	var b = []byte("header" + astichat.StampPlaceholder + "footer")
+	assert.NoError(t, astichat.StampBinary(b, s))
+	assert.NoError(t, ioutil.WriteFile(path, b, 0755))
+	sig, err := astichat.SignFile(path, k)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path+astichat.SignatureExtension, []byte(sig), 0644))
+}
+
+func TestVerify(t *testing.T) {
+	// Init
+	prv, pub := testKey(t)
+	f, err := astichat.KeyFingerprint(pub)
+	assert.NoError(t, err)
+	srv := newSigningKeyServer(pub)
+	defer srv.Close()
+	defer func(c *http.Client) { verifyHTTPClient = c }(verifyHTTPClient)
+	verifyHTTPClient = srv.Client()
+	dir, err := ioutil.TempDir("", "astichat_verify")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	var path = filepath.Join(dir, "astichat")
+	var s = astichat.Stamp{ServerHTTPAddr: srv.URL, Username: "bob"}
+	stampAndSign(t, path, s, prv)
+
+	// Success
+	assert.NoError(t, verify(path, s, "", f))
+	assert.NoError(t, verify(path, s, "", strings.ToUpper(f)))
+
+	// Fingerprint is empty or wrong
+	assert.Error(t, verify(path, s, "", ""))
+	assert.Error(t, verify(path, s, "", strings.Repeat("0", len(f))))
+
+	// Server addr doesn't use HTTPS
+	var ps = s
+	ps.ServerHTTPAddr = strings.Replace(srv.URL, "https://", "http://", 1)
+	assert.Error(t, verify(path, ps, "", f))
+
+	// Binary has been modified after being signed
+	b, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, append(b, '.'), 0755))
+	assert.Error(t, verify(path, s, "", f))
+
+	// Binary has been re-stamped to point at an attacker's server serving its own signing key and signature
+	aprv, err := astichat.NewPrivateKey("")
+	assert.NoError(t, err)
+	apub, err := aprv.PublicKey()
+	assert.NoError(t, err)
+	asrv := newSigningKeyServer(apub)
+	defer asrv.Close()
+	verifyHTTPClient = asrv.Client()
+	var as = s
+	as.ServerHTTPAddr = asrv.URL
+	stampAndSign(t, path, as, aprv)
+	assert.Error(t, verify(path, as, "", f))
+	af, err := astichat.KeyFingerprint(apub)
+	assert.NoError(t, err)
+	assert.NoError(t, verify(path, as, "", af))
+}
@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/asticode/go-astichat/astichat"
 	"github.com/asticode/go-astichat/builder"
 	"github.com/asticode/go-astilog"
 	"github.com/asticode/go-astimgo"
@@ -14,6 +15,7 @@ import (
 
 // Flags
 var (
+	addrAdmin     = flag.String("admin-addr", "", "the admin HTTP listen addr serving the metrics")
 	addrHTTP      = flag.String("http-addr", "", "the HTTP listen addr")
 	addrUDP       = flag.String("udp-addr", "", "the UDP listen addr")
 	configPath    = flag.String("c", "", "the config path")
@@ -24,18 +26,63 @@ var (
 // Configuration represents a configuration
 // TODO Find a way not to put the mongo configuration here so that people who want to use another storage can
 type Configuration struct {
-	Addr          ConfigurationAddr     `toml:"addr"`
-	Builder       builder.Configuration `toml:"builder"`
-	Logger        astilog.Configuration `toml:"logger"`
-	Mongo         astimgo.Configuration `toml:"mongo"`
-	PathStatic    string                `toml:"path_static"`
-	PathTemplates string                `toml:"path_templates"`
+	Addr           ConfigurationAddr                `toml:"addr"`
+	Broker         ConfigurationBroker              `toml:"broker"`
+	Builder        builder.Configuration            `toml:"builder"`
+	Federation     astichat.FederationConfiguration `toml:"federation"`
+	Fragmenter     astichat.FragmenterConfiguration `toml:"fragmenter"`
+	Logger         astilog.Configuration            `toml:"logger"`
+	MaxDevices     int                              `toml:"max_devices"`      // Maximum number of devices per chatterer
+	MaxMessageSize int                              `toml:"max_message_size"` // Maximum size of a queued message
+	MessageTTL     time.Duration                    `toml:"message_ttl"`
+	Mongo          astimgo.Configuration            `toml:"mongo"`
+	PathStatic     string                           `toml:"path_static"`
+	PathTemplates  string                           `toml:"path_templates"`
+	QUIC           astichat.QUICConfiguration       `toml:"quic"`
+	RateLimiter    ConfigurationRateLimiter         `toml:"rate_limiter"`
+	Reliable       astichat.ReliableConfiguration   `toml:"reliable"`
+	Shutdown       ConfigurationShutdown            `toml:"shutdown"`
+	Stream         astichat.StreamConfiguration     `toml:"stream"`
+	Webhook        astichat.WebhookConfiguration    `toml:"webhook"`
 }
 
 // ConfigurationAddr represents an addr configuration
+// The admin addr serves the metrics and should not be reachable publicly, metrics are disabled when it's empty
+// The UDP addr must listen on both stacks, e.g. "[::]:4000" or ":4000", so that the IPv6 candidates advertised by
+// dual-stack clients can reach it
 type ConfigurationAddr struct {
-	HTTP string `toml:"http"`
-	UDP  string `toml:"udp"`
+	Admin string `toml:"admin"`
+	HTTP  string `toml:"http"`
+	UDP   string `toml:"udp"`
+}
+
+// Broker types
+const (
+	brokerTypeAMQP   = "amqp"
+	brokerTypeMemory = "memory"
+)
+
+// ConfigurationBroker represents a broker configuration
+// Server instances sharing presence and relays must use the same AMQP broker
+type ConfigurationBroker struct {
+	AMQP    astichat.AMQPConfiguration    `toml:"amqp"`
+	Cluster astichat.ClusterConfiguration `toml:"cluster"`
+	Type    string                        `toml:"type"`
+}
+
+// ConfigurationRateLimiter represents a rate limiter configuration
+type ConfigurationRateLimiter struct {
+	Addr     astichat.RateLimiterConfiguration `toml:"addr"`
+	Username astichat.RateLimiterConfiguration `toml:"username"`
+}
+
+// ConfigurationShutdown represents a shutdown configuration
+// Notifying peers, draining HTTP requests and delivering the remaining webhook events have their own timeout
+type ConfigurationShutdown struct {
+	DrainTimeout   time.Duration `toml:"drain_timeout"`
+	NotifyTimeout  time.Duration `toml:"notify_timeout"`
+	ReconnectAfter time.Duration `toml:"reconnect_after"`
+	WebhookTimeout time.Duration `toml:"webhook_timeout"`
 }
 
 // TOMLDecodeFile allows testing functions using it
@@ -47,14 +94,81 @@ var TOMLDecodeFile = func(fpath string, v interface{}) (toml.MetaData, error) {
 func NewConfiguration() Configuration {
 	// Global config
 	var gc = Configuration{
+		Broker: ConfigurationBroker{
+			AMQP: astichat.AMQPConfiguration{
+				Exchange:         "astichat",
+				ReconnectBackoff: time.Second,
+			},
+			Cluster: astichat.ClusterConfiguration{
+				HeartbeatPeriod:  5 * time.Second,
+				HeartbeatTimeout: 15 * time.Second,
+			},
+			Type: brokerTypeMemory,
+		},
+		Builder: builder.Configuration{
+			ArtifactTTL:  10 * time.Minute,
+			BuildTimeout: 5 * time.Minute,
+			PollTimeout:  30 * time.Second,
+			QueueSize:    100,
+			Remote: builder.RemoteConfiguration{
+				MaxTemplateSize: 256 << 20,
+				Timeout:         10 * time.Minute,
+			},
+			Workers: 2,
+		},
+		Federation: astichat.FederationConfiguration{
+			Timeout: 5 * time.Second,
+		},
+		Fragmenter: astichat.FragmenterConfiguration{
+			ChunkSize:      768,
+			MaxBufferSize:  4 << 20,
+			MaxPayloadSize: 1 << 20,
+			Timeout:        10 * time.Second,
+		},
 		Logger: astilog.Configuration{
 			AppName: "go-astichat-server",
 		},
+		MaxDevices:     5,
+		MaxMessageSize: 64 << 10,
+		MessageTTL:     7 * 24 * time.Hour,
 		Mongo: astimgo.Configuration{
 			Timeout: 10 * time.Second,
 		},
 		PathStatic:    "static",
 		PathTemplates: "templates",
+		QUIC: astichat.QUICConfiguration{
+			KeepAlivePeriod: 15 * time.Second,
+		},
+		RateLimiter: ConfigurationRateLimiter{
+			Addr: astichat.RateLimiterConfiguration{
+				BanDuration:  10 * time.Minute,
+				BanThreshold: 20,
+				Burst:        10,
+				Rate:         2,
+			},
+			Username: astichat.RateLimiterConfiguration{
+				BanDuration:  time.Minute,
+				BanThreshold: 20,
+				Burst:        5,
+				Rate:         0.5,
+			},
+		},
+		Shutdown: ConfigurationShutdown{
+			DrainTimeout:   10 * time.Second,
+			NotifyTimeout:  5 * time.Second,
+			WebhookTimeout: 5 * time.Second,
+		},
+		Stream: astichat.StreamConfiguration{
+			AuthTimeout:   10 * time.Second,
+			IdleTimeout:   time.Minute,
+			MaxConnsPerIP: 10,
+		},
+		Webhook: astichat.WebhookConfiguration{
+			Backoff:     time.Second,
+			MaxAttempts: 5,
+			QueueSize:   1000,
+			Timeout:     5 * time.Second,
+		},
 	}
 
 	// Local config
@@ -68,8 +182,9 @@ func NewConfiguration() Configuration {
 	// Flag config
 	var c = Configuration{
 		Addr: ConfigurationAddr{
-			HTTP: *addrHTTP,
-			UDP:  *addrUDP,
+			Admin: *addrAdmin,
+			HTTP:  *addrHTTP,
+			UDP:   *addrUDP,
 		},
 		Builder:       builder.FlagConfig(),
 		Logger:        astilog.FlagConfig(),
@@ -0,0 +1,115 @@
+package main_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+	main "github.com/asticode/go-astichat/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFederation(t *testing.T) {
+	// Init storages
+	var prv1, pub1, prv2, pub2 = testKeys(t)
+	var stgA, stgB = astichat.NewMockedStorage(), astichat.NewMockedStorage()
+	stgA.ChattererCreate("alice", astichat.Device{ClientPublicKey: pub2, ID: "d1", ServerPrivateKey: prv2})
+	stgB.ChattererCreate("bob", astichat.Device{ClientPublicKey: pub2, ID: "d2", ServerPrivateKey: prv2})
+
+	// Init federations
+	var hA, hB *main.ServerHTTP
+	var sA = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) { hA.HandleFederationPOST(rw, r, nil) }))
+	defer sA.Close()
+	var sB = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) { hB.HandleFederationPOST(rw, r, nil) }))
+	defer sB.Close()
+	var fA = astichat.NewFederation(astichat.FederationConfiguration{
+		Name:       "a",
+		PrivateKey: prv1,
+		Servers:    []astichat.FederationServerConfiguration{{Addr: sB.URL, Name: "b", PublicKey: pub2}},
+		Timeout:    time.Second,
+	})
+	var fB = astichat.NewFederation(astichat.FederationConfiguration{
+		Name:       "b",
+		PrivateKey: prv2,
+		Servers:    []astichat.FederationServerConfiguration{{Addr: sA.URL, Name: "a", PublicKey: pub1}},
+		Timeout:    time.Second,
+	})
+
+	// Init servers
+	var dirA, dirB string
+	hA, dirA = newServerHTTP(t, stgA, fA)
+	defer os.RemoveAll(dirA)
+	defer hA.Close()
+	hB, dirB = newServerHTTP(t, stgB, fB)
+	defer os.RemoveAll(dirB)
+	defer hB.Close()
+	var uB, addrB = newServerUDP(t, stgB, fB)
+	defer uB.Close()
+
+	// Connect bob before server A starts
+	var bob = newTestPeer(t, "bob", "d2", prv2, pub2, addrB)
+	defer bob.close()
+	bob.write(astichat.EventNamePeerConnect, astichat.MessageConnect)
+	bob.wait(astichat.EventNamePeerConnected)
+
+	// Server A fetches the peers of server B when it starts
+	var uA, addrA = newServerUDP(t, stgA, fA)
+	defer uA.Close()
+	var alice = newTestPeer(t, "alice", "d1", prv2, pub2, addrA)
+	defer alice.close()
+	var deadline = time.Now().Add(5 * time.Second)
+	for {
+		alice.write(astichat.EventNamePeerConnect, astichat.MessageConnect)
+		var ps []*astichat.Peer
+		assert.NoError(t, json.Unmarshal(alice.wait(astichat.EventNamePeerConnected), &ps))
+		if len(ps) == 1 && ps[0].Username == "bob@b" {
+			assert.Equal(t, "d2", ps[0].Device.ID)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("bob@b has not been synced")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Public keys of a federated chatterer
+	var code, rsp = request(t, hA.HandlePublicKeysPOST, "alice", "d1", []byte("bob@b"), prv2, pub2)
+	assert.Equal(t, http.StatusOK, code)
+	var ds []astichat.Device
+	assert.NoError(t, json.Unmarshal(rsp, &ds))
+	assert.Len(t, ds, 1)
+	if len(ds) == 1 {
+		assert.Equal(t, "d2", ds[0].ID)
+	}
+
+	// Message to a federated chatterer is delivered by its server
+	var em = astichat.EncryptedMessage{Message: []byte("hello")}
+	var msg, err = json.Marshal(astichat.MessageRequest{Messages: map[string]astichat.EncryptedMessage{"d2": em}, Notify: true, Recipient: "bob@b"})
+	assert.NoError(t, err)
+	code, rsp = request(t, hA.HandleMessagesPOST, "alice", "d1", msg, prv2, pub2)
+	assert.Equal(t, http.StatusOK, code)
+	var ids []string
+	assert.NoError(t, json.Unmarshal(rsp, &ids))
+	assert.Len(t, ids, 1)
+	var m astichat.Message
+	assert.NoError(t, json.Unmarshal(bob.wait(astichat.EventNameMessageQueued), &m))
+	assert.Equal(t, em, m.Message)
+	assert.Equal(t, "alice@a", m.Sender)
+	var ms []astichat.Message
+	ms, _ = stgA.MessageFetchByRecipient("bob", "d2")
+	assert.Len(t, ms, 0)
+
+	// Peers of server B leaving and joining are broadcast to the peers of server A
+	var p astichat.Peer
+	uB.Disconnect("bob", "d2")
+	assert.NoError(t, json.Unmarshal(alice.wait(astichat.EventNamePeerDisconnected), &p))
+	assert.Equal(t, "bob@b", p.Username)
+	bob.write(astichat.EventNamePeerConnect, astichat.MessageConnect)
+	bob.wait(astichat.EventNamePeerConnected)
+	assert.NoError(t, json.Unmarshal(alice.wait(astichat.EventNamePeerJoined), &p))
+	assert.Equal(t, "bob@b", p.Username)
+}
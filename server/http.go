@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"text/template"
 	"time"
 
@@ -19,20 +22,34 @@ import (
 
 // ServerHTTP represents an HTTP server
 type ServerHTTP struct {
-	addr       string
-	builder    *builder.Builder
-	pathStatic string
-	storage    astichat.Storage
-	templates  *template.Template
+	addr           string
+	admin          *http.Server
+	builder        builder.Builder
+	disconnect     func(username, device string) // Disconnects revoked devices, optional
+	federation     *astichat.Federation
+	hook           astichat.Hook
+	maxDevices     int
+	maxMessageSize int
+	messageTTL     time.Duration
+	pathStatic     string
+	queue          *builder.Queue
+	server         *http.Server
+	signingKey     *astichat.PublicKey
+	storage        astichat.Storage
+	stream         *astichat.StreamServer
+	templates      *template.Template
 }
 
 // NewServerHTTP creates a new HTTP server
-func NewServerHTTP(addr, pathStatic string, b *builder.Builder, stg astichat.Storage) *ServerHTTP {
+func NewServerHTTP(addr, pathStatic string, b builder.Builder, stg astichat.Storage, stream *astichat.StreamServer, f *astichat.Federation) *ServerHTTP {
 	return &ServerHTTP{
 		addr:       addr,
 		builder:    b,
+		federation: f,
+		hook:       astichat.NopHook{},
 		pathStatic: pathStatic,
 		storage:    stg,
+		stream:     stream,
 	}
 }
 
@@ -42,35 +59,140 @@ func (s *ServerHTTP) Init(c Configuration) (err error) {
 	if s.templates, err = astitemplate.ParseDirectory(c.PathTemplates, ".html"); err != nil {
 		return
 	}
+
+	// Chatterers
+	if c.MaxDevices < 1 {
+		err = fmt.Errorf("Max devices %d must be at least 1", c.MaxDevices)
+		return
+	}
+	s.maxDevices = c.MaxDevices
+	s.maxMessageSize = c.MaxMessageSize
+	s.messageTTL = c.MessageTTL
+
+	// Signing key
+	// Its fingerprint must be published so that users can verify their clients
+	if c.Builder.SigningKey != nil {
+		if s.signingKey, err = c.Builder.SigningKey.PublicKey(); err != nil {
+			return
+		}
+		var fingerprint string
+		if fingerprint, err = astichat.KeyFingerprint(s.signingKey); err != nil {
+			return
+		}
+		astilog.Infof("Signing key fingerprint is %s", fingerprint)
+	}
+
+	// Init build queue
+	s.queue = builder.NewQueue(c.Builder)
+	s.queue.Logger = astilog.GetLogger()
+	s.queue.Start()
+
+	// Init server
+	s.server = &http.Server{Addr: s.addr, Handler: s.router()}
+
+	// Init admin server
+	// It's optional and only enabled when an addr is configured
+	if c.Addr.Admin != "" {
+		s.admin = &http.Server{Addr: c.Addr.Admin, Handler: s.adminRouter()}
+	}
 	return
 }
 
-// ListenAndServe listens and serve
-func (s *ServerHTTP) ListenAndServe() {
+// SetHook sets the hook reacting to the events of the HTTP server
+func (s *ServerHTTP) SetHook(h astichat.Hook) {
+	s.hook = h
+}
+
+// authFailed emits the hook event of a request that failed to authenticate
+func (s *ServerHTTP) authFailed(r *http.Request, username string, err error) {
+	var e = astichat.NewHookEvent(astichat.HookEventNameAuthFailed)
+	e.Addr = r.RemoteAddr
+	e.Reason = err.Error()
+	e.Username = username
+	s.hook.HandleEvent(e)
+}
+
+// router returns the router
+func (s *ServerHTTP) router() http.Handler {
 	// Init router
 	var r = httprouter.New()
 
 	// Website
 	r.GET("/", s.HandleHomepageGET)
 	r.POST("/download", s.HandleDownloadPOST)
+	r.GET("/download/:id", s.HandleDownloadGET)
+	r.GET("/download/:id/file", s.HandleDownloadFileGET)
+	r.POST("/federation", s.HandleFederationPOST)
+	r.POST("/devices/revoke", s.HandleDevicesRevokePOST)
 	r.GET("/now", s.HandleNowGET)
+	r.GET("/signing_key", s.HandleSigningKeyGET)
+	r.POST("/messages", s.HandleMessagesPOST)
+	r.POST("/public_keys", s.HandlePublicKeysPOST)
+	r.GET("/stream", s.HandleStreamGET)
 	r.POST("/token", s.HandleTokenPOST)
 
 	// Static files
 	r.ServeFiles("/static/*filepath", http.Dir(s.pathStatic))
+	return r
+}
+
+// adminRouter returns the router of the admin server
+// Metrics expose per-IP and per-username counters and are therefore not served publicly
+func (s *ServerHTTP) adminRouter() http.Handler {
+	var r = httprouter.New()
+	r.GET("/metrics", s.HandleMetricsGET)
+	return r
+}
 
-	// Serve
+// ListenAndServe listens and serve
+func (s *ServerHTTP) ListenAndServe() {
+	if s.admin != nil {
+		go func() {
+			astilog.Debugf("Listening and serving admin on http://%s", s.admin.Addr)
+			if err := s.admin.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				astilog.Fatal(err)
+			}
+		}()
+	}
 	astilog.Debugf("Listening and serving on http://%s", s.addr)
-	if err := http.ListenAndServe(s.addr, r); err != nil {
+	if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		astilog.Fatal(err)
 	}
 	return
 }
 
+// Shutdown stops accepting HTTP requests and waits for in-flight requests until the context is done
+func (s *ServerHTTP) Shutdown(ctx context.Context) error {
+	if s.admin != nil {
+		if err := s.admin.Shutdown(ctx); err != nil {
+			astilog.Errorf("%s while shutting down admin HTTP server", err)
+		}
+	}
+	return s.server.Shutdown(ctx)
+}
+
+// Close waits for the clients being built
+func (s *ServerHTTP) Close() {
+	if s.queue != nil {
+		s.queue.Close()
+	}
+}
+
+// HandleStreamGET upgrades the connection to a stream conn for clients that can't use UDP
+func (s *ServerHTTP) HandleStreamGET(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s.stream.ServeHTTP(rw, r)
+}
+
+// HandleFederationPOST handles events sent by federated servers
+func (s *ServerHTTP) HandleFederationPOST(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	s.federation.ServeHTTP(rw, r)
+}
+
 // HandleHomepageGET returns the homepage handler
+// The OS dropdown lists the platforms supported by the builder
 func (s *ServerHTTP) HandleHomepageGET(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
 	// Execute template
-	if err := s.templates.ExecuteTemplate(rw, "/homepage.html", nil); err != nil {
+	if err := s.templates.ExecuteTemplate(rw, "/homepage.html", builder.Platforms); err != nil {
 		astilog.Errorf("%s while executing homepage GET template", err)
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
@@ -108,8 +230,8 @@ var AstichatNewPrivateKey = func(passphrase string) (*astichat.PrivateKey, error
 }
 
 // BuilderBuild allows testing functions using it
-var BuilderBuild = func(b *builder.Builder, os, username string, prvClient *astichat.PrivateKey, pubServer *astichat.PublicKey) (string, error) {
-	return b.Build(os, username, prvClient, pubServer)
+var BuilderBuild = func(ctx context.Context, b builder.Builder, os, username, deviceID string, prvClient *astichat.PrivateKey, pubServer *astichat.PublicKey) (string, error) {
+	return b.Build(ctx, os, username, deviceID, prvClient, pubServer)
 }
 
 // OSRemove allows testing functions using it
@@ -117,17 +239,20 @@ var OSRemove = func(path string) error {
 	return os.Remove(path)
 }
 
+// Errors
+var errTooManyDevices = errors.New("Too many devices, please revoke one of them first")
+
 // IOUtilReadFile allows testing functions using it
 var IOUtilReadFile = func(path string) ([]byte, error) {
 	return ioutil.ReadFile(path)
 }
 
-// HandleDownloadPOST returns a newly built client
+// HandleDownloadPOST validates a download request and enqueues the build of the client
 func (srv *ServerHTTP) HandleDownloadPOST(rw http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	// Process HTTP errors
 	var errServer error
 	var errRequest error
-	defer srv.processErrors(rw, &errRequest, &errServer, "/")
+	defer srv.processErrors(rw, &errRequest, &errServer, "")
 
 	// Username is empty
 	var username = r.FormValue("username")
@@ -137,6 +262,13 @@ func (srv *ServerHTTP) HandleDownloadPOST(rw http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Username can't contain the separator of federated addresses
+	if strings.Contains(username, "@") {
+		astilog.Errorf("Invalid username %s", username)
+		errRequest = errors.New("Username can't contain @")
+		return
+	}
+
 	// Password is empty
 	var password = r.FormValue("password")
 	if len(password) == 0 {
@@ -171,17 +303,43 @@ func (srv *ServerHTTP) HandleDownloadPOST(rw http.ResponseWriter, r *http.Reques
 		}
 
 		// Decode the token
+		// It has been encoded by one of the chatterer's devices
 		var t astichat.Token
-		if t, errServer = astichat.DecodeToken(token, c.ServerPrivateKey); errServer != nil {
+		for _, d := range c.Devices {
+			if t, errServer = astichat.DecodeToken(token, d.ServerPrivateKey); errServer == nil {
+				break
+			}
+		}
+		if errServer != nil {
 			astilog.Errorf("%s while decoding token %s", errServer, token)
+			srv.authFailed(r, username, errServer)
 			return
 		}
 
 		// Validate token
 		if errServer = t.Validate(c); errServer != nil {
 			astilog.Errorf("%s while validating token %s", errServer, token)
+			srv.authFailed(r, username, errServer)
 			return
+		}
 
+		// Chatterer has too many devices
+		if len(c.Devices) >= srv.maxDevices {
+			astilog.Errorf("Chatterer %s has too many devices", username)
+			errRequest = errTooManyDevices
+			return
+		}
+
+		// Consume the token
+		// It's consumed before enqueuing so that it can't be used for several upgrades, even if the build fails
+		if errServer = srv.storage.ChattererConsumeToken(username, string(t)); errServer != nil && errServer != astichat.ErrNotFoundInStorage {
+			astilog.Errorf("%s while consuming token of chatterer %s", errServer, username)
+			return
+		} else if errServer == astichat.ErrNotFoundInStorage {
+			errServer = nil
+			astilog.Errorf("Token of chatterer %s has already been used", username)
+			errRequest = errors.New("Token has already been used")
+			return
 		}
 	} else {
 		// Username is unique
@@ -204,78 +362,229 @@ func (srv *ServerHTTP) HandleDownloadPOST(rw http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Generate client's private key
-	var prvClient *astichat.PrivateKey
-	if prvClient, errServer = AstichatNewPrivateKey(password); errServer != nil {
-		astilog.Errorf("%s while generating private key", errServer)
+	// Package format is valid
+	var format = r.FormValue("package")
+	if !builder.IsValidPackageFormat(format) {
+		astilog.Errorf("Invalid package format %s", format)
+		errRequest = errors.New("Invalid package format")
 		return
 	}
 
-	// Get client's public key
-	var pubClient *astichat.PublicKey
-	if pubClient, errServer = prvClient.PublicKey(); errServer != nil {
-		astilog.Errorf("%s while getting public key from rsa private key", errServer)
+	// Enqueue build
+	// Keys are generated and the client is built by the queue's workers so that concurrent downloads can't exhaust
+	// the server, and the browser polls the status of the job
+	var j builder.Job
+	if j, errServer = srv.queue.Enqueue(srv.buildJob(r, username, password, outputOS, format, isUpgrade)); errServer != nil {
+		astilog.Errorf("%s while enqueuing build for %s", errServer, username)
+		if errServer == builder.ErrQueueFull {
+			errServer = nil
+			errRequest = errors.New("Too many downloads in progress, please try again later")
+		}
 		return
 	}
 
-	// Generate server's private key
-	var prvServer *astichat.PrivateKey
-	if prvServer, errServer = AstichatNewPrivateKey(""); errServer != nil {
-		astilog.Errorf("%s while generating private key", errServer)
+	// Write
+	if errServer = json.NewEncoder(rw).Encode(j); errServer != nil {
+		astilog.Errorf("%s while writing", errServer)
 		return
 	}
+}
+
+// buildJob returns the job building a client
+// Errors returned by the job are displayed to the user
+func (srv *ServerHTTP) buildJob(r *http.Request, username, password, outputOS, format string, isUpgrade bool) builder.JobFunc {
+	var addr = r.RemoteAddr
+	var errUnknown = errors.New("Unknown error")
+	return func(ctx context.Context) (a builder.Artifact, err error) {
+		// Generate client's private key
+		var prvClient *astichat.PrivateKey
+		if prvClient, err = AstichatNewPrivateKey(password); err != nil {
+			astilog.Errorf("%s while generating private key", err)
+			return a, errUnknown
+		}
 
-	// Get server's public key
-	var pubServer *astichat.PublicKey
-	if pubServer, errServer = prvServer.PublicKey(); errServer != nil {
-		astilog.Errorf("%s while getting public key from rsa private key", errServer)
+		// Get client's public key
+		var pubClient *astichat.PublicKey
+		if pubClient, err = prvClient.PublicKey(); err != nil {
+			astilog.Errorf("%s while getting public key from rsa private key", err)
+			return a, errUnknown
+		}
+
+		// Generate server's private key
+		var prvServer *astichat.PrivateKey
+		if prvServer, err = AstichatNewPrivateKey(""); err != nil {
+			astilog.Errorf("%s while generating private key", err)
+			return a, errUnknown
+		}
+
+		// Get server's public key
+		var pubServer *astichat.PublicKey
+		if pubServer, err = prvServer.PublicKey(); err != nil {
+			astilog.Errorf("%s while getting public key from rsa private key", err)
+			return a, errUnknown
+		}
+
+		// Create device
+		var d = astichat.NewDevice(pubClient, prvServer)
+
+		// Build client
+		var outputPath string
+		if outputPath, err = BuilderBuild(ctx, srv.builder, outputOS, username, d.ID, prvClient, pubServer); err != nil {
+			astilog.Errorf("%s while building client for os %s", err, outputOS)
+			return a, buildErrorMessage(err, errUnknown)
+		}
+
+		// Package client
+		if a, err = srv.builder.Package(outputPath, outputOS, username, format); err != nil {
+			astilog.Errorf("%s while packaging client %s", err, outputPath)
+			OSRemove(outputPath)
+			return a, errUnknown
+		}
+
+		// Create/Update chatterer
+		// Both are atomic since other jobs or requests may have updated the chatterer or taken the username while
+		// the job was queued
+		if isUpgrade {
+			if err = srv.storage.ChattererAddDevice(username, d, srv.maxDevices); err != nil {
+				OSRemove(a.Path)
+				if err == astichat.ErrNotFoundInStorage {
+					astilog.Errorf("Chatterer %s has too many devices", username)
+					return a, errTooManyDevices
+				}
+				astilog.Errorf("%s while adding device to chatterer with username %s", err, username)
+				return a, errUnknown
+			}
+		} else {
+			if _, err = srv.storage.ChattererCreate(username, d); err != nil {
+				OSRemove(a.Path)
+				if err == astichat.ErrAlreadyExistsInStorage {
+					astilog.Errorf("Username %s is already used", username)
+					return a, errors.New("Username is already used")
+				}
+				astilog.Errorf("%s while creating chatterer with username %s", err, username)
+				return a, errUnknown
+			}
+		}
+
+		// Emit hook event
+		var e = astichat.NewHookEvent(astichat.HookEventNameChattererDownloaded)
+		if isUpgrade {
+			e.Name = astichat.HookEventNameChattererUpgraded
+		}
+		e.Addr = addr
+		e.Device = d.ID
+		e.OS = outputOS
+		e.Username = username
+		srv.hook.HandleEvent(e)
 		return
 	}
+}
 
-	// Build client
-	var outputPath string
-	if outputPath, errServer = BuilderBuild(srv.builder, outputOS, username, prvClient, pubServer); errServer != nil {
-		astilog.Errorf("%s while building client for os %s", errServer, outputOS)
+// buildErrorMessage returns the error displayed to the user when a build has failed
+// The output of the go tool is only logged
+func buildErrorMessage(err, errDefault error) error {
+	var e, ok = err.(*builder.BuildError)
+	if !ok {
+		return errDefault
+	}
+	if e.Output != "" {
+		astilog.Errorf("Output of the build for os %s: %s", e.OS, e.Output)
+	}
+	switch e.Code {
+	case builder.BuildErrorCodeCanceled:
+		return errors.New("Build has been canceled, please try again")
+	case builder.BuildErrorCodeTimeout:
+		return errors.New("Build has timed out, please try again later")
+	}
+	return errDefault
+}
+
+// HandleDownloadGET returns the status of a build job
+// The browser polls it until the job is over: jobs it stops polling are canceled
+func (srv *ServerHTTP) HandleDownloadGET(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	// Process HTTP errors
+	var errServer error
+	var errRequest error
+	defer srv.processErrors(rw, &errRequest, &errServer, "")
+
+	// Poll job
+	var j, ok = srv.queue.Poll(p.ByName("id"))
+	if !ok {
+		rw.WriteHeader(http.StatusNotFound)
 		return
 	}
-	defer OSRemove(outputPath)
 
-	// Create/Update chatterer
-	if isUpgrade {
-		c.ClientPublicKey = pubClient
-		c.ServerPrivateKey = prvServer
-		c.Token = ""
-		c.TokenAt = time.Time{}
-		if errServer = srv.storage.ChattererUpdate(c); errServer != nil {
-			astilog.Errorf("%s while updating chatterer with username %s", errServer, username)
-			return
-		}
-	} else {
-		if _, errServer = srv.storage.ChattererCreate(username, pubClient, prvServer); errServer != nil {
-			astilog.Errorf("%s while creating chatterer with username %s", errServer, username)
-			return
-		}
+	// Write
+	if errServer = json.NewEncoder(rw).Encode(j); errServer != nil {
+		astilog.Errorf("%s while writing", errServer)
+		return
+	}
+}
+
+// Headers
+const (
+	headerChecksum  = "X-Checksum-Sha256"
+	headerSignature = "X-Signature"
+)
+
+// HandleDownloadFileGET returns the client built by a job
+// The client is removed once it has been downloaded
+func (srv *ServerHTTP) HandleDownloadFileGET(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	// Process HTTP errors
+	var errServer error
+	var errRequest error
+	defer srv.processErrors(rw, &errRequest, &errServer, "/")
+
+	// Get job
+	var j, ok = srv.queue.Get(p.ByName("id"))
+	if !ok {
+		errRequest = errors.New("Download has expired")
+		return
+	} else if j.Status != builder.JobStatusDone {
+		errRequest = errors.New("Download is not ready")
+		return
 	}
 
 	// Read file
 	var b []byte
-	if b, errServer = IOUtilReadFile(outputPath); errServer != nil {
-		astilog.Errorf("%s while reading file %s", errServer, outputPath)
+	if b, errServer = IOUtilReadFile(j.Artifact.Path); errServer != nil {
+		astilog.Errorf("%s while reading file %s", errServer, j.Artifact.Path)
 		return
 	}
 
 	// Set headers
+	// The checksum and the signature allow users to check the file they've received
 	rw.Header().Set("Pragma", "public")
 	rw.Header().Set("Cache-Control", "private")
-	rw.Header().Set("Content-Disposition", "attachment; filename=astichat.exe")
-	rw.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+	rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", j.Artifact.Filename))
+	rw.Header().Set("Content-Type", j.Artifact.ContentType)
 	rw.Header().Set("Content-Transfer-Encoding", "binary")
 	rw.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	rw.Header().Set(headerChecksum, j.Artifact.Checksum)
+	if j.Artifact.Signature != "" {
+		rw.Header().Set(headerSignature, j.Artifact.Signature)
+	}
 	rw.Write(b)
+
+	// Remove job
+	if err := srv.queue.Remove(j.ID); err != nil {
+		astilog.Errorf("%s while removing job %s", err, j.ID)
+	}
 }
 
 // handle allows handling simple requests
 func (srv *ServerHTTP) handle(rw http.ResponseWriter, r *http.Request, expectedMsg []byte, fn func(c astichat.Chatterer) ([]byte, error)) {
+	srv.handleMessage(rw, r, func(c astichat.Chatterer, msg []byte) ([]byte, error) {
+		// Validate message
+		if err := astichat.ValidateMessage(msg, expectedMsg); err != nil {
+			return nil, err
+		}
+		return fn(c)
+	})
+}
+
+// handleMessage allows handling requests whose decrypted message is processed by the custom handler
+func (srv *ServerHTTP) handleMessage(rw http.ResponseWriter, r *http.Request, fn func(c astichat.Chatterer, msg []byte) ([]byte, error)) {
 	// Process HTTP errors
 	var errServer error
 	var errRequest error
@@ -292,30 +601,36 @@ func (srv *ServerHTTP) handle(rw http.ResponseWriter, r *http.Request, expectedM
 	var c astichat.Chatterer
 	if c, errServer = srv.storage.ChattererFetchByUsername(b.Request.Username); errServer != nil {
 		astilog.Errorf("%s while fetching chatterer by username %s", errServer, b.Request.Username)
+		srv.authFailed(r, b.Request.Username, errServer)
 		return
 	}
 
-	// Process body
-	var msg []byte
-	if msg, errServer = b.Process(astichat.TimeNow(), c.ServerPrivateKey); errServer != nil {
-		astilog.Errorf("%s while processing body", errServer)
+	// Retrieve device
+	var d astichat.Device
+	var ok bool
+	if d, ok = c.Device(b.Request.Device); !ok {
+		errServer = fmt.Errorf("Invalid device %s", b.Request.Device)
+		astilog.Errorf("%s for chatterer %s", errServer, c.Username)
+		srv.authFailed(r, c.Username, errServer)
 		return
 	}
 
-	// Validate message
-	if errServer = astichat.ValidateMessage(msg, expectedMsg); errServer != nil {
-		astilog.Errorf("%s while validating message", errServer)
+	// Process body
+	var msg []byte
+	if msg, errServer = b.Process(astichat.TimeNow(), d.ServerPrivateKey); errServer != nil {
+		astilog.Errorf("%s while processing body", errServer)
+		srv.authFailed(r, c.Username, errServer)
 		return
 	}
 
 	// Custom handler
-	if msg, errServer = fn(c); errServer != nil {
+	if msg, errServer = fn(c, msg); errServer != nil {
 		astilog.Errorf("%s while executing custom handler", errServer)
 		return
 	}
 
 	// Create new body
-	if b, errServer = astichat.NewBody(msg, astichat.TimeNow(), "", c.ClientPublicKey); errServer != nil {
+	if b, errServer = astichat.NewBody(msg, astichat.TimeNow(), "", d.ClientPublicKey); errServer != nil {
 		astilog.Errorf("%s while creating new body", errServer)
 		return
 	}
@@ -342,6 +657,26 @@ func (srv *ServerHTTP) HandleNowGET(rw http.ResponseWriter, r *http.Request, p h
 	}
 }
 
+// HandleSigningKeyGET returns the public key verifying the signature of the clients
+// It shouldn't be protected as clients need it to verify themselves
+func (srv *ServerHTTP) HandleSigningKeyGET(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	// Clients are not signed
+	if srv.signingKey == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Write
+	rw.Header().Set("Content-Type", "text/plain")
+	rw.Write([]byte(srv.signingKey.String()))
+}
+
+// HandleMetricsGET returns the metrics
+func (srv *ServerHTTP) HandleMetricsGET(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write([]byte(metrics.String()))
+}
+
 // HandleTokenPOST delivers a token for a specific username that can be used during a short period of time to interact
 // with the server
 func (srv *ServerHTTP) HandleTokenPOST(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
@@ -351,11 +686,176 @@ func (srv *ServerHTTP) HandleTokenPOST(rw http.ResponseWriter, r *http.Request,
 		c.TokenAt = astichat.TimeNow()
 
 		// Store token
-		if err = srv.storage.ChattererUpdate(c); err != nil {
-			astilog.Errorf("%s while updating chatterer %s", err, c.ID)
+		if err = srv.storage.ChattererSetToken(c.Username, c.Token, c.TokenAt); err != nil {
+			astilog.Errorf("%s while setting token of chatterer %s", err, c.Username)
 			return
 		}
+
+		// Emit hook event
+		var e = astichat.NewHookEvent(astichat.HookEventNameTokenIssued)
+		e.Addr = r.RemoteAddr
+		e.Username = c.Username
+		srv.hook.HandleEvent(e)
 		b = []byte(c.Token)
 		return
 	})
 }
+
+// HandleDevicesRevokePOST revokes the device of the chatterer whose ID is the message
+// The revoked device is disconnected and can't authenticate anymore, the last device can't be revoked
+func (srv *ServerHTTP) HandleDevicesRevokePOST(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	srv.handleMessage(rw, r, func(c astichat.Chatterer, msg []byte) (b []byte, err error) {
+		// Device is invalid
+		if _, ok := c.Device(string(msg)); !ok {
+			err = fmt.Errorf("Invalid device %s", msg)
+			return
+		}
+
+		// Remove device
+		// Devices are only removed by the storage so that devices added concurrently are not overwritten
+		if err = srv.storage.ChattererRemoveDevice(c.Username, string(msg)); err == astichat.ErrNotFoundInStorage {
+			err = fmt.Errorf("Device %s is the last device of chatterer %s", msg, c.Username)
+			return
+		} else if err != nil {
+			astilog.Errorf("%s while removing device %s of chatterer %s", err, msg, c.Username)
+			return
+		}
+
+		// Disconnect device
+		if srv.disconnect != nil {
+			srv.disconnect(c.Username, string(msg))
+		}
+
+		// Emit hook event
+		var e = astichat.NewHookEvent(astichat.HookEventNameDeviceRevoked)
+		e.Addr = r.RemoteAddr
+		e.Device = string(msg)
+		e.Username = c.Username
+		srv.hook.HandleEvent(e)
+		b = msg
+		return
+	})
+}
+
+// HandlePublicKeysPOST returns the devices' public keys of the chatterer whose address is the message so that messages
+// can be encrypted for him even if he's offline
+// Devices of chatterers of federated servers are fetched from their server
+func (srv *ServerHTTP) HandlePublicKeysPOST(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	srv.handleMessage(rw, r, func(c astichat.Chatterer, msg []byte) (b []byte, err error) {
+		// Fetch recipient's devices
+		var ds []astichat.Device
+		if username, ok := srv.federation.Local(string(msg)); !ok {
+			if ds, err = srv.federation.Devices(string(msg)); err != nil {
+				astilog.Errorf("%s while fetching devices of %s", err, msg)
+				return
+			}
+		} else {
+			var rc astichat.Chatterer
+			if rc, err = srv.storage.ChattererFetchByUsername(username); err != nil {
+				astilog.Errorf("%s while fetching chatterer by username %s", err, username)
+				return
+			}
+			ds = rc.Devices
+		}
+
+		// Marshal devices
+		if b, err = json.Marshal(ds); err != nil {
+			astilog.Errorf("%s while marshaling devices of %s", err, msg)
+			return
+		}
+		return
+	})
+}
+
+// HandleMessagesPOST queues an end-to-end encrypted message for an offline chatterer
+func (srv *ServerHTTP) HandleMessagesPOST(rw http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	srv.handleMessage(rw, r, func(c astichat.Chatterer, msg []byte) (b []byte, err error) {
+		// Unmarshal
+		var mr astichat.MessageRequest
+		if err = json.Unmarshal(msg, &mr); err != nil {
+			astilog.Errorf("%s while unmarshaling message request", err)
+			return
+		}
+
+		// A chatterer can't have more devices than the max number of devices
+		if len(mr.Messages) == 0 || len(mr.Messages) > srv.maxDevices {
+			err = fmt.Errorf("Invalid number of messages %d", len(mr.Messages))
+			astilog.Errorf("%s for %s", err, mr.Recipient)
+			return
+		}
+
+		// Messages are not too large
+		for device, em := range mr.Messages {
+			if em.Size() > srv.maxMessageSize {
+				err = fmt.Errorf("Message size %d for device %s exceeds max message size %d", em.Size(), device, srv.maxMessageSize)
+				astilog.Errorf("%s for %s", err, mr.Recipient)
+				return
+			}
+		}
+
+		// Recipient is a chatterer of a federated server
+		var username, ok = srv.federation.Local(mr.Recipient)
+		if !ok {
+			// Send message
+			var ids []string
+			if ids, err = srv.federation.Message(c.Username, mr); err != nil {
+				astilog.Errorf("%s while sending message to %s", err, mr.Recipient)
+				return
+			}
+
+			// Marshal
+			if b, err = json.Marshal(ids); err != nil {
+				astilog.Errorf("%s while marshaling message ids", err)
+				return
+			}
+			return
+		}
+		mr.Recipient = username
+
+		// Recipient exists
+		var rc astichat.Chatterer
+		if rc, err = srv.storage.ChattererFetchByUsername(mr.Recipient); err != nil {
+			astilog.Errorf("%s while fetching chatterer by username %s", err, mr.Recipient)
+			return
+		}
+
+		// Devices exist
+		// They're all checked before creating any message so that an invalid device doesn't leave part of the
+		// messages queued
+		for device := range mr.Messages {
+			if _, ok := rc.Device(device); !ok {
+				err = fmt.Errorf("Invalid device %s", device)
+				astilog.Errorf("%s for chatterer %s", err, rc.Username)
+				return
+			}
+		}
+
+		// Loop through devices
+		var now = astichat.TimeNow()
+		var ids []string
+		for device, em := range mr.Messages {
+			// Create message
+			var m astichat.Message
+			if m, err = srv.storage.MessageCreate(astichat.Message{
+				CreatedAt: now,
+				Device:    device,
+				ExpiresAt: now.Add(srv.messageTTL),
+				Message:   em,
+				Notify:    mr.Notify,
+				Recipient: mr.Recipient,
+				Sender:    c.Username,
+			}); err != nil {
+				astilog.Errorf("%s while creating message for %s", err, mr.Recipient)
+				return
+			}
+			ids = append(ids, m.ID)
+		}
+
+		// Marshal
+		if b, err = json.Marshal(ids); err != nil {
+			astilog.Errorf("%s while marshaling message ids", err)
+			return
+		}
+		return
+	})
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 
 	"github.com/asticode/go-astichat/astichat"
 	"github.com/asticode/go-astichat/builder"
@@ -11,6 +12,12 @@ import (
 	"gopkg.in/mgo.v2"
 )
 
+// Subcommands
+const (
+	subcommandFederationKey = "federation-key"
+	subcommandSigningKey    = "signing-key"
+)
+
 func main() {
 	// Parse command
 	var s = astiflag.Subcommand()
@@ -22,7 +29,19 @@ func main() {
 	// Init logger
 	astilog.SetLogger(astilog.New(c.Logger))
 
+	// Generate the private key used to authenticate the server in the federation or to sign the clients
+	// It doesn't need the server to be initialized
+	if s == subcommandFederationKey || s == subcommandSigningKey {
+		if err := newKey(); err != nil {
+			astilog.Fatal(err)
+		}
+		return
+	}
+
 	// Init builder
+	if err := c.Builder.Validate(); err != nil {
+		astilog.Fatal(err)
+	}
 	var b = builder.New(c.Builder)
 
 	// Init mongo
@@ -31,10 +50,13 @@ func main() {
 	if ms, err = astimgo.NewSession(c.Mongo); err != nil {
 		astilog.Fatal(err)
 	}
-	defer ms.Close()
 
 	// Init storage
+	// The mongo session is closed with the storage when the server is closed
 	var stg = astichat.NewStorageMongo(ms)
+	if err = stg.Init(); err != nil {
+		astilog.Fatal(err)
+	}
 
 	// Init server
 	var srv *Server
@@ -56,3 +78,22 @@ func main() {
 		srv.Wait()
 	}
 }
+
+// newKey prints a new private key and its public key
+func newKey() (err error) {
+	// Generate private key
+	var prv *astichat.PrivateKey
+	if prv, err = astichat.NewPrivateKey(""); err != nil {
+		return
+	}
+
+	// Get public key
+	var pub *astichat.PublicKey
+	if pub, err = prv.PublicKey(); err != nil {
+		return
+	}
+
+	// Print
+	fmt.Printf("private_key = \"%s\"\npublic_key = \"%s\"\n", prv, pub)
+	return
+}
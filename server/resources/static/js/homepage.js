@@ -16,11 +16,67 @@ var homepage = {
         // Errors
         $("button").click(function() {
             $('.form-error').hide();
+            $('.form-info').hide();
         });
         if (getQueryParam('error') != '') {
-            $('.form-error').show();
-            $('.form-error .alert').text(getQueryParam('error'));
+            homepage.error(getQueryParam('error'));
         }
+
+        // Download
+        // The client is built asynchronously therefore we poll the status of the build until it's done
+        $("form").submit(function(e) {
+            e.preventDefault();
+            var button = $("button");
+            var text = button.text();
+            button.prop("disabled", true).text("Building...");
+            var done = function() {
+                button.prop("disabled", false).text(text);
+            };
+            $.post("/download", $(this).serialize(), null, "json").done(function(job) {
+                homepage.poll(job.id, done);
+            }).fail(function(xhr) {
+                done();
+                homepage.error(xhr.responseJSON ? xhr.responseJSON.error : "Unknown error");
+            });
+        });
+    },
+    error: function(message) {
+        $('.form-error').show();
+        $('.form-error .alert').text(message);
+    },
+    info: function(message) {
+        $('.form-info').show();
+        $('.form-info .alert').text(message);
+    },
+    signature: function(artifact) {
+        // The signature is generated in the browser since the job is removed once the file has been downloaded
+        $('<a>').attr("download", artifact.filename + ".sig")
+            .attr("href", "data:text/plain;base64," + btoa(artifact.signature + "\n"))
+            .text("Download signature")
+            .appendTo($('.form-info .alert').append(" "));
+    },
+    poll: function(id, done) {
+        $.getJSON("/download/" + id).done(function(job) {
+            switch (job.status) {
+                case "done":
+                    done();
+                    homepage.info("SHA-256 of " + job.artifact.filename + ": " + job.artifact.checksum);
+                    if (job.artifact.signature) {
+                        homepage.signature(job.artifact);
+                    }
+                    window.location = "/download/" + id + "/file";
+                    break;
+                case "failed":
+                    done();
+                    homepage.error(job.error);
+                    break;
+                default:
+                    setTimeout(function() { homepage.poll(id, done); }, 1000);
+            }
+        }).fail(function() {
+            done();
+            homepage.error("Download has expired");
+        });
     }
 };
 
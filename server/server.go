@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"expvar"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -11,22 +14,70 @@ import (
 	"github.com/asticode/go-astilog"
 )
 
+// Vars
+var (
+	metrics                    = expvar.NewMap("astichat")
+	metricsClientVersions      = new(expvar.Map).Init() // Number of connections per client version
+	metricsClientVersionsMutex = &sync.Mutex{}
+)
+
+// Client versions consts
+const (
+	clientVersionOther     = "other"
+	maxClientVersionLength = 64
+	maxClientVersions      = 100
+)
+
+// addClientVersion counts a connection of a client version
+// Versions are sent by clients, therefore the versions exceeding the max length or the max number of versions are
+// counted as "other"
+func addClientVersion(version string) {
+	metricsClientVersionsMutex.Lock()
+	defer metricsClientVersionsMutex.Unlock()
+	if len(version) > maxClientVersionLength {
+		version = clientVersionOther
+	} else if metricsClientVersions.Get(version) == nil {
+		// A slot is kept for "other"
+		var n int
+		metricsClientVersions.Do(func(kv expvar.KeyValue) {
+			if kv.Key != clientVersionOther {
+				n++
+			}
+		})
+		if n >= maxClientVersions-1 {
+			version = clientVersionOther
+		}
+	}
+	metricsClientVersions.Add(version, 1)
+}
+
 // Server represents a server
 type Server struct {
 	channelQuit chan bool
+	hooks       astichat.Hooks
 	serverHTTP  *ServerHTTP
 	serverUDP   *ServerUDP
+	shutdown    ConfigurationShutdown
 	startedAt   time.Time
+	storage     astichat.Storage
+	webhook     *astichat.Webhook
 }
 
 // NewServer returns a new server
-func NewServer(c Configuration, b *builder.Builder, stg astichat.Storage) *Server {
+func NewServer(c Configuration, b builder.Builder, stg astichat.Storage) *Server {
 	astilog.Debug("Starting server")
+	var f = astichat.NewFederation(c.Federation)
+	f.Logger = astilog.GetLogger()
+	var u = NewServerUDP(stg, f)
+	var h = NewServerHTTP(c.Addr.HTTP, c.PathStatic, b, stg, u.stream, f)
+	h.disconnect = u.Disconnect
 	return &Server{
 		channelQuit: make(chan bool),
-		serverHTTP:  NewServerHTTP(c.Addr.HTTP, c.PathStatic, b, stg),
-		serverUDP:   NewServerUDP(stg),
+		serverHTTP:  h,
+		serverUDP:   u,
+		shutdown:    c.Shutdown,
 		startedAt:   time.Now(),
+		storage:     stg,
 	}
 }
 
@@ -43,13 +94,61 @@ func (s *Server) Init(c Configuration) (o *Server, err error) {
 	if err = o.serverHTTP.Init(c); err != nil {
 		return
 	}
+
+	// Init webhook
+	// It's optional and only enabled when an URL is configured
+	if c.Webhook.URL != "" {
+		o.webhook = astichat.NewWebhook(c.Webhook)
+		o.webhook.Logger = astilog.GetLogger()
+		o.webhook.Start()
+		o.AddHook(o.webhook)
+	}
 	return
 }
 
-// Close closes the server
+// AddHook adds a hook reacting to the events of both the UDP and the HTTP servers
+// It must be called before listening and serving
+func (s *Server) AddHook(h astichat.Hook) {
+	s.hooks = append(s.hooks, h)
+	s.serverHTTP.SetHook(s.hooks)
+	s.serverUDP.SetHook(s.hooks)
+}
+
+// Close shuts the server down gracefully
+// Peers are notified, in-flight HTTP requests are drained and storage is closed
 func (s *Server) Close() {
-	s.serverUDP.Close()
 	astilog.Debug("Stopping server")
+
+	// Notify peers
+	// Each phase has its own deadline so that slow peers can't prevent HTTP requests from being drained
+	var ctx, cancel = context.WithTimeout(context.Background(), s.shutdown.NotifyTimeout)
+	s.serverUDP.Shutdown(ctx, s.shutdown.ReconnectAfter)
+	cancel()
+
+	// Drain HTTP requests
+	ctx, cancel = context.WithTimeout(context.Background(), s.shutdown.DrainTimeout)
+	if err := s.serverHTTP.Shutdown(ctx); err != nil {
+		astilog.Errorf("%s while shutting down HTTP server", err)
+	}
+	cancel()
+
+	// Close UDP server
+	s.serverUDP.Close()
+
+	// Wait for builds
+	s.serverHTTP.Close()
+
+	// Deliver remaining hook events
+	if s.webhook != nil {
+		ctx, cancel = context.WithTimeout(context.Background(), s.shutdown.WebhookTimeout)
+		s.webhook.Close(ctx)
+		cancel()
+	}
+
+	// Close storage
+	if err := s.storage.Close(); err != nil {
+		astilog.Errorf("%s while closing storage", err)
+	}
 }
 
 // HandleSignals handles signals
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/asticode/go-astichat/astichat"
 	"github.com/asticode/go-astilog"
@@ -11,19 +17,39 @@ import (
 
 // ServerUDP represents an UDP server
 // TODO Create rooms => creator controls who can join
-// TODO Handle client-2-server connections with rabbitmq
 type ServerUDP struct {
-	peerPool *astichat.PeerPool
-	server   *astiudp.Server
-	storage  astichat.Storage
+	cluster         *astichat.Cluster
+	delivering      map[string]bool // Indexed by peer key
+	federation      *astichat.Federation
+	hook            astichat.Hook
+	limiterAddr     *astichat.RateLimiter
+	limiterUsername *astichat.RateLimiter
+	mutex           *sync.Mutex
+	peerPool        *astichat.PeerPool
+	quic            *astichat.QUICServer
+	reliable        *astichat.Reliable
+	remotePool      *astichat.PeerPool // Peers of federated servers
+	replays         *astichat.ReplayCache
+	server          *astiudp.Server
+	storage         astichat.Storage
+	stream          *astichat.StreamServer
 }
 
 // NewServerUDP creates a new UDP sever
-func NewServerUDP(stg astichat.Storage) *ServerUDP {
+// Clients that can't use UDP send and receive the same events through the stream server
+func NewServerUDP(stg astichat.Storage, f *astichat.Federation) *ServerUDP {
+	var s = astiudp.NewServer()
 	return &ServerUDP{
-		peerPool: astichat.NewPeerPool(),
-		server:   astiudp.NewServer(),
-		storage:  stg,
+		delivering: make(map[string]bool),
+		federation: f,
+		hook:       astichat.NopHook{},
+		mutex:      &sync.Mutex{},
+		peerPool:   astichat.NewPeerPool(),
+		remotePool: astichat.NewPeerPool(),
+		replays:    astichat.NewReplayCache(),
+		server:     s,
+		storage:    stg,
+		stream:     astichat.NewStreamServer(s),
 	}
 }
 
@@ -34,19 +60,232 @@ func (s *ServerUDP) Init(c Configuration) (err error) {
 		return
 	}
 
+	// IPv6 candidates advertised by dual-stack clients can't reach a server listening on IPv4 only
+	if !isDualStack(c.Addr.UDP) {
+		astilog.Warnf("UDP addr %s doesn't listen on both stacks, IPv6 clients won't be able to reach it, use [::] instead", c.Addr.UDP)
+	}
+
+	// Init rate limiters
+	s.limiterAddr = astichat.NewRateLimiter(c.RateLimiter.Addr)
+	s.limiterUsername = astichat.NewRateLimiter(c.RateLimiter.Username)
+	metrics.Set("udp_rate_limiter_addr", expvar.Func(func() interface{} { return s.limiterAddr.Counters() }))
+	metrics.Set("udp_rate_limiter_username", expvar.Func(func() interface{} { return s.limiterUsername.Counters() }))
+	metrics.Set("udp_client_versions", metricsClientVersions)
+
+	// Init stream server
+	s.stream.Logger = astilog.GetLogger()
+	s.stream.Init(c.Stream)
+
+	// Init cluster
+	if s.cluster, err = newCluster(c.Broker); err != nil {
+		return
+	}
+	s.cluster.Logger = astilog.GetLogger()
+	s.cluster.SetListener(astichat.EventNamePeerDisconnected, s.HandleClusterPeerDisconnected())
+	s.cluster.SetListener(astichat.EventNamePeerJoined, s.HandleClusterPeerJoined())
+	s.cluster.SetListener(astichat.EventNamePeerRelayed, s.HandleClusterPeerRelayed())
+	if err = s.cluster.Init(); err != nil {
+		return
+	}
+
+	// Init QUIC server
+	// It's optional and only enabled when an addr is configured
+	if c.QUIC.Addr != "" {
+		s.quic = astichat.NewQUICServer(s.stream)
+		s.quic.Logger = astilog.GetLogger()
+		if err = s.quic.Init(c.QUIC); err != nil {
+			return
+		}
+		astilog.Infof("QUIC certificate fingerprint is %s", s.quic.Fingerprint())
+	}
+
+	// Init fragmenter and reliable
+	// Fragments are rate limited before being buffered
+	var f = astichat.NewFragmenter(s.stream, c.Fragmenter)
+	f.Allow = s.allow
+	s.reliable = astichat.NewReliable(f, c.Reliable)
+
 	// Set up listeners
-	s.server.SetListener(astichat.EventNamePeerConnect, s.HandlePeerConnect())
-	s.server.SetListener(astichat.EventNamePeerDisconnect, s.HandlePeerDisconnect())
+	s.stream.SetListener(astichat.EventNamePeerRelay, s.limit(s.HandlePeerRelay()))
+	f.SetListener(astichat.EventNameAck, s.reliable.HandleAck())
+	f.SetListener(astichat.EventNamePeerConnect, s.limit(s.reliable.Listen(s.HandlePeerConnect())))
+	f.SetListener(astichat.EventNamePeerDisconnect, s.limit(s.reliable.Listen(s.HandlePeerDisconnect())))
+	f.SetListener(astichat.EventNamePeerPing, s.limit(s.reliable.Listen(s.HandlePeerPing())))
+
+	// Set up federation listeners
+	s.federation.SetListener(astichat.EventNamePeerDisconnected, s.HandleFederationPeerDisconnected())
+	s.federation.SetListener(astichat.EventNamePeerJoined, s.HandleFederationPeerJoined())
+	s.federation.SetListener(astichat.FederationEventNameDevices, astichat.HandleFederationDevices(s.storage))
+	s.federation.SetListener(astichat.FederationEventNameMessage, astichat.HandleFederationMessage(s.storage, c.MessageTTL, s.deliverFederated))
+	s.federation.SetListener(astichat.FederationEventNamePeers, s.HandleFederationPeers())
 	return
 }
 
+// isDualStack checks whether an addr listens on both IPv4 and IPv6
+func isDualStack(addr string) bool {
+	var h, _, err = net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	return h == "" || h == "::"
+}
+
+// SetHook sets the hook reacting to the events of the UDP server
+func (s *ServerUDP) SetHook(h astichat.Hook) {
+	s.hook = h
+}
+
+// authFailed penalizes an addr that failed to authenticate and emits the matching hook event
+func (s *ServerUDP) authFailed(addr *net.UDPAddr, b astichat.Body, err error) {
+	s.limiterAddr.Penalize(addr.IP.String())
+	var e = astichat.NewHookEvent(astichat.HookEventNameAuthFailed)
+	e.Addr = addr.String()
+	if b.Request != nil {
+		e.Device = b.Request.Device
+		e.Username = b.Request.Username
+	}
+	if err != nil {
+		e.Reason = err.Error()
+	}
+	s.hook.HandleEvent(e)
+}
+
+// peerEvent creates a hook event about a peer
+func peerEvent(name string, p *astichat.Peer) (e astichat.HookEvent) {
+	e = astichat.NewHookEvent(name)
+	e.Addr = p.Addr.String()
+	e.Device = p.Device.ID
+	e.Username = p.Username
+	return
+}
+
+// allow checks whether an addr is allowed by its rate limit
+func (s *ServerUDP) allow(eventName string, addr *net.UDPAddr) bool {
+	if !s.limiterAddr.Allow(addr.IP.String()) {
+		astilog.Debugf("Dropping %s from %s since its rate limit has been exceeded", eventName, addr)
+		return false
+	}
+	return true
+}
+
+// limit wraps a listener so that datagrams coming from an addr that exceeded its rate limit are dropped
+func (s *ServerUDP) limit(l astiudp.ListenerFunc) astiudp.ListenerFunc {
+	return func(as *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) error {
+		if !s.allow(eventName, addr) {
+			return nil
+		}
+		return l(as, eventName, payload, addr)
+	}
+}
+
 // Close closes the UDP server
 func (s *ServerUDP) Close() {
+	if s.quic != nil {
+		s.quic.Close()
+	}
+	s.stream.Close()
 	s.server.Close()
+	if s.cluster != nil {
+		if err := s.cluster.Close(); err != nil {
+			astilog.Errorf("%s while closing cluster", err)
+		}
+	}
+}
+
+// newCluster creates a new cluster based on the broker configuration
+func newCluster(c ConfigurationBroker) (o *astichat.Cluster, err error) {
+	var b astichat.Broker
+	switch c.Type {
+	case brokerTypeAMQP:
+		var ab *astichat.AMQPBroker
+		if ab, err = astichat.NewAMQPBroker(c.AMQP); err != nil {
+			return
+		}
+		ab.Logger = astilog.GetLogger()
+		b = ab
+	case brokerTypeMemory:
+		b = astichat.NewMemoryBroker()
+	default:
+		err = fmt.Errorf("Unknown broker type %s", c.Type)
+		return
+	}
+	o = astichat.NewCluster(b, c.Cluster)
+	return
+}
+
+// Shutdown notifies peers that the server is shutting down and waits for their acknowledgements until the context
+// is done
+func (s *ServerUDP) Shutdown(ctx context.Context, reconnectAfter time.Duration) {
+	// Marshal
+	var msg []byte
+	var err error
+	if msg, err = json.Marshal(astichat.Shutdown{ReconnectAfter: reconnectAfter}); err != nil {
+		astilog.Errorf("%s while marshaling shutdown", err)
+		return
+	}
+
+	// Loop through peers
+	var wg = &sync.WaitGroup{}
+	for _, p := range s.peerPool.Peers() {
+		// Create new body
+		var b astichat.Body
+		if b, err = astichat.NewBody(msg, astichat.TimeNow(), "", p.ClientPublicKey); err != nil {
+			astilog.Errorf("%s while creating body for %s", err, p)
+			continue
+		}
+
+		// Send server.shutdown event
+		astilog.Debugf("Sending server.shutdown to %s", p)
+		wg.Add(1)
+		if err = s.reliable.Write(astichat.EventNameServerShutdown, b, p.Addr, func(err error) {
+			wg.Done()
+		}); err != nil {
+			astilog.Errorf("%s while sending server.shutdown to %s", err, p)
+			wg.Done()
+			continue
+		}
+	}
+
+	// Notify other instances
+	for _, p := range s.peerPool.Peers() {
+		if err = s.cluster.Leave(p); err != nil {
+			astilog.Errorf("%s while leaving cluster with %s", err, p)
+		}
+	}
+
+	// Notify federated servers
+	if s.federation.Enabled() {
+		wg.Add(1)
+		go func(ps []*astichat.Peer) {
+			defer wg.Done()
+			for _, p := range ps {
+				s.federation.Broadcast(astichat.EventNamePeerDisconnected, astichat.NewFederatedPeer(p))
+			}
+		}(s.peerPool.Peers())
+	}
+
+	// Wait for acknowledgements
+	var done = make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		astilog.Debug("Not all peers have acknowledged server.shutdown in time")
+	}
 }
 
 // ListenAndServe listens and serve
 func (s *ServerUDP) ListenAndServe() {
+	if s.quic != nil {
+		astilog.Debugf("Listening and serving on quic://%s", s.quic.Addr())
+		go s.quic.Serve()
+	}
+	if s.federation.Enabled() {
+		go s.syncFederation()
+	}
 	s.server.ListenAndRead()
 }
 
@@ -59,44 +298,102 @@ func (s *ServerUDP) HandlePeerConnect() astiudp.ListenerFunc {
 			return
 		}
 
-		// Peer is new to the pool
+		// Pre-authenticate the body before doing any RSA work
+		if err = b.Validate(astichat.TimeNow()); err != nil {
+			s.authFailed(addr, b, err)
+			return
+		}
+
+		// Check username's rate limit
+		// The body is not authenticated yet so the username is only limited for the addr sending it, otherwise
+		// anyone could lock a chatterer out by flooding its username
+		if !s.limiterUsername.Allow(addr.IP.String() + "/" + b.Request.Username) {
+			astilog.Debugf("Dropping %s for %s from %s since its rate limit has been exceeded", eventName, b.Request.Username, addr)
+			return
+		}
+
+		// Peer is new to the pool or has changed its addr, which happens when it falls back to a stream conn
 		var p *astichat.Peer
 		var ok bool
-		if p, ok = s.peerPool.Get(b.Request.Username); !ok {
+		if p, ok = s.peerPool.Get(b.Request.Username, b.Request.Device); !ok || p.Addr.String() != addr.String() {
 			// Retrieve chatterer
 			var c astichat.Chatterer
 			if c, err = s.storage.ChattererFetchByUsername(b.Request.Username); err != nil {
+				s.authFailed(addr, b, err)
+				return
+			}
+
+			// Retrieve device
+			var d astichat.Device
+			if d, ok = c.Device(b.Request.Device); !ok {
+				err = fmt.Errorf("Invalid device %s for chatterer %s", b.Request.Device, c.Username)
+				s.authFailed(addr, b, err)
 				return
 			}
 
 			// Process body
 			var msg []byte
-			if msg, err = b.Process(astichat.TimeNow(), c.ServerPrivateKey); err != nil {
+			if msg, err = b.Process(astichat.TimeNow(), d.ServerPrivateKey); err != nil {
+				s.authFailed(addr, b, err)
 				return
 			}
 
-			// Validate message
-			if err = astichat.ValidateMessage(msg, astichat.MessageConnect); err != nil {
+			// Body has already been processed
+			// Otherwise anyone seeing a peer.connect could replay it from its own addr and take the peer over
+			if s.replays.Seen(b, astichat.TimeNow()) {
+				err = fmt.Errorf("Replayed %s for chatterer %s", eventName, c.Username)
+				s.authFailed(addr, b, err)
+				return
+			}
+
+			// Parse message
+			var cm astichat.Connect
+			if cm, err = astichat.ParseConnect(msg); err != nil {
 				return
 			}
 
 			// Create peer
-			p = astichat.NewPeer(addr, c)
+			// Peers connected through a stream conn can only be reached through the server
+			p = astichat.NewPeer(addr, c.Username, d)
+			if p.Relayed = s.stream.Has(addr); !p.Relayed {
+				p.SetCandidates(cm.Addrs)
+			}
 
 			// Add peer to the pool
+			// Its stream conn, if any, is now authenticated
 			s.peerPool.Set(p)
+			if p.Relayed {
+				s.stream.Authenticate(addr)
+			}
 
 			// Log
-			astilog.Infof("Welcome to %s", p)
-		} else {
-			// TODO Peer is not new, check it has not updated its addr
+			// Clients built before build metadata was embedded don't send it
+			var version = "unknown"
+			if cm.Build != nil {
+				version = cm.Build.Version
+			}
+			astilog.Infof("Welcome to %s running version %s", p, version)
+			addClientVersion(version)
+			var e = peerEvent(astichat.HookEventNamePeerJoined, p)
+			e.Build = cm.Build
+			s.hook.HandleEvent(e)
+
+			// Notify other instances
+			if err = s.cluster.Join(p); err != nil {
+				astilog.Errorf("%s while joining cluster with %s", err, p)
+			}
+
+			// Notify federated servers
+			if s.federation.Enabled() {
+				go s.federation.Broadcast(astichat.EventNamePeerJoined, astichat.NewFederatedPeer(p))
+			}
 		}
 
 		// Loop through peers
 		var ps []*astichat.Peer
 		for _, pp := range s.peerPool.Peers() {
 			// Peer is not the one which just connected
-			if p.Username != pp.Username {
+			if p.Key() != pp.Key() {
 				// Marshal
 				var msg []byte
 				if msg, err = json.Marshal(p); err != nil {
@@ -110,13 +407,17 @@ func (s *ServerUDP) HandlePeerConnect() astiudp.ListenerFunc {
 
 				// Send peer.joined event
 				astilog.Debugf("Sending peer.joined to %s", pp)
-				if err = as.Write(astichat.EventNamePeerJoined, b, pp.Addr); err != nil {
+				if err = s.reliable.Write(astichat.EventNamePeerJoined, b, pp.Addr, nil); err != nil {
 					return
 				}
 				ps = append(ps, pp)
 			}
 		}
 
+		// Peers of other instances and federated servers are here as well
+		ps = append(ps, s.cluster.Peers()...)
+		ps = append(ps, s.remotePool.Peers()...)
+
 		// Marshal
 		var msg []byte
 		if msg, err = json.Marshal(ps); err != nil {
@@ -130,13 +431,133 @@ func (s *ServerUDP) HandlePeerConnect() astiudp.ListenerFunc {
 
 		// Send peer.connected event
 		astilog.Debugf("Sending peer.connected to %s", p)
-		if err = as.Write(astichat.EventNamePeerConnected, b, p.Addr); err != nil {
+		// Queued messages are delivered once peer.connected has been acknowledged
+		if err = s.reliable.Write(astichat.EventNamePeerConnected, b, p.Addr, func(err error) {
+			if err == nil {
+				s.deliverMessages(p)
+			}
+		}); err != nil {
 			return
 		}
 		return
 	}
 }
 
+// deliverMessages delivers the messages queued for a peer in order
+func (s *ServerUDP) deliverMessages(p *astichat.Peer) {
+	// Messages are already being delivered
+	s.mutex.Lock()
+	if s.delivering[p.Key()] {
+		s.mutex.Unlock()
+		return
+	}
+	s.delivering[p.Key()] = true
+	s.mutex.Unlock()
+
+	// Fetch messages
+	var ms []astichat.Message
+	var err error
+	if ms, err = s.storage.MessageFetchByRecipient(p.Username, p.Device.ID); err != nil {
+		astilog.Errorf("%s while fetching messages of %s", err, p.Username)
+		s.stopDelivering(p)
+		return
+	}
+
+	// Deliver
+	s.deliverMessage(p, ms)
+}
+
+// deliverMessage delivers the first message and only delivers the next one once the previous one has been
+// acknowledged
+func (s *ServerUDP) deliverMessage(p *astichat.Peer, ms []astichat.Message) {
+	// No more messages
+	if len(ms) == 0 {
+		s.stopDelivering(p)
+		return
+	}
+
+	// Marshal
+	var m = ms[0]
+	var msg []byte
+	var err error
+	if msg, err = json.Marshal(m); err != nil {
+		astilog.Errorf("%s while marshaling message %s", err, m.ID)
+		s.stopDelivering(p)
+		return
+	}
+
+	// Create new body
+	var b astichat.Body
+	if b, err = astichat.NewBody(msg, astichat.TimeNow(), "", p.ClientPublicKey); err != nil {
+		astilog.Errorf("%s while creating body for message %s", err, m.ID)
+		s.stopDelivering(p)
+		return
+	}
+
+	// Send message.queued event
+	astilog.Debugf("Sending message.queued to %s", p)
+	if err = s.reliable.Write(astichat.EventNameMessageQueued, b, p.Addr, func(err error) {
+		// Message has not been delivered, it will be delivered on the next connect
+		if err != nil {
+			astilog.Errorf("%s while delivering message %s to %s", err, m.ID, p)
+			s.stopDelivering(p)
+			return
+		}
+
+		// Delete message
+		if err = s.storage.MessageDelete(m.ID); err != nil {
+			astilog.Errorf("%s while deleting message %s", err, m.ID)
+		}
+
+		// Notify sender
+		if m.Notify {
+			s.notifyDelivery(m)
+		}
+
+		// Next message
+		s.deliverMessage(p, ms[1:])
+	}); err != nil {
+		astilog.Errorf("%s while sending message.queued to %s", err, p)
+		s.stopDelivering(p)
+		return
+	}
+}
+
+// stopDelivering marks the delivery of a peer's messages as done
+func (s *ServerUDP) stopDelivering(p *astichat.Peer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.delivering, p.Key())
+}
+
+// notifyDelivery notifies the connected devices of the sender of a message that it has been delivered
+func (s *ServerUDP) notifyDelivery(m astichat.Message) {
+	// Marshal
+	var msg []byte
+	var err error
+	if msg, err = json.Marshal(astichat.MessageDelivery{ID: m.ID, Recipient: m.Recipient}); err != nil {
+		astilog.Errorf("%s while marshaling delivery of message %s", err, m.ID)
+		return
+	}
+
+	// Loop through sender's devices
+	for _, p := range s.peerPool.PeersByUsername(m.Sender) {
+		// Create new body
+		var b astichat.Body
+		if b, err = astichat.NewBody(msg, astichat.TimeNow(), "", p.ClientPublicKey); err != nil {
+			astilog.Errorf("%s while creating body for delivery of message %s", err, m.ID)
+			return
+		}
+
+		// Send message.delivered event
+		astilog.Debugf("Sending message.delivered to %s", p)
+		if err = s.reliable.Write(astichat.EventNameMessageDelivered, b, p.Addr, nil); err != nil {
+			astilog.Errorf("%s while sending message.delivered to %s", err, p)
+			continue
+		}
+	}
+}
+
 // HandlePeerDisconnect handles the peer.disconnect event
 func (s *ServerUDP) HandlePeerDisconnect() astiudp.ListenerFunc {
 	return func(as *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) (err error) {
@@ -146,11 +567,18 @@ func (s *ServerUDP) HandlePeerDisconnect() astiudp.ListenerFunc {
 			return
 		}
 
+		// Pre-authenticate the body before doing any RSA work
+		if err = b.Validate(astichat.TimeNow()); err != nil {
+			s.authFailed(addr, b, err)
+			return
+		}
+
 		// Peer is in the pool
-		if p, ok := s.peerPool.Get(b.Request.Username); ok {
+		if p, ok := s.peerPool.Get(b.Request.Username, b.Request.Device); ok {
 			// Process body
 			var msg []byte
-			if msg, err = b.Process(astichat.TimeNow(), p.Chatterer.ServerPrivateKey); err != nil {
+			if msg, err = b.Process(astichat.TimeNow(), p.ServerPrivateKey); err != nil {
+				s.authFailed(addr, b, err)
 				return
 			}
 
@@ -159,32 +587,362 @@ func (s *ServerUDP) HandlePeerDisconnect() astiudp.ListenerFunc {
 				return
 			}
 
-			// Delete from the pool
-			s.peerPool.Del(p.Username)
+			// Leave
+			s.leave(p)
+		}
+		return
+	}
+}
+
+// Disconnect disconnects the device of a chatterer, which happens when it has been revoked
+func (s *ServerUDP) Disconnect(username, device string) {
+	if p, ok := s.peerPool.Get(username, device); ok {
+		s.leave(p)
+	}
+}
 
-			// Log
-			astilog.Infof("%s has left us", p)
+// leave removes a peer from the pool and notifies the other peers, instances and federated servers
+func (s *ServerUDP) leave(p *astichat.Peer) {
+	// Delete from the pool
+	s.peerPool.Del(p.Username, p.Device.ID)
 
-			// Loop through peers
-			for _, pp := range s.peerPool.Peers() {
-				// Marshal
-				var msg []byte
-				if msg, err = json.Marshal(p); err != nil {
-					return
-				}
+	// Log
+	astilog.Infof("%s has left us", p)
+	s.hook.HandleEvent(peerEvent(astichat.HookEventNamePeerLeft, p))
 
-				// Create new body
-				if b, err = astichat.NewBody(msg, astichat.TimeNow(), "", pp.ClientPublicKey); err != nil {
-					return
-				}
+	// Notify other instances
+	if err := s.cluster.Leave(p); err != nil {
+		astilog.Errorf("%s while leaving cluster with %s", err, p)
+	}
 
-				// Send peer.disconnected event
-				astilog.Debugf("Sending peer.disconnected to %s", pp)
-				if err = as.Write(astichat.EventNamePeerDisconnected, b, pp.Addr); err != nil {
-					return
-				}
+	// Notify federated servers
+	if s.federation.Enabled() {
+		go s.federation.Broadcast(astichat.EventNamePeerDisconnected, astichat.NewFederatedPeer(p))
+	}
+
+	// Notify peers
+	if err := s.notifyPeers(astichat.EventNamePeerDisconnected, p); err != nil {
+		astilog.Errorf("%s while notifying peers that %s has left", err, p)
+	}
+}
+
+// HandlePeerPing handles the peer.ping event
+// Peers the server doesn't know, which happens when it has restarted, are asked to reconnect
+func (s *ServerUDP) HandlePeerPing() astiudp.ListenerFunc {
+	return func(as *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) (err error) {
+		// Unmarshal
+		var b astichat.Body
+		if err = json.Unmarshal(payload, &b); err != nil {
+			return
+		}
+
+		// Pre-authenticate the body before doing any RSA work
+		if err = b.Validate(astichat.TimeNow()); err != nil {
+			s.authFailed(addr, b, err)
+			return
+		}
+
+		// Peer is not in the pool or has moved
+		var p, ok = s.peerPool.Get(b.Request.Username, b.Request.Device)
+		if !ok || p.Addr.String() != addr.String() {
+			return s.unknown(eventName, b, addr)
+		}
+
+		// Process body
+		var msg []byte
+		if msg, err = b.Process(astichat.TimeNow(), p.ServerPrivateKey); err != nil {
+			s.authFailed(addr, b, err)
+			return
+		}
+
+		// Parse message
+		_, err = astichat.ParsePing(msg)
+		return
+	}
+}
+
+// unknown asks the device that sent a ping to reconnect
+// The ping is authenticated first and sent back encrypted for the device so that peer.unknown can't be used to
+// force clients to reconnect
+func (s *ServerUDP) unknown(eventName string, b astichat.Body, addr *net.UDPAddr) (err error) {
+	// Check username's rate limit
+	if !s.limiterUsername.Allow(addr.IP.String() + "/" + b.Request.Username) {
+		astilog.Debugf("Dropping %s for %s from %s since its rate limit has been exceeded", eventName, b.Request.Username, addr)
+		return
+	}
+
+	// Retrieve chatterer
+	var c astichat.Chatterer
+	if c, err = s.storage.ChattererFetchByUsername(b.Request.Username); err != nil {
+		s.authFailed(addr, b, err)
+		return
+	}
+
+	// Retrieve device
+	var d astichat.Device
+	var ok bool
+	if d, ok = c.Device(b.Request.Device); !ok {
+		err = fmt.Errorf("Invalid device %s for chatterer %s", b.Request.Device, c.Username)
+		s.authFailed(addr, b, err)
+		return
+	}
+
+	// Process body
+	var msg []byte
+	if msg, err = b.Process(astichat.TimeNow(), d.ServerPrivateKey); err != nil {
+		s.authFailed(addr, b, err)
+		return
+	}
+
+	// Parse message
+	var p astichat.Ping
+	if p, err = astichat.ParsePing(msg); err != nil {
+		return
+	}
+
+	// Marshal
+	if msg, err = json.Marshal(p); err != nil {
+		return
+	}
+
+	// Create new body
+	if b, err = astichat.NewBody(msg, astichat.TimeNow(), "", d.ClientPublicKey); err != nil {
+		return
+	}
+
+	// Send peer.unknown event
+	astilog.Debugf("Sending peer.unknown to %s", addr)
+	return s.stream.Write(astichat.EventNamePeerUnknown, b, addr)
+}
+
+// HandlePeerRelay handles the peer.relay event
+// Only events between connected peers are relayed so that the server can't be used as a reflector
+func (s *ServerUDP) HandlePeerRelay() astiudp.ListenerFunc {
+	return func(as *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) (err error) {
+		// Unmarshal
+		var r astichat.Relay
+		if err = json.Unmarshal(payload, &r); err != nil {
+			return
+		}
+
+		// Check sender
+		var sender *astichat.Peer
+		var ok bool
+		if sender, ok = s.peerPool.GetByAddr(addr); !ok {
+			err = fmt.Errorf("Relay sender %s is not a peer", addr)
+			s.authFailed(addr, astichat.Body{}, err)
+			return
+		}
+
+		// Check recipient
+		var recipient *astichat.Peer
+		if r.Addr == nil {
+			err = fmt.Errorf("Relay recipient of %s is empty", sender)
+			return
+		} else if recipient, ok = s.peerPool.GetByAddr(r.Addr); !ok {
+			// Recipient is connected to another instance
+			if recipient, ok = s.cluster.GetByAddr(r.Addr); ok {
+				astilog.Debugf("Relaying %s from %s to %s through the cluster", r.EventName, sender, recipient)
+				return s.cluster.Relay(r.Addr, astichat.Relay{Addr: addr, EventName: r.EventName, Payload: r.Payload})
 			}
+			err = fmt.Errorf("Relay recipient %s of %s is not a peer", r.Addr, sender)
+			return
+		}
+
+		// Relay
+		astilog.Debugf("Relaying %s from %s to %s", r.EventName, sender, recipient)
+		if err = s.stream.Write(astichat.EventNamePeerRelayed, astichat.Relay{Addr: addr, EventName: r.EventName, Payload: r.Payload}, recipient.Addr); err != nil {
+			return
+		}
+		return
+	}
+}
+
+// deliverFederated delivers a message sent by a chatterer of a federated server to its device if it's connected
+func (s *ServerUDP) deliverFederated(m astichat.Message) {
+	if p, ok := s.peerPool.Get(m.Recipient, m.Device); ok {
+		go s.deliverMessages(p)
+	}
+}
+
+// syncFederation fetches the peers already connected to federated servers
+func (s *ServerUDP) syncFederation() {
+	for _, n := range s.federation.Servers() {
+		// Fetch peers
+		var ps []*astichat.Peer
+		if err := s.federation.Send(n, astichat.FederationEventNamePeers, nil, &ps); err != nil {
+			astilog.Errorf("%s while fetching peers of server %s", err, n)
+			continue
+		}
+
+		// Add peers to the pool
+		for _, p := range ps {
+			if p, err := newRemotePeer(p, n); err == nil {
+				s.remotePool.Set(p)
+			}
+		}
+	}
+}
+
+// newRemotePeer qualifies a peer sent by a federated server with the server's name
+func newRemotePeer(p *astichat.Peer, server string) (o *astichat.Peer, err error) {
+	// Check username
+	if p == nil || p.ClientPublicKey == nil {
+		err = fmt.Errorf("Invalid peer sent by server %s", server)
+		return
+	} else if _, s := astichat.SplitAddress(p.Username); s != "" {
+		err = fmt.Errorf("Invalid username %s sent by server %s", p.Username, server)
+		return
+	}
+
+	// Qualify
+	o = astichat.NewFederatedPeer(p)
+	o.Username = astichat.JoinAddress(p.Username, server)
+	return
+}
+
+// notifyPeers sends an event about a peer to all local peers
+func (s *ServerUDP) notifyPeers(eventName string, p *astichat.Peer) (err error) {
+	// Marshal
+	var msg []byte
+	if msg, err = json.Marshal(p); err != nil {
+		return
+	}
+
+	// Loop through peers
+	for _, pp := range s.peerPool.Peers() {
+		// Create new body
+		var b astichat.Body
+		if b, err = astichat.NewBody(msg, astichat.TimeNow(), "", pp.ClientPublicKey); err != nil {
+			return
+		}
+
+		// Send event
+		astilog.Debugf("Sending %s to %s", eventName, pp)
+		if err = s.reliable.Write(eventName, b, pp.Addr, nil); err != nil {
+			astilog.Errorf("%s while sending %s to %s", err, eventName, pp)
+			continue
 		}
+	}
+	return
+}
+
+// HandleFederationPeers returns the peers connected to the server
+func (s *ServerUDP) HandleFederationPeers() astichat.FederationListenerFunc {
+	return func(server string, payload json.RawMessage) (v interface{}, err error) {
+		var ps = []*astichat.Peer{}
+		for _, p := range s.peerPool.Peers() {
+			ps = append(ps, astichat.NewFederatedPeer(p))
+		}
+		return ps, nil
+	}
+}
+
+// HandleFederationPeerJoined handles the peer.joined event sent by a federated server
+func (s *ServerUDP) HandleFederationPeerJoined() astichat.FederationListenerFunc {
+	return func(server string, payload json.RawMessage) (v interface{}, err error) {
+		// Unmarshal
+		var p *astichat.Peer
+		if err = json.Unmarshal(payload, &p); err != nil {
+			return
+		}
+
+		// Qualify
+		if p, err = newRemotePeer(p, server); err != nil {
+			return
+		}
+
+		// Add peer to the pool
+		s.remotePool.Set(p)
+		astilog.Infof("Welcome to %s", p)
+
+		// Notify peers
+		err = s.notifyPeers(astichat.EventNamePeerJoined, p)
 		return
 	}
 }
+
+// HandleFederationPeerDisconnected handles the peer.disconnected event sent by a federated server
+func (s *ServerUDP) HandleFederationPeerDisconnected() astichat.FederationListenerFunc {
+	return func(server string, payload json.RawMessage) (v interface{}, err error) {
+		// Unmarshal
+		var p *astichat.Peer
+		if err = json.Unmarshal(payload, &p); err != nil {
+			return
+		}
+
+		// Qualify
+		if p, err = newRemotePeer(p, server); err != nil {
+			return
+		}
+
+		// Peer is not in the pool
+		if _, ok := s.remotePool.Get(p.Username, p.Device.ID); !ok {
+			return
+		}
+
+		// Delete from the pool
+		s.remotePool.Del(p.Username, p.Device.ID)
+		astilog.Infof("%s has left us", p)
+
+		// Notify peers
+		err = s.notifyPeers(astichat.EventNamePeerDisconnected, p)
+		return
+	}
+}
+
+// HandleClusterPeerJoined handles the peer.joined event sent by another instance
+func (s *ServerUDP) HandleClusterPeerJoined() astichat.ClusterListenerFunc {
+	return func(eventName string, payload json.RawMessage) (err error) {
+		// Unmarshal
+		var p *astichat.Peer
+		if err = json.Unmarshal(payload, &p); err != nil {
+			return
+		}
+
+		// Notify peers
+		astilog.Infof("Welcome to %s", p)
+		return s.notifyPeers(astichat.EventNamePeerJoined, p)
+	}
+}
+
+// HandleClusterPeerDisconnected handles the peer.disconnected event sent by another instance
+func (s *ServerUDP) HandleClusterPeerDisconnected() astichat.ClusterListenerFunc {
+	return func(eventName string, payload json.RawMessage) (err error) {
+		// Unmarshal
+		var p *astichat.Peer
+		if err = json.Unmarshal(payload, &p); err != nil {
+			return
+		}
+
+		// Notify peers
+		astilog.Infof("%s has left us", p)
+		return s.notifyPeers(astichat.EventNamePeerDisconnected, p)
+	}
+}
+
+// HandleClusterPeerRelayed handles the peer.relayed event sent by another instance
+func (s *ServerUDP) HandleClusterPeerRelayed() astichat.ClusterListenerFunc {
+	return func(eventName string, payload json.RawMessage) (err error) {
+		// Unmarshal
+		var r astichat.ClusterRelay
+		if err = json.Unmarshal(payload, &r); err != nil {
+			return
+		}
+
+		// Check recipient
+		var recipient *astichat.Peer
+		var ok bool
+		if r.To == nil {
+			err = errors.New("Relay recipient is empty")
+			return
+		} else if recipient, ok = s.peerPool.GetByAddr(r.To); !ok {
+			err = fmt.Errorf("Relay recipient %s is not a peer", r.To)
+			return
+		}
+
+		// Relay
+		astilog.Debugf("Relaying %s from %s to %s", r.EventName, r.Addr, recipient)
+		return s.stream.Write(astichat.EventNamePeerRelayed, r.Relay, recipient.Addr)
+	}
+}
@@ -0,0 +1,388 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asticode/go-astichat/astichat"
+	main "github.com/asticode/go-astichat/server"
+	"github.com/asticode/go-astiudp"
+	"github.com/stretchr/testify/assert"
+)
+
+// freeUDPAddr returns a local UDP addr that is not used
+func freeUDPAddr(t *testing.T) string {
+	var c, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer c.Close()
+	return c.LocalAddr().String()
+}
+
+// newServerUDP creates an UDP server listening on a local addr
+func newServerUDP(t *testing.T, s astichat.Storage, f *astichat.Federation) (srv *main.ServerUDP, addr *net.UDPAddr) {
+	var c = main.Configuration{
+		Addr:       main.ConfigurationAddr{UDP: freeUDPAddr(t)},
+		Broker:     main.ConfigurationBroker{Type: "memory"},
+		MessageTTL: time.Hour,
+		// All test peers share the same IP
+		RateLimiter: main.ConfigurationRateLimiter{
+			Addr:     astichat.RateLimiterConfiguration{Burst: 1000, Rate: 1000},
+			Username: astichat.RateLimiterConfiguration{Burst: 100, Rate: 100},
+		},
+		Reliable: astichat.ReliableConfiguration{Backoff: 100 * time.Millisecond, MaxAttempts: 3},
+	}
+	srv = main.NewServerUDP(s, f)
+	var err = srv.Init(c)
+	assert.NoError(t, err)
+	addr, err = net.ResolveUDPAddr("udp", c.Addr.UDP)
+	assert.NoError(t, err)
+	go srv.ListenAndServe()
+	return
+}
+
+// testEvent represents an event received by a test peer
+type testEvent struct {
+	msg  []byte
+	name string
+}
+
+// testPeer represents the device of a chatterer connecting to the UDP server
+type testPeer struct {
+	device     string
+	events     chan testEvent
+	prv        *astichat.PrivateKey
+	pub        *astichat.PublicKey // Server's public key
+	reliable   *astichat.Reliable
+	server     *astiudp.Server
+	serverAddr *net.UDPAddr
+	t          *testing.T
+	username   string
+}
+
+// newTestPeer creates a new test peer
+func newTestPeer(t *testing.T, username, device string, prv *astichat.PrivateKey, pub *astichat.PublicKey, serverAddr *net.UDPAddr) (p *testPeer) {
+	// Init
+	p = &testPeer{
+		device:     device,
+		events:     make(chan testEvent, 100),
+		prv:        prv,
+		pub:        pub,
+		server:     astiudp.NewServer(),
+		serverAddr: serverAddr,
+		t:          t,
+		username:   username,
+	}
+	assert.NoError(t, p.server.Init("127.0.0.1:0"))
+
+	// Set up listeners
+	var f = astichat.NewFragmenter(p.server, astichat.FragmenterConfiguration{})
+	p.reliable = astichat.NewReliable(f, astichat.ReliableConfiguration{Backoff: 100 * time.Millisecond, MaxAttempts: 3})
+	f.SetListener(astichat.EventNameAck, p.reliable.HandleAck())
+	for _, n := range []string{
+		astichat.EventNameMessageDelivered,
+		astichat.EventNameMessageQueued,
+		astichat.EventNamePeerConnected,
+		astichat.EventNamePeerDisconnected,
+		astichat.EventNamePeerJoined,
+		astichat.EventNameServerShutdown,
+	} {
+		f.SetListener(n, p.reliable.Listen(p.handle))
+	}
+	f.SetListener(astichat.EventNamePeerUnknown, p.handle)
+	go p.server.ListenAndRead()
+	return
+}
+
+// handle decrypts the events sent by the server
+func (p *testPeer) handle(s *astiudp.Server, eventName string, payload json.RawMessage, addr *net.UDPAddr) (err error) {
+	var b astichat.Body
+	if err = json.Unmarshal(payload, &b); err != nil {
+		return
+	}
+	var msg []byte
+	if msg, err = b.Process(astichat.TimeNow(), p.prv); err != nil {
+		return
+	}
+	p.events <- testEvent{msg: msg, name: eventName}
+	return
+}
+
+// close closes the test peer
+func (p *testPeer) close() {
+	p.server.Close()
+}
+
+// write sends a message to the server
+func (p *testPeer) write(eventName string, msg []byte) {
+	var b, err = astichat.NewBody(msg, astichat.TimeNow(), p.username, p.pub)
+	assert.NoError(p.t, err)
+	b.Request.Device = p.device
+	assert.NoError(p.t, p.reliable.Write(eventName, b, p.serverAddr, nil))
+}
+
+// wait waits for the next event with the specified name, the other events are skipped
+func (p *testPeer) wait(eventName string) (msg []byte) {
+	for {
+		select {
+		case e := <-p.events:
+			if e.name == eventName {
+				return e.msg
+			}
+		case <-time.After(5 * time.Second):
+			p.t.Fatalf("%s has not received %s", p.username, eventName)
+		}
+	}
+}
+
+// none checks that no event with the specified name is received for a while
+func (p *testPeer) none(eventName string, d time.Duration) {
+	var t = time.After(d)
+	for {
+		select {
+		case e := <-p.events:
+			if e.name == eventName {
+				p.t.Errorf("%s has received %s", p.username, eventName)
+				return
+			}
+		case <-t:
+			return
+		}
+	}
+}
+
+func TestDeliverMessages(t *testing.T) {
+	// Init
+	var s = astichat.NewMockedStorage()
+	var _, _, prv2, pub2 = testKeys(t)
+	s.ChattererCreate("alice", astichat.Device{ClientPublicKey: pub2, ID: "d1", ServerPrivateKey: prv2})
+	s.ChattererCreate("bob", astichat.Device{ClientPublicKey: pub2, ID: "d2", ServerPrivateKey: prv2})
+	var srv, addr = newServerUDP(t, s, astichat.NewFederation(astichat.FederationConfiguration{}))
+	defer srv.Close()
+
+	// Queue messages
+	var now = time.Now()
+	var ms []astichat.Message
+	for _, m := range []astichat.Message{
+		{ExpiresAt: now.Add(-time.Minute), Message: astichat.EncryptedMessage{Message: []byte("expired")}, Recipient: "bob", Sender: "alice"},
+		{ExpiresAt: now.Add(time.Hour), Message: astichat.EncryptedMessage{Message: []byte("1")}, Notify: true, Recipient: "bob", Sender: "alice"},
+		{ExpiresAt: now.Add(time.Hour), Message: astichat.EncryptedMessage{Message: []byte("2")}, Recipient: "bob", Sender: "alice"},
+		{Device: "d1", ExpiresAt: now.Add(time.Hour), Message: astichat.EncryptedMessage{Message: []byte("3")}, Recipient: "bob", Sender: "alice"},
+	} {
+		if m.Device == "" {
+			m.Device = "d2"
+		}
+		m.CreatedAt = now
+		m, _ = s.MessageCreate(m)
+		ms = append(ms, m)
+	}
+
+	// Connect the sender
+	var alice = newTestPeer(t, "alice", "d1", prv2, pub2, addr)
+	defer alice.close()
+	alice.write(astichat.EventNamePeerConnect, astichat.MessageConnect)
+	alice.wait(astichat.EventNamePeerConnected)
+
+	// Connect the recipient
+	var bob = newTestPeer(t, "bob", "d2", prv2, pub2, addr)
+	defer bob.close()
+	bob.write(astichat.EventNamePeerConnect, astichat.MessageConnect)
+	bob.wait(astichat.EventNamePeerConnected)
+
+	// Messages are delivered in order
+	for _, e := range ms[1:3] {
+		var m astichat.Message
+		assert.NoError(t, json.Unmarshal(bob.wait(astichat.EventNameMessageQueued), &m))
+		assert.Equal(t, e.ID, m.ID)
+		assert.Equal(t, e.Message, m.Message)
+	}
+	bob.none(astichat.EventNameMessageQueued, 300*time.Millisecond)
+
+	// Sender is notified of the messages it asked to be notified of only
+	var d astichat.MessageDelivery
+	assert.NoError(t, json.Unmarshal(alice.wait(astichat.EventNameMessageDelivered), &d))
+	assert.Equal(t, astichat.MessageDelivery{ID: ms[1].ID, Recipient: "bob"}, d)
+	alice.none(astichat.EventNameMessageDelivered, 300*time.Millisecond)
+
+	// Delivered messages are deleted, the others are kept
+	var rms []astichat.Message
+	rms, _ = s.MessageFetchByRecipient("bob", "d2")
+	assert.Len(t, rms, 0)
+	rms, _ = s.MessageFetchByRecipient("bob", "d1")
+	assert.Equal(t, ms[3:], rms)
+}
+
+func TestDisconnect(t *testing.T) {
+	// Init
+	var s = astichat.NewMockedStorage()
+	var _, _, prv2, pub2 = testKeys(t)
+	s.ChattererCreate("alice", astichat.Device{ClientPublicKey: pub2, ID: "d1", ServerPrivateKey: prv2})
+	s.ChattererCreate("bob", astichat.Device{ClientPublicKey: pub2, ID: "d2", ServerPrivateKey: prv2})
+	var srv, addr = newServerUDP(t, s, astichat.NewFederation(astichat.FederationConfiguration{}))
+	defer srv.Close()
+
+	// Connect peers
+	var alice = newTestPeer(t, "alice", "d1", prv2, pub2, addr)
+	defer alice.close()
+	alice.write(astichat.EventNamePeerConnect, astichat.MessageConnect)
+	alice.wait(astichat.EventNamePeerConnected)
+	var bob = newTestPeer(t, "bob", "d2", prv2, pub2, addr)
+	defer bob.close()
+	bob.write(astichat.EventNamePeerConnect, astichat.MessageConnect)
+	bob.wait(astichat.EventNamePeerConnected)
+	alice.wait(astichat.EventNamePeerJoined)
+
+	// Disconnect a revoked device
+	srv.Disconnect("bob", "d2")
+	var p astichat.Peer
+	assert.NoError(t, json.Unmarshal(alice.wait(astichat.EventNamePeerDisconnected), &p))
+	assert.Equal(t, "bob", p.Username)
+
+	// Unknown devices are ignored
+	srv.Disconnect("bob", "d2")
+	alice.none(astichat.EventNamePeerDisconnected, 300*time.Millisecond)
+}
+
+func TestShutdown(t *testing.T) {
+	// Init
+	var s = astichat.NewMockedStorage()
+	var _, _, prv2, pub2 = testKeys(t)
+	s.ChattererCreate("alice", astichat.Device{ClientPublicKey: pub2, ID: "d1", ServerPrivateKey: prv2})
+	s.ChattererCreate("bob", astichat.Device{ClientPublicKey: pub2, ID: "d2", ServerPrivateKey: prv2})
+	var srv, addr = newServerUDP(t, s, astichat.NewFederation(astichat.FederationConfiguration{}))
+	defer srv.Close()
+
+	// Connect peers
+	var alice = newTestPeer(t, "alice", "d1", prv2, pub2, addr)
+	defer alice.close()
+	alice.write(astichat.EventNamePeerConnect, astichat.MessageConnect)
+	alice.wait(astichat.EventNamePeerConnected)
+	var bob = newTestPeer(t, "bob", "d2", prv2, pub2, addr)
+	bob.write(astichat.EventNamePeerConnect, astichat.MessageConnect)
+	bob.wait(astichat.EventNamePeerConnected)
+
+	// Bob doesn't acknowledge anymore
+	bob.close()
+
+	// Shutdown doesn't wait for the peers that don't acknowledge longer than the context allows
+	var ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	var start = time.Now()
+	srv.Shutdown(ctx, 2*time.Second)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// Peers are notified
+	var sd astichat.Shutdown
+	assert.NoError(t, json.Unmarshal(alice.wait(astichat.EventNameServerShutdown), &sd))
+	assert.Equal(t, astichat.Shutdown{ReconnectAfter: 2 * time.Second}, sd)
+}
+
+func TestHandlePeerPing(t *testing.T) {
+	// Init
+	var s = astichat.NewMockedStorage()
+	var _, pub1, prv2, pub2 = testKeys(t)
+	s.ChattererCreate("bob", astichat.Device{ClientPublicKey: pub2, ID: "d2", ServerPrivateKey: prv2})
+	var srv, addr = newServerUDP(t, s, astichat.NewFederation(astichat.FederationConfiguration{}))
+	defer srv.Close()
+	var bob = newTestPeer(t, "bob", "d2", prv2, pub2, addr)
+	defer bob.close()
+
+	// Unknown peer gets its ping back
+	bob.write(astichat.EventNamePeerPing, []byte(`{"nonce":"n"}`))
+	assert.Equal(t, `{"nonce":"n"}`, string(bob.wait(astichat.EventNamePeerUnknown)))
+
+	// Pings of older clients have no nonce
+	bob.write(astichat.EventNamePeerPing, astichat.MessagePing)
+	assert.Equal(t, `{"nonce":""}`, string(bob.wait(astichat.EventNamePeerUnknown)))
+
+	// Pings that can't be authenticated are not answered
+	var eve = newTestPeer(t, "bob", "d2", prv2, pub1, addr)
+	defer eve.close()
+	eve.write(astichat.EventNamePeerPing, []byte(`{"nonce":"n"}`))
+	eve.none(astichat.EventNamePeerUnknown, 300*time.Millisecond)
+
+	// Known peer is not asked to reconnect
+	bob.write(astichat.EventNamePeerConnect, astichat.MessageConnect)
+	bob.wait(astichat.EventNamePeerConnected)
+	bob.write(astichat.EventNamePeerPing, []byte(`{"nonce":"n"}`))
+	bob.none(astichat.EventNamePeerUnknown, 300*time.Millisecond)
+}
+
+func TestClientVersions(t *testing.T) {
+	// Init
+	var s = astichat.NewMockedStorage()
+	var _, _, prv2, pub2 = testKeys(t)
+	s.ChattererCreate("alice", astichat.Device{ClientPublicKey: pub2, ID: "d1", ServerPrivateKey: prv2})
+	var srv, addr = newServerUDP(t, s, astichat.NewFederation(astichat.FederationConfiguration{}))
+	defer srv.Close()
+	var versions = expvar.Get("astichat").(*expvar.Map).Get("udp_client_versions").(*expvar.Map)
+	var connect = func(version string) {
+		// Versions are counted when a peer joins, therefore each connection comes from a new addr
+		var alice = newTestPeer(t, "alice", "d1", prv2, pub2, addr)
+		defer alice.close()
+		var b, err = json.Marshal(astichat.Connect{Build: &astichat.BuildInfo{Version: version}})
+		assert.NoError(t, err)
+		alice.write(astichat.EventNamePeerConnect, b)
+		alice.wait(astichat.EventNamePeerConnected)
+	}
+
+	// Versions are counted
+	var count = func(version string) (n int) {
+		if v := versions.Get(version); v != nil {
+			n, _ = strconv.Atoi(v.String())
+		}
+		return
+	}
+	var n = count("v1")
+	connect("v1")
+	connect("v1")
+	assert.Equal(t, n+2, count("v1"))
+
+	// Versions sent by clients can't grow the metrics indefinitely
+	connect(strings.Repeat("v", 100))
+	for i := 0; i < 120; i++ {
+		connect(fmt.Sprintf("v1.%d", i))
+	}
+	var keys int
+	versions.Do(func(expvar.KeyValue) { keys++ })
+	assert.Equal(t, 100, keys)
+	assert.Nil(t, versions.Get(strings.Repeat("v", 100)))
+	assert.NotNil(t, versions.Get("other"))
+	assert.Equal(t, n+2, count("v1"))
+}
+
+func TestHandlePeerConnectReplay(t *testing.T) {
+	// Init
+	var s = astichat.NewMockedStorage()
+	var _, _, prv2, pub2 = testKeys(t)
+	s.ChattererCreate("bob", astichat.Device{ClientPublicKey: pub2, ID: "d2", ServerPrivateKey: prv2})
+	var srv, addr = newServerUDP(t, s, astichat.NewFederation(astichat.FederationConfiguration{}))
+	defer srv.Close()
+	var bob = newTestPeer(t, "bob", "d2", prv2, pub2, addr)
+	defer bob.close()
+	var eve = newTestPeer(t, "bob", "d2", prv2, pub2, addr)
+	defer eve.close()
+
+	// Connect
+	var b, err = astichat.NewBody(astichat.MessageConnect, astichat.TimeNow(), "bob", pub2)
+	assert.NoError(t, err)
+	b.Request.Device = "d2"
+	assert.NoError(t, bob.reliable.Write(astichat.EventNamePeerConnect, b, addr, nil))
+	bob.wait(astichat.EventNamePeerConnected)
+
+	// Body replayed from another addr doesn't take the peer over
+	assert.NoError(t, eve.reliable.Write(astichat.EventNamePeerConnect, b, addr, nil))
+	eve.none(astichat.EventNamePeerConnected, 300*time.Millisecond)
+	bob.write(astichat.EventNamePeerPing, []byte(`{"nonce":"n"}`))
+	bob.none(astichat.EventNamePeerUnknown, 300*time.Millisecond)
+
+	// Fresh body from another addr is accepted
+	eve.write(astichat.EventNamePeerConnect, astichat.MessageConnect)
+	eve.wait(astichat.EventNamePeerConnected)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/asticode/go-astichat/builder"
+	"github.com/asticode/go-astilog"
+	"github.com/imdario/mergo"
+	"github.com/rs/xlog"
+)
+
+// Flags
+var (
+	configPath = flag.String("c", "", "the config path")
+	listenAddr = flag.String("l", "", "the listen addr")
+)
+
+// Configuration represents a configuration
+type Configuration struct {
+	Builder    builder.Configuration `toml:"builder"`
+	CertFile   string                `toml:"cert_file"` // Templates are only served over HTTPS
+	KeyFile    string                `toml:"key_file"`
+	ListenAddr string                `toml:"listen_addr"`
+	Logger     astilog.Configuration `toml:"logger"`
+	Secret     string                `toml:"secret"` // Shared with the remote builders
+}
+
+// TOMLDecodeFile allows testing functions using it
+var TOMLDecodeFile = func(fpath string, v interface{}) (toml.MetaData, error) {
+	return toml.DecodeFile(fpath, v)
+}
+
+// NewConfiguration creates a new configuration object
+func NewConfiguration() Configuration {
+	// Global config
+	var gc = Configuration{
+		Builder: builder.Configuration{
+			BuildTimeout: 5 * time.Minute,
+		},
+		Logger: astilog.Configuration{
+			AppName: "go-astichat-worker",
+		},
+	}
+
+	// Local config
+	if *configPath != "" {
+		// Decode local config
+		if _, err := TOMLDecodeFile(*configPath, &gc); err != nil {
+			xlog.Fatalf("%v while decoding the config path %s", err, *configPath)
+		}
+	}
+
+	// Flag config
+	var c = Configuration{
+		Builder:    builder.FlagConfig(),
+		ListenAddr: *listenAddr,
+		Logger:     astilog.FlagConfig(),
+	}
+
+	// Merge configs
+	if err := mergo.Merge(&c, gc); err != nil {
+		xlog.Fatalf("%v while merging configs", err)
+	}
+
+	// Return
+	return c
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/asticode/go-astichat/builder"
+	"github.com/asticode/go-astilog"
+)
+
+// Vars
+var (
+	shutdownTimeout = 10 * time.Second
+)
+
+// The worker builds the templates of remote builders so that go builds can be offloaded from the server
+func main() {
+	// Parse flags
+	flag.Parse()
+
+	// Init configuration
+	var c = NewConfiguration()
+
+	// Init logger
+	astilog.SetLogger(astilog.New(c.Logger))
+
+	// Templates are served to anyone knowing the secret
+	if c.Secret == "" {
+		astilog.Fatal(errors.New("Secret is empty"))
+	}
+
+	// Templates end up in signed clients, therefore they must not go through the network in clear
+	if c.CertFile == "" || c.KeyFile == "" {
+		astilog.Fatal(errors.New("Cert file or key file is empty"))
+	}
+
+	// Init worker
+	if err := c.Builder.Validate(); err != nil {
+		astilog.Fatal(err)
+	}
+	var b = builder.NewLocal(c.Builder)
+	var w = builder.NewWorker(b, c.Secret)
+	w.Logger = astilog.GetLogger()
+
+	// Init server
+	var srv = &http.Server{Addr: c.ListenAddr, Handler: w}
+
+	// Handle signals
+	var ch = make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGABRT, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
+	go func() {
+		var sig = <-ch
+		astilog.Debugf("Received signal %s", sig)
+		var ctx, cancel = context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			astilog.Errorf("%s while shutting down", err)
+		}
+	}()
+
+	// Listen and serve
+	astilog.Debugf("Worker %s listening and serving on https://%s", b.Version(), c.ListenAddr)
+	if err := srv.ListenAndServeTLS(c.CertFile, c.KeyFile); err != nil && err != http.ErrServerClosed {
+		astilog.Fatal(err)
+	}
+}